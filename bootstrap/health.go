@@ -0,0 +1,82 @@
+package bootstrap
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/skrassiev/meerkat/feed"
+	"github.com/skrassiev/meerkat/health"
+	"github.com/skrassiev/meerkat/telega"
+)
+
+const (
+	// runLoopStallTimeout is how long the bot may be busy with a single update before it's considered hung.
+	// It covers a command handler and the Telegram API retries, so set WatchdogSec above it.
+	runLoopStallTimeout = 3 * time.Minute
+	// sensorStaleAfter is the age of the last temperature reading, after which the sensor is not ready.
+	sensorStaleAfter = 3 * tempChangeMonitorPeriod
+)
+
+func newHealthChecker(bot *telega.Bot, tempMonitor bool) *health.Checker {
+	var (
+		checker health.Checker
+		started = time.Now()
+	)
+
+	checker.AddLiveness("bot", func() error {
+		hb := bot.LastHeartbeat()
+		if hb.IsZero() {
+			return errors.New("not running")
+		}
+		if age := time.Since(hb); age > runLoopStallTimeout {
+			return fmt.Errorf("run loop stuck for %v", age.Round(time.Second))
+		}
+		return nil
+	})
+
+	checker.AddReadiness("telegram", func() error {
+		if api := bot.Status().Telegram; !api.Connected {
+			return fmt.Errorf("disconnected since %v: %s", api.LastFailure.Format(time.RFC3339), api.LastError)
+		}
+		return nil
+	})
+
+	checker.AddReadiness("background", func() error {
+		if s := bot.Status(); s.BackgroundRunning != s.BackgroundTasks {
+			return fmt.Errorf("%d of %d background tasks exited", s.BackgroundTasks-s.BackgroundRunning, s.BackgroundTasks)
+		}
+		return nil
+	})
+
+	if tempMonitor {
+		checker.AddReadiness("temperature", func() error {
+			// the first reading is taken one monitoring period after the start
+			if time.Since(started) < sensorStaleAfter {
+				return nil
+			}
+			var stale []string
+			for _, v := range feed.GetStatus().Sensors {
+				if time.Since(v.Time) > sensorStaleAfter {
+					stale = append(stale, v.Sensor)
+				}
+			}
+			if len(stale) > 0 {
+				return fmt.Errorf("no fresh readings from %s", strings.Join(stale, ", "))
+			}
+			return nil
+		})
+	}
+
+	return &checker
+}
+
+// systemdStatus is a one-line summary for systemctl status.
+func systemdStatus(s telega.Status) string {
+	telegram := "connected"
+	if !s.Telegram.Connected {
+		telegram = "disconnected"
+	}
+	return fmt.Sprintf("telegram %s, outbox %d, %d/%d background tasks", telegram, s.Outbox, s.BackgroundRunning, s.BackgroundTasks)
+}
@@ -0,0 +1,32 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/skrassiev/meerkat/telega"
+)
+
+const httpShutdownTimeout = 5 * time.Second
+
+// serveHTTP returns a background function, which serves handler on addr till interrupted. It never sends events.
+func serveHTTP(addr string, handler http.Handler) telega.BackgroundFunction {
+	return func(ctx context.Context, _ chan<- telega.ChattableCloser) {
+		srv := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: httpShutdownTimeout}
+
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+			defer cancel()
+			_ = srv.Shutdown(shutdownCtx)
+		}()
+
+		slog.Info("http: serving", "addr", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("http: serve failed", "err", err)
+		}
+	}
+}
@@ -3,8 +3,10 @@ package bootstrap
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -12,7 +14,11 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/skrassiev/meerkat/control"
 	"github.com/skrassiev/meerkat/feed"
+	"github.com/skrassiev/meerkat/health"
+	"github.com/skrassiev/meerkat/history"
+	"github.com/skrassiev/meerkat/metrics"
 	"github.com/skrassiev/meerkat/telega"
 )
 
@@ -25,9 +31,13 @@ const (
 	ServiceModeFSMoinitor
 	ServiceModeHealthcheck
 	ServiceModeTempMonitor
+	ServiceModeControl
 
 	tempChangeMonitorPeriod = 5 * time.Minute
 	ipChangeMonitorPeriod   = 30 * time.Minute
+	historySampleInterval   = time.Minute
+	connectivityInterval    = 30 * time.Second
+	portCheckPeriod         = 15 * time.Minute
 )
 
 // Main adds standard handlers to the telega bot.
@@ -37,17 +47,82 @@ func Main(runtime string, serviceMode byte) (status string, err error) {
 
 	var bot telega.Bot
 	if err = bot.Init(ctx, runtime); err != nil {
-		log.Println(err)
+		slog.Error("failed to init", "err", err)
 		cancel()
 		return "failed to init", err
 	}
 
-	log.Println("telegram API initialized")
+	slog.Info("telegram API initialized")
+
+	if (serviceMode & (ServiceModeCommands | ServiceModeTempMonitor)) != 0 {
+		if root := strings.TrimSpace(os.Getenv("SYSFS_ROOT")); len(root) > 0 {
+			feed.SysfsRoot = root
+		}
+		if unit := os.Getenv("TEMP_UNIT"); len(unit) > 0 {
+			if err = feed.SetTemperatureUnit(unit); err != nil {
+				slog.Error("invalid TEMP_UNIT", "err", err)
+				cancel()
+				return "failed to init", err
+			}
+		}
+		if err = feed.ConfigureSensors(feed.SysfsRoot, os.Getenv("TEMP_SENSORS")); err != nil {
+			slog.Error("invalid sensors configuration", "err", err)
+			cancel()
+			return "failed to init", err
+		}
+
+		// sample the sensors for the history regardless of the commands
+		retention := history.DefaultRetention
+		if v, err := history.ParseDuration(os.Getenv("HISTORY_RAW_RETENTION")); err == nil {
+			retention.Raw = v
+		}
+		if v, err := history.ParseDuration(os.Getenv("HISTORY_HOURLY_RETENTION")); err == nil {
+			retention.Hourly = v
+		}
+		if err := feed.OpenSensorHistory(os.Getenv("HISTORY_DIR"), retention); err == nil {
+			sampleInterval := historySampleInterval
+			if v, err := history.ParseDuration(os.Getenv("HISTORY_INTERVAL")); err == nil {
+				sampleInterval = v
+			}
+			slog.Info("adding sensor sampling", "interval", sampleInterval)
+			bot.AddBackgroundTask(feed.SensorSampler(sampleInterval))
+
+			if at := strings.TrimSpace(os.Getenv("CHART_DAILY")); len(at) > 0 {
+				dailyChart, err := feed.DailyChart(at)
+				if err != nil {
+					slog.Error("invalid CHART_DAILY", "err", err)
+					cancel()
+					return "failed to init", err
+				}
+				slog.Info("adding daily chart", "at", at)
+				bot.AddBackgroundTask(dailyChart)
+			}
+		} else {
+			slog.Warn("sensor history is disabled", "err", err)
+		}
+
+		if spec := strings.TrimSpace(os.Getenv("THERMOSTAT")); len(spec) > 0 {
+			thermostat, err := feed.Thermostat(spec, os.Getenv("THERMOSTAT_ON_COMMAND"), os.Getenv("THERMOSTAT_OFF_COMMAND"))
+			if err != nil {
+				slog.Error("invalid THERMOSTAT", "err", err)
+				cancel()
+				return "failed to init", err
+			}
+			slog.Info("adding thermostat")
+			bot.AddBackgroundTask(thermostat)
+		}
+	}
 
 	if (serviceMode & ServiceModeCommands) == ServiceModeCommands {
 		// add handlers
-		log.Println("adding commands handlers")
+		slog.Info("adding commands handlers")
 		bot.AddHandler("/temp", feed.HandleCommandlTemp)
+		bot.AddHandler("/chart", feed.HandleCommandChart)
+		bot.AddHandler("/export", feed.HandleCommandExport)
+		bot.AddHandler("/sensors", feed.HandleCommandSensors)
+		bot.AddHandler("/thermostat", feed.HandleCommandThermostat)
+		bot.AddHandler("/ip", feed.HandleCommandIP)
+		bot.AddBackgroundTask(feed.PublicIPNotices)
 		if imageURL := os.Getenv("IMAGE_URL"); len(imageURL) > 0 {
 			bot.AddHandler("/pic", feed.GetPictureByURL(imageURL))
 		}
@@ -55,30 +130,71 @@ func Main(runtime string, serviceMode byte) (status string, err error) {
 
 	if (serviceMode & ServiceModePeriodic) == ServiceModePeriodic {
 		// add periodic tasks
-		log.Println("adding periodic tasks handlers")
+		slog.Info("adding periodic tasks handlers")
+		if err = feed.ConfigurePublicIP(os.Getenv("PUBLIC_IP_FAMILIES"), os.Getenv("IPV6_PREFIX_LENGTH"),
+			os.Getenv("PUBLIC_IP_RESOLVERS"), os.Getenv("PUBLIC_IP_CONSENSUS") == "true"); err != nil {
+			slog.Error("invalid public IP configuration", "err", err)
+			cancel()
+			return "failed to init", err
+		}
+		if err = feed.ConfigureDDNS(os.Getenv("DDNS"), ""); err != nil {
+			slog.Error("invalid DDNS configuration", "err", err)
+			cancel()
+			return "failed to init", err
+		}
 		bot.AddPeriodicTask(ipChangeMonitorPeriod, "Public IP Changed:", feed.PublicIP)
+		bot.AddBackgroundTask(feed.WANMonitor())
+		bot.AddBackgroundTask(feed.DDNSUpdater())
+		if spec := strings.TrimSpace(os.Getenv("PORT_CHECKS")); len(spec) > 0 {
+			if err = feed.ConfigurePortChecks(spec, os.Getenv("PORT_CHECK_PROBE"), ""); err != nil {
+				slog.Error("invalid port checks configuration", "err", err)
+				cancel()
+				return "failed to init", err
+			}
+			bot.AddBackgroundTask(feed.PortChecks(portCheckPeriod))
+		}
+
+		if targets := strings.TrimSpace(os.Getenv("CONNECTIVITY_TARGETS")); len(targets) > 0 {
+			interval := connectivityInterval
+			if v, err := history.ParseDuration(os.Getenv("CONNECTIVITY_INTERVAL")); err == nil {
+				interval = v
+			}
+			connectivity, err := feed.ConnectivityMonitor(targets, interval, strings.TrimSpace(os.Getenv("CONNECTIVITY_SUMMARY")), "")
+			if err != nil {
+				slog.Error("invalid connectivity monitor configuration", "err", err)
+				cancel()
+				return "failed to init", err
+			}
+			slog.Info("adding connectivity monitor", "interval", interval)
+			bot.AddBackgroundTask(connectivity)
+		}
 	}
 
 	if (serviceMode & ServiceModeTempMonitor) == ServiceModeTempMonitor {
-		// add temperature change monitoring
-		log.Println("adding temperature change monitoring")
+		// add temperature change monitoring and alerts
+		if err = feed.ConfigureAlerts(os.Getenv("TEMP_ALERTS"), ""); err != nil {
+			slog.Error("invalid alerts configuration", "err", err)
+			cancel()
+			return "failed to init", err
+		}
+		slog.Info("adding temperature change monitoring")
 		bot.AddPeriodicTask(tempChangeMonitorPeriod, "Temperature changed:", feed.TemperatureMonitor)
 	}
 
 	if (serviceMode & ServiceModeFSMoinitor) == ServiceModeFSMoinitor {
 		// add FS monitor
-		log.Println("adding background tasks")
+		slog.Info("adding background tasks")
 		directores := os.Getenv("MONITORED_DIRECTORIES")
 		rateLimit, _ := time.ParseDuration(os.Getenv("FS_RATE_LIMIT"))
-		log.Println("rate limit requested", rateLimit)
+		slog.Info("rate limit requested", "feed", "fsmonitor", "rate_limit", rateLimit)
 
 		if len(strings.TrimSpace(directores)) > 0 {
 			for _, v := range strings.Split(strings.TrimSpace(directores), ";") {
-				log.Println("checking path:", v)
+				slog.Debug("checking path", "feed", "fsmonitor", "directory", v)
 				if finf, err := os.Stat(v); err == nil && finf.IsDir() {
 					bot.AddBackgroundTask(feed.MonitorDirectoryTree(v, feed.RatelimitFilterChain(rateLimit, feed.NewfileFilterChain(feed.FilenameFilter([]string{`(?i)\.jpg$`, `\.mp4$`})))))
 				} else {
-					log.Println("fsmonitor: invalid path", v)
+					slog.Warn("invalid path", "feed", "fsmonitor", "directory", v)
 					bot.AddBackgroundTask(feed.MonitorDirectoryTree(v, feed.RatelimitFilterChain(rateLimit, feed.NewfileFilterChain(feed.FilenameFilter([]string{`(?i)\.jpg$`, `\.mp4`})))))
 				}
 			}
@@ -89,6 +205,32 @@ func Main(runtime string, serviceMode byte) (status string, err error) {
 		bot.AddHandler("/ping", feed.PingCommand)
 	}
 
+	if (serviceMode & ServiceModeControl) == ServiceModeControl {
+		// local programs push messages via the control socket
+		socketMode := control.DefaultSocketMode
+		if v, err := strconv.ParseUint(os.Getenv("CONTROL_SOCKET_MODE"), 8, 32); err == nil {
+			socketMode = os.FileMode(v)
+		}
+		slog.Info("adding control socket", "socket", control.SocketPath(), "mode", socketMode)
+		bot.AddBackgroundTask(control.Serve(control.SocketPath(), socketMode, func() control.Status {
+			return control.Status{Bot: bot.Status(), Feed: feed.GetStatus()}
+		}))
+	}
+
+	checker := newHealthChecker(&bot, (serviceMode&ServiceModeTempMonitor) == ServiceModeTempMonitor)
+	if len(os.Getenv("NOTIFY_SOCKET")) > 0 {
+		// run by systemd with Type=notify
+		bot.AddBackgroundTask(health.Systemd(checker, func() string { return systemdStatus(bot.Status()) }))
+	}
+
+	if addr := strings.TrimSpace(os.Getenv("HTTP_LISTEN")); len(addr) > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		mux.Handle("/healthz", checker.LivenessHandler())
+		mux.Handle("/readyz", checker.ReadinessHandler())
+		bot.AddBackgroundTask(serveHTTP(addr, mux))
+	}
+
 	// synchronization tasks
 	var wg sync.WaitGroup
 
@@ -103,7 +245,7 @@ func Main(runtime string, serviceMode byte) (status string, err error) {
 	done := make(chan struct{})
 	go func() {
 		wg.Wait()
-		log.Println("wg finished")
+		slog.Debug("wg finished")
 		done <- struct{}{}
 	}()
 
@@ -115,15 +257,15 @@ func Main(runtime string, serviceMode byte) (status string, err error) {
 		select {
 		case <-interrupt:
 			cancel()
-			log.Printf("%s was interrupted by system signal", runtime)
+			slog.Info("interrupted by system signal", "runtime", runtime)
 			time.Sleep(1 * time.Second)
 			return fmt.Sprintf("%s was interrupted by system signal", runtime), nil
 		case <-done:
 			cancel()
 			if err == nil {
-				log.Println(status)
+				slog.Info(status)
 			} else {
-				log.Println("error", err)
+				slog.Error("bot failed", "err", err)
 			}
 			return
 		}
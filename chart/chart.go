@@ -0,0 +1,417 @@
+// Package chart renders line charts of time series as PNG images. It has no dependencies beyond the standard
+// library, text is drawn with a built-in bitmap font.
+package chart
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	defaultWidth  = 800
+	defaultHeight = 480
+	textScale     = 2
+	textHeight    = glyphHeight * textScale
+	lineWidth     = 2
+	markerSize    = 5
+)
+
+var (
+	// ErrNoData is returned if none of the series has points.
+	ErrNoData = errors.New("no data to chart")
+
+	background = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	gridColor  = color.RGBA{0xe0, 0xe0, 0xe0, 0xff}
+	axisColor  = color.RGBA{0x60, 0x60, 0x60, 0xff}
+	textColor  = color.RGBA{0x20, 0x20, 0x20, 0xff}
+
+	// palette is the series colors, they repeat if there are more series.
+	palette = []color.RGBA{
+		{0x1f, 0x77, 0xb4, 0xff}, {0xff, 0x7f, 0x0e, 0xff}, {0x2c, 0xa0, 0x2c, 0xff}, {0xd6, 0x27, 0x28, 0xff},
+		{0x94, 0x67, 0xbd, 0xff}, {0x8c, 0x56, 0x4b, 0xff}, {0xe3, 0x77, 0xc2, 0xff}, {0x7f, 0x7f, 0x7f, 0xff},
+	}
+
+	// timeSteps are the candidate intervals between the time axis ticks.
+	timeSteps = []time.Duration{
+		time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute, time.Hour, 3 * time.Hour, 6 * time.Hour,
+		12 * time.Hour, 24 * time.Hour, 2 * 24 * time.Hour, 7 * 24 * time.Hour, 14 * 24 * time.Hour, 28 * 24 * time.Hour,
+		91 * 24 * time.Hour,
+	}
+)
+
+// Point is a value at a time.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// Series is a named line of the chart.
+type Series struct {
+	Name   string
+	Points []Point
+}
+
+// Chart is a line chart of one or more series over a time window.
+type Chart struct {
+	Title string
+	// Unit is shown above the value axis, e.g. ℃.
+	Unit string
+	// From and To is the time window, the window of the data by default.
+	From, To time.Time
+	// Width and Height are the image size, 800x480 by default.
+	Width, Height int
+	Series        []Series
+	// MaxGap is the longest interval between points, which are still connected by the line.
+	// By default it's three times the median interval of a series.
+	MaxGap time.Duration
+	// Location is the time zone of the time axis labels, time.Local by default.
+	Location *time.Location
+}
+
+// Render encodes the chart as PNG.
+func (c *Chart) Render(w io.Writer) error {
+	img, err := c.Image()
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, img)
+}
+
+// plot maps the data to the pixels of the plot area.
+type plot struct {
+	rect     image.Rectangle
+	from, to time.Time
+	lo, hi   float64
+}
+
+func (p plot) x(t time.Time) int {
+	return p.rect.Min.X + int(math.Round(float64(t.Sub(p.from))/float64(p.to.Sub(p.from))*float64(p.rect.Dx())))
+}
+
+func (p plot) y(v float64) int {
+	return p.rect.Max.Y - int(math.Round((v-p.lo)/(p.hi-p.lo)*float64(p.rect.Dy())))
+}
+
+// Image draws the chart.
+func (c *Chart) Image() (*image.RGBA, error) {
+	width, height := c.Width, c.Height
+	if width <= 0 || height <= 0 {
+		width, height = defaultWidth, defaultHeight
+	}
+	loc := c.Location
+	if loc == nil {
+		loc = time.Local
+	}
+
+	series := make([]Series, len(c.Series))
+	var (
+		lo, hi   = math.Inf(1), math.Inf(-1)
+		from, to time.Time
+	)
+	for i, s := range c.Series {
+		var points []Point
+		for _, p := range s.Points {
+			if (c.From.IsZero() || !p.Time.Before(c.From)) && (c.To.IsZero() || !p.Time.After(c.To)) {
+				points = append(points, p)
+			}
+		}
+		sort.Slice(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+		series[i] = Series{Name: s.Name, Points: points}
+		for _, p := range points {
+			lo, hi = math.Min(lo, p.Value), math.Max(hi, p.Value)
+			if from.IsZero() || p.Time.Before(from) {
+				from = p.Time
+			}
+			if p.Time.After(to) {
+				to = p.Time
+			}
+		}
+	}
+	if math.IsInf(lo, 1) {
+		return nil, ErrNoData
+	}
+
+	if !c.From.IsZero() {
+		from = c.From
+	}
+	if !c.To.IsZero() {
+		to = c.To
+	}
+	if !to.After(from) {
+		from, to = from.Add(-30*time.Minute), from.Add(30*time.Minute)
+	}
+
+	step := valueStep(lo, hi)
+	lo, hi = math.Floor(lo/step)*step, math.Ceil(hi/step)*step
+	if hi-lo < step {
+		lo, hi = lo-step, hi+step
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{background}, image.Point{}, draw.Src)
+
+	// the value labels set the left margin
+	var valueLabels []string
+	labelWidth := textWidth(c.Unit, textScale)
+	for v := lo; v <= hi+step/2; v += step {
+		label := formatValue(v, step)
+		valueLabels = append(valueLabels, label)
+		if w := textWidth(label, textScale); w > labelWidth {
+			labelWidth = w
+		}
+	}
+
+	const top, bottom, right = 3*textHeight + 24, 2*textHeight + 8, 24
+	if width-right-labelWidth-16 < 10 || height-bottom-top < 10 {
+		return nil, fmt.Errorf("chart size %dx%d is too small", width, height)
+	}
+	p := plot{rect: image.Rect(labelWidth+16, top, width-right, height-bottom), from: from, to: to, lo: lo, hi: hi}
+
+	// value grid
+	for i, label := range valueLabels {
+		y := p.y(lo + float64(i)*step)
+		drawLine(img, p.rect.Min.X, y, p.rect.Max.X, y, gridColor, 1)
+		drawText(img, p.rect.Min.X-8-textWidth(label, textScale), y-textHeight/2, label, textColor, textScale)
+	}
+	drawText(img, p.rect.Min.X-8-textWidth(c.Unit, textScale), p.rect.Min.Y-textHeight-8, c.Unit, textColor, textScale)
+
+	// time grid
+	tickStep := timeStep(to.Sub(from))
+	for t := firstTick(from, tickStep, loc); !t.After(to); t = nextTick(t, tickStep, loc) {
+		x := p.x(t)
+		drawLine(img, x, p.rect.Min.Y, x, p.rect.Max.Y, gridColor, 1)
+		label := t.In(loc).Format("15:04")
+		if lt := t.In(loc); lt.Hour() == 0 && lt.Minute() == 0 {
+			label = lt.Format("Jan 2")
+		}
+		lx := x - textWidth(label, textScale)/2
+		if lx >= 0 && lx+textWidth(label, textScale) <= width {
+			drawText(img, lx, p.rect.Max.Y+8, label, textColor, textScale)
+		}
+	}
+
+	// axes
+	drawLine(img, p.rect.Min.X, p.rect.Min.Y, p.rect.Min.X, p.rect.Max.Y, axisColor, 1)
+	drawLine(img, p.rect.Min.X, p.rect.Max.Y, p.rect.Max.X, p.rect.Max.Y, axisColor, 1)
+
+	// title and legend
+	drawText(img, p.rect.Min.X, 8, c.Title, textColor, textScale)
+	x := p.rect.Min.X
+	for i, s := range series {
+		col := palette[i%len(palette)]
+		name := s.Name
+		if len(s.Points) == 0 {
+			name += " (no data)"
+		}
+		fillRect(img, x, textHeight+16, textHeight, textHeight, col)
+		drawText(img, x+textHeight+6, textHeight+16, name, textColor, textScale)
+		x += textHeight + 6 + textWidth(name, textScale) + 24
+	}
+
+	clip := img.SubImage(p.rect.Inset(-lineWidth)).(*image.RGBA)
+	for i, s := range series {
+		drawSeries(clip, p, s.Points, c.MaxGap, palette[i%len(palette)])
+	}
+	for i, s := range series {
+		drawMinMax(img, p, s.Points, step, palette[i%len(palette)])
+	}
+
+	return img, nil
+}
+
+// drawSeries draws the line of a series. Points further apart than maxGap are not connected,
+// a point with no connected neighbors is drawn as a dot.
+func drawSeries(img *image.RGBA, p plot, points []Point, maxGap time.Duration, col color.Color) {
+	if maxGap <= 0 {
+		maxGap = 3 * medianInterval(points)
+	}
+	for i, v := range points {
+		joinedPrev := i > 0 && v.Time.Sub(points[i-1].Time) <= maxGap
+		joinedNext := i < len(points)-1 && points[i+1].Time.Sub(v.Time) <= maxGap
+		if joinedNext {
+			next := points[i+1]
+			drawLine(img, p.x(v.Time), p.y(v.Value), p.x(next.Time), p.y(next.Value), col, lineWidth)
+		} else if !joinedPrev {
+			fillRect(img, p.x(v.Time)-lineWidth, p.y(v.Value)-lineWidth, 2*lineWidth+1, 2*lineWidth+1, col)
+		}
+	}
+}
+
+// drawMinMax marks the lowest and the highest points of a series with triangles and labels.
+func drawMinMax(img *image.RGBA, p plot, points []Point, step float64, col color.Color) {
+	if len(points) == 0 {
+		return
+	}
+	minP, maxP := points[0], points[0]
+	for _, v := range points {
+		if v.Value < minP.Value {
+			minP = v
+		}
+		if v.Value > maxP.Value {
+			maxP = v
+		}
+	}
+
+	for _, m := range []struct {
+		p     Point
+		label string
+		dir   int
+	}{
+		{p: maxP, label: "max " + formatValue(maxP.Value, step/10), dir: -1},
+		{p: minP, label: "min " + formatValue(minP.Value, step/10), dir: 1},
+	} {
+		x, y := p.x(m.p.Time), p.y(m.p.Value)
+		// the triangle points at the value from above the max and below the min
+		for i := 0; i <= markerSize; i++ {
+			drawLine(img, x-i, y+m.dir*(2+i), x+i, y+m.dir*(2+i), col, 1)
+		}
+
+		w := textWidth(m.label, textScale)
+		lx := x - w/2
+		if lx < p.rect.Min.X {
+			lx = p.rect.Min.X
+		} else if lx+w > p.rect.Max.X {
+			lx = p.rect.Max.X - w
+		}
+		ly := y - markerSize - 6 - textHeight
+		if m.dir > 0 {
+			ly = y + markerSize + 6
+		}
+		if ly < p.rect.Min.Y {
+			ly = p.rect.Min.Y
+		} else if ly+textHeight > p.rect.Max.Y {
+			ly = p.rect.Max.Y - textHeight
+		}
+		drawText(img, lx, ly, m.label, col, textScale)
+	}
+}
+
+// medianInterval is the median time between the points, or an hour if there are less than two points.
+func medianInterval(points []Point) time.Duration {
+	if len(points) < 2 {
+		return time.Hour
+	}
+	intervals := make([]time.Duration, 0, len(points)-1)
+	for i := 1; i < len(points); i++ {
+		intervals = append(intervals, points[i].Time.Sub(points[i-1].Time))
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+	if m := intervals[len(intervals)/2]; m > 0 {
+		return m
+	}
+	return time.Second
+}
+
+// valueStep is a round interval between about 5 value axis ticks: 1, 2 or 5 times a power of 10.
+func valueStep(lo, hi float64) float64 {
+	span := hi - lo
+	if span <= 0 {
+		span = math.Max(math.Abs(hi), 1)
+	}
+	raw := span / 5
+	pow := math.Pow(10, math.Floor(math.Log10(raw)))
+	for _, m := range []float64{1, 2, 5} {
+		if raw <= m*pow {
+			return m * pow
+		}
+	}
+	return 10 * pow
+}
+
+// formatValue prints a value with as many decimals as the step needs.
+func formatValue(v, step float64) string {
+	decimals := 0
+	if step < 1 {
+		decimals = int(math.Ceil(-math.Log10(step)))
+	}
+	if decimals > 3 {
+		decimals = 3
+	}
+	if math.Abs(v) < math.Pow(10, -float64(decimals))/2 {
+		// no -0
+		v = 0
+	}
+	return fmt.Sprintf("%.*f", decimals, v)
+}
+
+// timeStep is the shortest tick interval, which makes no more than 8 ticks over the window.
+func timeStep(window time.Duration) time.Duration {
+	for _, v := range timeSteps {
+		if window/v <= 8 {
+			return v
+		}
+	}
+	return timeSteps[len(timeSteps)-1]
+}
+
+// firstTick is the first tick at or after from. Ticks of a day or longer are at the local midnight.
+func firstTick(from time.Time, step time.Duration, loc *time.Location) time.Time {
+	if step < 24*time.Hour {
+		t := from.Truncate(step)
+		if t.Before(from) {
+			t = t.Add(step)
+		}
+		return t
+	}
+	lt := from.In(loc)
+	t := time.Date(lt.Year(), lt.Month(), lt.Day(), 0, 0, 0, 0, loc)
+	if t.Before(from) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+func nextTick(t time.Time, step time.Duration, loc *time.Location) time.Time {
+	if step < 24*time.Hour {
+		return t.Add(step)
+	}
+	lt := t.In(loc)
+	return time.Date(lt.Year(), lt.Month(), lt.Day()+int(step/(24*time.Hour)), 0, 0, 0, 0, loc)
+}
+
+func fillRect(img *image.RGBA, x, y, w, h int, c color.Color) {
+	draw.Draw(img, image.Rect(x, y, x+w, y+h).Intersect(img.Bounds()), &image.Uniform{c}, image.Point{}, draw.Src)
+}
+
+// drawLine draws a line with a square brush of the width.
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.Color, width int) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		fillRect(img, x0-width/2, y0-width/2, width, width, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,123 @@
+package chart
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var epoch = time.Date(2024, 1, 30, 22, 0, 0, 0, time.UTC)
+
+func series(name string, from, to int, value func(i int) float64) Series {
+	s := Series{Name: name}
+	for i := from; i < to; i++ {
+		s.Points = append(s.Points, Point{Time: epoch.Add(time.Duration(i) * time.Minute), Value: value(i)})
+	}
+	return s
+}
+
+// hasColor tells if any pixel of the rectangle is of the color.
+func hasColor(img image.Image, r image.Rectangle, c [3]uint8) bool {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			cr, cg, cb, _ := img.At(x, y).RGBA()
+			if uint8(cr>>8) == c[0] && uint8(cg>>8) == c[1] && uint8(cb>>8) == c[2] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestChart_Render(t *testing.T) {
+	attic := series("attic", 0, 240, func(i int) float64 { return 20 + 3*math.Sin(float64(i)/40) })
+	// the cellar sensor was offline for an hour
+	cellar := series("cellar", 0, 60, func(int) float64 { return 4.5 })
+	cellar.Points = append(cellar.Points, series("", 120, 240, func(int) float64 { return 4.5 }).Points...)
+
+	c := Chart{Title: "temperature, last 4h", Unit: "℃", Series: []Series{attic, cellar}, Location: time.UTC}
+
+	var b bytes.Buffer
+	require.NoError(t, c.Render(&b))
+	img, err := png.Decode(&b)
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, defaultWidth, defaultHeight), img.Bounds())
+
+	blue, orange := [3]uint8{0x1f, 0x77, 0xb4}, [3]uint8{0xff, 0x7f, 0x0e}
+	rgba, err := c.Image()
+	require.NoError(t, err)
+
+	// the plot area, value axis labels and the legend
+	var plotArea image.Rectangle
+	for x := 0; x < defaultWidth; x++ {
+		if _, g, _, _ := rgba.At(x, defaultHeight/2).RGBA(); g>>8 == 0x60 {
+			plotArea.Min.X = x
+			break
+		}
+	}
+	require.Greater(t, plotArea.Min.X, 0)
+	assert.True(t, hasColor(rgba, image.Rect(plotArea.Min.X, 0, plotArea.Min.X+textHeight, 3*textHeight), blue), "attic legend")
+	assert.True(t, hasColor(rgba, image.Rect(plotArea.Min.X+textHeight, 0, defaultWidth, 3*textHeight), orange), "cellar legend")
+
+	// both lines are drawn, but the cellar one is not connected over the gap
+	p := plot{rect: image.Rect(plotArea.Min.X, 3*textHeight+24, defaultWidth-24, defaultHeight-2*textHeight-8), from: epoch, to: epoch.Add(239 * time.Minute)}
+	gap := p.x(epoch.Add(90 * time.Minute))
+	assert.True(t, hasColor(rgba, image.Rect(p.x(epoch.Add(30*time.Minute)), p.rect.Min.Y, p.x(epoch.Add(30*time.Minute))+1, p.rect.Max.Y), orange))
+	assert.False(t, hasColor(rgba, image.Rect(gap, p.rect.Min.Y, gap+1, p.rect.Max.Y), orange))
+	assert.True(t, hasColor(rgba, image.Rect(gap, p.rect.Min.Y, gap+1, p.rect.Max.Y), blue))
+}
+
+func TestChart_Window(t *testing.T) {
+	c := Chart{Series: []Series{series("attic", 0, 10, func(int) float64 { return 1 })}, From: epoch.Add(time.Hour), To: epoch.Add(2 * time.Hour)}
+	_, err := c.Image()
+	assert.ErrorIs(t, err, ErrNoData)
+
+	c = Chart{Series: []Series{{Name: "attic"}}}
+	_, err = c.Image()
+	assert.ErrorIs(t, err, ErrNoData)
+
+	// a single point is still a chart
+	c = Chart{Series: []Series{series("attic", 0, 1, func(int) float64 { return 1 })}, Width: 200, Height: 150}
+	img, err := c.Image()
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 200, 150), img.Bounds())
+
+	c.Width, c.Height = 20, 20
+	_, err = c.Image()
+	assert.Error(t, err)
+}
+
+func TestChart_Axes(t *testing.T) {
+	for _, v := range []struct {
+		lo, hi, step float64
+	}{
+		{lo: 18.2, hi: 23.1, step: 1},
+		{lo: -10.8, hi: 29.8, step: 10},
+		{lo: 1013.2, hi: 1013.4, step: 0.05},
+		{lo: 5, hi: 5, step: 1},
+	} {
+		assert.InDelta(t, v.step, valueStep(v.lo, v.hi), 1e-9, "%v..%v", v.lo, v.hi)
+	}
+
+	assert.Equal(t, "20", formatValue(20, 1))
+	assert.Equal(t, "0.0", formatValue(-0.01, 0.5))
+	assert.Equal(t, "1013.25", formatValue(1013.25, 0.05))
+
+	assert.Equal(t, 30*time.Minute, timeStep(4*time.Hour))
+	assert.Equal(t, 3*time.Hour, timeStep(24*time.Hour))
+	assert.Equal(t, 24*time.Hour, timeStep(7*24*time.Hour))
+
+	// day ticks are at midnight
+	first := firstTick(epoch, 24*time.Hour, time.UTC)
+	assert.Equal(t, time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC), first)
+	assert.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), nextTick(first, 24*time.Hour, time.UTC))
+
+	assert.Equal(t, textWidth("°C", 1), textWidth("℃", 1))
+	assert.Equal(t, 0, textWidth("", 2))
+}
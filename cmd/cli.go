@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/skrassiev/meerkat/control"
+)
+
+// subcommands talk to a running daemon over the control socket.
+var subcommands = map[string]func(args []string) int{
+	"send":   sendCommand,
+	"status": statusCommand,
+	"export": exportCommand,
+}
+
+// sendCommand implements `meerkat send [--chat ID] [--file PATH] text`.
+func sendCommand(args []string) int {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	var (
+		socket = fs.String("socket", control.SocketPath(), "control socket path")
+		chatID = fs.Int64("chat", 0, "chat ID to send to, all allowed chats if omitted")
+		file   = fs.String("file", "", "file to attach: pictures and videos are sent as such, anything else as a document")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: meerkat send [--chat ID] [--file PATH] text")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	text := strings.Join(fs.Args(), " ")
+	if len(strings.TrimSpace(text)) == 0 && len(*file) == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if err := control.NewClient(*socket).Send(context.Background(), *chatID, text, *file); err != nil {
+		var partial *control.PartialDeliveryError
+		if errors.As(err, &partial) {
+			// the rest of the chats got it, a retry would repeat it to them
+			fmt.Fprintln(os.Stderr, "warning:", err)
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, "send failed:", err)
+		return 1
+	}
+	return 0
+}
+
+// exportCommand implements `meerkat export [--format csv|json] [--gzip] [--output PATH] sensor range`.
+func exportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var (
+		socket   = fs.String("socket", control.SocketPath(), "control socket path")
+		format   = fs.String("format", "csv", "csv or json")
+		compress = fs.Bool("gzip", false, "gzip the export")
+		output   = fs.String("output", "-", "file to write, - for stdout, a directory to use the suggested name")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: meerkat export [--format csv|json] [--gzip] [--output PATH] sensor|all range")
+		fmt.Fprintln(fs.Output(), "range is a window, such as 7d, or days, such as 2024-01-01..2024-01-31")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	var (
+		w    io.Writer = os.Stdout
+		tmp  *os.File
+		dest = *output
+	)
+	if dest != "-" {
+		// the name is known after the daemon replies, write to a temporary file next to the destination
+		dir := dest
+		if fi, err := os.Stat(dest); err != nil || !fi.IsDir() {
+			dir = filepath.Dir(dest)
+		}
+		var err error
+		if tmp, err = os.CreateTemp(dir, ".meerkat-export-*"); err != nil {
+			fmt.Fprintln(os.Stderr, "export failed:", err)
+			return 1
+		}
+		defer os.Remove(tmp.Name())
+		w = tmp
+	}
+
+	name, err := control.NewClient(*socket).Export(context.Background(), fs.Arg(0), fs.Arg(1), *format, *compress, w)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export failed:", err)
+		return 1
+	}
+	if tmp == nil {
+		return 0
+	}
+
+	if err = tmp.Close(); err == nil {
+		if fi, statErr := os.Stat(dest); statErr == nil && fi.IsDir() {
+			dest = filepath.Join(dest, filepath.Base(name))
+		}
+		err = os.Rename(tmp.Name(), dest)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export failed:", err)
+		return 1
+	}
+	return 0
+}
+
+// statusCommand implements `meerkat status [--json]`.
+func statusCommand(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	var (
+		socket = fs.String("socket", control.SocketPath(), "control socket path")
+		asJSON = fs.Bool("json", false, "print raw JSON")
+	)
+	_ = fs.Parse(args)
+
+	s, err := control.NewClient(*socket).Status(context.Background())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "status failed:", err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(s)
+		return 0
+	}
+
+	printStatus(os.Stdout, s)
+	return 0
+}
+
+func printStatus(out io.Writer, s control.Status) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	tg := s.Bot.Telegram
+	fmt.Fprintf(w, "Telegram:\t%s\n", func() string {
+		if tg.Connected {
+			return "connected, last success " + formatTime(tg.LastSuccess)
+		}
+		return fmt.Sprintf("disconnected since %s: %s", formatTime(tg.LastFailure), tg.LastError)
+	}())
+	fmt.Fprintf(w, "Outbox:\t%d\n", s.Bot.Outbox)
+	fmt.Fprintf(w, "Commands:\t%s\n", strings.Join(s.Bot.Commands, " "))
+	fmt.Fprintf(w, "Background tasks:\t%d\n", s.Bot.BackgroundTasks)
+
+	for _, v := range s.Feed.Sensors {
+		if v.Offline {
+			fmt.Fprintf(w, "Sensor %s:\toffline since %s, %d failed reads: %s\n", v.Sensor, formatTime(v.FailingSince), v.Failures, v.Error)
+			continue
+		}
+		if v.Time.IsZero() {
+			fmt.Fprintf(w, "Sensor %s:\tnot read yet\n", v.Sensor)
+			continue
+		}
+		// the daemon formats the readings in the display unit
+		fmt.Fprintf(w, "Sensor %s:\t%s on %s\n", v.Sensor, strings.Join(v.Display, ", "), formatTime(v.Time))
+	}
+
+	for _, v := range s.Feed.Resolvers {
+		if v.Failures > 0 {
+			fmt.Fprintf(w, "Resolver %s %s:\tfailing since %s, %d failed queries: %s\n", v.Family, v.Resolver, formatTime(v.LastFailure), v.Failures, v.Error)
+			continue
+		}
+		fmt.Fprintf(w, "Resolver %s %s:\tok on %s\n", v.Family, v.Resolver, formatTime(v.LastSuccess))
+	}
+
+	if len(s.Bot.PeriodicTasks) > 0 {
+		fmt.Fprintln(w, "\nPeriodic task\tEvery\tLast run\tNext run\tLast result")
+		for _, v := range s.Bot.PeriodicTasks {
+			fmt.Fprintf(w, "%s\t%v\t%s\t%s\t%s\n", v.Name, v.Interval, formatTime(v.LastRun), formatTime(v.NextRun), v.LastResult)
+		}
+	}
+
+	if len(s.Feed.Directories) > 0 {
+		fmt.Fprintln(w, "\nMonitored directory\tWatches")
+		for _, v := range s.Feed.Directories {
+			fmt.Fprintf(w, "%s\t%d\n", v.Path, v.Watches)
+		}
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format("Jan 2 15:04:05")
+}
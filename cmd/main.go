@@ -2,8 +2,11 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
 
 	"github.com/skrassiev/meerkat/bootstrap"
+	"github.com/skrassiev/meerkat/logging"
 )
 
 var (
@@ -12,10 +15,23 @@ var (
 	fServiceModeFSMon       = flag.Bool("mode-fsmon", false, "monitor file system for images")
 	fServiceModeHealthcheck = flag.Bool("mode-healthcheck", false, "ping-pong")
 	fServiceModeTempMonitor = flag.Bool("mode-tempmon", false, "monitor and report temp changes more than 0.5")
+	fServiceModeControl     = flag.Bool("mode-control", false, "serve local control socket (send, status, export)")
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, found := subcommands[os.Args[1]]; found {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
+
+	if err := logging.Setup(os.Stderr, logging.OptionsFromEnv()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
 	var runmode byte
 	if *fServiceModeCommands {
 		runmode |= bootstrap.ServiceModeCommands
@@ -32,6 +48,9 @@ func main() {
 	if *fServiceModeTempMonitor {
 		runmode |= bootstrap.ServiceModeTempMonitor
 	}
+	if *fServiceModeControl {
+		runmode |= bootstrap.ServiceModeControl
+	}
 
 	_, _ = bootstrap.Main("process", runmode)
 }
@@ -0,0 +1,169 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// clientTimeout bounds a single call over the control socket. Delivery takes a while if Telegram is not reachable.
+const clientTimeout = 5 * time.Minute
+
+// PartialDeliveryError is returned by Send, if some of the chats did not get the message. The rest of them did,
+// so it should not be sent again to all of the chats.
+type PartialDeliveryError struct {
+	Undelivered []int64
+	msg         string
+}
+
+func (e *PartialDeliveryError) Error() string {
+	return e.msg
+}
+
+// Client talks to a running daemon over the control socket.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient returns a client for the control socket at socketPath.
+func NewClient(socketPath string) *Client {
+	return &Client{
+		http: &http.Client{
+			Timeout: clientTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// Send delivers text and an optional file to chatID, or to all of the allowed chats if chatID is zero.
+func (c *Client) Send(ctx context.Context, chatID int64, text, filePath string) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	if chatID != 0 {
+		if err := mw.WriteField("chat", strconv.FormatInt(chatID, 10)); err != nil {
+			return err
+		}
+	}
+	if err := mw.WriteField("text", text); err != nil {
+		return err
+	}
+
+	if len(filePath) > 0 {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		part, err := mw.CreateFormFile("file", filepath.Base(filePath))
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(part, f); err != nil {
+			return err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://meerkat"+sendPath, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	var resp response
+	if err = c.do(req, &resp); err != nil {
+		return err
+	}
+	if len(resp.Undelivered) > 0 {
+		return &PartialDeliveryError{Undelivered: resp.Undelivered, msg: resp.Error}
+	}
+	return nil
+}
+
+// Status returns the state of the daemon.
+func (c *Client) Status(ctx context.Context) (s Status, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://meerkat"+statusPath, nil)
+	if err != nil {
+		return s, err
+	}
+	err = c.do(req, &s)
+	return s, err
+}
+
+// Export writes the history of a sensor, or of all sensors, over a range, such as 7d or 2024-01-01..2024-01-31, to w
+// in the format, csv or json. It returns the file name the daemon suggests.
+func (c *Client) Export(ctx context.Context, sensor, rng, format string, compress bool, w io.Writer) (string, error) {
+	query := url.Values{"sensor": {sensor}, "range": {rng}, "format": {format}, "gzip": {strconv.FormatBool(compress)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://meerkat"+exportPath+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	// an export of a long range takes a while to transfer
+	client := *c.http
+	client.Timeout = 0
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+	var name string
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	_, err = io.Copy(w, resp.Body)
+	return name, err
+}
+
+// do executes the request and decodes the response into out, if not nil.
+func (c *Client) do(req *http.Request, out interface{}) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// responseError is the error the daemon replied with.
+func responseError(resp *http.Response) error {
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err == nil && len(r.Error) > 0 {
+		return errors.New(r.Error)
+	}
+	return fmt.Errorf("control: %s", resp.Status)
+}
@@ -0,0 +1,285 @@
+package control
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/feed"
+	"github.com/skrassiev/meerkat/telega"
+)
+
+const (
+	// DefaultSocketPath is the control socket location, unless overridden by CONTROL_SOCKET env var.
+	DefaultSocketPath = "/run/meerkat/control.sock"
+	// DefaultSocketMode allows the owner and the group of the daemon to use the control socket.
+	DefaultSocketMode os.FileMode = 0660
+
+	// telegram bots can't upload files bigger than 50MB
+	maxUploadSize = 50 << 20
+	sendPath      = "/send"
+	statusPath    = "/status"
+	exportPath    = "/export"
+)
+
+type response struct {
+	Error string `json:"error,omitempty"`
+	// Undelivered are the chats, which did not get a message the rest of the chats got
+	Undelivered []int64 `json:"undelivered,omitempty"`
+}
+
+// Status is the daemon state reported over the control socket.
+type Status struct {
+	Bot  telega.Status `json:"bot"`
+	Feed feed.Status   `json:"feed"`
+}
+
+// StatusFunc returns the current daemon state.
+type StatusFunc func() Status
+
+// SocketPath returns the control socket path configured in the environment.
+func SocketPath() string {
+	if p := strings.TrimSpace(os.Getenv("CONTROL_SOCKET")); len(p) > 0 {
+		return p
+	}
+	return DefaultSocketPath
+}
+
+// Serve returns a function, which serves the control API on a Unix domain socket till interrupted.
+// Access to the API is controlled by the socket file permissions only.
+// Messages received over the socket are passed to the bot as background events.
+func Serve(socketPath string, mode os.FileMode, status StatusFunc) telega.BackgroundFunction {
+	return func(ctx context.Context, events chan<- telega.ChattableCloser) {
+		listener, err := listen(socketPath, mode)
+		if err != nil {
+			slog.Error("control: failed to listen", "socket", socketPath, "err", err)
+			return
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc(sendPath, handleSend(events))
+		mux.HandleFunc(statusPath, handleStatus(status))
+		mux.HandleFunc(exportPath, handleExport)
+
+		srv := &http.Server{
+			Handler:     mux,
+			BaseContext: func(net.Listener) context.Context { return ctx },
+		}
+
+		go func() {
+			<-ctx.Done()
+			_ = srv.Close()
+		}()
+
+		slog.Info("control: serving", "socket", socketPath)
+		if err = srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("control: serve failed", "err", err)
+		}
+	}
+}
+
+func listen(socketPath string, mode os.FileMode) (net.Listener, error) {
+	// a stale socket is left behind if the daemon was killed
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// the socket is created in a private directory and moved in place once it has the mode, so that no one can
+	// connect to it in between
+	dir, err := os.MkdirTemp(filepath.Dir(socketPath), ".control")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir)
+
+	tmpPath := filepath.Join(dir, "sock")
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(tmpPath, mode); err == nil {
+		err = os.Rename(tmpPath, socketPath)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	return &socketListener{Listener: listener, path: socketPath}, nil
+}
+
+// socketListener removes the socket, which was moved in place, once closed.
+type socketListener struct {
+	net.Listener
+	path string
+}
+
+func (l *socketListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// handleSend accepts a multipart form with optional 'chat', 'text' and 'file' fields and waits for the delivery.
+func handleSend(events chan<- telega.ChattableCloser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+			writeResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var chatID int64
+		if v := strings.TrimSpace(r.FormValue("chat")); len(v) > 0 {
+			var err error
+			if chatID, err = strconv.ParseInt(v, 10, 64); err != nil {
+				writeResponse(w, http.StatusBadRequest, errors.New("invalid chat id "+v))
+				return
+			}
+		}
+
+		msg, err := newChattable(r)
+		if err != nil {
+			writeResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		result := make(chan error, 1)
+		select {
+		case events <- &telega.ChattableAddressed{ChattableCloser: msg, ChatID: chatID, Result: result}:
+		case <-r.Context().Done():
+			writeResponse(w, http.StatusServiceUnavailable, r.Context().Err())
+			return
+		}
+
+		select {
+		case err = <-result:
+		case <-r.Context().Done():
+			err = r.Context().Err()
+		}
+
+		var delivery *telega.DeliveryError
+		switch {
+		case errors.As(err, &delivery) && len(delivery.Delivered) > 0:
+			// sending it again would repeat it to the chats, which got it
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(response{Error: err.Error(), Undelivered: delivery.Undelivered()})
+		case errors.Is(err, telega.ErrChatNotAllowed):
+			writeResponse(w, http.StatusForbidden, err)
+		case err != nil:
+			writeResponse(w, http.StatusBadGateway, err)
+		default:
+			writeResponse(w, http.StatusOK, nil)
+		}
+	}
+}
+
+func handleStatus(status StatusFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status())
+	}
+}
+
+// handleExport streams the sensor history for the 'sensor', 'range' and 'format' query parameters,
+// gzip compressed if 'gzip' is set.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeResponse(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	if len(format) == 0 {
+		format = "csv"
+	}
+	export, err := feed.NewExport(q.Get("sensor"), q.Get("range"), format)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	name, out := export.Filename(), io.Writer(w)
+	if compress, _ := strconv.ParseBool(q.Get("gzip")); compress {
+		name += ".gz"
+		zw := gzip.NewWriter(w)
+		defer zw.Close()
+		out = zw
+	}
+	w.Header().Set("Content-Type", export.ContentType())
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	if _, err = export.WriteTo(out); err != nil {
+		// the status is sent already, the client sees a truncated body
+		slog.Warn("control: export failed", "err", err)
+	}
+}
+
+// newChattable builds a text message, or a picture, video or document with a caption, if a file is attached.
+func newChattable(r *http.Request) (telega.ChattableCloser, error) {
+	text := r.FormValue("text")
+
+	file, header, err := r.FormFile("file")
+	if errors.Is(err, http.ErrMissingFile) {
+		if len(strings.TrimSpace(text)) == 0 {
+			return nil, errors.New("neither text nor file provided")
+		}
+		return &telega.ChattableText{MessageConfig: tgbotapi.NewMessage(0, text)}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// the same message is sent to every allowed chat, so the file can't be streamed
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	fileData := tgbotapi.FileBytes{Name: path.Base(header.Filename), Bytes: data}
+
+	switch strings.Split(mime.TypeByExtension(path.Ext(header.Filename)), "/")[0] {
+	case "image":
+		m := tgbotapi.NewPhoto(0, fileData)
+		m.Caption = text
+		return &telega.ChattablePicture{PhotoConfig: m}, nil
+	case "video":
+		m := tgbotapi.NewVideo(0, fileData)
+		m.Caption = text
+		return &telega.ChattableVideo{VideoConfig: m}, nil
+	}
+	m := tgbotapi.NewDocument(0, fileData)
+	m.Caption = text
+	return &telega.ChattableDocument{DocumentConfig: m}, nil
+}
+
+func writeResponse(w http.ResponseWriter, code int, err error) {
+	var resp response
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(resp)
+}
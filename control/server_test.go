@@ -0,0 +1,192 @@
+package control
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skrassiev/meerkat/feed"
+	"github.com/skrassiev/meerkat/history"
+	"github.com/skrassiev/meerkat/telega"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer runs the control server and replies to every event with result().
+func startServer(t *testing.T, result func(ev *telega.ChattableAddressed) error) (socketPath string, received <-chan *telega.ChattableAddressed) {
+	socketPath = filepath.Join(t.TempDir(), "control.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var (
+		wg     sync.WaitGroup
+		events = make(chan telega.ChattableCloser)
+		out    = make(chan *telega.ChattableAddressed, 10)
+	)
+
+	status := func() Status {
+		return Status{Bot: telega.Status{Commands: []string{"/ping"}, Outbox: 3}}
+	}
+
+	wg.Add(2)
+	go func() { Serve(socketPath, 0600, status)(ctx, events); wg.Done() }()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case ev := <-events:
+				addressed := ev.(*telega.ChattableAddressed)
+				out <- addressed
+				addressed.Result <- result(addressed)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	t.Cleanup(func() { cancel(); wg.Wait() })
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socketPath)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	return socketPath, out
+}
+
+func TestControl_SocketMode(t *testing.T) {
+	socketPath, _ := startServer(t, func(*telega.ChattableAddressed) error { return nil })
+
+	fi, err := os.Stat(socketPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	// the private directory, the socket was created in, is gone
+	entries, err := os.ReadDir(filepath.Dir(socketPath))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestControl_SendText(t *testing.T) {
+	socketPath, received := startServer(t, func(*telega.ChattableAddressed) error { return nil })
+
+	require.NoError(t, NewClient(socketPath).Send(context.Background(), 42, "backup finished", ""))
+
+	ev := <-received
+	assert.Equal(t, int64(42), ev.ChatID)
+	msg, ok := ev.ChattableCloser.(*telega.ChattableText)
+	require.True(t, ok)
+	assert.Equal(t, "backup finished", msg.Text)
+}
+
+func TestControl_SendFile(t *testing.T) {
+	socketPath, received := startServer(t, func(*telega.ChattableAddressed) error { return nil })
+
+	dir := t.TempDir()
+	for _, v := range []struct {
+		name   string
+		verify func(t *testing.T, msg telega.ChattableCloser)
+	}{
+		{name: "motion.jpg", verify: func(t *testing.T, msg telega.ChattableCloser) {
+			p, ok := msg.(*telega.ChattablePicture)
+			require.True(t, ok)
+			assert.Equal(t, "caption", p.Caption)
+		}},
+		{name: "motion.mp4", verify: func(t *testing.T, msg telega.ChattableCloser) {
+			_, ok := msg.(*telega.ChattableVideo)
+			assert.True(t, ok)
+		}},
+		{name: "backup.log", verify: func(t *testing.T, msg telega.ChattableCloser) {
+			_, ok := msg.(*telega.ChattableDocument)
+			assert.True(t, ok)
+		}},
+	} {
+		fpath := filepath.Join(dir, v.name)
+		require.NoError(t, os.WriteFile(fpath, []byte("data"), 0644))
+		require.NoError(t, NewClient(socketPath).Send(context.Background(), 0, "caption", fpath))
+
+		ev := <-received
+		assert.Equal(t, int64(0), ev.ChatID)
+		v.verify(t, ev.ChattableCloser)
+	}
+}
+
+func TestControl_SendErrors(t *testing.T) {
+	socketPath, _ := startServer(t, func(*telega.ChattableAddressed) error { return telega.ErrChatNotAllowed })
+	c := NewClient(socketPath)
+
+	assert.EqualError(t, c.Send(context.Background(), 13, "hi", ""), telega.ErrChatNotAllowed.Error())
+	assert.Error(t, c.Send(context.Background(), 0, " ", ""))
+	assert.Error(t, c.Send(context.Background(), 0, "hi", "/nonexistent/file"))
+}
+
+func TestControl_SendPartially(t *testing.T) {
+	socketPath, _ := startServer(t, func(*telega.ChattableAddressed) error {
+		return &telega.DeliveryError{Failed: map[int64]error{13: errors.New("Bad Request: chat not found")}, Delivered: []int64{42}}
+	})
+
+	err := NewClient(socketPath).Send(context.Background(), 0, "backup finished", "")
+	var partial *PartialDeliveryError
+	require.True(t, errors.As(err, &partial), err)
+	assert.Equal(t, []int64{13}, partial.Undelivered)
+	assert.EqualError(t, err, "not delivered to chat 13: Bad Request: chat not found, delivered to 1 of 2 chats")
+
+	// none of the chats got it
+	socketPath, _ = startServer(t, func(*telega.ChattableAddressed) error {
+		return &telega.DeliveryError{Failed: map[int64]error{13: errors.New("Bad Request: chat not found"), 14: errors.New("Bad Request: chat not found")}}
+	})
+	err = NewClient(socketPath).Send(context.Background(), 0, "backup finished", "")
+	require.Error(t, err)
+	assert.False(t, errors.As(err, &partial))
+}
+
+func TestControl_NoDaemon(t *testing.T) {
+	assert.Error(t, NewClient(filepath.Join(t.TempDir(), "none.sock")).Send(context.Background(), 0, "hi", ""))
+}
+
+func TestControl_Status(t *testing.T) {
+	socketPath, _ := startServer(t, func(*telega.ChattableAddressed) error { return nil })
+
+	s, err := NewClient(socketPath).Status(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/ping"}, s.Bot.Commands)
+	assert.Equal(t, 3, s.Bot.Outbox)
+}
+
+func TestControl_Export(t *testing.T) {
+	socketPath, _ := startServer(t, func(*telega.ChattableAddressed) error { return nil })
+	c := NewClient(socketPath)
+
+	var b bytes.Buffer
+	_, err := c.Export(context.Background(), "attic", "7d", "csv", false, &b)
+	assert.EqualError(t, err, "history is not enabled")
+
+	require.NoError(t, feed.ConfigureSensors("../testdata/sys", "attic=28-3c01d607ca0a"))
+	require.NoError(t, feed.OpenSensorHistory(t.TempDir(), history.DefaultRetention))
+
+	name, err := c.Export(context.Background(), "attic", "2024-01-01..2024-01-31", "csv", false, &b)
+	require.NoError(t, err)
+	assert.Equal(t, "attic-2024-01-01-2024-01-31.csv", name)
+	assert.Equal(t, "time,sensor,quantity,unit,min,max,avg,count\n", b.String())
+
+	b.Reset()
+	name, err = c.Export(context.Background(), "all", "1d", "json", true, &b)
+	require.NoError(t, err)
+	assert.Regexp(t, `^all-\d{4}-\d\d-\d\d-\d{4}-\d\d-\d\d\.json\.gz$`, name)
+	zr, err := gzip.NewReader(&b)
+	require.NoError(t, err)
+	data, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, "[]\n", string(data))
+
+	_, err = c.Export(context.Background(), "shed", "1d", "csv", false, &b)
+	assert.EqualError(t, err, "unknown sensor shed")
+	_, err = c.Export(context.Background(), "attic", "1d", "xlsx", false, &b)
+	assert.Error(t, err)
+}
@@ -0,0 +1,418 @@
+package feed
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skrassiev/meerkat/history"
+)
+
+const (
+	alertStateFilename = "alerts.json"
+	defaultHysteresis  = 0.5
+	defaultTrendWindow = time.Hour
+	anySensor          = "*"
+	// minTrendReadings is how many readings the slope of a trend takes
+	minTrendReadings = 3
+)
+
+// alertKind is what an alert rule watches for.
+type alertKind string
+
+const (
+	// alertChange reports readings, which changed more than the rule value since the last report.
+	alertChange alertKind = "change"
+	alertBelow  alertKind = "below"
+	alertAbove  alertKind = "above"
+	// alertFalling and alertRising watch the rate of change per hour over the rule window.
+	alertFalling alertKind = "falling"
+	alertRising  alertKind = "rising"
+)
+
+// alertRule is a condition on a quantity of a sensor.
+type alertRule struct {
+	// sensor is a sensor name or ID, or anySensor
+	sensor   string
+	quantity Quantity
+	kind     alertKind
+	// value is the threshold, the reported change or the rate per hour
+	value float64
+	// configured is the value as written in the rule, in the display unit
+	configured float64
+	// hysteresis is how far back over the threshold the reading must get to recover
+	hysteresis float64
+	// minDuration is how long the threshold must be crossed before alerting
+	minDuration time.Duration
+	// repeat is the interval of the reminders while the alert is active, zero for none
+	repeat time.Duration
+	// window is the time span the trend slope is computed over
+	window time.Duration
+	// predict is a value, which a trend alert predicts the time of reaching, or nil
+	predict *float64
+}
+
+// alertState is the state of a rule for a sensor. It's persisted, so that a restart neither repeats nor loses alerts.
+type alertState struct {
+	// Pending is when the threshold was crossed
+	Pending time.Time `json:"pending,omitempty"`
+	Active  bool      `json:"active,omitempty"`
+	// Notified is the last alert or reminder time
+	Notified time.Time `json:"notified,omitempty"`
+	// Reported is the last reported value of a change rule
+	Reported *float64 `json:"reported,omitempty"`
+}
+
+var (
+	// defaultAlertRules report changes of all sensors, if no rules are configured.
+	defaultAlertRules = []alertRule{
+		{sensor: anySensor, quantity: Temperature, kind: alertChange, value: monitoredChanges[Temperature], configured: monitoredChanges[Temperature]},
+		{sensor: anySensor, quantity: Humidity, kind: alertChange, value: monitoredChanges[Humidity], configured: monitoredChanges[Humidity]},
+		{sensor: anySensor, quantity: Pressure, kind: alertChange, value: monitoredChanges[Pressure], configured: monitoredChanges[Pressure]},
+	}
+
+	alerts = alertSet{rules: defaultAlertRules, states: make(map[string]*alertState), recent: make(map[string][]Reading)}
+)
+
+// alertSet is the configured rules and their state by the rule key.
+type alertSet struct {
+	mu        sync.Mutex
+	rules     []alertRule
+	states    map[string]*alertState
+	stateFile string
+	// recent are the readings of the trend rule windows by the sensor and quantity, starting with the recorded ones
+	recent map[string][]Reading
+}
+
+// parseAlertRules parses a list of rules in the form "sensor,kind=value[,key=value...][;...]", e.g.
+// "attic,below=2,hysteresis=1,for=10m,repeat=1h;cellar,quantity=humidity,above=80;*,change=0.5;
+// attic,falling=2,window=1h,predict=0".
+func parseAlertRules(spec string) ([]alertRule, error) {
+	var ret []alertRule
+
+	for _, entry := range strings.Split(spec, ";") {
+		if len(strings.TrimSpace(entry)) == 0 {
+			continue
+		}
+
+		fields := strings.Split(entry, ",")
+		rule := alertRule{sensor: strings.TrimSpace(fields[0]), quantity: Temperature, hysteresis: defaultHysteresis, window: defaultTrendWindow}
+		if len(rule.sensor) == 0 || strings.Contains(rule.sensor, "=") {
+			return nil, fmt.Errorf("alert rule %q: no sensor", entry)
+		}
+
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 || len(kv[1]) == 0 {
+				return nil, fmt.Errorf("alert rule %q: invalid setting %q", entry, field)
+			}
+
+			var err error
+			switch k, v := kv[0], kv[1]; k {
+			case string(alertChange), string(alertBelow), string(alertAbove), string(alertFalling), string(alertRising):
+				if len(rule.kind) > 0 {
+					return nil, fmt.Errorf("alert rule %q: both %s and %s", entry, rule.kind, k)
+				}
+				rule.kind = alertKind(k)
+				rule.value, err = strconv.ParseFloat(v, 64)
+			case "quantity":
+				rule.quantity = Quantity(v)
+				if _, found := quantityUnits[rule.quantity]; !found {
+					err = errors.New("unknown quantity")
+				}
+			case "hysteresis":
+				rule.hysteresis, err = strconv.ParseFloat(v, 64)
+				if err == nil && rule.hysteresis < 0 {
+					err = errors.New("negative hysteresis")
+				}
+			case "for":
+				rule.minDuration, err = history.ParseDuration(v)
+			case "repeat":
+				rule.repeat, err = history.ParseDuration(v)
+			case "window":
+				rule.window, err = history.ParseDuration(v)
+			case "predict":
+				var value float64
+				value, err = strconv.ParseFloat(v, 64)
+				rule.predict = &value
+			default:
+				err = errors.New("unknown setting")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("alert rule %q: %s: %w", entry, field, err)
+			}
+		}
+
+		if len(rule.kind) == 0 {
+			return nil, fmt.Errorf("alert rule %q: one of change, below, above, falling or rising is required", entry)
+		}
+		if (rule.kind == alertChange || rule.trend()) && rule.value <= 0 {
+			return nil, fmt.Errorf("alert rule %q: %s must be positive", entry, rule.kind)
+		}
+		if rule.predict != nil && !rule.trend() {
+			return nil, fmt.Errorf("alert rule %q: predict requires falling or rising", entry)
+		}
+
+		// the rules are in the display unit, the readings in ℃
+		rule.configured = rule.value
+		if rule.kind == alertBelow || rule.kind == alertAbove {
+			rule.value = fromDisplay(rule.quantity, rule.value)
+		} else {
+			rule.value = deltaFromDisplay(rule.quantity, rule.value)
+		}
+		rule.hysteresis = deltaFromDisplay(rule.quantity, rule.hysteresis)
+		if rule.predict != nil {
+			*rule.predict = fromDisplay(rule.quantity, *rule.predict)
+		}
+		ret = append(ret, rule)
+	}
+
+	return ret, nil
+}
+
+// ConfigureAlerts sets the alert rules and loads their state from stateFile, or from the storage directory
+// if stateFile is empty. Changes of all sensors are reported if spec is empty.
+func ConfigureAlerts(spec, stateFile string) error {
+	rules, err := parseAlertRules(spec)
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		rules = defaultAlertRules
+	}
+
+	if len(stateFile) == 0 {
+		if dir := getStorageDir(); len(dir) > 0 {
+			stateFile = filepath.Join(dir, alertStateFilename)
+		}
+	}
+
+	states := make(map[string]*alertState)
+	if len(stateFile) > 0 {
+		b, err := os.ReadFile(stateFile)
+		if err == nil {
+			err = json.Unmarshal(b, &states)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to load alert state", "feed", "temperature", "file", stateFile, "err", err)
+			states = make(map[string]*alertState)
+		}
+	}
+
+	alerts.mu.Lock()
+	alerts.rules, alerts.states, alerts.stateFile = rules, states, stateFile
+	alerts.recent = make(map[string][]Reading)
+	alerts.mu.Unlock()
+	return nil
+}
+
+// matches tells if the rule applies to the sensor.
+func (r alertRule) matches(s *sensor) bool {
+	return r.sensor == anySensor || r.sensor == s.name || r.sensor == s.dev.ID()
+}
+
+// key identifies the state of the rule for a sensor. It does not depend on the rule order, so that
+// the state survives edits of other rules, nor on the display unit, so that it survives a change of the unit.
+func (r alertRule) key(sensor string) string {
+	return fmt.Sprintf("%s/%s/%s/%g", sensor, r.quantity, r.kind, r.configured)
+}
+
+// trend tells if the rule watches the rate of change.
+func (r alertRule) trend() bool {
+	return r.kind == alertFalling || r.kind == alertRising
+}
+
+func (r alertRule) threshold() string {
+	if r.trend() {
+		return fmt.Sprintf("%s faster than %.1f %s/h", r.kind, deltaToDisplay(r.quantity, r.value), unitSymbol(r.quantity))
+	}
+	return string(r.kind) + " " + formatQuantity(r.quantity, r.value)
+}
+
+// slope is the least squares rate of change per hour of the readings over the window before now.
+// It's not known, unless there are minTrendReadings, which span at least a half of the window.
+func slope(readings []Reading, window time.Duration, now time.Time) (float64, bool) {
+	var n, sumT, sumV, sumTT, sumTV float64
+	var first time.Time
+	for _, v := range readings {
+		if v.Time.Before(now.Add(-window)) {
+			continue
+		}
+		if first.IsZero() {
+			first = v.Time
+		}
+		t := v.Time.Sub(first).Hours()
+		n, sumT, sumV, sumTT, sumTV = n+1, sumT+t, sumV+v.Value, sumTT+t*t, sumTV+t*v.Value
+	}
+	if n < minTrendReadings || now.Sub(first) < window/2 {
+		return 0, false
+	}
+	d := n*sumTT - sumT*sumT
+	if d == 0 {
+		return 0, false
+	}
+	return (n*sumTV - sumT*sumV) / d, true
+}
+
+// prediction tells when the reading reaches the predicted value at the rate, e.g. "at this rate 0.0 ℃ in ~3h".
+func (r alertRule) prediction(v Reading, rate float64) string {
+	if r.predict == nil || rate == 0 || (*r.predict-v.Value)/rate <= 0 {
+		return ""
+	}
+	eta := time.Duration((*r.predict - v.Value) / rate * float64(time.Hour))
+	if eta < time.Hour {
+		eta = max(eta.Round(10*time.Minute), 10*time.Minute)
+	} else {
+		eta = eta.Round(time.Hour)
+	}
+	return fmt.Sprintf(", at this rate %s in ~%s", formatQuantity(r.quantity, *r.predict), formatWindow(eta))
+}
+
+// evaluate checks a reading against the rule, trend rules check the recent readings too. It returns true
+// if a change rule reports the reading, or a message if a threshold alert is raised, repeated or recovered.
+func (r alertRule) evaluate(st *alertState, sensor string, v Reading, recent []Reading, now time.Time) (reported bool, msg string) {
+	if r.kind == alertChange {
+		if st.Reported == nil || math.Abs(v.Value-*st.Reported) > r.value {
+			value := v.Value
+			st.Reported = &value
+			return true, ""
+		}
+		return false, ""
+	}
+
+	var crossed, recovered bool
+	current := v.String()
+	switch r.kind {
+	case alertBelow:
+		crossed, recovered = v.Value < r.value, v.Value >= r.value+r.hysteresis
+	case alertAbove:
+		crossed, recovered = v.Value > r.value, v.Value <= r.value-r.hysteresis
+	case alertFalling, alertRising:
+		rate, ok := slope(recent, r.window, now)
+		if !ok {
+			return false, ""
+		}
+		if r.kind == alertFalling {
+			crossed, recovered = rate < -r.value, rate >= -r.value+r.hysteresis
+		} else {
+			crossed, recovered = rate > r.value, rate <= r.value-r.hysteresis
+		}
+		current = formatRate(r.quantity, rate) + ", " + v.String()
+		if crossed || !recovered {
+			current += r.prediction(v, rate)
+		}
+	}
+
+	switch {
+	case !st.Active && crossed:
+		if st.Pending.IsZero() {
+			st.Pending = now
+		}
+		if now.Sub(st.Pending) >= r.minDuration {
+			st.Active, st.Notified = true, now
+			return false, fmt.Sprintf("⚠️ %s %s is %s since %s: %s", sensor, r.quantity, r.threshold(), st.Pending.Format("Jan 2 15:04"), current)
+		}
+	case !st.Active:
+		st.Pending = time.Time{}
+	case recovered:
+		*st = alertState{}
+		return false, fmt.Sprintf("✅ %s %s is no longer %s: %s", sensor, r.quantity, r.threshold(), current)
+	case r.repeat > 0 && now.Sub(st.Notified) >= r.repeat:
+		st.Notified = now
+		return false, fmt.Sprintf("⚠️ %s %s is still %s since %s: %s", sensor, r.quantity, r.threshold(), st.Pending.Format("Jan 2 15:04"), current)
+	}
+	return false, ""
+}
+
+// check evaluates the rules against the readings of a sensor. It returns the readings reported by
+// the change rules and the threshold alert messages.
+func (a *alertSet) check(s *sensor, readings []Reading, now time.Time) (changed []Reading, messages []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	before, _ := json.Marshal(a.states)
+	for _, v := range readings {
+		recent := a.remember(s, v, now)
+		reported := false
+		for _, r := range a.rules {
+			if r.quantity != v.Quantity || !r.matches(s) {
+				continue
+			}
+			key := r.key(s.name)
+			st, found := a.states[key]
+			if !found {
+				st = &alertState{}
+				a.states[key] = st
+			}
+			ok, msg := r.evaluate(st, s.name, v, recent, now)
+			reported = reported || ok
+			if len(msg) > 0 {
+				slog.Info("sensor alert", "feed", "temperature", "sensor", s.name, "msg", msg)
+				messages = append(messages, msg)
+			}
+		}
+		if reported {
+			changed = append(changed, v)
+		}
+	}
+
+	if after, _ := json.Marshal(a.states); string(after) != string(before) {
+		a.save(after)
+	}
+	return
+}
+
+// remember adds a reading to the recent readings of the sensor quantity, which are kept for the longest
+// trend rule window, and returns them. The window starts with the recorded readings, so that a restart
+// does not silence the trend rules until it's filled again.
+func (a *alertSet) remember(s *sensor, v Reading, now time.Time) []Reading {
+	var window time.Duration
+	for _, r := range a.rules {
+		if r.trend() && r.quantity == v.Quantity && r.matches(s) {
+			window = max(window, r.window)
+		}
+	}
+	key := historySeries(s.name, v.Quantity)
+	if window == 0 {
+		delete(a.recent, key)
+		return nil
+	}
+
+	recent, found := a.recent[key]
+	if !found {
+		// the recorded time is truncated to a second, the reading itself is not taken from the history
+		recent = historyReadings(s.name, v.Quantity, now.Add(-window), v.Time.Truncate(time.Second))
+	}
+	// a reading cached since the last check is the same reading
+	if len(recent) == 0 || !v.Time.Equal(recent[len(recent)-1].Time) {
+		recent = append(recent, v)
+	}
+	for len(recent) > 0 && recent[0].Time.Before(now.Add(-window)) {
+		recent = recent[1:]
+	}
+	a.recent[key] = recent
+	return recent
+}
+
+// save writes the state, so that a crash in the middle does not corrupt it.
+func (a *alertSet) save(b []byte) {
+	if len(a.stateFile) == 0 {
+		return
+	}
+	tmp := a.stateFile + ".tmp"
+	err := os.WriteFile(tmp, b, 0644)
+	if err == nil {
+		err = os.Rename(tmp, a.stateFile)
+	}
+	if err != nil {
+		slog.Warn("failed to save alert state", "feed", "temperature", "file", a.stateFile, "err", err)
+	}
+}
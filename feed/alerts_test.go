@@ -0,0 +1,193 @@
+package feed
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skrassiev/meerkat/history"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resetAlerts configures the rules with a fresh state and restores the previous rules after the test.
+func resetAlerts(t *testing.T, spec string) {
+	alerts.mu.Lock()
+	rules, states, stateFile := alerts.rules, alerts.states, alerts.stateFile
+	alerts.mu.Unlock()
+	t.Cleanup(func() {
+		alerts.mu.Lock()
+		alerts.rules, alerts.states, alerts.stateFile = rules, states, stateFile
+		alerts.mu.Unlock()
+	})
+
+	require.NoError(t, ConfigureAlerts(spec, filepath.Join(t.TempDir(), alertStateFilename)))
+}
+
+func Test001_alertRulesParse(t *testing.T) {
+	rules, err := parseAlertRules("attic,below=2,hysteresis=1,for=10m,repeat=1h; cellar,quantity=humidity,above=80;*,change=0.5;")
+	require.NoError(t, err)
+	require.Len(t, rules, 3)
+	assert.Equal(t, alertRule{sensor: "attic", quantity: Temperature, kind: alertBelow, value: 2, configured: 2, hysteresis: 1, minDuration: 10 * time.Minute, repeat: time.Hour, window: time.Hour}, rules[0])
+	assert.Equal(t, alertRule{sensor: "cellar", quantity: Humidity, kind: alertAbove, value: 80, configured: 80, hysteresis: defaultHysteresis, window: time.Hour}, rules[1])
+	assert.Equal(t, alertKind("change"), rules[2].kind)
+
+	rules, err = parseAlertRules("")
+	require.NoError(t, err)
+	assert.Empty(t, rules)
+
+	for _, v := range []string{
+		"attic",
+		"below=2",
+		"attic,below=2,above=30",
+		"attic,below=cold",
+		"attic,quantity=wind,above=10",
+		"attic,below=2,hysteresis=-1",
+		"attic,below=2,for=soon",
+		"attic,below=2,color=red",
+		"attic,change=0",
+	} {
+		_, err = parseAlertRules(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func Test002_alertThresholdHysteresis(t *testing.T) {
+	resetAlerts(t, "attic,below=2,hysteresis=1,for=10m,repeat=1h")
+	s, _ := newTestSensor("attic", "28-3c01d607ca0a", "")
+
+	start := time.Date(2024, 1, 30, 3, 0, 0, 0, time.Local)
+	check := func(minutes int, value float64) []string {
+		changed, messages := alerts.check(s, []Reading{{Quantity: Temperature, Value: value, Unit: "℃"}}, start.Add(time.Duration(minutes)*time.Minute))
+		// there are no change rules
+		assert.Empty(t, changed)
+		return messages
+	}
+
+	// a short dip is not reported
+	assert.Empty(t, check(0, 1.5))
+	assert.Empty(t, check(5, 2.5))
+
+	assert.Empty(t, check(10, 1.5))
+	assert.Empty(t, check(15, 1.2))
+	assert.Equal(t, []string{"⚠️ attic temperature is below 2.0 ℃ since Jan 30 03:10: 1.0 ℃ 🌡"}, check(20, 1.0))
+
+	// within the hysteresis band the alert stays active
+	assert.Empty(t, check(25, 2.5))
+	assert.Empty(t, check(30, 1.8))
+	assert.Equal(t, []string{"⚠️ attic temperature is still below 2.0 ℃ since Jan 30 03:10: 0.5 ℃ 🌡"}, check(80, 0.5))
+	assert.Empty(t, check(85, 0.5))
+
+	assert.Equal(t, []string{"✅ attic temperature is no longer below 2.0 ℃: 3.0 ℃ 🌡"}, check(90, 3.0))
+	assert.Empty(t, check(95, 3.0))
+}
+
+func Test003_alertStatePersisted(t *testing.T) {
+	resetAlerts(t, "")
+	stateFile := filepath.Join(t.TempDir(), alertStateFilename)
+	const spec = "*,above=30;*,change=0.5"
+	require.NoError(t, ConfigureAlerts(spec, stateFile))
+
+	s, dev := newTestSensor("attic", "28-3c01d607ca0a", "32_8c")
+	s.minRead = time.Nanosecond
+	defer setSensors(getSensors())
+	setSensors([]*sensor{s})
+
+	assert.Regexp(t, `^32\.8 ℃ 🌡\n⚠️ attic temperature is above 30\.0 ℃ since \w+ \d+ \d\d:\d\d: 32\.8 ℃ 🌡$`, TemperatureMonitor(context.Background()))
+
+	// neither the change nor the alert are repeated after a restart
+	require.NoError(t, ConfigureAlerts(spec, stateFile))
+	assert.Empty(t, TemperatureMonitor(context.Background()))
+
+	dev.path = path.Join(testDataDir, "temp_sensor_readings", "28_8c")
+	require.NoError(t, ConfigureAlerts(spec, stateFile))
+	assert.Equal(t, "28.8 ℃ 🌡\n✅ attic temperature is no longer above 30.0 ℃: 28.8 ℃ 🌡", TemperatureMonitor(context.Background()))
+}
+
+func Test004_alertTrend(t *testing.T) {
+	start := time.Date(2024, 1, 30, 3, 0, 0, 0, time.Local)
+	at := func(minutes int, value float64) Reading {
+		return Reading{Quantity: Temperature, Value: value, Unit: "℃", Time: start.Add(time.Duration(minutes) * time.Minute)}
+	}
+
+	// noise does not change the slope of a steady fall much
+	readings := []Reading{at(0, 20), at(15, 19.6), at(30, 18.4), at(45, 18.2), at(60, 17)}
+	rate, ok := slope(readings, time.Hour, start.Add(time.Hour))
+	require.True(t, ok)
+	assert.InDelta(t, -2.96, rate, 0.01)
+
+	// the readings before the window are ignored, and too few are not a trend
+	_, ok = slope(readings, 20*time.Minute, start.Add(time.Hour))
+	assert.False(t, ok)
+	_, ok = slope(readings[:2], time.Hour, start.Add(15*time.Minute))
+	assert.False(t, ok)
+	// a trend takes at least a half of the window
+	_, ok = slope(readings[:3], 2*time.Hour, start.Add(30*time.Minute))
+	assert.False(t, ok)
+
+	rules, err := parseAlertRules("attic,falling=2,predict=0,window=1h;attic,rising=1,predict=10")
+	require.NoError(t, err)
+	assert.Equal(t, ", at this rate 0.0 ℃ in ~6h", rules[0].prediction(at(60, 17), -2.8))
+	assert.Equal(t, ", at this rate 0.0 ℃ in ~20m", rules[0].prediction(at(60, 1), -2.8))
+	// moving away from the value
+	assert.Empty(t, rules[1].prediction(at(60, 17), 2))
+	assert.Empty(t, rules[1].prediction(at(60, 9), -2))
+
+	for _, v := range []string{"attic,falling=0", "attic,below=2,predict=0", "attic,rising=1,window=0"} {
+		_, err = parseAlertRules(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func Test005_alertTrendMonitor(t *testing.T) {
+	resetAlerts(t, "attic,falling=2,predict=0")
+	s, _ := newTestSensor("attic", "28-3c01d607ca0a", "")
+
+	start := time.Date(2024, 1, 30, 3, 0, 0, 0, time.Local)
+	check := func(minutes int, value float64) []string {
+		now := start.Add(time.Duration(minutes) * time.Minute)
+		_, messages := alerts.check(s, []Reading{{Quantity: Temperature, Value: value, Unit: "℃", Time: now}}, now)
+		return messages
+	}
+
+	// a steady 20 ℃ and the heating fails at 04:00, the temperature falls 3 ℃/h
+	for i := 0; i <= 60; i += 5 {
+		assert.Empty(t, check(i, 20))
+	}
+	alerted := make(map[int][]string)
+	for i := 65; i <= 150; i += 5 {
+		if msg := check(i, 20-float64(i-60)/20); len(msg) > 0 {
+			alerted[i] = msg
+		}
+	}
+	// and stops at 15.5 ℃
+	for i := 155; i <= 240; i += 5 {
+		if msg := check(i, 15.5); len(msg) > 0 {
+			alerted[i] = msg
+		}
+	}
+
+	assert.Equal(t, map[int][]string{
+		100: {"⚠️ attic temperature is falling faster than 2.0 ℃/h since Jan 30 04:40: -2.2 ℃/h, 18.0 ℃ 🌡, at this rate 0.0 ℃ in ~8h"},
+		185: {"✅ attic temperature is no longer falling faster than 2.0 ℃/h: -1.2 ℃/h, 15.5 ℃ 🌡"},
+	}, alerted)
+}
+
+func Test006_alertTrendAfterRestart(t *testing.T) {
+	defer sensorHistory.Store(sensorHistory.Load())
+	require.NoError(t, OpenSensorHistory(t.TempDir(), history.DefaultRetention))
+	s, _ := newTestSensor("attic", "28-3c01d607ca0a", "")
+
+	// the temperature falls 3 ℃/h over the last hour before a restart
+	now := time.Now()
+	for i := 60; i > 0; i -= 5 {
+		require.NoError(t, sensorHistory.Load().Append(historySeries("attic", Temperature), now.Add(-time.Duration(i)*time.Minute), 20-float64(60-i)/20))
+	}
+
+	resetAlerts(t, "attic,falling=2")
+	_, messages := alerts.check(s, []Reading{{Quantity: Temperature, Value: 17, Unit: "℃", Time: now}}, now)
+	require.Len(t, messages, 1)
+	assert.Regexp(t, `^⚠️ attic temperature is falling faster than 2\.0 ℃/h since .+: -3\.0 ℃/h, 17\.0 ℃ 🌡$`, messages[0])
+}
@@ -0,0 +1,123 @@
+package feed
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxFilterSize = 60
+
+// calibration corrects the readings of a quantity linearly: value*scale + offset.
+type calibration struct {
+	scale, offset float64
+}
+
+// readingFilter smooths readings with the median or the average of the last size values.
+// The median drops single spikes, the average evens out noise.
+type readingFilter struct {
+	median bool
+	size   int
+	values map[Quantity][]float64
+}
+
+// parseCalibrationSetting tells if a sensor setting is a calibration, such as offset, scale, humidity-offset or
+// pressure-scale, and of which quantity. offset and scale calibrate the temperature.
+func parseCalibrationSetting(key string) (q Quantity, offset bool, ok bool) {
+	q = Temperature
+	if prefix, setting, found := strings.Cut(key, "-"); found {
+		q, key = Quantity(prefix), setting
+		if _, known := quantityUnits[q]; !known {
+			return "", false, false
+		}
+	}
+	switch key {
+	case "offset":
+		return q, true, true
+	case "scale":
+		return q, false, true
+	}
+	return "", false, false
+}
+
+// setCalibration applies a calibration setting. The offset is in the display unit.
+func (s *sensor) setCalibration(q Quantity, offset bool, value string) error {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+
+	if s.calibration == nil {
+		s.calibration = make(map[Quantity]calibration)
+	}
+	c, found := s.calibration[q]
+	if !found {
+		c.scale = 1
+	}
+	if offset {
+		c.offset = deltaFromDisplay(q, v)
+	} else {
+		if v == 0 {
+			return fmt.Errorf("zero scale")
+		}
+		c.scale = v
+	}
+	s.calibration[q] = c
+	return nil
+}
+
+// parseFilter parses median:N or avg:N.
+func parseFilter(spec string) (*readingFilter, error) {
+	kind, size, found := strings.Cut(spec, ":")
+	n, err := strconv.Atoi(size)
+	if !found || err != nil || n < 2 || n > maxFilterSize {
+		return nil, fmt.Errorf("filter %q: use median:N or avg:N, N is 2 to %d", spec, maxFilterSize)
+	}
+	switch kind {
+	case "median":
+		return &readingFilter{median: true, size: n, values: make(map[Quantity][]float64)}, nil
+	case "avg":
+		return &readingFilter{size: n, values: make(map[Quantity][]float64)}, nil
+	}
+	return nil, fmt.Errorf("filter %q: unknown kind %s", spec, kind)
+}
+
+// calibrate corrects fresh readings, and smooths them if the sensor has a filter. The caller holds the sensor lock.
+func (s *sensor) calibrate(readings []Reading) []Reading {
+	ret := make([]Reading, 0, len(readings))
+	for _, v := range readings {
+		if c, found := s.calibration[v.Quantity]; found {
+			v.Value = v.Value*c.scale + c.offset
+		}
+		if s.filter != nil {
+			v.Value = s.filter.apply(v.Quantity, v.Value)
+		}
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+// apply adds a value to the window of its quantity and returns the filtered value.
+func (f *readingFilter) apply(q Quantity, v float64) float64 {
+	window := append(f.values[q], v)
+	if len(window) > f.size {
+		window = window[len(window)-f.size:]
+	}
+	f.values[q] = window
+
+	if f.median {
+		sorted := append([]float64(nil), window...)
+		sort.Float64s(sorted)
+		if n := len(sorted); n%2 == 0 {
+			return (sorted[n/2-1] + sorted[n/2]) / 2
+		}
+		return sorted[len(sorted)/2]
+	}
+
+	var sum float64
+	for _, x := range window {
+		sum += x
+	}
+	return sum / float64(len(window))
+}
@@ -0,0 +1,75 @@
+package feed
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test001_calibrationSettings(t *testing.T) {
+	s, _ := newTestSensor("attic", "28-3c01d607ca0a", "29_8c")
+	require.NoError(t, s.applySettings(map[string]string{"offset": "-0.7", "humidity-scale": "1.1", "filter": "median:3"}))
+	assert.Equal(t, calibration{scale: 1, offset: -0.7}, s.calibration[Temperature])
+	assert.Equal(t, calibration{scale: 1.1}, s.calibration[Humidity])
+	assert.True(t, s.filter.median)
+	assert.Equal(t, 3, s.filter.size)
+
+	for _, v := range []map[string]string{
+		{"offset": "high"},
+		{"scale": "0"},
+		{"wind-offset": "1"},
+		{"humidity-gain": "1"},
+		{"filter": "median"},
+		{"filter": "median:1"},
+		{"filter": "mode:5"},
+	} {
+		assert.Error(t, s.applySettings(v), v)
+	}
+
+	// the offset is in the display unit
+	useTemperatureUnit(t, "F")
+	require.NoError(t, s.applySettings(map[string]string{"offset": "-1.8"}))
+	assert.InDelta(t, -1, s.calibration[Temperature].offset, 1e-9)
+}
+
+func Test002_calibratedReadings(t *testing.T) {
+	s, dev := newTestSensor("attic", "28-3c01d607ca0a", "29_8c")
+	s.minRead = time.Nanosecond
+	require.NoError(t, s.applySettings(map[string]string{"offset": "-0.7", "scale": "1.1"}))
+
+	readings, err := s.getReadingsWithRetries(context.Background(), 1)
+	require.NoError(t, err)
+	assert.InDelta(t, 29.812*1.1-0.7, readings[0].Value, 1e-9)
+
+	// the cache and the monitor get the calibrated value
+	last, _ := s.lastReadings()
+	assert.Equal(t, readings, last)
+
+	dev.path = path.Join(testDataDir, "temp_sensor_readings", "28_8c")
+	readings, err = s.getReadingsWithRetries(context.Background(), 1)
+	require.NoError(t, err)
+	assert.InDelta(t, 28.812*1.1-0.7, readings[0].Value, 1e-9)
+}
+
+func Test003_readingFilters(t *testing.T) {
+	median, err := parseFilter("median:3")
+	require.NoError(t, err)
+	avg, err := parseFilter("avg:3")
+	require.NoError(t, err)
+
+	var medians, averages []float64
+	for _, v := range []float64{20, 20.2, 85, 20.4, 20.6, 20.8} {
+		medians = append(medians, median.apply(Temperature, v))
+		averages = append(averages, avg.apply(Temperature, v))
+	}
+	// the spike does not get through the median
+	assert.InDeltaSlice(t, []float64{20, 20.1, 20.2, 20.4, 20.6, 20.6}, medians, 1e-9)
+	assert.InDeltaSlice(t, []float64{20, 20.1, 41.733333, 41.866666, 42, 20.6}, averages, 1e-5)
+
+	// the quantities are filtered separately
+	assert.Equal(t, 45.0, median.apply(Humidity, 45))
+}
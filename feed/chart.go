@@ -0,0 +1,171 @@
+package feed
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/chart"
+	"github.com/skrassiev/meerkat/history"
+	"github.com/skrassiev/meerkat/telega"
+)
+
+const defaultChartWindow = 24 * time.Hour
+
+// renderSensorChart draws the history of a quantity of the sensors over the window as PNG.
+func renderSensorChart(store *history.Store, sensors []*sensor, q Quantity, window time.Duration) ([]byte, error) {
+	now := time.Now()
+	c := chart.Chart{
+		Title: fmt.Sprintf("%s, last %s", q, formatWindow(window)),
+		Unit:  unitSymbol(q),
+		From:  now.Add(-window),
+		To:    now,
+	}
+
+	for _, s := range sensors {
+		points, err := store.Query(historySeries(s.name, q), c.From, c.To)
+		if err != nil {
+			return nil, err
+		}
+		series := chart.Series{Name: s.name, Points: make([]chart.Point, 0, len(points))}
+		for _, v := range points {
+			series.Points = append(series.Points, chart.Point{Time: v.Time, Value: toDisplay(q, v.Avg)})
+		}
+		c.Series = append(c.Series, series)
+	}
+
+	var b bytes.Buffer
+	if err := c.Render(&b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// formatWindow prints a window the way it's typed, e.g. 7d or 12h rather than 168h0m0s or 12h0m0s.
+func formatWindow(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// sensorChartPicture is a chart of a quantity as a chat picture.
+func sensorChartPicture(chatID int64, store *history.Store, sensors []*sensor, q Quantity, window time.Duration) (*telega.ChattablePicture, error) {
+	png, err := renderSensorChart(store, sensors, q, window)
+	if err != nil {
+		return nil, err
+	}
+	return &telega.ChattablePicture{PhotoConfig: tgbotapi.NewPhoto(chatID, tgbotapi.FileBytes{Name: "chart.png", Bytes: png})}, nil
+}
+
+// HandleCommandChart charts the history of all sensors, or the ones named in the arguments. Other arguments
+// are the window and the quantity, e.g. /chart attic cellar 7d or /chart humidity. The default is temperature over 24h.
+func HandleCommandChart(ctx context.Context, cmd *tgbotapi.Message, _ *tgbotapi.BotAPI) (response telega.ChattableCloser, _ error) {
+	reply := func(text string) (telega.ChattableCloser, error) {
+		return &telega.ChattableText{MessageConfig: tgbotapi.NewMessage(cmd.Chat.ID, text)}, nil
+	}
+
+	store := sensorHistory.Load()
+	if store == nil {
+		return reply("history is not enabled")
+	}
+
+	var (
+		sensors []*sensor
+		window  = defaultChartWindow
+		q       = Temperature
+	)
+	for _, arg := range commandArgs(cmd) {
+		if d, err := history.ParseDuration(arg); err == nil {
+			window = d
+			continue
+		}
+		if _, found := quantityUnits[Quantity(arg)]; found {
+			q = Quantity(arg)
+			continue
+		}
+		s := findSensor(arg)
+		if s == nil {
+			return reply("unknown sensor " + arg)
+		}
+		sensors = append(sensors, s)
+	}
+	if len(sensors) == 0 {
+		sensors = getSensors()
+	}
+	if len(sensors) == 0 {
+		return reply("no temperature sensors")
+	}
+
+	pic, err := sensorChartPicture(cmd.Chat.ID, store, sensors, q, window)
+	if errors.Is(err, chart.ErrNoData) {
+		return reply(fmt.Sprintf("no %s readings in %s", q, formatWindow(window)))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pic, nil
+}
+
+// nextTimeOfDay returns the next local time after now, which is the time of day of tod.
+func nextTimeOfDay(tod, now time.Time) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), tod.Hour(), tod.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// DailyChart returns a background function, which sends charts of the last day to all chats every day at the
+// local time of day, such as 08:00. There is a chart for every quantity, which has readings.
+func DailyChart(at string) (telega.BackgroundFunction, error) {
+	tod, err := time.Parse("15:04", at)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time of day %q", at)
+	}
+
+	return func(ctx context.Context, events chan<- telega.ChattableCloser) {
+		for {
+			next := nextTimeOfDay(tod, time.Now())
+			slog.Debug("next daily chart", "feed", "temperature", "time", next)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Until(next)):
+			}
+
+			store := sensorHistory.Load()
+			if store == nil {
+				continue
+			}
+			for _, q := range historyQuantities {
+				pic, err := sensorChartPicture(0, store, getSensors(), q, 24*time.Hour)
+				if errors.Is(err, chart.ErrNoData) {
+					continue
+				}
+				if err != nil {
+					slog.Warn("failed to render daily chart", "feed", "temperature", "quantity", q, "err", err)
+					continue
+				}
+				select {
+				case events <- pic:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}, nil
+}
@@ -0,0 +1,78 @@
+package feed
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/history"
+	"github.com/skrassiev/meerkat/telega"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test001_chartCommand(t *testing.T) {
+	defer setSensors(getSensors())
+	defer sensorHistory.Store(sensorHistory.Load())
+
+	attic, _ := newTestSensor("attic", "28-3c01d607ca0a", "29_8c")
+	cellar, _ := newTestSensor("cellar", "10-000802b4a1c2", "minus_10_8_c")
+	setSensors([]*sensor{attic, cellar})
+
+	command := func(text string) telega.ChattableCloser {
+		resp, err := HandleCommandChart(context.Background(), &tgbotapi.Message{Text: text, Chat: &tgbotapi.Chat{ID: 1}}, nil)
+		require.NoError(t, err)
+		return resp
+	}
+	text := func(text string) string {
+		return command(text).(*telega.ChattableText).Text
+	}
+
+	sensorHistory.Store(nil)
+	assert.Equal(t, "history is not enabled", text("/chart"))
+
+	require.NoError(t, OpenSensorHistory(t.TempDir(), history.DefaultRetention))
+	assert.Equal(t, "no temperature readings in 1d", text("/chart"))
+	assert.Equal(t, "no humidity readings in 12h", text("/chart humidity 12h"))
+	assert.Equal(t, "unknown sensor shed", text("/chart shed"))
+
+	store := sensorHistory.Load()
+	now := time.Now()
+	for i := 0; i < 60; i++ {
+		require.NoError(t, store.Append(historySeries("attic", Temperature), now.Add(time.Duration(i-60)*time.Minute), 20+float64(i)/10))
+	}
+
+	pic, ok := command("/chart attic 2h").(*telega.ChattablePicture)
+	require.True(t, ok)
+	assert.Equal(t, int64(1), pic.ChatID)
+	img, err := png.Decode(bytes.NewReader(pic.File.(tgbotapi.FileBytes).Bytes))
+	require.NoError(t, err)
+	assert.Equal(t, 800, img.Bounds().Dx())
+
+	// the cellar has no readings, but it's still in the legend
+	_, ok = command("/chart").(*telega.ChattablePicture)
+	assert.True(t, ok)
+}
+
+func Test002_chartWindowFormat(t *testing.T) {
+	for k, v := range map[time.Duration]string{
+		24 * time.Hour:     "1d",
+		7 * 24 * time.Hour: "7d",
+		12 * time.Hour:     "12h",
+		90 * time.Minute:   "1h30m",
+		30 * time.Minute:   "30m",
+		45 * time.Second:   "45s",
+	} {
+		assert.Equal(t, v, formatWindow(k))
+	}
+}
+
+func Test003_dailyChart(t *testing.T) {
+	_, err := DailyChart("8am")
+	assert.Error(t, err)
+	_, err = DailyChart("08:00")
+	assert.NoError(t, err)
+}
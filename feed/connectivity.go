@@ -0,0 +1,333 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/telega"
+)
+
+const (
+	connectivityStateFilename = "connectivity.json"
+	connectivityTimeout       = 5 * time.Second
+	// connectivityDownProbes is how many probes in a row must fail for the internet to be down, so a single
+	// lost probe is not an outage
+	connectivityDownProbes = 2
+	// outageRetention is how long the outages are kept for
+	outageRetention = 7 * 24 * time.Hour
+	// maxProbeResponse is how much of an HTTP response is read, the status is what matters
+	maxProbeResponse = 4 << 10
+)
+
+// probeTarget is a host:port to connect to, or a URL to get. Any HTTP response, but a server error, tells
+// the internet is up.
+type probeTarget struct {
+	address string
+	url     string
+}
+
+func (p probeTarget) String() string {
+	if len(p.url) > 0 {
+		return p.url
+	}
+	return p.address
+}
+
+// probe connects to the target.
+func (p probeTarget) probe(ctx context.Context) error {
+	if len(p.url) == 0 {
+		dialer := &net.Dialer{}
+		conn, err := dialer.DialContext(ctx, "tcp", p.address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return err
+	}
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, DisableKeepAlives: true}}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxProbeResponse))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// parseProbeTargets parses a list of targets: tcp://host:port, host:port or an http(s) URL[;...].
+func parseProbeTargets(spec string) ([]probeTarget, error) {
+	var targets []probeTarget
+	for _, v := range strings.Split(spec, ";") {
+		if v = strings.TrimSpace(v); len(v) == 0 {
+			continue
+		}
+		if u, err := url.Parse(v); err == nil && (u.Scheme == "http" || u.Scheme == "https") && len(u.Host) > 0 {
+			targets = append(targets, probeTarget{url: v})
+			continue
+		}
+		address := strings.TrimPrefix(v, "tcp://")
+		if host, port, err := net.SplitHostPort(address); err != nil || len(host) == 0 || len(port) == 0 || strings.Contains(address, "/") {
+			return nil, fmt.Errorf("invalid probe target %q, use tcp://host:port or a URL", v)
+		}
+		targets = append(targets, probeTarget{address: address})
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("no probe targets")
+	}
+	return targets, nil
+}
+
+// outage is a time the internet was down. End is zero while it lasts.
+type outage struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// connectivityMonitor probes the targets and keeps the outages in the state file, so an outage, which lasts over
+// a restart, is reported once the internet is up.
+type connectivityMonitor struct {
+	targets   []probeTarget
+	stateFile string
+	outages   []outage
+
+	// failures is the number of failed probes in a row, the first of them at failingSince
+	failures     int
+	failingSince time.Time
+}
+
+// newConnectivityMonitor loads the outages from stateFile, or from the storage directory if stateFile is empty.
+func newConnectivityMonitor(targets []probeTarget, stateFile string) *connectivityMonitor {
+	if len(stateFile) == 0 {
+		if dir := getStorageDir(); len(dir) > 0 {
+			stateFile = filepath.Join(dir, connectivityStateFilename)
+		}
+	}
+	m := &connectivityMonitor{targets: targets, stateFile: stateFile}
+	if len(stateFile) > 0 {
+		var state struct {
+			Outages []outage `json:"outages"`
+		}
+		b, err := os.ReadFile(stateFile)
+		if err == nil {
+			err = json.Unmarshal(b, &state)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to load connectivity state", "feed", "connectivity", "file", stateFile, "err", err)
+		}
+		m.outages = state.Outages
+	}
+	return m
+}
+
+// ConnectivityMonitor returns a background function, which probes the targets every interval, see
+// parseProbeTargets. The internet is up if any of them answers. Once it's back, the outage is reported to all
+// chats, e.g. "Internet was down from 02:14 to 05:40 (3h26m)". If summaryAt is a local time of day, such as
+// 08:00, the uptime of the last day is reported then. The outages are kept in stateFile, or in the storage
+// directory if stateFile is empty.
+func ConnectivityMonitor(targets string, interval time.Duration, summaryAt, stateFile string) (telega.BackgroundFunction, error) {
+	probeTargets, err := parseProbeTargets(targets)
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid probe interval %s", interval)
+	}
+	var tod time.Time
+	if len(summaryAt) > 0 {
+		if tod, err = time.Parse("15:04", summaryAt); err != nil {
+			return nil, fmt.Errorf("invalid time of day %q", summaryAt)
+		}
+	}
+
+	m := newConnectivityMonitor(probeTargets, stateFile)
+	return func(ctx context.Context, events chan<- telega.ChattableCloser) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var summary *time.Timer
+		var summaryC <-chan time.Time
+		if len(summaryAt) > 0 {
+			summary = time.NewTimer(time.Until(nextTimeOfDay(tod, time.Now())))
+			defer summary.Stop()
+			summaryC = summary.C
+		}
+
+		msg := m.step(ctx, time.Now())
+		for {
+			if len(msg) > 0 {
+				select {
+				case events <- &telega.ChattableText{MessageConfig: tgbotapi.NewMessage(0, msg)}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				msg = m.step(ctx, time.Now())
+			case <-summaryC:
+				msg = m.summary(time.Now())
+				summary.Reset(time.Until(nextTimeOfDay(tod, time.Now())))
+			}
+		}
+	}, nil
+}
+
+// probe tells if any of the targets answers, they're probed at once.
+func (m *connectivityMonitor) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, connectivityTimeout)
+	defer cancel()
+
+	results := make(chan error, len(m.targets))
+	for _, v := range m.targets {
+		go func(p probeTarget) {
+			if err := p.probe(ctx); err != nil {
+				results <- fmt.Errorf("%s: %w", p, err)
+				return
+			}
+			results <- nil
+		}(v)
+	}
+
+	var errs []error
+	for range m.targets {
+		err := <-results
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// ongoing returns the outage, which lasts, nil if the internet is up.
+func (m *connectivityMonitor) ongoing() *outage {
+	if n := len(m.outages); n > 0 && m.outages[n-1].End.IsZero() {
+		return &m.outages[n-1]
+	}
+	return nil
+}
+
+// step probes the targets and returns the message about the outage, once it's over.
+func (m *connectivityMonitor) step(ctx context.Context, now time.Time) string {
+	err := m.probe(ctx)
+	if ctx.Err() != nil {
+		// stopping
+		return ""
+	}
+
+	if err == nil {
+		m.failures = 0
+		internetUp.Set(1)
+		o := m.ongoing()
+		if o == nil {
+			return ""
+		}
+		o.End = now
+		m.save(now)
+		slog.Info("internet is up", "feed", "connectivity", "down", o.End.Sub(o.Start))
+		return formatOutage(*o)
+	}
+
+	if m.failures == 0 {
+		m.failingSince = now
+	}
+	m.failures++
+	if m.failures >= connectivityDownProbes && m.ongoing() == nil {
+		m.outages = append(m.outages, outage{Start: m.failingSince})
+		m.save(now)
+		internetUp.Set(0)
+		internetOutages.Inc()
+		slog.Warn("internet is down", "feed", "connectivity", "since", m.failingSince, "err", err)
+	}
+	return ""
+}
+
+// formatOutage tells when the internet was down, with the days if it was down over midnight.
+func formatOutage(o outage) string {
+	start, end := o.Start.Local(), o.End.Local()
+	layout := "15:04"
+	if sy, sm, sd := start.Date(); end.Day() != sd || end.Month() != sm || end.Year() != sy {
+		layout = "Jan 2 15:04"
+	}
+	return fmt.Sprintf("Internet was down from %s to %s (%s)", start.Format(layout), end.Format(layout), formatAge(end.Sub(start)))
+}
+
+// summary tells the uptime over the last day, and the outages during it.
+func (m *connectivityMonitor) summary(now time.Time) string {
+	const day = 24 * time.Hour
+	from := now.Add(-day)
+
+	var down time.Duration
+	var count int
+	for _, o := range m.outages {
+		start, end := o.Start, o.End
+		if end.IsZero() {
+			end = now
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(start) {
+			down += end.Sub(start)
+			count++
+		}
+	}
+
+	// rounded down, so a short outage is not 100%
+	uptime := math.Floor(10000*(1-float64(down)/float64(day))) / 100
+	msg := fmt.Sprintf("Internet uptime in the last day: %s%%", strconv.FormatFloat(uptime, 'f', -1, 64))
+	switch count {
+	case 0:
+	case 1:
+		msg += fmt.Sprintf(", 1 outage for %s", formatAge(down))
+	default:
+		msg += fmt.Sprintf(", %d outages for %s", count, formatAge(down))
+	}
+	return msg
+}
+
+// save writes the outages of the last week, so that a crash in the middle does not corrupt them.
+func (m *connectivityMonitor) save(now time.Time) {
+	for len(m.outages) > 0 && !m.outages[0].End.IsZero() && m.outages[0].End.Before(now.Add(-outageRetention)) {
+		m.outages = m.outages[1:]
+	}
+	if len(m.stateFile) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(struct {
+		Outages []outage `json:"outages"`
+	}{m.outages})
+	if err == nil {
+		tmp := m.stateFile + ".tmp"
+		if err = os.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, m.stateFile)
+		}
+	}
+	if err != nil {
+		slog.Warn("failed to save connectivity state", "feed", "connectivity", "file", m.stateFile, "err", err)
+	}
+}
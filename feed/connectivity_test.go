@@ -0,0 +1,169 @@
+package feed
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skrassiev/meerkat/telega"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// probeServer stands in for a probe target, which fails with 503 while down is set.
+func probeServer(t *testing.T, down *atomic.Bool) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestConnectivity_parseProbeTargets(t *testing.T) {
+	targets, err := parseProbeTargets("tcp://1.1.1.1:443; 8.8.8.8:53;https://connectivitycheck.gstatic.com/generate_204;tcp://[2606:4700:4700::1111]:443")
+	require.NoError(t, err)
+	assert.Equal(t, []probeTarget{
+		{address: "1.1.1.1:443"},
+		{address: "8.8.8.8:53"},
+		{url: "https://connectivitycheck.gstatic.com/generate_204"},
+		{address: "[2606:4700:4700::1111]:443"},
+	}, targets)
+
+	for _, v := range []string{"", " ; ", "1.1.1.1", "tcp://1.1.1.1", "ftp://example.com", "https://"} {
+		_, err = parseProbeTargets(v)
+		assert.Error(t, err, v)
+	}
+
+	_, err = ConnectivityMonitor("1.1.1.1:443", 0, "", "")
+	assert.Error(t, err)
+	_, err = ConnectivityMonitor("1.1.1.1:443", time.Minute, "8am", "")
+	assert.Error(t, err)
+}
+
+func TestConnectivity_Probe(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("no loopback:", err)
+	}
+	up := probeTarget{address: l.Addr().String()}
+	require.NoError(t, up.probe(context.Background()))
+	l.Close()
+	assert.Error(t, up.probe(context.Background()))
+
+	var down atomic.Bool
+	web := probeTarget{url: probeServer(t, &down)}
+	assert.NoError(t, web.probe(context.Background()))
+	down.Store(true)
+	assert.EqualError(t, web.probe(context.Background()), "unexpected status 503 Service Unavailable")
+
+	// any target answering is enough
+	m := &connectivityMonitor{targets: []probeTarget{up, web}}
+	assert.Error(t, m.probe(context.Background()))
+	down.Store(false)
+	assert.NoError(t, m.probe(context.Background()))
+}
+
+func TestConnectivity_Outages(t *testing.T) {
+	var down atomic.Bool
+	targets := []probeTarget{{url: probeServer(t, &down)}}
+	stateFile := filepath.Join(t.TempDir(), connectivityStateFilename)
+	m := newConnectivityMonitor(targets, stateFile)
+	ctx := context.Background()
+
+	start := time.Date(2024, 1, 30, 2, 14, 0, 0, time.Local)
+	assert.Equal(t, "", m.step(ctx, start.Add(-time.Minute)))
+
+	// a single failed probe is not an outage
+	down.Store(true)
+	assert.Equal(t, "", m.step(ctx, start))
+	assert.Nil(t, m.ongoing())
+	_, err := os.Stat(stateFile)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Equal(t, "", m.step(ctx, start.Add(time.Minute)))
+	require.NotNil(t, m.ongoing())
+	assert.Equal(t, start, m.ongoing().Start)
+
+	// the outage lasts over a restart
+	m = newConnectivityMonitor(targets, stateFile)
+	require.NotNil(t, m.ongoing())
+	assert.True(t, m.ongoing().Start.Equal(start))
+	assert.Equal(t, "", m.step(ctx, start.Add(time.Hour)))
+	assert.Len(t, m.outages, 1)
+
+	down.Store(false)
+	end := start.Add(3*time.Hour + 26*time.Minute)
+	assert.Equal(t, "Internet was down from 02:14 to 05:40 (3h26m)", m.step(ctx, end))
+	assert.Nil(t, m.ongoing())
+	assert.Equal(t, "", m.step(ctx, end.Add(time.Minute)))
+
+	m = newConnectivityMonitor(targets, stateFile)
+	require.Len(t, m.outages, 1)
+	assert.True(t, m.outages[0].Start.Equal(start) && m.outages[0].End.Equal(end), m.outages)
+
+	// over midnight
+	assert.Equal(t, "Internet was down from Jan 29 23:50 to Jan 30 00:20 (30m)",
+		formatOutage(outage{Start: start.Add(-2*time.Hour - 24*time.Minute), End: start.Add(-time.Hour - 54*time.Minute)}))
+
+	// the outages of the last week are kept
+	down.Store(true)
+	later := end.Add(outageRetention + time.Hour)
+	m.step(ctx, later)
+	m.step(ctx, later.Add(time.Minute))
+	assert.Equal(t, []outage{{Start: later}}, m.outages)
+}
+
+func TestConnectivity_Summary(t *testing.T) {
+	now := time.Date(2024, 1, 30, 8, 0, 0, 0, time.Local)
+	m := &connectivityMonitor{}
+	assert.Equal(t, "Internet uptime in the last day: 100%", m.summary(now))
+
+	m.outages = []outage{
+		// before the last day, and partly in it
+		{Start: now.Add(-48 * time.Hour), End: now.Add(-47 * time.Hour)},
+		{Start: now.Add(-25 * time.Hour), End: now.Add(-23 * time.Hour)},
+		{Start: now.Add(-2 * time.Hour), End: now.Add(-2*time.Hour + time.Second)},
+	}
+	assert.Equal(t, "Internet uptime in the last day: 95.83%, 2 outages for 1h", m.summary(now))
+
+	m.outages = []outage{{Start: now.Add(-time.Minute)}}
+	assert.Equal(t, "Internet uptime in the last day: 99.93%, 1 outage for 1m", m.summary(now))
+}
+
+func TestConnectivity_Monitor(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	stateFile := filepath.Join(t.TempDir(), connectivityStateFilename)
+	task, err := ConnectivityMonitor(probeServer(t, &down), 20*time.Millisecond, "", stateFile)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan telega.ChattableCloser)
+	go task(ctx, events)
+
+	require.Eventually(t, func() bool {
+		b, _ := os.ReadFile(stateFile)
+		return strings.Contains(string(b), `"end":"0001-01-01T00:00:00Z"`)
+	}, 5*time.Second, 10*time.Millisecond)
+	down.Store(false)
+
+	select {
+	case e := <-events:
+		assert.Equal(t, int64(0), e.(*telega.ChattableText).ChatID)
+		assert.True(t, strings.HasPrefix(e.(*telega.ChattableText).Text, "Internet was down from "), e.(*telega.ChattableText).Text)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no outage reported")
+	}
+}
@@ -0,0 +1,585 @@
+package feed
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/telega"
+)
+
+const (
+	ddnsStateFilename = "ddns.json"
+	ddnsAttempts      = 3
+	ddnsTimeout       = 30 * time.Second
+	maxDDNSResponse   = 64 << 10
+
+	defaultDyndns2URL    = "https://members.dyndns.org/nic/update"
+	defaultDuckDNSURL    = "https://www.duckdns.org/update"
+	defaultCloudflareURL = "https://api.cloudflare.com/client/v4"
+)
+
+// ddnsRetryDelay is the delay before the second attempt of an update, which doubles for the next ones.
+var ddnsRetryDelay = 10 * time.Second
+
+// ddnsUpdater sets a DNS record to the public address.
+type ddnsUpdater interface {
+	update(ctx context.Context, addr netip.Addr) error
+	String() string
+}
+
+// ddnsTarget is an updater and the families it updates, IPv4 and IPv6 by default.
+type ddnsTarget struct {
+	ddnsUpdater
+	families map[string]bool
+}
+
+// ddnsSet updates the records, when the public addresses change.
+type ddnsSet struct {
+	mu      sync.Mutex
+	targets []ddnsTarget
+	// updated are the addresses the records are set to, by the updater and the family. They are persisted,
+	// so that an update, which failed before a restart, is retried
+	updated map[string]map[string]string
+	// failed are the addresses, the failure to set which has been reported, by the updater and the family
+	failed    map[string]string
+	stateFile string
+}
+
+var (
+	ddns ddnsSet
+	// ddnsPending wakes DDNSUpdater up, once the public addresses have been checked
+	ddnsPending = make(chan struct{}, 1)
+)
+
+// ConfigureDDNS parses the updaters: provider,option=value[,...][;...], see parseDDNS. The state is kept in
+// the stateFile, ddns.json in the storage directory by default.
+func ConfigureDDNS(spec, stateFile string) error {
+	targets, err := parseDDNS(spec)
+	if err != nil {
+		return err
+	}
+
+	if len(stateFile) == 0 {
+		if dir := getStorageDir(); len(dir) > 0 {
+			stateFile = filepath.Join(dir, ddnsStateFilename)
+		}
+	}
+
+	updated := make(map[string]map[string]string)
+	if len(stateFile) > 0 {
+		b, err := os.ReadFile(stateFile)
+		if err == nil {
+			err = json.Unmarshal(b, &updated)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to load DDNS state", "feed", "ddns", "file", stateFile, "err", err)
+			updated = make(map[string]map[string]string)
+		}
+	}
+
+	ddns.mu.Lock()
+	ddns.targets, ddns.updated, ddns.stateFile = targets, updated, stateFile
+	ddns.failed = make(map[string]string)
+	ddns.mu.Unlock()
+	return nil
+}
+
+// parseDDNS parses the updaters:
+//
+//	dyndns2,hostname=home.example.com,username=user,password=secret[,url=https://members.dyndns.org/nic/update]
+//	duckdns,domains=home,token=token
+//	cloudflare,zone=zone ID,record=home.example.com,token=API token[,ttl=1][,proxied=false]
+//	rfc2136,server=ns.example.com[:53],zone=example.com,name=home.example.com[,ttl=300][,key=[algorithm:]name:secret]
+//
+// Each of them takes [,family=ipv4|ipv6] to update a single record type.
+func parseDDNS(spec string) ([]ddnsTarget, error) {
+	var targets []ddnsTarget
+	for _, entry := range strings.Split(spec, ";") {
+		if entry = strings.TrimSpace(entry); len(entry) == 0 {
+			continue
+		}
+		fields := strings.Split(entry, ",")
+		provider := strings.TrimSpace(fields[0])
+		options := make(map[string]string)
+		for _, v := range fields[1:] {
+			key, value, found := strings.Cut(strings.TrimSpace(v), "=")
+			if !found {
+				return nil, fmt.Errorf("DDNS %s: option %q is not key=value", provider, v)
+			}
+			options[key] = value
+		}
+		// take an option out, so that the unknown ones are left
+		option := func(key, def string) string {
+			if v, found := options[key]; found {
+				delete(options, key)
+				return v
+			}
+			return def
+		}
+		var missing []string
+		required := func(key string) string {
+			v := option(key, "")
+			if len(v) == 0 {
+				missing = append(missing, key)
+			}
+			return v
+		}
+
+		t := ddnsTarget{families: map[string]bool{ipv4.name: true, ipv6.name: true}}
+		switch family := option("family", ""); family {
+		case "":
+		case "ipv4":
+			t.families = map[string]bool{ipv4.name: true}
+		case "ipv6":
+			t.families = map[string]bool{ipv6.name: true}
+		default:
+			return nil, fmt.Errorf("DDNS %s: unknown family %s", provider, family)
+		}
+
+		switch provider {
+		case "dyndns2":
+			t.ddnsUpdater = &dyndns2Updater{url: option("url", defaultDyndns2URL), hostname: required("hostname"),
+				username: required("username"), password: required("password")}
+		case "duckdns":
+			t.ddnsUpdater = &duckDNSUpdater{url: option("url", defaultDuckDNSURL), domains: required("domains"), token: required("token")}
+		case "cloudflare":
+			u := &cloudflareUpdater{url: strings.TrimSuffix(option("url", defaultCloudflareURL), "/"), zone: required("zone"),
+				record: required("record"), token: required("token")}
+			ttl, err := strconv.Atoi(option("ttl", "1"))
+			if err != nil || ttl < 1 {
+				return nil, fmt.Errorf("DDNS %s: invalid ttl", provider)
+			}
+			if u.proxied, err = strconv.ParseBool(option("proxied", "false")); err != nil {
+				return nil, fmt.Errorf("DDNS %s: invalid proxied", provider)
+			}
+			u.ttl = ttl
+			t.ddnsUpdater = u
+		case "rfc2136":
+			u := &rfc2136Updater{server: required("server"), zone: required("zone"), name: required("name")}
+			if _, _, err := net.SplitHostPort(u.server); err != nil && len(u.server) > 0 {
+				u.server = net.JoinHostPort(u.server, "53")
+			}
+			ttl, err := strconv.ParseUint(option("ttl", "300"), 10, 31)
+			if err != nil {
+				return nil, fmt.Errorf("DDNS %s: invalid ttl", provider)
+			}
+			u.ttl = uint32(ttl)
+			if key := option("key", ""); len(key) > 0 {
+				if u.key, err = parseTSIGKey(key); err != nil {
+					return nil, fmt.Errorf("DDNS %s: %w", provider, err)
+				}
+			}
+			t.ddnsUpdater = u
+		default:
+			return nil, fmt.Errorf("unknown DDNS provider %q, use dyndns2, duckdns, cloudflare or rfc2136", provider)
+		}
+
+		for key := range options {
+			return nil, fmt.Errorf("DDNS %s: unknown option %s", provider, key)
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("DDNS %s: missing %s", provider, strings.Join(missing, ", "))
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// requestDDNSSync tells DDNSUpdater to set the records to the last known addresses. It does not block.
+func requestDDNSSync() {
+	select {
+	case ddnsPending <- struct{}{}:
+	default:
+	}
+}
+
+// DDNSUpdater returns a background function, which sets the DDNS records to the public addresses after every check
+// of them by PublicIP, and reports the updates and the failures to all chats. The updates and their retries take
+// a while, if the provider is not reachable, so they don't hold the checks up.
+func DDNSUpdater() telega.BackgroundFunction {
+	return func(ctx context.Context, events chan<- telega.ChattableCloser) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ddnsPending:
+			}
+
+			var lines []string
+			for _, f := range publicIPFamilies {
+				// the failed updates are retried
+				if addr := f.known(); addr.IsValid() {
+					lines = append(lines, ddns.sync(ctx, f.name, addr)...)
+				}
+			}
+			if len(lines) == 0 {
+				continue
+			}
+			select {
+			case events <- &telega.ChattableText{MessageConfig: tgbotapi.NewMessage(0, strings.Join(lines, "\n"))}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// sync sets the records of the family, which are not set to the address yet. An update is attempted a few times,
+// a failed one is retried by the next sync. It returns the lines to report: the updates and the first failure
+// to set an address.
+func (d *ddnsSet) sync(ctx context.Context, family string, addr netip.Addr) (lines []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	changed := false
+	for _, t := range d.targets {
+		key := t.String()
+		if !t.families[family] || d.updated[key][family] == addr.String() {
+			continue
+		}
+
+		var err error
+		for attempt := 0; attempt < ddnsAttempts; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-ctx.Done():
+				case <-time.After(ddnsRetryDelay << (attempt - 1)):
+				}
+			}
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			if err = t.update(ctx, addr); err == nil {
+				break
+			}
+		}
+
+		if err != nil {
+			ddnsFailures.With(key).Inc()
+			slog.Warn("failed to update DDNS", "feed", "ddns", "updater", key, "address", addr, "err", err)
+			if d.failed[key+"/"+family] != addr.String() {
+				d.failed[key+"/"+family] = addr.String()
+				lines = append(lines, fmt.Sprintf("❌ DDNS %s failed to set %s: %v, will retry", key, addr, err))
+			}
+			continue
+		}
+
+		ddnsUpdates.With(key).Inc()
+		slog.Info("DDNS updated", "feed", "ddns", "updater", key, "address", addr)
+		delete(d.failed, key+"/"+family)
+		if d.updated[key] == nil {
+			d.updated[key] = make(map[string]string)
+		}
+		d.updated[key][family] = addr.String()
+		changed = true
+		lines = append(lines, fmt.Sprintf("✅ DDNS %s set to %s", key, addr))
+	}
+
+	if changed {
+		d.save()
+	}
+	return lines
+}
+
+// save writes the state, so that a crash in the middle does not corrupt it. The caller holds the lock.
+func (d *ddnsSet) save() {
+	if len(d.stateFile) == 0 {
+		return
+	}
+	b, err := json.Marshal(d.updated)
+	if err == nil {
+		tmp := d.stateFile + ".tmp"
+		if err = os.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, d.stateFile)
+		}
+	}
+	if err != nil {
+		slog.Warn("failed to save DDNS state", "feed", "ddns", "file", d.stateFile, "err", err)
+	}
+}
+
+// ddnsRequest makes a request to an update API and returns the response body. The responses other than
+// 200 are errors.
+func ddnsRequest(ctx context.Context, method, url string, header http.Header, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("User-Agent", "meerkat - ddns - 1.0")
+
+	c := &http.Client{Timeout: ddnsTimeout}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDDNSResponse))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if msg := strings.TrimSpace(string(data)); len(msg) > 0 && len(msg) < 200 {
+			return data, fmt.Errorf("unexpected status %s: %s", resp.Status, msg)
+		}
+		return data, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return data, nil
+}
+
+// dyndns2Updater speaks the dyndns2 protocol, which many providers support.
+type dyndns2Updater struct {
+	url                          string
+	hostname, username, password string
+}
+
+func (u *dyndns2Updater) String() string {
+	return "dyndns2 " + u.hostname
+}
+
+// update sets the address, the responses other than good and nochg are errors.
+func (u *dyndns2Updater) update(ctx context.Context, addr netip.Addr) error {
+	q := url.Values{"hostname": {u.hostname}, "myip": {addr.String()}}
+	header := http.Header{"Authorization": {"Basic " + basicAuth(u.username, u.password)}}
+	body, err := ddnsRequest(ctx, http.MethodGet, u.url+"?"+q.Encode(), header, nil)
+	if err != nil {
+		return err
+	}
+
+	code, _, _ := strings.Cut(strings.TrimSpace(string(body)), " ")
+	switch code {
+	case "good", "nochg":
+		return nil
+	case "":
+		return errors.New("empty response")
+	}
+	return fmt.Errorf("response %s", code)
+}
+
+func basicAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+// duckDNSUpdater updates the DuckDNS subdomains.
+type duckDNSUpdater struct {
+	url            string
+	domains, token string
+}
+
+func (u *duckDNSUpdater) String() string {
+	return "duckdns " + u.domains
+}
+
+func (u *duckDNSUpdater) update(ctx context.Context, addr netip.Addr) error {
+	q := url.Values{"domains": {u.domains}, "token": {u.token}}
+	if addr.Is4() {
+		q.Set("ip", addr.String())
+	} else {
+		q.Set("ipv6", addr.String())
+	}
+	body, err := ddnsRequest(ctx, http.MethodGet, u.url+"?"+q.Encode(), nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp := strings.TrimSpace(string(body)); resp != "OK" {
+		return fmt.Errorf("response %q", resp)
+	}
+	return nil
+}
+
+// cloudflareUpdater sets a record with the Cloudflare DNS API, creating it if it does not exist.
+type cloudflareUpdater struct {
+	url          string
+	zone, record string
+	token        string
+	ttl          int
+	proxied      bool
+}
+
+func (u *cloudflareUpdater) String() string {
+	return "cloudflare " + u.record
+}
+
+// cloudflareResponse is the envelope of the API responses.
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl,omitempty"`
+	Proxied *bool  `json:"proxied,omitempty"`
+}
+
+// call makes an API request and decodes the result.
+func (u *cloudflareUpdater) call(ctx context.Context, method, path string, request, result interface{}) error {
+	var body []byte
+	header := http.Header{"Authorization": {"Bearer " + u.token}}
+	if request != nil {
+		var err error
+		if body, err = json.Marshal(request); err != nil {
+			return err
+		}
+		header.Set("Content-Type", "application/json")
+	}
+
+	data, err := ddnsRequest(ctx, method, u.url+path, header, body)
+	var resp cloudflareResponse
+	if jsonErr := json.Unmarshal(data, &resp); jsonErr != nil {
+		if err != nil {
+			return err
+		}
+		return jsonErr
+	}
+	if !resp.Success || err != nil {
+		var msgs []string
+		for _, v := range resp.Errors {
+			msgs = append(msgs, fmt.Sprintf("%s (%d)", v.Message, v.Code))
+		}
+		if len(msgs) == 0 {
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, "unsuccessful")
+		}
+		return errors.New(strings.Join(msgs, ", "))
+	}
+	if result != nil {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
+
+func (u *cloudflareUpdater) update(ctx context.Context, addr netip.Addr) error {
+	typ := "A"
+	if addr.Is6() {
+		typ = "AAAA"
+	}
+	records := "/zones/" + url.PathEscape(u.zone) + "/dns_records"
+
+	var existing []cloudflareRecord
+	q := url.Values{"type": {typ}, "name": {u.record}}
+	if err := u.call(ctx, http.MethodGet, records+"?"+q.Encode(), nil, &existing); err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		if existing[0].Content == addr.String() {
+			return nil
+		}
+		return u.call(ctx, http.MethodPatch, records+"/"+url.PathEscape(existing[0].ID), cloudflareRecord{Content: addr.String()}, nil)
+	}
+	return u.call(ctx, http.MethodPost, records, cloudflareRecord{Type: typ, Name: u.record, Content: addr.String(), TTL: u.ttl,
+		Proxied: &u.proxied}, nil)
+}
+
+// rfc2136Updater replaces the address records of a name with the dynamic update of RFC 2136, which BIND, Knot,
+// PowerDNS and others support. The updates are signed, if there's a key.
+type rfc2136Updater struct {
+	server string
+	zone   string
+	name   string
+	ttl    uint32
+	key    *tsigKey
+}
+
+func (u *rfc2136Updater) String() string {
+	return "rfc2136 " + strings.TrimSuffix(u.name, ".")
+}
+
+// message makes the update, which deletes the records of the address type and adds the address.
+func (u *rfc2136Updater) message(id uint16, addr netip.Addr) ([]byte, error) {
+	typ := uint16(dnsTypeA)
+	if addr.Is6() {
+		typ = dnsTypeAAAA
+	}
+
+	msg := dnsHeader{id: id, flags: dnsOpcodeUpdate << 11, counts: [4]uint16{1, 0, 2, 0}}.append(nil)
+	var err error
+	if msg, err = (dnsRR{name: u.zone, typ: dnsTypeSOA, class: dnsClassIN}).appendQuestion(msg); err != nil {
+		return nil, err
+	}
+	// the class ANY without data deletes the RRset
+	if msg, err = (dnsRR{name: u.name, typ: typ, class: dnsClassANY}).append(msg); err != nil {
+		return nil, err
+	}
+	return dnsRR{name: u.name, typ: typ, class: dnsClassIN, ttl: u.ttl, data: addr.AsSlice()}.append(msg)
+}
+
+func (u *rfc2136Updater) update(ctx context.Context, addr netip.Addr) error {
+	id := uint16(rand.Uint32())
+	msg, err := u.message(id, addr)
+	if err != nil {
+		return err
+	}
+	var mac []byte
+	if u.key != nil {
+		if msg, mac, err = u.key.sign(msg, nil, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ddnsTimeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", u.server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if _, err = conn.Write(msg); err != nil {
+		return err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		resp := buf[:n]
+		h, err := parseDNSHeader(resp)
+		if err != nil || h.id != id || h.flags&dnsFlagResponse == 0 {
+			// not a response to the update
+			continue
+		}
+		if rcode := h.rcode(); rcode != 0 {
+			return fmt.Errorf("update failed: %s", dnsRcodeName(rcode))
+		}
+		if u.key != nil {
+			if _, err = u.key.verify(resp, mac, time.Now()); err != nil {
+				return fmt.Errorf("invalid response: %w", err)
+			}
+		}
+		return nil
+	}
+}
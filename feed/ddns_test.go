@@ -0,0 +1,352 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skrassiev/meerkat/telega"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resetDDNS configures the updaters with a test state file.
+func resetDDNS(t *testing.T, spec string) string {
+	stateFile := filepath.Join(t.TempDir(), ddnsStateFilename)
+	require.NoError(t, ConfigureDDNS(spec, stateFile))
+	t.Cleanup(func() { ConfigureDDNS("", stateFile) })
+	return stateFile
+}
+
+func TestDDNS_parseDDNS(t *testing.T) {
+	targets, err := parseDDNS("dyndns2,hostname=home.example.com,username=user,password=pass=word;" +
+		"duckdns,domains=home,token=t0ken,family=ipv4;" +
+		"cloudflare,zone=z1,record=home.example.com,token=t0ken,ttl=120,proxied=true,family=ipv6;" +
+		"rfc2136,server=ns.example.com,zone=example.com,name=home.example.com,key=hmac-sha512:ddns-key:c2VjcmV0")
+	require.NoError(t, err)
+	require.Len(t, targets, 4)
+
+	assert.Equal(t, &dyndns2Updater{url: defaultDyndns2URL, hostname: "home.example.com", username: "user", password: "pass=word"},
+		targets[0].ddnsUpdater)
+	assert.Equal(t, map[string]bool{"IPv4": true, "IPv6": true}, targets[0].families)
+	assert.Equal(t, &duckDNSUpdater{url: defaultDuckDNSURL, domains: "home", token: "t0ken"}, targets[1].ddnsUpdater)
+	assert.Equal(t, map[string]bool{"IPv4": true}, targets[1].families)
+	assert.Equal(t, &cloudflareUpdater{url: defaultCloudflareURL, zone: "z1", record: "home.example.com", token: "t0ken", ttl: 120,
+		proxied: true}, targets[2].ddnsUpdater)
+	assert.Equal(t, map[string]bool{"IPv6": true}, targets[2].families)
+	assert.Equal(t, &rfc2136Updater{server: "ns.example.com:53", zone: "example.com", name: "home.example.com", ttl: 300,
+		key: &tsigKey{name: "ddns-key.", algorithm: "hmac-sha512.", secret: []byte("secret")}}, targets[3].ddnsUpdater)
+
+	assert.Equal(t, "dyndns2 home.example.com", targets[0].String())
+	assert.Equal(t, "rfc2136 home.example.com", targets[3].String())
+
+	for spec, msg := range map[string]string{
+		"noip,hostname=home":                       `unknown DDNS provider "noip", use dyndns2, duckdns, cloudflare or rfc2136`,
+		"duckdns,domains=home":                     "DDNS duckdns: missing token",
+		"dyndns2,hostname=home.example.com":        "DDNS dyndns2: missing username, password",
+		"duckdns,domains=home,token=t,ttl=5":       "DDNS duckdns: unknown option ttl",
+		"duckdns,domains=home,token=t,family=ipx":  "DDNS duckdns: unknown family ipx",
+		"duckdns,domains=home,token":               `DDNS duckdns: option "token" is not key=value`,
+		"cloudflare,zone=z,record=r,token=t,ttl=0": "DDNS cloudflare: invalid ttl",
+		"rfc2136,server=ns,zone=z,name=n,key=k":    "DDNS rfc2136: TSIG key is not [algorithm:]name:secret",
+	} {
+		_, err = parseDDNS(spec)
+		assert.EqualError(t, err, msg, spec)
+	}
+}
+
+func TestDDNS_Dyndns2DuckDNS(t *testing.T) {
+	var response string
+	var queries []*http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r)
+		io.WriteString(w, response)
+	}))
+	defer srv.Close()
+
+	dyndns := &dyndns2Updater{url: srv.URL + "/nic/update", hostname: "home.example.com", username: "user", password: "secret"}
+	for _, v := range []struct {
+		response string
+		err      string
+	}{
+		{response: "good 203.0.113.7"},
+		{response: "nochg 203.0.113.7\n"},
+		{response: "badauth", err: "response badauth"},
+		{response: "", err: "empty response"},
+	} {
+		response = v.response
+		err := dyndns.update(context.Background(), netip.MustParseAddr("203.0.113.7"))
+		if len(v.err) > 0 {
+			assert.EqualError(t, err, v.err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+	r := queries[0]
+	assert.Equal(t, "/nic/update", r.URL.Path)
+	assert.Equal(t, "home.example.com", r.URL.Query().Get("hostname"))
+	assert.Equal(t, "203.0.113.7", r.URL.Query().Get("myip"))
+	username, password, ok := r.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "user", username)
+	assert.Equal(t, "secret", password)
+	assert.NotEmpty(t, r.UserAgent())
+
+	queries = nil
+	duck := &duckDNSUpdater{url: srv.URL + "/update", domains: "home", token: "t0ken"}
+	response = "OK"
+	assert.NoError(t, duck.update(context.Background(), netip.MustParseAddr("203.0.113.7")))
+	assert.NoError(t, duck.update(context.Background(), netip.MustParseAddr("2001:db8::7")))
+	response = "KO"
+	assert.EqualError(t, duck.update(context.Background(), netip.MustParseAddr("203.0.113.7")), `response "KO"`)
+
+	assert.Equal(t, "domains=home&ip=203.0.113.7&token=t0ken", queries[0].URL.RawQuery)
+	assert.Equal(t, "domains=home&ipv6=2001%3Adb8%3A%3A7&token=t0ken", queries[1].URL.RawQuery)
+}
+
+// cloudflareServer stands in for the Cloudflare DNS records API of a zone.
+type cloudflareServer struct {
+	mu      sync.Mutex
+	records map[string]cloudflareRecord
+	calls   []string
+}
+
+func (c *cloudflareServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, r.Method+" "+r.URL.Path)
+
+	reply := func(status int, result interface{}) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": status == http.StatusOK, "result": result,
+			"errors": func() interface{} {
+				if status == http.StatusOK {
+					return []interface{}{}
+				}
+				return []interface{}{map[string]interface{}{"code": 10000, "message": "Authentication error"}}
+			}()})
+	}
+	if r.Header.Get("Authorization") != "Bearer t0ken" {
+		reply(http.StatusForbidden, nil)
+		return
+	}
+
+	const records = "/client/v4/zones/z1/dns_records"
+	var body cloudflareRecord
+	json.NewDecoder(r.Body).Decode(&body)
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == records:
+		found := []cloudflareRecord{}
+		for _, v := range c.records {
+			if v.Type == r.URL.Query().Get("type") && v.Name == r.URL.Query().Get("name") {
+				found = append(found, v)
+			}
+		}
+		reply(http.StatusOK, found)
+	case r.Method == http.MethodPost && r.URL.Path == records:
+		body.ID = body.Type + "-id"
+		c.records[body.ID] = body
+		reply(http.StatusOK, body)
+	case r.Method == http.MethodPatch && filepath.Dir(r.URL.Path) == records:
+		rec := c.records[filepath.Base(r.URL.Path)]
+		rec.Content = body.Content
+		c.records[rec.ID] = rec
+		reply(http.StatusOK, rec)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestDDNS_Cloudflare(t *testing.T) {
+	api := &cloudflareServer{records: map[string]cloudflareRecord{
+		"a1": {ID: "a1", Type: "A", Name: "home.example.com", Content: "198.51.100.2"},
+	}}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	u := &cloudflareUpdater{url: srv.URL + "/client/v4", zone: "z1", record: "home.example.com", token: "t0ken", ttl: 1}
+	require.NoError(t, u.update(context.Background(), netip.MustParseAddr("203.0.113.7")))
+	assert.Equal(t, "203.0.113.7", api.records["a1"].Content)
+	assert.Equal(t, []string{"GET /client/v4/zones/z1/dns_records", "PATCH /client/v4/zones/z1/dns_records/a1"}, api.calls)
+
+	// unchanged
+	api.calls = nil
+	require.NoError(t, u.update(context.Background(), netip.MustParseAddr("203.0.113.7")))
+	assert.Equal(t, []string{"GET /client/v4/zones/z1/dns_records"}, api.calls)
+
+	// the AAAA record is created
+	api.calls = nil
+	require.NoError(t, u.update(context.Background(), netip.MustParseAddr("2001:db8::7")))
+	assert.Equal(t, []string{"GET /client/v4/zones/z1/dns_records", "POST /client/v4/zones/z1/dns_records"}, api.calls)
+	proxied := false
+	assert.Equal(t, cloudflareRecord{ID: "AAAA-id", Type: "AAAA", Name: "home.example.com", Content: "2001:db8::7", TTL: 1,
+		Proxied: &proxied}, api.records["AAAA-id"])
+
+	u.token = "wrong"
+	assert.EqualError(t, u.update(context.Background(), netip.MustParseAddr("203.0.113.8")), "Authentication error (10000)")
+}
+
+// rfc2136Server stands in for a DNS server of example.com, which takes the updates signed with the key. It returns
+// the address and a function, which returns the records.
+func rfc2136Server(t *testing.T, key *tsigKey) (string, func() map[string]string) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	var mu sync.Mutex
+	records := make(map[string]string)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg := buf[:n]
+			h, err := parseDNSHeader(msg)
+			if err != nil {
+				continue
+			}
+			resp := dnsHeader{id: h.id, flags: dnsFlagResponse | dnsOpcodeUpdate<<11}
+
+			mac, err := key.verify(msg, nil, time.Now())
+			if err != nil {
+				// unsigned NOTAUTH
+				resp.flags |= 9
+				conn.WriteTo(resp.append(nil), from)
+				continue
+			}
+
+			mu.Lock()
+			zone, off, _ := readDNSQuestion(msg, dnsHeaderSize)
+			if zone.name != "example.com." || zone.typ != dnsTypeSOA {
+				resp.flags |= 10
+				h.counts[2] = 0
+			}
+			for i := 0; i < int(h.counts[2]); i++ {
+				var rr dnsRR
+				if rr, off, err = readDNSRR(msg, off); err != nil {
+					break
+				}
+				key := rr.name + "/" + map[uint16]string{dnsTypeA: "A", dnsTypeAAAA: "AAAA"}[rr.typ]
+				if rr.class == dnsClassANY {
+					delete(records, key)
+				} else if addr, ok := netip.AddrFromSlice(rr.data); ok {
+					records[key] = addr.String() + " " + (time.Duration(rr.ttl) * time.Second).String()
+				}
+			}
+			mu.Unlock()
+
+			signed, _, _ := key.sign(resp.append(nil), mac, time.Now())
+			conn.WriteTo(signed, from)
+		}
+	}()
+	return conn.LocalAddr().String(), func() map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		ret := make(map[string]string)
+		for k, v := range records {
+			ret[k] = v
+		}
+		return ret
+	}
+}
+
+func TestDDNS_RFC2136(t *testing.T) {
+	key, err := parseTSIGKey("ddns-key:c2VjcmV0IGtleSBvZiB0aGUgdXBkYXRlcw==")
+	require.NoError(t, err)
+	server, records := rfc2136Server(t, key)
+
+	targets, err := parseDDNS("rfc2136,server=" + server + ",zone=example.com,name=home.example.com,ttl=60,key=ddns-key:c2VjcmV0IGtleSBvZiB0aGUgdXBkYXRlcw==")
+	require.NoError(t, err)
+	u := targets[0].ddnsUpdater
+
+	require.NoError(t, u.update(context.Background(), netip.MustParseAddr("203.0.113.7")))
+	require.NoError(t, u.update(context.Background(), netip.MustParseAddr("203.0.113.8")))
+	require.NoError(t, u.update(context.Background(), netip.MustParseAddr("2001:db8::7")))
+	assert.Equal(t, map[string]string{"home.example.com./A": "203.0.113.8 1m0s", "home.example.com./AAAA": "2001:db8::7 1m0s"}, records())
+
+	// another zone, a wrong key and no key
+	u.(*rfc2136Updater).zone = "example.org"
+	assert.EqualError(t, u.update(context.Background(), netip.MustParseAddr("203.0.113.9")), "update failed: NOTZONE")
+	u.(*rfc2136Updater).zone = "example.com"
+	u.(*rfc2136Updater).key = &tsigKey{name: "ddns-key.", algorithm: "hmac-sha256.", secret: []byte("wrong")}
+	assert.EqualError(t, u.update(context.Background(), netip.MustParseAddr("203.0.113.9")), "update failed: NOTAUTH")
+	u.(*rfc2136Updater).key = nil
+	assert.EqualError(t, u.update(context.Background(), netip.MustParseAddr("203.0.113.9")), "update failed: NOTAUTH")
+	assert.Equal(t, "203.0.113.8 1m0s", records()["home.example.com./A"])
+}
+
+func TestDDNS_Sync(t *testing.T) {
+	defer func(delay time.Duration) { ddnsRetryDelay = delay }(ddnsRetryDelay)
+	ddnsRetryDelay = time.Millisecond
+
+	var response string
+	var queries int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		io.WriteString(w, response)
+	}))
+	defer srv.Close()
+
+	stateFile := resetDDNS(t, "duckdns,domains=home,token=t0ken,url="+srv.URL+";duckdns,domains=home6,token=t0ken,family=ipv6,url="+srv.URL)
+	addr := netip.MustParseAddr("203.0.113.7")
+
+	// failed three times, reported once
+	response = "KO"
+	assert.Equal(t, []string{`❌ DDNS duckdns home failed to set 203.0.113.7: response "KO", will retry`}, ddns.sync(context.Background(), "IPv4", addr))
+	assert.Equal(t, ddnsAttempts, queries)
+	assert.Empty(t, ddns.sync(context.Background(), "IPv4", addr))
+	assert.Equal(t, 2*ddnsAttempts, queries)
+
+	response = "OK"
+	assert.Equal(t, []string{"✅ DDNS duckdns home set to 203.0.113.7"}, ddns.sync(context.Background(), "IPv4", addr))
+	assert.Empty(t, ddns.sync(context.Background(), "IPv4", addr))
+	assert.Equal(t, 2*ddnsAttempts+1, queries)
+
+	assert.Equal(t, []string{"✅ DDNS duckdns home set to 2001:db8::7", "✅ DDNS duckdns home6 set to 2001:db8::7"},
+		ddns.sync(context.Background(), "IPv6", netip.MustParseAddr("2001:db8::7")))
+
+	// the updated records are persisted
+	b, err := os.ReadFile(stateFile)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"duckdns home": {"IPv4": "203.0.113.7", "IPv6": "2001:db8::7"}, "duckdns home6": {"IPv6": "2001:db8::7"}}`, string(b))
+	require.NoError(t, ConfigureDDNS("duckdns,domains=home,token=t0ken,url="+srv.URL, stateFile))
+	assert.Empty(t, ddns.sync(context.Background(), "IPv4", addr))
+	assert.Equal(t, []string{"✅ DDNS duckdns home set to 203.0.113.8"}, ddns.sync(context.Background(), "IPv4", netip.MustParseAddr("203.0.113.8")))
+
+	// the records are set in the background, once the address is checked
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "203.0.113.9")
+	}))
+	defer resolver.Close()
+	orig := publicIPFamilies
+	defer func() { publicIPFamilies = orig }()
+	publicIPFamilies = []*addressFamily{testFamily(t, ipv4, resolver.URL)}
+	for len(ddnsPending) > 0 {
+		<-ddnsPending
+	}
+	assert.Equal(t, "IPv4 203.0.113.9", PublicIP(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan telega.ChattableCloser)
+	done := make(chan struct{})
+	go func() { DDNSUpdater()(ctx, events); close(done) }()
+	defer func() { cancel(); <-done }()
+	select {
+	case e := <-events:
+		assert.Equal(t, int64(0), e.(*telega.ChattableText).ChatID)
+		assert.Equal(t, "✅ DDNS duckdns home set to 203.0.113.9", e.(*telega.ChattableText).Text)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no DDNS update")
+	}
+}
@@ -0,0 +1,377 @@
+package feed
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// The DNS message format, just enough for the dynamic updates of RFC 2136, signed with TSIG of RFC 8945.
+
+const (
+	dnsTypeA    = 1
+	dnsTypeSOA  = 6
+	dnsTypeAAAA = 28
+	dnsTypeTSIG = 250
+
+	dnsClassIN  = 1
+	dnsClassANY = 255
+
+	dnsOpcodeUpdate = 5
+	dnsHeaderSize   = 12
+	// dnsFlagResponse is the QR bit
+	dnsFlagResponse = 0x8000
+
+	// tsigFudge is the clock skew allowed between the signer and the verifier
+	tsigFudge = 300 * time.Second
+)
+
+var errDNSShort = errors.New("short DNS message")
+
+// dnsRcodes name the response codes, including the extended TSIG ones.
+var dnsRcodes = map[uint16]string{1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 4: "NOTIMP", 5: "REFUSED", 6: "YXDOMAIN",
+	7: "YXRRSET", 8: "NXRRSET", 9: "NOTAUTH", 10: "NOTZONE", 16: "BADSIG", 17: "BADKEY", 18: "BADTIME"}
+
+func dnsRcodeName(rcode uint16) string {
+	if name, found := dnsRcodes[rcode]; found {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// dnsHeader is the message header. counts are of the questions, the answers, the authority and the additional
+// records, or of the zone, the prerequisite, the update and the additional records of an update.
+type dnsHeader struct {
+	id     uint16
+	flags  uint16
+	counts [4]uint16
+}
+
+func (h dnsHeader) append(b []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, h.id)
+	b = binary.BigEndian.AppendUint16(b, h.flags)
+	for _, v := range h.counts {
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	return b
+}
+
+func (h dnsHeader) rcode() uint16 {
+	return h.flags & 0xf
+}
+
+func parseDNSHeader(msg []byte) (h dnsHeader, err error) {
+	if len(msg) < dnsHeaderSize {
+		return h, errDNSShort
+	}
+	h.id = binary.BigEndian.Uint16(msg)
+	h.flags = binary.BigEndian.Uint16(msg[2:])
+	for i := range h.counts {
+		h.counts[i] = binary.BigEndian.Uint16(msg[4+2*i:])
+	}
+	return h, nil
+}
+
+// appendDNSName appends a name uncompressed and lowercased, which is also its canonical form for the signatures.
+func appendDNSName(b []byte, name string) ([]byte, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if len(name) > 253 {
+		return b, fmt.Errorf("name %s is too long", name)
+	}
+	if len(name) > 0 {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return b, fmt.Errorf("invalid name %s", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// readDNSName reads a possibly compressed name at off. It returns the name with the trailing dot and the offset
+// past it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSShort
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errDNSShort
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, errors.New("DNS name compression loop")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		case l > 63:
+			return "", 0, fmt.Errorf("invalid DNS label length %d", l)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSShort
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// dnsRR is a resource record. The zone and the question entries are records without the TTL and the data.
+type dnsRR struct {
+	name  string
+	typ   uint16
+	class uint16
+	ttl   uint32
+	data  []byte
+}
+
+func (r dnsRR) append(b []byte) ([]byte, error) {
+	b, err := r.appendQuestion(b)
+	if err != nil {
+		return b, err
+	}
+	b = binary.BigEndian.AppendUint32(b, r.ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(r.data)))
+	return append(b, r.data...), nil
+}
+
+func (r dnsRR) appendQuestion(b []byte) ([]byte, error) {
+	b, err := appendDNSName(b, r.name)
+	if err != nil {
+		return b, err
+	}
+	b = binary.BigEndian.AppendUint16(b, r.typ)
+	return binary.BigEndian.AppendUint16(b, r.class), nil
+}
+
+// readDNSQuestion reads a question or a zone entry at off.
+func readDNSQuestion(msg []byte, off int) (r dnsRR, next int, err error) {
+	if r.name, off, err = readDNSName(msg, off); err != nil {
+		return r, 0, err
+	}
+	if off+4 > len(msg) {
+		return r, 0, errDNSShort
+	}
+	r.typ = binary.BigEndian.Uint16(msg[off:])
+	r.class = binary.BigEndian.Uint16(msg[off+2:])
+	return r, off + 4, nil
+}
+
+// readDNSRR reads a record at off.
+func readDNSRR(msg []byte, off int) (r dnsRR, next int, err error) {
+	if r, off, err = readDNSQuestion(msg, off); err != nil {
+		return r, 0, err
+	}
+	if off+6 > len(msg) {
+		return r, 0, errDNSShort
+	}
+	r.ttl = binary.BigEndian.Uint32(msg[off:])
+	size := int(binary.BigEndian.Uint16(msg[off+4:]))
+	off += 6
+	if off+size > len(msg) {
+		return r, 0, errDNSShort
+	}
+	r.data = msg[off : off+size]
+	return r, off + size, nil
+}
+
+// tsigAlgorithms are the HMAC algorithms of the signatures by their names.
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha1.":   sha1.New,
+	"hmac-sha256.": sha256.New,
+	"hmac-sha512.": sha512.New,
+}
+
+// tsigKey is a shared secret key, which signs the messages.
+type tsigKey struct {
+	name      string
+	algorithm string
+	secret    []byte
+}
+
+// parseTSIGKey parses [algorithm:]name:secret, the secret is base64, as in nsupdate -y. The algorithm is
+// hmac-sha256 by default.
+func parseTSIGKey(s string) (*tsigKey, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 2 {
+		parts = append([]string{"hmac-sha256"}, parts...)
+	}
+	if len(parts) != 3 {
+		return nil, errors.New("TSIG key is not [algorithm:]name:secret")
+	}
+
+	k := tsigKey{name: strings.ToLower(strings.TrimSuffix(parts[1], ".")) + ".", algorithm: strings.ToLower(strings.TrimSuffix(parts[0], ".")) + "."}
+	if _, found := tsigAlgorithms[k.algorithm]; !found {
+		return nil, fmt.Errorf("unknown TSIG algorithm %s, use hmac-sha1, hmac-sha256 or hmac-sha512", parts[0])
+	}
+	var err error
+	if k.secret, err = base64.StdEncoding.DecodeString(parts[2]); err != nil || len(k.secret) == 0 {
+		return nil, fmt.Errorf("invalid TSIG secret of %s", k.name)
+	}
+	return &k, nil
+}
+
+// tsigFields are the TSIG record fields, which are signed along with the message.
+type tsigFields struct {
+	signed time.Time
+	fudge  uint16
+	err    uint16
+	other  []byte
+}
+
+// mac signs a message without its TSIG record. A response is signed along with the MAC of the request.
+func (k *tsigKey) mac(msg, requestMAC []byte, f tsigFields) []byte {
+	h := hmac.New(tsigAlgorithms[k.algorithm], k.secret)
+	if requestMAC != nil {
+		h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(requestMAC))))
+		h.Write(requestMAC)
+	}
+	h.Write(msg)
+
+	// the names are valid, they've been parsed
+	vars, _ := appendDNSName(nil, k.name)
+	vars = binary.BigEndian.AppendUint16(vars, dnsClassANY)
+	vars = binary.BigEndian.AppendUint32(vars, 0)
+	vars, _ = appendDNSName(vars, k.algorithm)
+	vars = appendTSIGTime(vars, f.signed)
+	vars = binary.BigEndian.AppendUint16(vars, f.fudge)
+	vars = binary.BigEndian.AppendUint16(vars, f.err)
+	vars = binary.BigEndian.AppendUint16(vars, uint16(len(f.other)))
+	h.Write(append(vars, f.other...))
+	return h.Sum(nil)
+}
+
+// appendTSIGTime appends the time as 48-bit seconds since the epoch.
+func appendTSIGTime(b []byte, t time.Time) []byte {
+	s := uint64(t.Unix())
+	return append(b, byte(s>>40), byte(s>>32), byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
+}
+
+// sign appends the TSIG record to a message. It returns the signed message and its MAC, which the response is
+// verified with.
+func (k *tsigKey) sign(msg, requestMAC []byte, now time.Time) (signed, mac []byte, err error) {
+	h, err := parseDNSHeader(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	f := tsigFields{signed: now, fudge: uint16(tsigFudge / time.Second)}
+	mac = k.mac(msg, requestMAC, f)
+
+	data, _ := appendDNSName(nil, k.algorithm)
+	data = appendTSIGTime(data, f.signed)
+	data = binary.BigEndian.AppendUint16(data, f.fudge)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(mac)))
+	data = append(data, mac...)
+	data = binary.BigEndian.AppendUint16(data, h.id)
+	data = binary.BigEndian.AppendUint16(data, f.err)
+	data = binary.BigEndian.AppendUint16(data, 0)
+
+	h.counts[3]++
+	signed = h.append(nil)
+	signed = append(signed, msg[dnsHeaderSize:]...)
+	if signed, err = (dnsRR{name: k.name, typ: dnsTypeTSIG, class: dnsClassANY, data: data}).append(signed); err != nil {
+		return nil, nil, err
+	}
+	return signed, mac, nil
+}
+
+// verify checks the TSIG record, which is the last one of a message, and returns its MAC.
+func (k *tsigKey) verify(msg, requestMAC []byte, now time.Time) ([]byte, error) {
+	h, err := parseDNSHeader(msg)
+	if err != nil {
+		return nil, err
+	}
+	if h.counts[3] == 0 {
+		return nil, errors.New("the message is not signed")
+	}
+
+	// skip to the last record
+	off := dnsHeaderSize
+	for i := 0; i < int(h.counts[0]); i++ {
+		if _, off, err = readDNSQuestion(msg, off); err != nil {
+			return nil, err
+		}
+	}
+	records := int(h.counts[1]) + int(h.counts[2]) + int(h.counts[3]) - 1
+	for i := 0; i < records; i++ {
+		if _, off, err = readDNSRR(msg, off); err != nil {
+			return nil, err
+		}
+	}
+	start := off
+	rr, _, err := readDNSRR(msg, start)
+	if err != nil {
+		return nil, err
+	}
+	if rr.typ != dnsTypeTSIG {
+		return nil, errors.New("the message is not signed")
+	}
+	if !strings.EqualFold(rr.name, k.name) {
+		return nil, fmt.Errorf("the message is signed with the key %s", rr.name)
+	}
+
+	algorithm, off, err := readDNSName(rr.data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if off+10 > len(rr.data) {
+		return nil, errDNSShort
+	}
+	d := rr.data[off:]
+	var f tsigFields
+	f.signed = time.Unix(int64(binary.BigEndian.Uint16(d))<<32|int64(binary.BigEndian.Uint32(d[2:])), 0)
+	f.fudge = binary.BigEndian.Uint16(d[6:])
+	size := int(binary.BigEndian.Uint16(d[8:]))
+	if 10+size+6 > len(d) {
+		return nil, errDNSShort
+	}
+	mac := d[10 : 10+size]
+	origID := binary.BigEndian.Uint16(d[10+size:])
+	f.err = binary.BigEndian.Uint16(d[12+size:])
+	otherSize := int(binary.BigEndian.Uint16(d[14+size:]))
+	if 16+size+otherSize > len(d) {
+		return nil, errDNSShort
+	}
+	f.other = d[16+size : 16+size+otherSize]
+
+	if f.err != 0 {
+		return nil, fmt.Errorf("TSIG error %s", dnsRcodeName(f.err))
+	}
+	if !strings.EqualFold(algorithm, k.algorithm) {
+		return nil, fmt.Errorf("the message is signed with %s", algorithm)
+	}
+
+	// the message as it was signed, without the TSIG record and with the original ID
+	h.id = origID
+	h.counts[3]--
+	unsigned := h.append(nil)
+	unsigned = append(unsigned, msg[dnsHeaderSize:start]...)
+	if !hmac.Equal(mac, k.mac(unsigned, requestMAC, f)) {
+		return nil, errors.New("TSIG error BADSIG")
+	}
+	if skew := now.Sub(f.signed); skew > time.Duration(f.fudge)*time.Second || -skew > time.Duration(f.fudge)*time.Second {
+		return nil, errors.New("TSIG error BADTIME")
+	}
+	return mac, nil
+}
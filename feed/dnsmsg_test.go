@@ -0,0 +1,95 @@
+package feed
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSMessage_Names(t *testing.T) {
+	b, err := appendDNSName(nil, "Home.Example.com.")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("\x04home\x07example\x03com\x00"), b)
+
+	b, err = appendDNSName(nil, ".")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0}, b)
+
+	_, err = appendDNSName(nil, "home..example.com")
+	assert.Error(t, err)
+	_, err = appendDNSName(nil, string(make([]byte, 64))+".com")
+	assert.Error(t, err)
+
+	// a name, which ends with a pointer to the one before
+	msg := append(b, "\x04home\x07example\x03com\x00"...)
+	msg = append(msg, "\x03www\xc0\x01"...)
+	name, next, err := readDNSName(msg, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "home.example.com.", name)
+	assert.Equal(t, 19, next)
+	name, next, err = readDNSName(msg, 19)
+	require.NoError(t, err)
+	assert.Equal(t, "www.home.example.com.", name)
+	assert.Equal(t, len(msg), next)
+
+	// loops and truncation
+	_, _, err = readDNSName([]byte{0xc0, 0x00}, 0)
+	assert.Error(t, err)
+	_, _, err = readDNSName([]byte("\x04hom"), 0)
+	assert.Error(t, err)
+}
+
+func TestDNSMessage_TSIG(t *testing.T) {
+	key, err := parseTSIGKey("ddns-key.:c2VjcmV0IGtleSBvZiB0aGUgdXBkYXRlcw==")
+	require.NoError(t, err)
+	assert.Equal(t, &tsigKey{name: "ddns-key.", algorithm: "hmac-sha256.", secret: []byte("secret key of the updates")}, key)
+
+	other, err := parseTSIGKey("HMAC-SHA512:ddns-key:b3RoZXIga2V5")
+	require.NoError(t, err)
+	assert.Equal(t, "hmac-sha512.", other.algorithm)
+
+	for _, v := range []string{"ddns-key", "hmac-md5:ddns-key:c2VjcmV0", "ddns-key:not base64", "ddns-key:"} {
+		_, err = parseTSIGKey(v)
+		assert.Error(t, err, v)
+	}
+
+	now := time.Date(2024, 1, 30, 12, 0, 0, 0, time.UTC)
+	u := rfc2136Updater{zone: "example.com", name: "home.example.com", ttl: 300}
+	msg, err := u.message(0x1234, netip.MustParseAddr("203.0.113.7"))
+	require.NoError(t, err)
+
+	signed, mac, err := key.sign(msg, nil, now)
+	require.NoError(t, err)
+	assert.Len(t, mac, 32)
+	assert.Equal(t, uint16(1), binary.BigEndian.Uint16(signed[10:]))
+	assert.Equal(t, msg[dnsHeaderSize:], signed[dnsHeaderSize:len(msg)])
+
+	verified, err := key.verify(signed, nil, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, mac, verified)
+
+	_, err = key.verify(signed, nil, now.Add(10*time.Minute))
+	assert.EqualError(t, err, "TSIG error BADTIME")
+	_, err = other.verify(signed, nil, now)
+	assert.EqualError(t, err, "the message is signed with hmac-sha256.")
+	_, err = key.verify(msg, nil, now)
+	assert.EqualError(t, err, "the message is not signed")
+
+	tampered := append([]byte(nil), signed...)
+	tampered[len(msg)-1]++
+	_, err = key.verify(tampered, nil, now)
+	assert.EqualError(t, err, "TSIG error BADSIG")
+
+	// a response is signed along with the request MAC
+	resp := dnsHeader{id: 0x1234, flags: dnsFlagResponse | dnsOpcodeUpdate<<11}.append(nil)
+	signedResp, _, err := key.sign(resp, mac, now)
+	require.NoError(t, err)
+	_, err = key.verify(signedResp, mac, now)
+	assert.NoError(t, err)
+	_, err = key.verify(signedResp, nil, now)
+	assert.EqualError(t, err, "TSIG error BADSIG")
+}
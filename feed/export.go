@@ -0,0 +1,245 @@
+package feed
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/history"
+	"github.com/skrassiev/meerkat/telega"
+)
+
+const (
+	// exportGzipSize is the export size, above which it's sent compressed
+	exportGzipSize = 1 << 20
+	// telegram bots can't upload files bigger than 50MB
+	maxExportSize = 50 << 20
+
+	exportDateLayout = "2006-01-02"
+)
+
+// export formats and their content types.
+var exportFormats = map[string]string{"csv": "text/csv", "json": "application/json"}
+
+var errHistoryDisabled = errors.New("history is not enabled")
+
+// Export is a query of the readings history, which is written as CSV or JSON.
+type Export struct {
+	store    *history.Store
+	sensors  []*sensor
+	from, to time.Time
+	format   string
+}
+
+// exportRow is a history point of a sensor quantity. Raw samples have the count of 1, hourly ones more.
+type exportRow struct {
+	Time     time.Time `json:"time"`
+	Sensor   string    `json:"sensor"`
+	Quantity Quantity  `json:"quantity"`
+	Unit     string    `json:"unit"`
+	Min      float64   `json:"min"`
+	Max      float64   `json:"max"`
+	Avg      float64   `json:"avg"`
+	Count    int       `json:"count"`
+}
+
+// parseExportRange parses a window before now, such as 7d, or a range of days, such as 2024-01-01..2024-01-31,
+// which includes the last day.
+func parseExportRange(s string, now time.Time) (from, to time.Time, err error) {
+	if d, err := history.ParseDuration(s); err == nil {
+		return now.Add(-d), now, nil
+	}
+
+	first, last, found := strings.Cut(s, "..")
+	if !found {
+		last = first
+	}
+	if from, err = time.ParseInLocation(exportDateLayout, first, now.Location()); err == nil {
+		to, err = time.ParseInLocation(exportDateLayout, last, now.Location())
+	}
+	if err != nil || to.Before(from) {
+		return from, to, fmt.Errorf("invalid range %q, use a window like 7d or days like 2024-01-01..2024-01-31", s)
+	}
+	return from, to.AddDate(0, 0, 1), nil
+}
+
+// NewExport prepares an export of the history of a sensor, or of all sensors if the name is "all", over the range
+// in the format, csv or json.
+func NewExport(sensorName, rng, format string) (*Export, error) {
+	store := sensorHistory.Load()
+	if store == nil {
+		return nil, errHistoryDisabled
+	}
+	if _, found := exportFormats[format]; !found {
+		return nil, fmt.Errorf("unknown format %s, use csv or json", format)
+	}
+
+	e := Export{store: store, format: format}
+	if sensorName == "all" {
+		e.sensors = getSensors()
+	} else if s := findSensor(sensorName); s != nil {
+		e.sensors = []*sensor{s}
+	} else {
+		return nil, fmt.Errorf("unknown sensor %s", sensorName)
+	}
+
+	var err error
+	if e.from, e.to, err = parseExportRange(rng, time.Now()); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Filename names the export by the sensor and the range, e.g. attic-2024-01-23-2024-01-30.csv.
+func (e *Export) Filename() string {
+	name := "all"
+	if len(e.sensors) == 1 {
+		name = e.sensors[0].name
+	}
+	last := e.to.Add(-time.Second)
+	return fmt.Sprintf("%s-%s-%s.%s", name, e.from.Format(exportDateLayout), last.Format(exportDateLayout), e.format)
+}
+
+// ContentType is the MIME type of the format, which the control socket serves the export with. The chat documents
+// are not typed, see document.
+func (e *Export) ContentType() string {
+	return exportFormats[e.format]
+}
+
+// WriteTo streams the export. The values are in the display unit.
+func (e *Export) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	var (
+		write  func(exportRow) error
+		finish func() error
+	)
+
+	switch e.format {
+	case "csv":
+		out := csv.NewWriter(cw)
+		if err := out.Write([]string{"time", "sensor", "quantity", "unit", "min", "max", "avg", "count"}); err != nil {
+			return cw.n, err
+		}
+		format := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+		write = func(r exportRow) error {
+			return out.Write([]string{r.Time.Format(time.RFC3339), r.Sensor, string(r.Quantity), r.Unit,
+				format(r.Min), format(r.Max), format(r.Avg), strconv.Itoa(r.Count)})
+		}
+		finish = func() error {
+			out.Flush()
+			return out.Error()
+		}
+	default:
+		// a JSON array, which is written a row at a time
+		enc := json.NewEncoder(cw)
+		sep := "[\n"
+		write = func(r exportRow) error {
+			if _, err := io.WriteString(cw, sep); err != nil {
+				return err
+			}
+			sep = ","
+			return enc.Encode(r)
+		}
+		finish = func() error {
+			if sep == "[\n" {
+				_, err := io.WriteString(cw, "[]\n")
+				return err
+			}
+			_, err := io.WriteString(cw, "]\n")
+			return err
+		}
+	}
+
+	for _, s := range e.sensors {
+		for _, q := range historyQuantities {
+			points, err := e.store.Query(historySeries(s.name, q), e.from, e.to)
+			if err != nil {
+				return cw.n, err
+			}
+			for _, p := range points {
+				row := exportRow{Time: p.Time, Sensor: s.name, Quantity: q, Unit: unitSymbol(q),
+					Min: toDisplay(q, p.Min), Max: toDisplay(q, p.Max), Avg: toDisplay(q, p.Avg), Count: p.Count}
+				if err = write(row); err != nil {
+					return cw.n, err
+				}
+			}
+		}
+	}
+	return cw.n, finish()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// document renders the export as a chat document. Exports over exportGzipSize are compressed. tgbotapi uploads
+// the files as application/octet-stream with no way to set the MIME type, so Telegram types the document by the
+// extension of its name, .csv, .json or .gz.
+func (e *Export) document(chatID int64) (*telega.ChattableDocument, error) {
+	var b bytes.Buffer
+	if _, err := e.WriteTo(&b); err != nil {
+		return nil, err
+	}
+
+	name, data := e.Filename(), b.Bytes()
+	if len(data) > exportGzipSize {
+		var gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		zw.Name = name
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		name, data = name+".gz", gz.Bytes()
+	}
+	if len(data) > maxExportSize {
+		return nil, fmt.Errorf("export is %d MB, use a shorter range", len(data)>>20)
+	}
+
+	return &telega.ChattableDocument{DocumentConfig: tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: name, Bytes: data})}, nil
+}
+
+// HandleCommandExport sends the history as a document: /export <sensor|all> <range> [csv|json], e.g.
+// /export attic 7d or /export all 2024-01-01..2024-01-31 json.
+func HandleCommandExport(ctx context.Context, cmd *tgbotapi.Message, _ *tgbotapi.BotAPI) (response telega.ChattableCloser, _ error) {
+	reply := func(text string) (telega.ChattableCloser, error) {
+		return &telega.ChattableText{MessageConfig: tgbotapi.NewMessage(cmd.Chat.ID, text)}, nil
+	}
+
+	args := commandArgs(cmd)
+	if len(args) < 2 || len(args) > 3 {
+		return reply("usage: /export <sensor|all> <range> [csv|json], e.g. /export attic 7d")
+	}
+	format := "csv"
+	if len(args) == 3 {
+		format = args[2]
+	}
+
+	e, err := NewExport(args[0], args[1], format)
+	if err != nil {
+		return reply(err.Error())
+	}
+	doc, err := e.document(cmd.Chat.ID)
+	if err != nil {
+		return reply(err.Error())
+	}
+	return doc, nil
+}
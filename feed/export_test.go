@@ -0,0 +1,124 @@
+package feed
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/history"
+	"github.com/skrassiev/meerkat/telega"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test001_exportRange(t *testing.T) {
+	now := time.Date(2024, 1, 30, 15, 4, 0, 0, time.Local)
+
+	from, to, err := parseExportRange("7d", now)
+	require.NoError(t, err)
+	assert.Equal(t, now.AddDate(0, 0, -7), from)
+	assert.Equal(t, now, to)
+
+	from, to, err = parseExportRange("2024-01-01..2024-01-31", now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local), from)
+	assert.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, time.Local), to)
+
+	from, to, err = parseExportRange("2024-01-15", now)
+	require.NoError(t, err)
+	assert.Equal(t, 24*time.Hour, to.Sub(from))
+
+	for _, v := range []string{"", "week", "2024-01-31..2024-01-01", "2024-01-01..", "01/02/2024"} {
+		_, _, err = parseExportRange(v, now)
+		assert.Error(t, err, v)
+	}
+}
+
+func Test002_exportFormats(t *testing.T) {
+	defer setSensors(getSensors())
+	defer sensorHistory.Store(sensorHistory.Load())
+
+	attic, _ := newTestSensor("attic", "28-3c01d607ca0a", "29_8c")
+	setSensors([]*sensor{attic})
+	require.NoError(t, OpenSensorHistory(t.TempDir(), history.DefaultRetention))
+
+	at := time.Now().Add(-time.Hour).Truncate(time.Second).UTC()
+	store := sensorHistory.Load()
+	require.NoError(t, store.Append(historySeries("attic", Temperature), at, 21.5))
+	require.NoError(t, store.Append(historySeries("attic", Humidity), at, 45))
+
+	_, err := NewExport("attic", "1d", "xlsx")
+	assert.Error(t, err)
+	_, err = NewExport("shed", "1d", "csv")
+	assert.EqualError(t, err, "unknown sensor shed")
+
+	e, err := NewExport("attic", "1d", "csv")
+	require.NoError(t, err)
+	assert.Equal(t, "text/csv", e.ContentType())
+	var b bytes.Buffer
+	_, err = e.WriteTo(&b)
+	require.NoError(t, err)
+	assert.Equal(t, "time,sensor,quantity,unit,min,max,avg,count\n"+
+		at.Format(time.RFC3339)+",attic,temperature,℃,21.5,21.5,21.5,1\n"+
+		at.Format(time.RFC3339)+",attic,humidity,%,45,45,45,1\n", b.String())
+
+	// the values are in the display unit
+	useTemperatureUnit(t, "F")
+	e, err = NewExport("all", "1d", "json")
+	require.NoError(t, err)
+	b.Reset()
+	_, err = e.WriteTo(&b)
+	require.NoError(t, err)
+	var rows []exportRow
+	require.NoError(t, json.Unmarshal(b.Bytes(), &rows))
+	require.Len(t, rows, 2)
+	assert.Equal(t, exportRow{Time: at, Sensor: "attic", Quantity: Temperature, Unit: "℉", Min: 70.7, Max: 70.7, Avg: 70.7, Count: 1}, rows[0])
+}
+
+func Test003_exportCommand(t *testing.T) {
+	defer setSensors(getSensors())
+	defer sensorHistory.Store(sensorHistory.Load())
+
+	attic, _ := newTestSensor("attic", "28-3c01d607ca0a", "29_8c")
+	setSensors([]*sensor{attic})
+	require.NoError(t, OpenSensorHistory(t.TempDir(), history.DefaultRetention))
+
+	command := func(text string) telega.ChattableCloser {
+		resp, err := HandleCommandExport(context.Background(), &tgbotapi.Message{Text: text, Chat: &tgbotapi.Chat{ID: 1}}, nil)
+		require.NoError(t, err)
+		return resp
+	}
+
+	assert.True(t, strings.HasPrefix(command("/export").(*telega.ChattableText).Text, "usage: "))
+	assert.Equal(t, "unknown sensor shed", command("/export shed 1d").(*telega.ChattableText).Text)
+
+	doc := command("/export attic 2024-01-01..2024-01-31").(*telega.ChattableDocument)
+	assert.Equal(t, int64(1), doc.ChatID)
+	assert.Equal(t, "attic-2024-01-01-2024-01-31.csv", doc.File.(tgbotapi.FileBytes).Name)
+
+	// a large export is compressed
+	store := sensorHistory.Load()
+	start := time.Now().Add(-6 * 24 * time.Hour)
+	for i := 0; i < 6*24*60; i++ {
+		require.NoError(t, store.Append(historySeries("attic", Temperature), start.Add(time.Duration(i)*time.Minute), 20+float64(i%100)/10))
+		require.NoError(t, store.Append(historySeries("attic", Humidity), start.Add(time.Duration(i)*time.Minute), 40+float64(i%100)/10))
+	}
+	doc = command("/export attic 1d").(*telega.ChattableDocument)
+	file := doc.File.(tgbotapi.FileBytes)
+	assert.True(t, strings.HasSuffix(file.Name, ".csv"), file.Name)
+
+	doc = command("/export attic 5d json").(*telega.ChattableDocument)
+	file = doc.File.(tgbotapi.FileBytes)
+	require.True(t, strings.HasSuffix(file.Name, ".json.gz"), file.Name)
+	zr, err := gzip.NewReader(bytes.NewReader(file.Bytes))
+	require.NoError(t, err)
+	data, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Greater(t, len(data), exportGzipSize)
+}
@@ -2,69 +2,353 @@ package feed
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
-	"net"
-	"net/http"
+	"log/slog"
+	"net/netip"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// maxAddressResponse is longer than any address, ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff\r\n included
+	maxAddressResponse    = 64
+	publicIPTimeout       = 30 * time.Second
+	defaultIPv6PrefixBits = 64
+)
+
+// addressFamily tracks the public address of an IP version. It's resolved over that version only, so a dual stack
+// host gets both of its addresses.
+type addressFamily struct {
+	name      string
+	network   string
+	resolvers []*familyResolver
+	stored    storedAddress
+	// prefixBits is the length of the delegated IPv6 prefix, which is reported when it changes. 0 for IPv4
+	prefixBits int
+
+	mu      sync.Mutex
+	loaded  bool
+	address netip.Addr
+	// wan is the WAN address of the router, when it's behind another NAT
+	wan netip.Addr
+}
+
+// defaultPublicIPResolvers are asked unless configured otherwise, see parseResolvers
+const defaultPublicIPResolvers = "https://api.ipify.org,family=ipv4;https://api6.ipify.org,family=ipv6;" +
+	"https://ipv4.icanhazip.com,family=ipv4;https://ipv6.icanhazip.com,family=ipv6;dns://resolver1.opendns.com/myip.opendns.com"
+
 var (
-	storedIP             IPv4
-	publicIP             = net.ParseIP(storedIP.read())
-	publicIPResolverURLs = []string{"http://ifconfig.io", "https://api.ipify.org"}
-	publicIPResolverURL  = publicIPResolverURLs[1]
+	ipv4 = &addressFamily{name: "IPv4", network: "tcp4", stored: ipAddressFilename}
+	ipv6 = &addressFamily{name: "IPv6", network: "tcp6", stored: ipv6AddressFilename, prefixBits: defaultIPv6PrefixBits}
+
+	// publicIPFamilies are the address families PublicIP checks
+	publicIPFamilies = []*addressFamily{ipv4, ipv6}
+	// publicIPConsensus requires the majority of the resolvers of a family to agree on a changed address
+	publicIPConsensus atomic.Bool
 )
 
+func init() {
+	v4, v6, err := parseResolvers(defaultPublicIPResolvers)
+	if err != nil {
+		panic(err)
+	}
+	ipv4.resolvers, ipv6.resolvers = familyResolvers(v4), familyResolvers(v6)
+}
+
+func familyResolvers(resolvers []addressResolver) []*familyResolver {
+	ret := make([]*familyResolver, 0, len(resolvers))
+	for _, v := range resolvers {
+		ret = append(ret, &familyResolver{addressResolver: v})
+	}
+	return ret
+}
+
 func onError(msg string, arg interface{}) string {
-	log.Println(msg, arg)
+	slog.Warn(msg, "err", arg)
 	return ""
 }
 
-// PublicIP returns current public IP of the system as a string. Returns emptry string if not changed or could not be determined.
-func PublicIP(ctx context.Context) (ipAddress string) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, publicIPResolverURL, nil)
+// ConfigurePublicIP selects the families to check, a comma-separated list of ipv4 and ipv6, both by default, and
+// the length of the delegated IPv6 prefix, 64 by default. ISPs delegate /56 or /48 prefixes as well.
+// resolvers replace the default ones, see parseResolvers. With consensus, a changed address is confirmed by
+// the majority of the resolvers of the family, otherwise the first one answering is trusted.
+func ConfigurePublicIP(families, prefixLength, resolvers string, consensus bool) error {
+	bits := defaultIPv6PrefixBits
+	if len(strings.TrimSpace(prefixLength)) > 0 {
+		var err error
+		if bits, err = strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(prefixLength), "/")); err != nil || bits < 1 || bits > 128 {
+			return fmt.Errorf("invalid IPv6 prefix length %q", prefixLength)
+		}
+	}
+
+	selected := []*addressFamily{ipv4, ipv6}
+	if len(strings.TrimSpace(families)) > 0 {
+		selected = nil
+		for _, v := range strings.Split(families, ",") {
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "ipv4":
+				selected = append(selected, ipv4)
+			case "ipv6":
+				selected = append(selected, ipv6)
+			default:
+				return fmt.Errorf("unknown address family %q, use ipv4 and ipv6", v)
+			}
+		}
+	}
+
+	if len(strings.TrimSpace(resolvers)) == 0 {
+		resolvers = defaultPublicIPResolvers
+	}
+	r4, r6, err := parseResolvers(resolvers)
 	if err != nil {
-		return onError("error getting public IP", err)
+		return err
+	}
+	v4, v6 := familyResolvers(r4), familyResolvers(r6)
+	for _, f := range selected {
+		if (f == ipv4 && len(v4) == 0) || (f == ipv6 && len(v6) == 0) {
+			return fmt.Errorf("no %s resolvers", f.name)
+		}
 	}
 
-	// ifconfig.io does not like programmatic access
-	req.Header.Add("User-Agent", "curl/7.74.0")
+	ipv4.mu.Lock()
+	ipv4.resolvers = v4
+	ipv4.mu.Unlock()
+	ipv6.mu.Lock()
+	ipv6.prefixBits, ipv6.resolvers = bits, v6
+	ipv6.mu.Unlock()
+	publicIPFamilies = selected
+	publicIPConsensus.Store(consensus)
+	return nil
+}
 
-	c := &http.Client{Timeout: time.Second * 30}
-	resp, err := c.Do(req)
+// PublicIP checks the public addresses of the system and reports the changed ones, a line per family, e.g.
+// "IPv6 2001:db8:0:2::7, prefix 2001:db8:0:2::/64 (was 2001:db8:0:1::/64)". The DDNS records are set
+// by DDNSUpdater afterwards. Returns emptry string if none changed or could be determined.
+func PublicIP(ctx context.Context) string {
+	publicIPMu.Lock()
+	defer publicIPMu.Unlock()
 
+	var changes []string
+	for _, f := range publicIPFamilies {
+		if msg := f.check(ctx); len(msg) > 0 {
+			changes = append(changes, msg)
+		}
+	}
+	requestDDNSSync()
+	return strings.Join(changes, "\n")
+}
+
+// check resolves the address and tells how it changed, and if the router got behind NAT or out of it.
+// Returns emptry string if nothing changed or the address couldn't be resolved.
+func (f *addressFamily) check(ctx context.Context) string {
+	addr, wan, err := f.resolve(ctx)
 	if err != nil {
-		return onError("error getting public IP", err)
-	}
-
-	if resp.StatusCode == 200 {
-
-		if resp.ContentLength > int64(len("255.255.255.255\r")) {
-			return onError("error getting public IP: long response", resp.ContentLength)
-		}
-
-		defer resp.Body.Close()
-		body := make([]byte, 26)
-		rbytes, err := resp.Body.Read(body)
-		if err == nil || err == io.EOF {
-			if rbytes >= len("1.1.1.1\r") && rbytes <= len("255.255.255.255\r") {
-				newIP := net.ParseIP(strings.TrimSpace(string(body[0:rbytes])))
-				if newIP != nil {
-					if !newIP.Equal(publicIP) {
-						publicIP = newIP
-						storedIP = IPv4(publicIP.String())
-						storedIP.write()
-						return string(storedIP)
-					}
-					return ""
-				}
+		onError("error getting public "+f.name, err)
+		// a router with a private WAN address is behind NAT, whatever the public address is
+		if wan.IsValid() && !isPublicAddress(wan) {
+			return f.updateWAN(wan, addr)
+		}
+		return ""
+	}
+	var changes []string
+	for _, msg := range []string{f.update(addr), f.updateWAN(wan, addr)} {
+		if len(msg) > 0 {
+			changes = append(changes, msg)
+		}
+	}
+	return strings.Join(changes, "\n")
+}
+
+// resolve asks the resolvers in turn, the failing ones last, until one answers. With consensus, a changed address
+// is confirmed by the rest of them. A router, which tells a private or a CGNAT WAN address, doesn't know
+// the public one, so the next resolver is asked. wan is that address of the router, if one answered.
+func (f *addressFamily) resolve(ctx context.Context) (addr, wan netip.Addr, _ error) {
+	f.mu.Lock()
+	resolvers := byHealth(f.resolvers)
+	f.mu.Unlock()
+
+	var errs []error
+	total := len(resolvers)
+	for i, r := range resolvers {
+		addr, err := f.query(ctx, r)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r, err))
+			continue
+		}
+		if _, ok := r.addressResolver.(gatewayResolver); ok {
+			wan = addr
+			if !isPublicAddress(addr) {
+				total--
+				continue
+			}
+		}
+		if !publicIPConsensus.Load() || addr == f.known() {
+			return addr, wan, nil
+		}
+		addr, err = f.confirm(ctx, r, addr, total, resolvers[i+1:], &wan)
+		return addr, wan, err
+	}
+	if len(errs) == 0 {
+		if wan.IsValid() {
+			return netip.Addr{}, wan, fmt.Errorf("the router is behind %s, no other resolvers", natKind(wan))
+		}
+		return netip.Addr{}, wan, errors.New("no resolvers")
+	}
+	return netip.Addr{}, wan, errors.Join(errs...)
+}
+
+// confirm asks the rest of the resolvers and returns the address, which more than half of all the resolvers
+// answered. The ones which answered another address are unhealthy, except the routers, which are behind NAT then.
+// The routers behind NAT don't vote. wan is set to the address of a router, unless one has answered before.
+func (f *addressFamily) confirm(ctx context.Context, first *familyResolver, addr netip.Addr, total int, rest []*familyResolver, wan *netip.Addr) (netip.Addr, error) {
+	asked := append([]*familyResolver{first}, rest...)
+	answers := make([]netip.Addr, len(asked))
+	answers[0] = addr
+
+	var wg sync.WaitGroup
+	for i := 1; i < len(asked); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			answers[i], _ = f.query(ctx, asked[i])
+		}(i)
+	}
+	wg.Wait()
+
+	routers := make([]bool, len(asked))
+	for i, v := range answers {
+		if _, ok := asked[i].addressResolver.(gatewayResolver); ok && v.IsValid() {
+			routers[i] = true
+			if !wan.IsValid() {
+				*wan = v
+			}
+			if !isPublicAddress(v) {
+				answers[i] = netip.Addr{}
+				total--
 			}
-			return onError("error parsing public IP:", string(body))
 		}
-		return onError("error getting public IP:", err)
 	}
-	return onError("error code getting public IP", fmt.Sprintf("%d %s", resp.StatusCode, resp.Status))
+
+	var majority netip.Addr
+	votes := make(map[netip.Addr]int)
+	for _, v := range answers {
+		if v.IsValid() {
+			if votes[v]++; votes[v] > votes[majority] {
+				majority = v
+			}
+		}
+	}
+	if votes[majority]*2 <= total {
+		var tally []string
+		for addr, n := range votes {
+			tally = append(tally, fmt.Sprintf("%s by %d", addr, n))
+		}
+		sort.Strings(tally)
+		return netip.Addr{}, fmt.Errorf("no majority of %d resolvers: %s", total, strings.Join(tally, ", "))
+	}
+
+	now := time.Now()
+	for i, v := range answers {
+		if v.IsValid() && v != majority && !routers[i] {
+			asked[i].record(f.name, fmt.Errorf("answered %s, the majority %s", v, majority), now)
+		}
+	}
+	return majority, nil
+}
+
+// query asks a resolver and records its health. The answer must be an address of the family.
+func (f *addressFamily) query(ctx context.Context, r *familyResolver) (netip.Addr, error) {
+	addr, err := r.resolve(ctx, f.network)
+	if err == nil && addr.Is4() != (f.network == "tcp4") {
+		err = fmt.Errorf("%s is not an %s address", addr, f.name)
+	}
+	if err != nil && ctx.Err() != nil {
+		// cancelled by the caller, not the resolver's fault
+		return netip.Addr{}, err
+	}
+	r.record(f.name, err, time.Now())
+	return addr, err
+}
+
+// known returns the last address, reading the stored one first.
+func (f *addressFamily) known() netip.Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.load()
+	return f.address
+}
+
+// load reads the stored address once. The caller holds the lock.
+func (f *addressFamily) load() {
+	if !f.loaded {
+		f.address, f.loaded = f.stored.read(), true
+	}
+}
+
+// update records a resolved address, persists it and adds it to the history if it's changed.
+func (f *addressFamily) update(addr netip.Addr) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.load()
+	if addr == f.address {
+		return ""
+	}
+
+	prev := f.address
+	f.address = addr
+	f.stored.write(addr)
+	ipHistory.append(f.name, addr, time.Now())
+	publicIPChanges.With(f.name).Inc()
+
+	msg := f.name + " " + addr.String()
+	if f.prefixBits > 0 {
+		prefix, _ := addr.Prefix(f.prefixBits)
+		if old, err := prev.Prefix(f.prefixBits); err != nil || !prev.IsValid() {
+			msg += fmt.Sprintf(", prefix %s", prefix)
+		} else if old != prefix {
+			ipv6PrefixChanges.Inc()
+			msg += fmt.Sprintf(", prefix %s (was %s)", prefix, old)
+		}
+	}
+	return msg
+}
+
+// updateWAN compares the WAN address of the router with the public one, and tells if the router got behind NAT,
+// such as the carrier-grade NAT of the ISP, or out of it. Nothing is known, unless a router answered.
+func (f *addressFamily) updateWAN(wan, public netip.Addr) string {
+	if !wan.IsValid() {
+		return ""
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	prev := f.wan
+	if wan == public {
+		f.wan = netip.Addr{}
+		publicIPBehindNAT.With(f.name).Set(0)
+		if prev.IsValid() {
+			return fmt.Sprintf("%s router is no longer behind NAT, its WAN address is %s", f.name, wan)
+		}
+		return ""
+	}
+
+	f.wan = wan
+	publicIPBehindNAT.With(f.name).Set(1)
+	if wan != prev {
+		return fmt.Sprintf("⚠️ %s router is behind %s, its WAN address is %s", f.name, natKind(wan), wan)
+	}
+	return ""
+}
+
+// behindNAT returns the WAN address of the router, if it's behind another NAT.
+func (f *addressFamily) behindNAT() netip.Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.wan
 }
@@ -4,14 +4,21 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var (
@@ -21,7 +28,7 @@ var (
 
 func TestMain(m *testing.M) {
 	flag.Parse()
-	apiURL, _ := url.Parse(publicIPResolverURL)
+	apiURL, _ := url.Parse(ipv4.resolvers[0].addressResolver.(*httpResolver).url)
 	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", apiURL.Hostname(), func() uint16 {
 		switch apiURL.Scheme {
 		case "http":
@@ -47,8 +54,12 @@ func TestPublicIP_OK(t *testing.T) {
 			*assertPublicIP = os.Getenv("TEST_PUBLIC_IP")
 		}
 
-		assert.Equal(t, *assertPublicIP, PublicIP(context.Background()))
-		assert.Equal(t, "", PublicIP(context.Background()))
+		expect := ""
+		if len(*assertPublicIP) > 0 {
+			expect = "IPv4 " + *assertPublicIP
+		}
+		assert.Equal(t, expect, ipv4.check(context.Background()))
+		assert.Equal(t, "", ipv4.check(context.Background()))
 	}
 }
 
@@ -75,23 +86,136 @@ func TestPublicIP_ConnectFailure(t *testing.T) {
 
 func TestPublicIP_404(t *testing.T) {
 	if !noConn {
-		origURL := publicIPResolverURL
-		defer func() { publicIPResolverURL = origURL }()
-		publicIPResolverURL = publicIPResolverURLs[0] + "/safdaf/sgsdg/sgd"
-		assert.Equal(t, "", PublicIP(context.Background()))
+		orig := ipv4.resolvers
+		defer func() { ipv4.resolvers = orig }()
+		ipv4.resolvers = httpResolvers([]string{"http://ifconfig.io/safdaf/sgsdg/sgd"})
+		assert.Equal(t, "", ipv4.check(context.Background()))
 	}
 }
 
 func TestPublicIP_403(t *testing.T) {
-	origURL := publicIPResolverURL
-	defer func() { publicIPResolverURL = origURL }()
-	publicIPResolverURL = "https://www.google.com/search?q=vim"
-	assert.Equal(t, "", PublicIP(context.Background()))
+	orig := ipv4.resolvers
+	defer func() { ipv4.resolvers = orig }()
+	ipv4.resolvers = httpResolvers([]string{"https://www.google.com/search?q=vim"})
+	assert.Equal(t, "", ipv4.check(context.Background()))
 }
 
 func TestPublicIP_BigBody(t *testing.T) {
-	origURL := publicIPResolverURL
-	defer func() { publicIPResolverURL = origURL }()
-	publicIPResolverURL = "https://en.wikipedia.org/wiki/Vim_(text_editor)"
-	assert.Equal(t, "", PublicIP(context.Background()))
+	orig := ipv4.resolvers
+	defer func() { ipv4.resolvers = orig }()
+	ipv4.resolvers = httpResolvers([]string{"https://en.wikipedia.org/wiki/Vim_(text_editor)"})
+	assert.Equal(t, "", ipv4.check(context.Background()))
+}
+
+func httpResolvers(urls []string) []*familyResolver {
+	ret := make([]*familyResolver, 0, len(urls))
+	for _, v := range urls {
+		ret = append(ret, &familyResolver{addressResolver: &httpResolver{url: v}})
+	}
+	return ret
+}
+
+// testFamily is a family with the resolvers, which is persisted to a test file.
+func testFamily(t *testing.T, f *addressFamily, resolvers ...string) *addressFamily {
+	stored := storedAddress("test-" + string(f.stored))
+	t.Cleanup(func() { os.Remove(filepath.Join(getStorageDir(), string(stored))) })
+	testHistory(t)
+
+	v4, v6, err := parseResolvers(strings.Join(resolvers, ";"))
+	require.NoError(t, err)
+	if f == ipv6 {
+		v4 = v6
+	}
+	return &addressFamily{name: f.name, network: f.network, resolvers: familyResolvers(v4), stored: stored, prefixBits: f.prefixBits}
+}
+
+func TestPublicIP_Responses(t *testing.T) {
+	responses := []struct {
+		status int
+		body   string
+		expect string
+	}{
+		{status: http.StatusOK, body: "203.0.113.7\n", expect: "IPv4 203.0.113.7"},
+		{status: http.StatusOK, body: "203.0.113.7", expect: ""},
+		{status: http.StatusOK, body: "2001:db8::7", expect: ""},
+		{status: http.StatusOK, body: "<html>" + strings.Repeat(" ", maxAddressResponse) + "</html>", expect: ""},
+		{status: http.StatusOK, body: "203.0.113", expect: ""},
+		{status: http.StatusTooManyRequests, body: "198.51.100.2", expect: ""},
+		{status: http.StatusOK, body: "::ffff:198.51.100.2\r\n", expect: "IPv4 198.51.100.2"},
+	}
+	var n int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(responses[n].status)
+		io.WriteString(w, responses[n].body)
+	}))
+	defer srv.Close()
+
+	f := testFamily(t, ipv4, srv.URL)
+	for n = range responses {
+		assert.Equal(t, responses[n].expect, f.check(context.Background()), "response %d", n)
+	}
+
+	// the address is persisted
+	n = 0
+	responses[0].body = "198.51.100.2"
+	assert.Equal(t, "", testFamily(t, ipv4, srv.URL).check(context.Background()))
+}
+
+func TestPublicIP_IPv6Prefix(t *testing.T) {
+	f := testFamily(t, ipv6)
+	for _, v := range []struct {
+		addr   string
+		expect string
+	}{
+		{addr: "2001:db8:0:1::7", expect: "IPv6 2001:db8:0:1::7, prefix 2001:db8:0:1::/64"},
+		{addr: "2001:db8:0:1::7", expect: ""},
+		{addr: "2001:db8:0:1:a1b2::8", expect: "IPv6 2001:db8:0:1:a1b2::8"},
+		{addr: "2001:db8:0:2::8", expect: "IPv6 2001:db8:0:2::8, prefix 2001:db8:0:2::/64 (was 2001:db8:0:1::/64)"},
+	} {
+		assert.Equal(t, v.expect, f.update(netip.MustParseAddr(v.addr)))
+	}
+
+	// a /56 prefix does not change with the subnet
+	f.prefixBits = 56
+	assert.Equal(t, "IPv6 2001:db8:0:3::8", f.update(netip.MustParseAddr("2001:db8:0:3::8")))
+	assert.Equal(t, "IPv6 2001:db8:0:103::8, prefix 2001:db8:0:100::/56 (was 2001:db8::/56)",
+		f.update(netip.MustParseAddr("2001:db8:0:103::8")))
+}
+
+func TestPublicIP_FamilyNetwork(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "2001:db8::7")
+	}))
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	// IPv4 resolvers are not reached over IPv6
+	assert.Equal(t, "", testFamily(t, ipv4, srv.URL).check(context.Background()))
+	assert.Equal(t, "IPv6 2001:db8::7, prefix 2001:db8::/64", testFamily(t, ipv6, srv.URL).check(context.Background()))
+}
+
+func TestPublicIP_Configure(t *testing.T) {
+	defer ConfigurePublicIP("", "", "", false)
+
+	assert.NoError(t, ConfigurePublicIP("ipv6", "/56", "https://ifconfig.co/json,json=ip", true))
+	assert.Equal(t, []*addressFamily{ipv6}, publicIPFamilies)
+	assert.Equal(t, 56, ipv6.prefixBits)
+	assert.True(t, publicIPConsensus.Load())
+	if assert.Len(t, ipv6.resolvers, 1) {
+		assert.Equal(t, "ifconfig.co", ipv6.resolvers[0].String())
+	}
+
+	assert.NoError(t, ConfigurePublicIP("", "", "", false))
+	assert.Equal(t, []*addressFamily{ipv4, ipv6}, publicIPFamilies)
+	assert.Equal(t, 64, ipv6.prefixBits)
+	assert.Len(t, ipv4.resolvers, 3)
+
+	assert.Error(t, ConfigurePublicIP("ipv5", "", "", false))
+	assert.Error(t, ConfigurePublicIP("", "129", "", false))
+	assert.Error(t, ConfigurePublicIP("ipv4", "", "https://api6.ipify.org,family=ipv6", false))
 }
@@ -3,16 +3,19 @@ package feed
 import (
 	"context"
 	"io/fs"
-	"log"
+	"log/slog"
 	"mime"
 	"os"
 	"path"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/logging"
 	"github.com/skrassiev/meerkat/telega"
 )
 
@@ -33,8 +36,31 @@ var (
 		return false, watcher.Add(fpath)
 	}
 	gotest = false
+
+	// directoryMonitors keeps a *watchedTree per monitored directory for the status reports.
+	directoryMonitors sync.Map
 )
 
+// watchedTree tracks directories of a monitored tree, which are in the inotify watch list.
+type watchedTree struct {
+	directory string
+	watches   sync.Map
+	count     int32
+}
+
+func (w *watchedTree) added(fpath string) {
+	if _, loaded := w.watches.LoadOrStore(fpath, struct{}{}); !loaded {
+		inotifyWatches.With(w.directory).Set(float64(atomic.AddInt32(&w.count, 1)))
+	}
+}
+
+// removed accounts for a removed directory: inotify drops watches of removed directories by itself.
+func (w *watchedTree) removed(fpath string) {
+	if _, loaded := w.watches.LoadAndDelete(fpath); loaded {
+		inotifyWatches.With(w.directory).Set(float64(atomic.AddInt32(&w.count, -1)))
+	}
+}
+
 // MonitorDirectoryTree returns a function, which  watches all subdirectories for changes, starting at directory.
 //
 // The logic as following:
@@ -58,28 +84,38 @@ func monitorDirectoryTree(directory string, filter FilterFunc, fsAddWatch fsnoti
 	// we should always use a new instance of the watcher
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("failed to create fsnotify watcher", "err", err)
 	}
 
 	var (
 		directoriesToScan = make(chan string, 100)
 		modifiedFiles     = make(chan string, 100)
 		fsAddWatchWrapper fsnotifyAdderWrapper
+		tree              = &watchedTree{directory: directory}
 	)
 
 	fsAddWatchWrapper = func(fpath string) (exists bool, err error) {
-		return fsAddWatch(fpath, watcher)
+		if exists, err = fsAddWatch(fpath, watcher); !exists && err == nil {
+			tree.added(fpath)
+		}
+		return
 	}
 
-	log.Println("staring to monitor", directory)
+	slog.Info("starting to monitor", "feed", "fsmonitor", "directory", directory)
 
 	return func(ctx context.Context, events chan<- telega.ChattableCloser) {
 		defer watcher.Close()
 		done := make(chan bool)
 
+		directoryMonitors.Store(directory, tree)
+		defer func() {
+			directoryMonitors.Delete(directory)
+			inotifyWatches.Delete(directory)
+		}()
+
 		handleModifiedFile := func(fname string) {
 			if tgEvent, err := processFile(fname); err != nil {
-				log.Println("eror handling file", fname)
+				slog.Warn("error handling file", "feed", "fsmonitor", "file", fname, "err", err)
 			} else if !gotest {
 				events <- tgEvent
 			}
@@ -96,6 +132,9 @@ func monitorDirectoryTree(directory string, filter FilterFunc, fsAddWatch fsnoti
 						return
 					}
 					//log.Println("event:", event)
+					if (event.Op & fsnotify.Remove) != 0 {
+						tree.removed(event.Name)
+					}
 					if fname := onFsModification(event, fsAddWatchWrapper, directoriesToScan, filter); len(fname) != 0 {
 						handleModifiedFile(fname)
 					}
@@ -103,7 +142,7 @@ func monitorDirectoryTree(directory string, filter FilterFunc, fsAddWatch fsnoti
 					if !ok {
 						return
 					}
-					log.Println("error:", err)
+					slog.Warn("fsnotify error", "feed", "fsmonitor", "err", err)
 				case modifiedFile := <-modifiedFiles:
 					handleModifiedFile(modifiedFile)
 
@@ -114,7 +153,7 @@ func monitorDirectoryTree(directory string, filter FilterFunc, fsAddWatch fsnoti
 		}()
 
 		if _, err = fsAddWatchWrapper(directory); err != nil {
-			log.Fatalln("can't start watching possibly non-existent directory", directory)
+			logging.Fatal("can't start watching possibly non-existent directory", "feed", "fsmonitor", "directory", directory, "err", err)
 		}
 		go oneLevelDirectoryWalker(directoriesToScan, modifiedFiles, fsAddWatchWrapper, filter)
 		directoriesToScan <- directory
@@ -133,13 +172,13 @@ func onFsModification(event fsnotify.Event, fsAdd fsnotifyAdderWrapper, walkRequ
 	if (event.Op & (fsnotify.Create | fsnotify.CloseWrite)) != 0 {
 		fi, err := os.Stat(event.Name)
 		if err != nil {
-			log.Println("onFsModification", event, err)
+			slog.Debug("onFsModification", "feed", "fsmonitor", "file", event.Name, "op", event.Op.String(), "err", err)
 			return
 		}
 		if fi.IsDir() {
 			if (event.Op & fsnotify.Create) != 0 {
 				if exists, err := fsAdd(event.Name); err != nil {
-					log.Println("failed to add directory", event.Name, "watch:", err)
+					slog.Warn("failed to add directory watch", "feed", "fsmonitor", "directory", event.Name, "err", err)
 					return
 				} else if !exists {
 					walkRequests <- event.Name
@@ -148,10 +187,12 @@ func onFsModification(event fsnotify.Event, fsAdd fsnotifyAdderWrapper, walkRequ
 		} else if (event.Op & fsnotify.CloseWrite) != 0 {
 			// it's a newly created file
 			//log.Println("modified or created file:", event.Name)
+			filesDetected.Inc()
 			if filter(event.Name) {
-				log.Println(event.Name, "accepted")
+				slog.Info("file accepted", "feed", "fsmonitor", "file", event.Name)
 				return event.Name
 			}
+			filesFiltered.Inc()
 		}
 	} else if (event.Op & fsnotify.Remove) != 0 {
 		// We don't know if it was a dir or file.
@@ -165,7 +206,7 @@ func onFsModification(event fsnotify.Event, fsAdd fsnotifyAdderWrapper, walkRequ
 }
 
 func processFile(fname string) (telega.ChattableCloser, error) {
-	log.Println("process file", fname)
+	slog.Debug("process file", "feed", "fsmonitor", "file", fname)
 	switch strings.Split(mime.TypeByExtension(path.Ext(fname)), "/")[0] {
 	case "image":
 		return &telega.ChattablePicture{
@@ -198,7 +239,7 @@ func oneLevelDirectoryWalker(fpaths <-chan string, modifiedFiles chan<- string,
 				fullPath := path.Join(nextdir, fpath)
 				if d.IsDir() {
 					if exists, err := fsAdd(fullPath); err != nil {
-						log.Println("failed to add directory", fullPath, "watch:", err)
+						slog.Warn("failed to add directory watch", "feed", "fsmonitor", "directory", fullPath, "err", err)
 						return err
 					} else if !exists && strings.Count(fpath, "/") == 0 {
 						// only requesting to walk a first-level directory
@@ -207,7 +248,12 @@ func oneLevelDirectoryWalker(fpaths <-chan string, modifiedFiles chan<- string,
 					// never decend but to the frist level (see above for ".")
 					return fs.SkipDir
 				}
-				if strings.Count(fpath, "/") == 0 && filter(fpath) {
+				if strings.Count(fpath, "/") == 0 {
+					filesDetected.Inc()
+					if !filter(fpath) {
+						filesFiltered.Inc()
+						return nil
+					}
 					// it's ok if it blocks. That might happen in two cases:
 					// when there are lots of files in the dir
 					// or telegram bot is not connected to the server.
@@ -220,7 +266,7 @@ func oneLevelDirectoryWalker(fpaths <-chan string, modifiedFiles chan<- string,
 		}
 
 	}
-	log.Println("exiting WALKER")
+	slog.Debug("exiting directory walker", "feed", "fsmonitor")
 }
 
 // FilenameFilter accepts an array of regexp string to match a file name against.
@@ -288,6 +334,7 @@ func RatelimitFilterChain(oncePerDuration time.Duration, filter FilterFunc) Filt
 				p[m] = time.Now()
 				return true
 			}
+			filesRateLimited.Inc()
 		}
 		return false
 	}
@@ -176,14 +176,17 @@ func TestFS_MonitorDirConcurrently(t *testing.T) {
 
 	time.Sleep(500 * time.Millisecond)
 	assert.Equal(t, mulArray(dirStructCount)+1, monitoredCounter)
+	assert.Equal(t, []DirectoryStatus{{Path: fsroot, Watches: mulArray(dirStructCount) + 1}}, GetStatus().Directories)
 
 	assert.NoError(t, fsw.Remove("fsroot/aac/bac"))
 
 	cleanup(fsroot)
 	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []DirectoryStatus{{Path: fsroot, Watches: 0}}, GetStatus().Directories)
 
 	cancel()
 	wg.Wait()
+	assert.Empty(t, GetStatus().Directories)
 }
 
 func TestFS_MonitorDirFiles(t *testing.T) {
@@ -283,3 +286,14 @@ func TestMIME_Std(t *testing.T) {
 	assert.Equal(t, "video", strings.Split(mime.TypeByExtension(path.Ext("foo/bar/baz/add.mP4")), "/")[0])
 	assert.Equal(t, "image", strings.Split(mime.TypeByExtension(path.Ext("baz/bar/foo/pic.jpG")), "/")[0])
 }
+
+func TestFS_RatelimitFilterChainMetrics(t *testing.T) {
+	filter := RatelimitFilterChain(time.Hour, FilenameFilter([]string{`\.jpg$`}))
+	limited := filesRateLimited.Value()
+
+	assert.True(t, filter("cam/a.jpg"))
+	assert.False(t, filter("cam/a.mp4"))
+	assert.False(t, filter("cam/b.jpg"))
+	assert.True(t, filter("cam2/c.jpg"))
+	assert.Equal(t, limited+1, filesRateLimited.Value())
+}
@@ -0,0 +1,513 @@
+package feed
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ssdpAddress is the multicast group UPnP devices listen to searches at
+	ssdpAddress = "239.255.255.250:1900"
+	ssdpPort    = "1900"
+	natpmpPort  = "5351"
+	// gatewayTimeout limits the discovery and the NAT-PMP/PCP retransmissions, the router is next door
+	gatewayTimeout  = 4 * time.Second
+	maxUPnPResponse = 64 << 10
+	// pcpMapLifetime is how long the mapping a PCP query makes lasts, in seconds
+	pcpMapLifetime = 120
+)
+
+// procNetRoute is the routing table, where the default gateway is found
+var procNetRoute = "/proc/net/route"
+
+// cgnatPrefix is the shared address space ISPs use for carrier-grade NAT, RFC 6598
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// gatewayResolver asks the home router for its WAN address, so no internet service learns about the system, and
+// it works while the internet is partially down. The WAN address is the public one, unless the ISP puts
+// the router behind carrier-grade NAT.
+type gatewayResolver interface {
+	addressResolver
+	router()
+}
+
+// isPublicAddress tells if the address is reachable from the internet, rather than a private or a CGNAT one.
+func isPublicAddress(addr netip.Addr) bool {
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !cgnatPrefix.Contains(addr)
+}
+
+// natKind names the NAT a router with the WAN address is behind.
+func natKind(wan netip.Addr) string {
+	if cgnatPrefix.Contains(wan) {
+		return "carrier-grade NAT"
+	}
+	return "another NAT"
+}
+
+// gatewayDeadline is when to give up on the router.
+func gatewayDeadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(gatewayTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+// upnpResolver asks a UPnP Internet Gateway Device, which it discovers with SSDP, for the external address.
+type upnpResolver struct {
+	// ssdp is where the search is sent, the multicast group, or a router which answers unicast searches
+	ssdp string
+}
+
+func (u *upnpResolver) router() {}
+
+func (u *upnpResolver) String() string {
+	if u.ssdp == ssdpAddress {
+		return "upnp"
+	}
+	return "upnp " + strings.TrimSuffix(u.ssdp, ":"+ssdpPort)
+}
+
+// resolve discovers the router, finds its WAN connection service in the device description and calls
+// GetExternalIPAddress of it. IGD only knows IPv4.
+func (u *upnpResolver) resolve(ctx context.Context, _ string) (netip.Addr, error) {
+	ctx, cancel := context.WithTimeout(ctx, publicIPTimeout)
+	defer cancel()
+
+	location, err := u.discover(ctx)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	control, service, err := upnpControlURL(ctx, location)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return upnpExternalAddress(ctx, control, service)
+}
+
+// discover searches for an Internet Gateway Device and returns the location of its description. The devices of
+// the second version answer the searches for the first one.
+func (u *upnpResolver) discover(ctx context.Context) (string, error) {
+	to, err := net.ResolveUDPAddr("udp4", u.ssdp)
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	search := "M-SEARCH * HTTP/1.1\r\nHOST: " + ssdpAddress + "\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n"
+	// twice, as UDP gets lost
+	for i := 0; i < 2; i++ {
+		if _, err = conn.WriteTo([]byte(search), to); err != nil {
+			return "", err
+		}
+	}
+
+	conn.SetReadDeadline(gatewayDeadline(ctx))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return "", errors.New("no Internet Gateway Device answered")
+			}
+			return "", err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if location := resp.Header.Get("Location"); resp.StatusCode == http.StatusOK && strings.HasPrefix(location, "http") {
+			return location, nil
+		}
+	}
+}
+
+// upnpDevice is a device of a UPnP description, the services of the device and the embedded devices.
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// wanService finds the WAN IP or PPP connection service, which is usually two devices deep.
+func (d *upnpDevice) wanService() (serviceType, controlURL string) {
+	for _, v := range d.Services {
+		if strings.HasPrefix(v.ServiceType, "urn:schemas-upnp-org:service:WANIPConnection:") ||
+			strings.HasPrefix(v.ServiceType, "urn:schemas-upnp-org:service:WANPPPConnection:") {
+			return v.ServiceType, v.ControlURL
+		}
+	}
+	for i := range d.Devices {
+		if serviceType, controlURL = d.Devices[i].wanService(); len(serviceType) > 0 {
+			return serviceType, controlURL
+		}
+	}
+	return "", ""
+}
+
+// upnpControlURL reads the device description and returns the control URL and the type of the WAN connection service.
+func upnpControlURL(ctx context.Context, location string) (control, service string, err error) {
+	data, status, err := upnpRequest(ctx, http.MethodGet, location, nil, nil)
+	if err != nil {
+		return "", "", err
+	}
+	if status != http.StatusOK {
+		return "", "", fmt.Errorf("unexpected status %d of %s", status, location)
+	}
+
+	var desc struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err = xml.Unmarshal(data, &desc); err != nil {
+		return "", "", fmt.Errorf("invalid device description: %w", err)
+	}
+	service, control = desc.Device.wanService()
+	if len(service) == 0 {
+		return "", "", errors.New("no WAN connection service")
+	}
+
+	base, err := url.Parse(location)
+	if len(desc.URLBase) > 0 {
+		base, err = url.Parse(desc.URLBase)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	ref, err := url.Parse(control)
+	if err != nil {
+		return "", "", err
+	}
+	return base.ResolveReference(ref).String(), service, nil
+}
+
+// upnpExternalAddress calls GetExternalIPAddress of the service. The errors are SOAP faults with a UPnP error.
+func upnpExternalAddress(ctx context.Context, control, service string) (netip.Addr, error) {
+	body := `<?xml version="1.0"?>` + "\n" +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:GetExternalIPAddress xmlns:u="` + service + `"></u:GetExternalIPAddress></s:Body></s:Envelope>`
+	header := http.Header{
+		"Content-Type": {`text/xml; charset="utf-8"`},
+		"Soapaction":   {`"` + service + `#GetExternalIPAddress"`},
+	}
+	data, status, err := upnpRequest(ctx, http.MethodPost, control, header, []byte(body))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	var envelope struct {
+		Body struct {
+			Response struct {
+				Address string `xml:"NewExternalIPAddress"`
+			} `xml:"GetExternalIPAddressResponse"`
+			Fault *struct {
+				Code        int    `xml:"detail>UPnPError>errorCode"`
+				Description string `xml:"detail>UPnPError>errorDescription"`
+			} `xml:"Fault"`
+		} `xml:"Body"`
+	}
+	if err = xml.Unmarshal(data, &envelope); err != nil {
+		return netip.Addr{}, fmt.Errorf("unexpected status %d: %w", status, err)
+	}
+	if f := envelope.Body.Fault; f != nil {
+		return netip.Addr{}, fmt.Errorf("UPnP error %d: %s", f.Code, f.Description)
+	}
+	if status != http.StatusOK {
+		return netip.Addr{}, fmt.Errorf("unexpected status %d", status)
+	}
+
+	text := strings.TrimSpace(envelope.Body.Response.Address)
+	addr, err := netip.ParseAddr(text)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("unexpected external address %q", text)
+	}
+	if addr.IsUnspecified() {
+		return netip.Addr{}, errors.New("the router has no external address")
+	}
+	return addr.Unmap(), nil
+}
+
+// upnpRequest makes a request to the router and returns the status and the body, the SOAP faults come with
+// status 500. The router is asked directly, not through a proxy.
+func upnpRequest(ctx context.Context, method, url string, header http.Header, body []byte) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	c := &http.Client{Timeout: publicIPTimeout, Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxUPnPResponse))
+	return data, resp.StatusCode, err
+}
+
+// natpmpResolver asks the router for the external address with NAT-PMP, RFC 6886, or its successor PCP, RFC 6887.
+type natpmpResolver struct {
+	// gateway is the router as host:port, the default gateway if empty
+	gateway string
+	// pcp asks with PCP first, and falls back to NAT-PMP if the router doesn't speak it
+	pcp bool
+}
+
+func (n *natpmpResolver) router() {}
+
+func (n *natpmpResolver) String() string {
+	name := "natpmp"
+	if n.pcp {
+		name = "pcp"
+	}
+	if len(n.gateway) == 0 {
+		return name
+	}
+	return name + " " + strings.TrimSuffix(n.gateway, ":"+natpmpPort)
+}
+
+// natpmpResults are the NAT-PMP result codes, the PCP ones are pcpResults
+var natpmpResults = []string{"SUCCESS", "UNSUPP_VERSION", "NOT_AUTHORIZED", "NETWORK_FAILURE", "NO_RESOURCES", "UNSUPP_OPCODE"}
+
+var pcpResults = []string{"SUCCESS", "UNSUPP_VERSION", "NOT_AUTHORIZED", "MALFORMED_REQUEST", "UNSUPP_OPCODE", "UNSUPP_OPTION",
+	"MALFORMED_OPTION", "NETWORK_FAILURE", "NO_RESOURCES", "UNSUPP_PROTOCOL", "USER_EX_QUOTA", "CANNOT_PROVIDE_EXTERNAL",
+	"ADDRESS_MISMATCH", "EXCESSIVE_REMOTE_PEERS"}
+
+func resultName(names []string, code int) string {
+	if code < len(names) {
+		return names[code]
+	}
+	return strconv.Itoa(code)
+}
+
+// errNATPMPOnly is returned by a PCP query, which a NAT-PMP router answered
+var errNATPMPOnly = errors.New("the router speaks NAT-PMP only")
+
+// resolve asks the router over IPv4, which is the only version NAT-PMP knows.
+func (n *natpmpResolver) resolve(ctx context.Context, _ string) (netip.Addr, error) {
+	gateway := n.gateway
+	if len(gateway) == 0 {
+		addr, err := defaultGateway()
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		gateway = net.JoinHostPort(addr.String(), natpmpPort)
+	}
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "udp4", gateway)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if n.pcp {
+		addr, err := pcpExternalAddress(ctx, conn)
+		if !errors.Is(err, errNATPMPOnly) {
+			return addr, err
+		}
+	}
+	return natpmpExternalAddress(ctx, conn)
+}
+
+// natpmpExternalAddress sends the external address request of NAT-PMP.
+func natpmpExternalAddress(ctx context.Context, conn net.Conn) (netip.Addr, error) {
+	resp, err := gatewayExchange(ctx, conn, []byte{0, 0}, func(resp []byte) bool {
+		return len(resp) >= 12 && resp[0] == 0 && resp[1] == 128
+	})
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if code := int(binary.BigEndian.Uint16(resp[2:])); code != 0 {
+		return netip.Addr{}, fmt.Errorf("NAT-PMP error %s", resultName(natpmpResults, code))
+	}
+	addr := netip.AddrFrom4([4]byte(resp[8:12]))
+	if addr.IsUnspecified() {
+		return netip.Addr{}, errors.New("the router has no external address")
+	}
+	return addr, nil
+}
+
+// pcpExternalAddress asks for a short-lived mapping of the UDP port of the query, which is deleted right after,
+// since the external address comes with mappings only.
+func pcpExternalAddress(ctx context.Context, conn net.Conn) (netip.Addr, error) {
+	local, err := netip.ParseAddrPort(conn.LocalAddr().String())
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	// the common header: version 2, opcode MAP, lifetime and the client address
+	req := make([]byte, 60)
+	req[0], req[1] = 2, 1
+	binary.BigEndian.PutUint32(req[4:], pcpMapLifetime)
+	// IPv4 as an IPv4-mapped IPv6 address
+	client := local.Addr().As16()
+	copy(req[8:24], client[:])
+	// MAP: a nonce, UDP, the internal port and no preference for the external port and the IPv4 address
+	if _, err = rand.Read(req[24:36]); err != nil {
+		return netip.Addr{}, err
+	}
+	req[36] = 17
+	binary.BigEndian.PutUint16(req[40:], local.Port())
+	req[54], req[55] = 0xff, 0xff
+
+	resp, err := gatewayExchange(ctx, conn, req, func(resp []byte) bool {
+		// NAT-PMP routers answer with their version
+		return (len(resp) >= 2 && resp[0] == 0) || (len(resp) >= 60 && resp[0] == 2 && resp[1] == 0x81 && bytes.Equal(resp[24:36], req[24:36]))
+	})
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if resp[0] == 0 {
+		return netip.Addr{}, errNATPMPOnly
+	}
+	if code := int(resp[3]); code != 0 {
+		return netip.Addr{}, fmt.Errorf("PCP error %s", resultName(pcpResults, code))
+	}
+	addr := netip.AddrFrom16([16]byte(resp[44:60])).Unmap()
+
+	// the same request with a zero lifetime deletes the mapping, otherwise it lasts for pcpMapLifetime
+	binary.BigEndian.PutUint32(req[4:], 0)
+	resp, err = gatewayExchange(ctx, conn, req, func(resp []byte) bool {
+		// a retransmitted answer to the mapping has its lifetime
+		return len(resp) >= 60 && resp[0] == 2 && resp[1] == 0x81 && bytes.Equal(resp[24:36], req[24:36]) &&
+			(resp[3] != 0 || binary.BigEndian.Uint32(resp[4:]) == 0)
+	})
+	if err == nil && resp[3] != 0 {
+		err = fmt.Errorf("PCP error %s", resultName(pcpResults, int(resp[3])))
+	}
+	if err != nil && ctx.Err() == nil {
+		slog.Warn("failed to delete the PCP mapping", "gateway", conn.RemoteAddr().String(), "err", err)
+	}
+
+	if addr.IsUnspecified() {
+		return netip.Addr{}, errors.New("the router has no external address")
+	}
+	return addr, nil
+}
+
+// gatewayExchange sends the request until an accepted response comes, every 250ms, doubling the interval as
+// the RFCs suggest, for gatewayTimeout at most.
+func gatewayExchange(ctx context.Context, conn net.Conn, req []byte, accept func([]byte) bool) ([]byte, error) {
+	deadline := gatewayDeadline(ctx)
+	buf := make([]byte, 1100)
+	for wait := 250 * time.Millisecond; ; wait *= 2 {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		until := time.Now().Add(wait)
+		if until.After(deadline) {
+			until = deadline
+		}
+		conn.SetReadDeadline(until)
+		for {
+			n, err := conn.Read(buf)
+			if err == nil {
+				if accept(buf[:n]) {
+					return buf[:n], nil
+				}
+				continue
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil, err
+			}
+			break
+		}
+		if !time.Now().Before(deadline) {
+			return nil, errors.New("the router did not answer")
+		}
+	}
+}
+
+// defaultRoute is a default route of the routing table. gateway is invalid for point-to-point links, such as PPP.
+type defaultRoute struct {
+	iface   string
+	gateway netip.Addr
+	metric  int
+}
+
+// defaultGateway finds the IPv4 default route via a gateway with the lowest metric in the routing table.
+func defaultGateway() (netip.Addr, error) {
+	routes, err := defaultRoutes()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	for _, v := range routes {
+		if v.gateway.IsValid() {
+			return v.gateway, nil
+		}
+	}
+	return netip.Addr{}, errors.New("no default gateway")
+}
+
+// defaultRoutes reads the IPv4 default routes, which are up, the lowest metric first.
+func defaultRoutes() ([]defaultRoute, error) {
+	data, err := os.ReadFile(procNetRoute)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []defaultRoute
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ..., the addresses are little endian hex
+		fields := strings.Fields(line)
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		flags, err1 := strconv.ParseUint(fields[3], 16, 16)
+		metric, err2 := strconv.Atoi(fields[6])
+		gw, err3 := strconv.ParseUint(fields[2], 16, 32)
+		if err1 != nil || err2 != nil || err3 != nil || flags&1 == 0 {
+			continue
+		}
+		r := defaultRoute{iface: fields[0], metric: metric}
+		// via a gateway
+		if flags&2 != 0 {
+			var b [4]byte
+			binary.LittleEndian.PutUint32(b[:], uint32(gw))
+			r.gateway = netip.AddrFrom4(b)
+		}
+		routes = append(routes, r)
+	}
+	sort.SliceStable(routes, func(i, j int) bool { return routes[i].metric < routes[j].metric })
+	return routes, nil
+}
@@ -0,0 +1,295 @@
+package feed
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// udpServer stands in for a router, which answers the requests with handle, nil for no answer.
+func udpServer(t *testing.T, handle func(req []byte) []byte) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("no loopback:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := handle(append([]byte(nil), buf[:n]...)); resp != nil {
+				conn.WriteTo(resp, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// upnpServer stands in for an Internet Gateway Device, which answers unicast searches. The external address
+// is the answer, or a UPnP error if it's a number.
+func upnpServer(t *testing.T, answer *atomic.Value) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rootDesc.xml":
+			io.WriteString(w, `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0"><device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType><controlURL>/ctl/L3F</controlURL></service></serviceList>
+<deviceList><device><deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList><device><deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType><controlURL>ctl/IPConn</controlURL></service></serviceList>
+</device></deviceList></device></deviceList></device></root>`)
+		case "/ctl/IPConn":
+			body, _ := io.ReadAll(r.Body)
+			if r.Method != http.MethodPost || r.Header.Get("SOAPAction") != `"urn:schemas-upnp-org:service:WANIPConnection:1#GetExternalIPAddress"` ||
+				!bytes.Contains(body, []byte(`<u:GetExternalIPAddress xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">`)) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			v := answer.Load().(string)
+			if !strings.Contains(v, ".") {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>`+
+					`<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0">`+
+					`<errorCode>%s</errorCode><errorDescription>Action Failed</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, v)
+				return
+			}
+			fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+				`<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">`+
+				`<NewExternalIPAddress>%s</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`, v)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return udpServer(t, func(req []byte) []byte {
+		if !bytes.HasPrefix(req, []byte("M-SEARCH * HTTP/1.1\r\n")) || !bytes.Contains(req, []byte("ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n")) {
+			return nil
+		}
+		return []byte("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=120\r\nST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+			"LOCATION: " + srv.URL + "/rootDesc.xml\r\nEXT:\r\n\r\n")
+	})
+}
+
+// natpmpServer stands in for a NAT-PMP router, which speaks PCP as well if pcp is set. The external address is
+// the answer, or a result code if it's a number.
+func natpmpServer(t *testing.T, pcp bool, answer *atomic.Value) string {
+	return pcpServer(t, pcp, answer, nil)
+}
+
+// pcpServer is natpmpServer, which counts the PCP mappings, which are not deleted, in mappings.
+func pcpServer(t *testing.T, pcp bool, answer *atomic.Value, mappings *atomic.Int32) string {
+	return udpServer(t, func(req []byte) []byte {
+		v := answer.Load().(string)
+		var code byte
+		if !strings.Contains(v, ".") {
+			fmt.Sscan(v, &code)
+		}
+
+		switch {
+		case len(req) == 2 && req[0] == 0 && req[1] == 0:
+			resp := []byte{0, 128, 0, code, 0, 0, 0, 1, 0, 0, 0, 0}
+			if code == 0 {
+				copy(resp[8:], netip.MustParseAddr(v).AsSlice())
+			}
+			return resp
+		case len(req) == 60 && req[0] == 2 && req[1] == 1:
+			if !pcp {
+				// an unsupported version
+				return []byte{0, 129, 0, 1, 0, 0, 0, 1}
+			}
+			resp := make([]byte, 60)
+			resp[0], resp[1], resp[3] = 2, 0x81, code
+			copy(resp[4:8], req[4:8])
+			copy(resp[24:44], req[24:44])
+			if mappings != nil && code == 0 {
+				if binary.BigEndian.Uint32(req[4:]) > 0 {
+					mappings.Add(1)
+				} else {
+					mappings.Add(-1)
+				}
+			}
+			if code == 0 {
+				a := netip.MustParseAddr(v).As16()
+				copy(resp[44:], a[:])
+			}
+			// the client address must be the one the request came from
+			if netip.AddrFrom16([16]byte(req[8:24])).Unmap() != netip.MustParseAddr("127.0.0.1") {
+				resp[3] = 12
+			}
+			return resp
+		}
+		return nil
+	})
+}
+
+func TestGateway_parseResolvers(t *testing.T) {
+	v4, v6, err := parseResolvers("upnp://;natpmp://;pcp://192.168.1.1;upnp://192.168.1.1:5000,family=ipv4;natpmp://10.0.0.1:5350")
+	require.NoError(t, err)
+	assert.Equal(t, []addressResolver{
+		&upnpResolver{ssdp: ssdpAddress},
+		&natpmpResolver{},
+		&natpmpResolver{gateway: "192.168.1.1:5351", pcp: true},
+		&upnpResolver{ssdp: "192.168.1.1:5000"},
+		&natpmpResolver{gateway: "10.0.0.1:5350"},
+	}, v4)
+	assert.Empty(t, v6)
+
+	var names []string
+	for _, v := range v4 {
+		names = append(names, v.String())
+	}
+	assert.Equal(t, []string{"upnp", "natpmp", "pcp 192.168.1.1", "upnp 192.168.1.1:5000", "natpmp 10.0.0.1:5350"}, names)
+
+	for _, v := range []string{"upnp://,family=ipv6", "natpmp://192.168.1.1/gateway", "pcp://,type=a"} {
+		_, _, err = parseResolvers(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestGateway_UPnP(t *testing.T) {
+	var answer atomic.Value
+	answer.Store("100.64.12.34")
+	r := &upnpResolver{ssdp: upnpServer(t, &answer)}
+
+	addr, err := r.resolve(context.Background(), "tcp4")
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddr("100.64.12.34"), addr)
+
+	answer.Store("501")
+	_, err = r.resolve(context.Background(), "tcp4")
+	assert.EqualError(t, err, "UPnP error 501: Action Failed")
+
+	answer.Store("0.0.0.0")
+	_, err = r.resolve(context.Background(), "tcp4")
+	assert.EqualError(t, err, "the router has no external address")
+
+	// nobody answers the search
+	silent := &upnpResolver{ssdp: udpServer(t, func([]byte) []byte { return nil })}
+	ctx, cancel := context.WithTimeout(context.Background(), gatewayTimeout/4)
+	defer cancel()
+	_, err = silent.resolve(ctx, "tcp4")
+	assert.Error(t, err)
+}
+
+func TestGateway_NATPMP(t *testing.T) {
+	var answer atomic.Value
+	answer.Store("203.0.113.7")
+
+	for _, v := range []struct {
+		resolver *natpmpResolver
+		pcp      bool
+	}{
+		{resolver: &natpmpResolver{}},
+		{resolver: &natpmpResolver{pcp: true}, pcp: true},
+		// falls back to NAT-PMP
+		{resolver: &natpmpResolver{pcp: true}},
+	} {
+		v.resolver.gateway = natpmpServer(t, v.pcp, &answer)
+
+		answer.Store("203.0.113.7")
+		addr, err := v.resolver.resolve(context.Background(), "tcp4")
+		require.NoError(t, err, v.resolver)
+		assert.Equal(t, netip.MustParseAddr("203.0.113.7"), addr)
+
+		answer.Store("2")
+		_, err = v.resolver.resolve(context.Background(), "tcp4")
+		require.Error(t, err, v.resolver)
+		assert.Contains(t, err.Error(), "error NOT_AUTHORIZED", v.resolver)
+	}
+
+	// the mapping is deleted once the address is known
+	var mappings atomic.Int32
+	answer.Store("203.0.113.7")
+	addr, err := (&natpmpResolver{gateway: pcpServer(t, true, &answer, &mappings), pcp: true}).resolve(context.Background(), "tcp4")
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddr("203.0.113.7"), addr)
+	assert.Equal(t, int32(0), mappings.Load())
+
+	answer.Store("11")
+	_, err = (&natpmpResolver{gateway: natpmpServer(t, true, &answer), pcp: true}).resolve(context.Background(), "tcp4")
+	assert.EqualError(t, err, "PCP error CANNOT_PROVIDE_EXTERNAL")
+
+	ctx, cancel := context.WithTimeout(context.Background(), gatewayTimeout/4)
+	defer cancel()
+	_, err = (&natpmpResolver{gateway: udpServer(t, func([]byte) []byte { return nil })}).resolve(ctx, "tcp4")
+	assert.Error(t, err)
+}
+
+func TestGateway_DefaultGateway(t *testing.T) {
+	prev := procNetRoute
+	procNetRoute = filepath.Join(t.TempDir(), "route")
+	defer func() { procNetRoute = prev }()
+
+	_, err := defaultGateway()
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(procNetRoute, []byte(
+		"Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"+
+			"wlan0\t00000000\t0100000A\t0003\t0\t0\t600\t00000000\t0\t0\t0\n"+
+			"eth0\t00000000\t0101A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n"+
+			"eth0\t0001A8C0\t00000000\t0001\t0\t0\t100\t00FFFFFF\t0\t0\t0\n"+
+			"wg0\t00000000\t0200000A\t0002\t0\t0\t50\t00000000\t0\t0\t0\n"), 0644))
+	addr, err := defaultGateway()
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddr("192.168.1.1"), addr)
+}
+
+func TestGateway_BehindNAT(t *testing.T) {
+	var router atomic.Value
+	router.Store("100.64.12.34")
+	gateway := natpmpServer(t, false, &router)
+	answer, queries := "203.0.113.7", int32(0)
+	srv := resolverServer(t, &answer, &queries)
+	f := testFamily(t, ipv4, "natpmp://"+gateway, srv.URL)
+
+	// the router doesn't know the public address
+	assert.Equal(t, "IPv4 203.0.113.7\n⚠️ IPv4 router is behind carrier-grade NAT, its WAN address is 100.64.12.34", f.check(context.Background()))
+	assert.Equal(t, int32(1), queries)
+	assert.Equal(t, "", f.check(context.Background()))
+	assert.Contains(t, f.describe(time.Now()), "\n  behind carrier-grade NAT, the router's WAN address is 100.64.12.34")
+
+	router.Store("192.168.100.2")
+	assert.Equal(t, "⚠️ IPv4 router is behind another NAT, its WAN address is 192.168.100.2", f.check(context.Background()))
+
+	// the router's public address is trusted, the internet services are not asked
+	router.Store("203.0.113.7")
+	assert.Equal(t, "IPv4 router is no longer behind NAT, its WAN address is 203.0.113.7", f.check(context.Background()))
+	router.Store("198.51.100.9")
+	assert.Equal(t, "IPv4 198.51.100.9", f.check(context.Background()))
+	assert.Equal(t, int32(3), queries)
+	assert.NotContains(t, f.describe(time.Now()), "behind")
+
+	// with consensus, a router which disagrees with the majority is behind NAT rather than unhealthy
+	publicIPConsensus.Store(true)
+	defer publicIPConsensus.Store(false)
+	router.Store("192.0.2.1")
+	f = testFamily(t, ipv4, "natpmp://"+gateway, srv.URL, srv.URL+"/again")
+	assert.Equal(t, "IPv4 203.0.113.7\n⚠️ IPv4 router is behind another NAT, its WAN address is 192.0.2.1", f.check(context.Background()))
+	assert.False(t, f.resolvers[0].failing())
+
+	// the router alone tells it's behind NAT, not the public address, which stays as it was
+	router.Store("100.64.1.1")
+	f = testFamily(t, ipv4, "natpmp://"+gateway)
+	assert.Equal(t, "⚠️ IPv4 router is behind carrier-grade NAT, its WAN address is 100.64.1.1", f.check(context.Background()))
+	assert.Equal(t, netip.MustParseAddr("203.0.113.7"), f.known())
+}
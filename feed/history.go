@@ -0,0 +1,164 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/skrassiev/meerkat/history"
+	"github.com/skrassiev/meerkat/telega"
+)
+
+const historyDir = "history"
+
+var (
+	// sensorHistory is the readings store, or nil if the history is not enabled.
+	sensorHistory atomic.Pointer[history.Store]
+
+	// historyQuantities is the order of the quantities in the history replies.
+	historyQuantities = []Quantity{Temperature, Humidity, Pressure}
+)
+
+// OpenSensorHistory opens the readings history in dir, or under the storage directory if dir is empty.
+func OpenSensorHistory(dir string, retention history.Retention) error {
+	if len(dir) == 0 {
+		storage := getStorageDir()
+		if len(storage) == 0 {
+			return errors.New("no storage directory")
+		}
+		dir = filepath.Join(storage, historyDir)
+	}
+
+	store, err := history.Open(dir, retention)
+	if err != nil {
+		return err
+	}
+	slog.Info("sensor history", "feed", "temperature", "dir", dir, "raw", retention.Raw, "hourly", retention.Hourly)
+	sensorHistory.Store(store)
+	return nil
+}
+
+// historySeries is the series name of a sensor quantity, e.g. attic.temperature.
+func historySeries(sensor string, q Quantity) string {
+	return sensor + "." + string(q)
+}
+
+// historyReadings returns the recorded readings of a sensor quantity in [from, to), none if the history is not enabled.
+func historyReadings(sensor string, q Quantity, from, to time.Time) []Reading {
+	store := sensorHistory.Load()
+	if store == nil {
+		return nil
+	}
+	points, err := store.Query(historySeries(sensor, q), from, to)
+	if err != nil {
+		slog.Warn("failed to query history", "feed", "temperature", "sensor", sensor, "err", err)
+		return nil
+	}
+	ret := make([]Reading, 0, len(points))
+	for _, p := range points {
+		ret = append(ret, Reading{Quantity: q, Value: p.Avg, Unit: quantityUnits[q], Time: p.Time})
+	}
+	return ret
+}
+
+// SensorSampler returns a background function, which reads all sensors every interval and records the readings.
+func SensorSampler(interval time.Duration) telega.BackgroundFunction {
+	return func(ctx context.Context, _ chan<- telega.ChattableCloser) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		recorded := make(map[*sensor]time.Time)
+		for {
+			sampleSensors(ctx, recorded)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+}
+
+// sampleSensors records fresh readings of all sensors. A reading cached by a /temp command might have been
+// recorded already, the last recorded time of every sensor is tracked to skip it.
+func sampleSensors(ctx context.Context, recorded map[*sensor]time.Time) {
+	store := sensorHistory.Load()
+	if store == nil {
+		return
+	}
+
+	for _, s := range getSensors() {
+		readings, err := s.getReadingsWithRetries(ctx, 3)
+		if err != nil {
+			slog.Warn("failed to sample sensor", "feed", "temperature", "sensor", s.name, "err", err)
+			continue
+		}
+		for _, v := range readings {
+			if !v.Time.After(recorded[s]) {
+				continue
+			}
+			if err = store.Append(historySeries(s.name, v.Quantity), v.Time, v.Value); err != nil {
+				slog.Warn("failed to record reading", "feed", "temperature", "sensor", s.name, "err", err)
+			}
+		}
+		if len(readings) > 0 && readings[0].Time.After(recorded[s]) {
+			recorded[s] = readings[0].Time
+		}
+	}
+}
+
+// historySummary describes every quantity of a sensor over the window, one line each, e.g.
+// "min 18.2 ℃ at Jan 2 05:40, max 23.1 ℃ at Jan 2 14:10, avg 20.7 ℃, last 21.3 ℃ at Jan 2 15:04".
+func (s *sensor) historySummary(store *history.Store, window time.Duration) ([]string, error) {
+	const layout = "Jan 2 15:04"
+	now := time.Now()
+
+	var ret []string
+	for _, q := range historyQuantities {
+		points, err := store.Query(historySeries(s.name, q), now.Add(-window), now)
+		if err != nil {
+			return nil, err
+		}
+		sum := history.Summarize(points)
+		if sum.Count == 0 {
+			continue
+		}
+		ret = append(ret, fmt.Sprintf("min %s at %s, max %s at %s, avg %s, last %s at %s",
+			formatQuantity(q, sum.Min), sum.MinTime.Local().Format(layout),
+			formatQuantity(q, sum.Max), sum.MaxTime.Local().Format(layout),
+			formatQuantity(q, sum.Avg),
+			formatQuantity(q, sum.Last.Avg), sum.Last.Time.Local().Format(layout)))
+	}
+	return ret, nil
+}
+
+// historyReply summarizes the history of the sensors over the window.
+func historyReply(sensors []*sensor, window time.Duration) string {
+	store := sensorHistory.Load()
+	if store == nil {
+		return "history is not enabled"
+	}
+
+	var lines []string
+	for _, s := range sensors {
+		summary, err := s.historySummary(store, window)
+		if err != nil {
+			slog.Warn("failed to query history", "feed", "temperature", "sensor", s.name, "err", err)
+			summary = []string{"history is not available"}
+		} else if len(summary) == 0 {
+			summary = []string{"no readings in " + formatWindow(window)}
+		}
+		for _, v := range summary {
+			if len(getSensors()) > 1 {
+				v = s.name + ": " + v
+			}
+			lines = append(lines, v)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
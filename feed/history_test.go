@@ -0,0 +1,59 @@
+package feed
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/history"
+	"github.com/skrassiev/meerkat/telega"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test001_historySampling(t *testing.T) {
+	defer setSensors(getSensors())
+	defer sensorHistory.Store(sensorHistory.Load())
+
+	attic, dev := newTestSensor("attic", "28-3c01d607ca0a", "29_8c")
+	attic.minRead = time.Hour
+	setSensors([]*sensor{attic})
+
+	reply := func(text string) string {
+		resp, err := HandleCommandlTemp(context.Background(), &tgbotapi.Message{Text: text, Chat: &tgbotapi.Chat{ID: 1}}, nil)
+		require.NoError(t, err)
+		return resp.(*telega.ChattableText).Text
+	}
+
+	sensorHistory.Store(nil)
+	assert.Equal(t, "history is not enabled", reply("/temp 24h"))
+
+	require.NoError(t, OpenSensorHistory(t.TempDir(), history.DefaultRetention))
+	store := sensorHistory.Load()
+	assert.Equal(t, "no readings in 1d", reply("/temp 24h"))
+
+	// the reading cached by /temp is sampled once
+	assert.True(t, strings.HasPrefix(reply("/temp"), "29.8 ℃"))
+	recorded := make(map[*sensor]time.Time)
+	sampleSensors(context.Background(), recorded)
+	sampleSensors(context.Background(), recorded)
+
+	attic.minRead = time.Nanosecond
+	dev.path = strings.Replace(dev.path, "29_8c", "minus_10_8_c", 1)
+	sampleSensors(context.Background(), recorded)
+
+	points, err := store.Query(historySeries("attic", Temperature), time.Now().Add(-time.Hour), time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, points, 2)
+	assert.InDelta(t, 29.812, points[0].Avg, 1e-5)
+	assert.InDelta(t, -10.801, points[1].Avg, 1e-5)
+
+	msg := reply("/temp attic 24h")
+	assert.True(t, strings.HasPrefix(msg, "min -10.8 ℃ at "), msg)
+	assert.Contains(t, msg, "max 29.8 ℃ at ")
+	assert.Contains(t, msg, "avg 9.5 ℃, last -10.8 ℃ at ")
+	assert.Equal(t, msg, reply("/temp 1d"))
+	assert.Equal(t, "unknown sensor 24x", reply("/temp 24x"))
+}
@@ -0,0 +1,164 @@
+package feed
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/telega"
+)
+
+const (
+	ipHistoryFilename = "ip.history"
+	// ipHistoryShown is the number of the previous addresses /ip lists per family
+	ipHistoryShown = 10
+)
+
+var (
+	// ipHistory keeps every change of the public addresses
+	ipHistory addressHistory = ipHistoryFilename
+	// publicIPMu serializes the checks of the periodic task and the /ip command
+	publicIPMu sync.Mutex
+	// ipCheckRequests are the checks asked for by the /ip command, which PublicIPNotices runs
+	ipCheckRequests = make(chan struct{}, 1)
+)
+
+// addressHistory is an append-only file in the persistent storage, a line per change of a public address,
+// e.g. "2024-01-30T12:00:00Z IPv4 203.0.113.7".
+type addressHistory string
+
+// addressChange is a public address of a family and the time it was first seen at.
+type addressChange struct {
+	family  string
+	address netip.Addr
+	since   time.Time
+}
+
+// append records a new address of the family.
+func (h addressHistory) append(family string, addr netip.Addr, now time.Time) {
+	dir := getStorageDir()
+	if dir == "" {
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(dir, string(h)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err == nil {
+		_, err = fmt.Fprintf(f, "%s %s %s\n", now.UTC().Format(time.RFC3339), family, addr)
+		err = errors.Join(err, f.Close())
+	}
+	if err != nil {
+		slog.Warn("failed to append public address history", "file", string(h), "err", err)
+	}
+}
+
+// read returns the changes of the family, the oldest first. Malformed lines are skipped.
+func (h addressHistory) read(family string) ([]addressChange, error) {
+	dir := getStorageDir()
+	if dir == "" {
+		return nil, nil
+	}
+	f, err := os.Open(filepath.Join(dir, string(h)))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var ret []addressChange
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[1] != family {
+			continue
+		}
+		since, err := time.Parse(time.RFC3339, fields[0])
+		if err != nil {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[2])
+		if err != nil {
+			continue
+		}
+		ret = append(ret, addressChange{family: family, address: addr, since: since})
+	}
+	return ret, scanner.Err()
+}
+
+// describe tells the current address of the family, when it was first seen, and the previous ones with
+// the time they were in use, the latest first.
+func (f *addressFamily) describe(now time.Time) string {
+	addr := f.known()
+	if !addr.IsValid() {
+		return f.name + " not detected"
+	}
+
+	changes, err := ipHistory.read(f.name)
+	if err != nil {
+		slog.Warn("failed to read public address history", "file", string(ipHistory), "err", err)
+	}
+	lines := []string{f.name + " " + addr.String()}
+	if len(changes) > 0 && changes[len(changes)-1].address == addr {
+		current := changes[len(changes)-1]
+		lines[0] += fmt.Sprintf(" since %s (%s)", current.since.Local().Format("Jan 2 15:04"), formatAge(now.Sub(current.since)))
+	} else {
+		// seen before the history was kept
+		changes = nil
+	}
+	if wan := f.behindNAT(); wan.IsValid() {
+		lines = append(lines, fmt.Sprintf("  behind %s, the router's WAN address is %s", natKind(wan), wan))
+	}
+	for i := len(changes) - 2; i >= 0 && len(changes)-2-i < ipHistoryShown; i-- {
+		v, until := changes[i], changes[i+1].since
+		lines = append(lines, fmt.Sprintf("  was %s from %s to %s (%s)", v.address, v.since.Local().Format("Jan 2 15:04"),
+			until.Local().Format("Jan 2 15:04"), formatAge(until.Sub(v.since))))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// HandleCommandIP tells the last known public addresses along with the previous ones, and asks PublicIPNotices
+// to check them right away. The changes it finds are sent to all chats as the periodic check would.
+func HandleCommandIP(_ context.Context, cmd *tgbotapi.Message, _ *tgbotapi.BotAPI) (telega.ChattableCloser, error) {
+	// a check is already pending otherwise
+	select {
+	case ipCheckRequests <- struct{}{}:
+	default:
+	}
+
+	now := time.Now()
+	lines := make([]string, 0, len(publicIPFamilies))
+	for _, f := range publicIPFamilies {
+		lines = append(lines, f.describe(now))
+	}
+	return &telega.ChattableText{MessageConfig: tgbotapi.NewMessage(cmd.Chat.ID, strings.Join(lines, "\n"))}, nil
+}
+
+// PublicIPNotices is a background function, which checks the public addresses, when the /ip command asks for it,
+// and sends the changes to all chats.
+func PublicIPNotices(ctx context.Context, events chan<- telega.ChattableCloser) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ipCheckRequests:
+			msg := PublicIP(ctx)
+			if len(msg) == 0 {
+				continue
+			}
+			select {
+			case events <- &telega.ChattableText{MessageConfig: tgbotapi.NewMessage(0, "Public IP Changed: "+msg)}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
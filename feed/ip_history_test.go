@@ -0,0 +1,130 @@
+package feed
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/telega"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testHistory keeps the address history of a test apart from the service one.
+func testHistory(t *testing.T) addressHistory {
+	h := addressHistory("test-" + ipHistoryFilename)
+	os.Remove(filepath.Join(getStorageDir(), string(h)))
+	prev := ipHistory
+	ipHistory = h
+	t.Cleanup(func() {
+		ipHistory = prev
+		os.Remove(filepath.Join(getStorageDir(), string(h)))
+	})
+	return h
+}
+
+func TestIPHistory_Describe(t *testing.T) {
+	h := testHistory(t)
+	f := testFamily(t, ipv4, "http://127.0.0.1:1")
+
+	assert.Equal(t, "IPv4 not detected", f.describe(time.Now()))
+
+	// an address seen before the history was kept
+	f.address, f.loaded = netip.MustParseAddr("198.51.100.2"), true
+	assert.Equal(t, "IPv4 198.51.100.2", f.describe(time.Now()))
+
+	start := time.Date(2024, 1, 30, 12, 0, 0, 0, time.UTC)
+	h.append("IPv4", netip.MustParseAddr("198.51.100.2"), start)
+	h.append("IPv6", netip.MustParseAddr("2001:db8::7"), start.Add(time.Hour))
+	h.append("IPv4", netip.MustParseAddr("203.0.113.7"), start.Add(26*time.Hour))
+	f.address = netip.MustParseAddr("203.0.113.7")
+
+	data, err := os.ReadFile(filepath.Join(getStorageDir(), string(h)))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "2024-01-30T12:00:00Z IPv4 198.51.100.2\n"), string(data))
+
+	changes, err := h.read("IPv6")
+	require.NoError(t, err)
+	assert.Equal(t, []addressChange{{family: "IPv6", address: netip.MustParseAddr("2001:db8::7"), since: start.Add(time.Hour)}}, changes)
+
+	at := func(d time.Duration) string { return start.Add(d).Local().Format("Jan 2 15:04") }
+	assert.Equal(t, "IPv4 203.0.113.7 since "+at(26*time.Hour)+" (2h)\n"+
+		"  was 198.51.100.2 from "+at(0)+" to "+at(26*time.Hour)+" (26h)", f.describe(start.Add(28*time.Hour)))
+
+	// only the latest previous addresses are listed
+	for i := 0; i < ipHistoryShown+5; i++ {
+		h.append("IPv4", netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}), start.Add(time.Duration(30+i)*time.Hour))
+	}
+	h.append("IPv4", f.address, start.Add(50*time.Hour))
+	lines := strings.Split(f.describe(start.Add(50*time.Hour)), "\n")
+	require.Len(t, lines, ipHistoryShown+1)
+	assert.True(t, strings.HasPrefix(lines[1], "  was 192.0.2.14 from "), lines[1])
+	assert.True(t, strings.HasPrefix(lines[ipHistoryShown], "  was 192.0.2.5 from "), lines[ipHistoryShown])
+
+	// malformed lines are skipped
+	file, err := os.OpenFile(filepath.Join(getStorageDir(), string(h)), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	file.WriteString("garbage\nyesterday IPv4 192.0.2.1\n2024-02-01T12:00:00Z IPv4 192.0.2\n")
+	file.Close()
+	changes, err = h.read("IPv4")
+	require.NoError(t, err)
+	assert.Len(t, changes, ipHistoryShown+8)
+}
+
+func TestIPHistory_Command(t *testing.T) {
+	resetDDNS(t, "")
+	answer, queries := "203.0.113.7", int32(0)
+	srv := resolverServer(t, &answer, &queries)
+	f := testFamily(t, ipv4, srv.URL)
+
+	prev := publicIPFamilies
+	publicIPFamilies = []*addressFamily{f}
+	t.Cleanup(func() { publicIPFamilies = prev })
+	for len(ipCheckRequests) > 0 {
+		<-ipCheckRequests
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan telega.ChattableCloser, 1)
+	done := make(chan struct{})
+	go func() { PublicIPNotices(ctx, events); close(done) }()
+	defer func() { cancel(); <-done }()
+
+	text := func() string {
+		resp, err := HandleCommandIP(ctx, &tgbotapi.Message{Text: "/ip", Chat: &tgbotapi.Chat{ID: 1}}, nil)
+		require.NoError(t, err)
+		return resp.(*telega.ChattableText).Text
+	}
+
+	// the reply tells the last known address, and the check runs in the background
+	assert.Equal(t, "IPv4 not detected", text())
+	select {
+	case e := <-events:
+		assert.Equal(t, int64(0), e.(*telega.ChattableText).ChatID)
+		assert.Equal(t, "Public IP Changed: IPv4 203.0.113.7", e.(*telega.ChattableText).Text)
+	case <-time.After(time.Second):
+		t.Fatal("no notice")
+	}
+	assert.Equal(t, int32(1), queries)
+
+	answer = "198.51.100.2"
+	assert.True(t, strings.HasPrefix(text(), "IPv4 203.0.113.7 since "))
+	select {
+	case e := <-events:
+		assert.Equal(t, "Public IP Changed: IPv4 198.51.100.2", e.(*telega.ChattableText).Text)
+	case <-time.After(time.Second):
+		t.Fatal("no notice")
+	}
+	lines := strings.Split(text(), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "IPv4 198.51.100.2 since "), lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "  was 203.0.113.7 from "), lines[1])
+
+	// the periodic check doesn't report it again
+	assert.Empty(t, PublicIP(ctx))
+}
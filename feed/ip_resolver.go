@@ -0,0 +1,352 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxJSONResponse limits the JSON resolver responses, which carry more than the address.
+const maxJSONResponse = 64 << 10
+
+// addressResolver tells the public address of the system, connecting over network, tcp4 or tcp6.
+type addressResolver interface {
+	resolve(ctx context.Context, network string) (netip.Addr, error)
+	String() string
+}
+
+// httpResolver is a web service, which responds with the address of the client, as text or as JSON.
+type httpResolver struct {
+	url string
+	// field is the path to the address in a JSON response, e.g. ["data", "ip"], nil for text responses
+	field []string
+}
+
+func (h *httpResolver) String() string {
+	if u, err := url.Parse(h.url); err == nil {
+		return u.Host
+	}
+	return h.url
+}
+
+// resolve asks the service for the address. A text response is limited to maxAddressResponse.
+func (h *httpResolver) resolve(ctx context.Context, network string) (netip.Addr, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	// ifconfig.io does not like programmatic access
+	req.Header.Add("User-Agent", "curl/7.74.0")
+	if h.field != nil {
+		req.Header.Add("Accept", "application/json")
+	}
+
+	dialer := &net.Dialer{}
+	c := &http.Client{Timeout: publicIPTimeout, Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSHandshakeTimeout: 10 * time.Second,
+		DisableKeepAlives:   true,
+	}}
+	resp, err := c.Do(req)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return netip.Addr{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	limit := maxAddressResponse
+	if h.field != nil {
+		limit = maxJSONResponse
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if len(body) > limit {
+		return netip.Addr{}, errors.New("long response")
+	}
+
+	text := string(body)
+	if h.field != nil {
+		if text, err = jsonField(body, h.field); err != nil {
+			return netip.Addr{}, err
+		}
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(text))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("unexpected response %q", text)
+	}
+	return addr.Unmap(), nil
+}
+
+// jsonField returns the string at the path in a JSON document. Array elements are selected by their index.
+func jsonField(data []byte, path []string) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return "", err
+	}
+	for _, key := range path {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", fmt.Errorf("no element %s in the response", key)
+			}
+			v = node[i]
+		default:
+			v = nil
+		}
+		if v == nil {
+			return "", fmt.Errorf("no field %s in the response", strings.Join(path, "."))
+		}
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return "", fmt.Errorf("field %s is not a string", strings.Join(path, "."))
+}
+
+// dnsResolver asks a DNS server, which answers a special name with the address of the client, such as
+// myip.opendns.com at resolver1.opendns.com, or the TXT record o-o.myaddr.l.google.com at ns1.google.com.
+// DNS is rarely rate limited or blocked, unlike the web services.
+type dnsResolver struct {
+	server string
+	name   string
+	txt    bool
+}
+
+func (d *dnsResolver) String() string {
+	if host, port, err := net.SplitHostPort(d.server); err == nil && port == "53" {
+		return host
+	}
+	return d.server
+}
+
+// resolve looks the name up at the server, which is asked over the IP version of the network. The address
+// records of that version are asked, or the TXT ones.
+func (d *dnsResolver) resolve(ctx context.Context, network string) (netip.Addr, error) {
+	version := network[len(network)-1:]
+	dialer := &net.Dialer{}
+	r := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+		// the server, rather than the system ones, over udp4, tcp4 etc.
+		return dialer.DialContext(ctx, network+version, d.server)
+	}}
+
+	ctx, cancel := context.WithTimeout(ctx, publicIPTimeout)
+	defer cancel()
+
+	if d.txt {
+		records, err := r.LookupTXT(ctx, d.name)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		for _, v := range records {
+			if addr, err := netip.ParseAddr(strings.TrimSpace(v)); err == nil {
+				return addr.Unmap(), nil
+			}
+		}
+		return netip.Addr{}, fmt.Errorf("no address in the TXT records %q", records)
+	}
+
+	addrs, err := r.LookupNetIP(ctx, "ip"+version, d.name)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addrs[0].Unmap(), nil
+}
+
+// familyResolver is a resolver of an address family and its health in that family. A dual stack service may
+// work over one IP version only.
+type familyResolver struct {
+	addressResolver
+
+	mu          sync.Mutex
+	failures    int
+	lastError   error
+	lastSuccess time.Time
+	lastFailure time.Time
+}
+
+// record updates the health with a query result.
+func (r *familyResolver) record(family string, err error, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err == nil {
+		r.failures, r.lastError, r.lastSuccess = 0, nil, now
+		resolverUp.With(r.String(), family).Set(1)
+		return
+	}
+	r.failures++
+	r.lastError, r.lastFailure = err, now
+	resolverUp.With(r.String(), family).Set(0)
+	resolverFailures.With(r.String(), family).Inc()
+}
+
+func (r *familyResolver) failing() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failures > 0
+}
+
+// ResolverStatus is the health of a public IP resolver in an address family.
+type ResolverStatus struct {
+	Resolver    string    `json:"resolver"`
+	Family      string    `json:"family"`
+	Failures    int       `json:"failures"`
+	LastSuccess time.Time `json:"last_success"`
+	LastFailure time.Time `json:"last_failure"`
+	Error       string    `json:"error,omitempty"`
+}
+
+func (r *familyResolver) status(family string) ResolverStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := ResolverStatus{Resolver: r.String(), Family: family, Failures: r.failures, LastSuccess: r.lastSuccess, LastFailure: r.lastFailure}
+	if r.lastError != nil {
+		s.Error = r.lastError.Error()
+	}
+	return s
+}
+
+// byHealth orders the resolvers to query, the failing ones last, otherwise as configured.
+func byHealth(resolvers []*familyResolver) []*familyResolver {
+	ret := append([]*familyResolver(nil), resolvers...)
+	sort.SliceStable(ret, func(i, j int) bool { return !ret[i].failing() && ret[j].failing() })
+	return ret
+}
+
+// parseResolvers parses a list of resolvers: url[,family=ipv4|ipv6][,json=field.path][;...]. A resolver is
+// used for both families, unless one is set. The URL is a web service, or dns://server[:port]/name[,type=a|txt].
+// upnp://[router], natpmp://[router] and pcp://[router] ask the router for its IPv4 WAN address, the one
+// which answers the UPnP search or the default gateway if none is set.
+func parseResolvers(spec string) (v4, v6 []addressResolver, err error) {
+	for _, entry := range strings.Split(spec, ";") {
+		if entry = strings.TrimSpace(entry); len(entry) == 0 {
+			continue
+		}
+		fields := strings.Split(entry, ",")
+		options := make(map[string]string)
+		for _, v := range fields[1:] {
+			key, value, found := strings.Cut(strings.TrimSpace(v), "=")
+			if !found {
+				return nil, nil, fmt.Errorf("resolver %s: option %q is not key=value", fields[0], v)
+			}
+			options[key] = value
+		}
+
+		r, err := parseResolver(strings.TrimSpace(fields[0]), options)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		family := options["family"]
+		delete(options, "family")
+		for key := range options {
+			return nil, nil, fmt.Errorf("resolver %s: unknown option %s", r, key)
+		}
+		switch family {
+		case "":
+			v4, v6 = append(v4, r), append(v6, r)
+		case "ipv4":
+			v4 = append(v4, r)
+		case "ipv6":
+			v6 = append(v6, r)
+		default:
+			return nil, nil, fmt.Errorf("resolver %s: unknown family %s", r, family)
+		}
+	}
+	return v4, v6, nil
+}
+
+// parseResolver makes a resolver by the URL scheme. It takes the options it uses out.
+func parseResolver(addr string, options map[string]string) (addressResolver, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolver %s: %w", addr, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		h := &httpResolver{url: addr}
+		if path, found := options["json"]; found {
+			delete(options, "json")
+			if len(path) == 0 {
+				return nil, fmt.Errorf("resolver %s: empty json field", addr)
+			}
+			h.field = strings.Split(path, ".")
+		}
+		return h, nil
+
+	case "dns":
+		name := strings.Trim(u.Path, "/")
+		if len(u.Host) == 0 || len(name) == 0 {
+			return nil, fmt.Errorf("resolver %s: use dns://server/name", addr)
+		}
+		d := &dnsResolver{server: withPort(u, "53"), name: name + "."}
+		if kind, found := options["type"]; found {
+			delete(options, "type")
+			switch strings.ToLower(kind) {
+			case "a":
+			case "txt":
+				d.txt = true
+			default:
+				return nil, fmt.Errorf("resolver %s: unknown record type %s, use a or txt", addr, kind)
+			}
+		}
+		return d, nil
+
+	case "upnp", "natpmp", "pcp":
+		if len(u.Path) > 0 && u.Path != "/" {
+			return nil, fmt.Errorf("resolver %s: use %s://[router]", addr, u.Scheme)
+		}
+		// the routers tell IPv4 addresses only
+		switch options["family"] {
+		case "":
+			options["family"] = "ipv4"
+		case "ipv6":
+			return nil, fmt.Errorf("resolver %s: %s tells IPv4 addresses only", addr, u.Scheme)
+		}
+		if u.Scheme == "upnp" {
+			if len(u.Host) == 0 {
+				return &upnpResolver{ssdp: ssdpAddress}, nil
+			}
+			return &upnpResolver{ssdp: withPort(u, ssdpPort)}, nil
+		}
+		n := &natpmpResolver{pcp: u.Scheme == "pcp"}
+		if len(u.Host) > 0 {
+			n.gateway = withPort(u, natpmpPort)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("resolver %s: unsupported scheme %q", addr, u.Scheme)
+}
+
+// withPort returns the host:port of the URL, with the default port if it has none.
+func withPort(u *url.URL, port string) string {
+	if len(u.Port()) > 0 {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
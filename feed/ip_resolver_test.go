@@ -0,0 +1,296 @@
+package feed
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resolverServer stands in for a resolver, which answers the address, or fails if it's empty. It counts the queries.
+func resolverServer(t *testing.T, answer *string, queries *int32) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(queries, 1)
+		if len(*answer) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, *answer)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// dnsServer stands in for a DNS server, which answers the names with the records by type, 1 (A), 28 (AAAA)
+// or 16 (TXT). Unknown names don't exist.
+func dnsServer(t *testing.T, network string, records map[string]map[uint16][]string) string {
+	addr := "127.0.0.1:0"
+	if network == "udp6" {
+		addr = "[::1]:0"
+	}
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		t.Skip("no loopback:", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := dnsAnswer(buf[:n], records); resp != nil {
+				conn.WriteTo(resp, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// dnsAnswer answers the question of a query, the EDNS record and such are ignored.
+func dnsAnswer(query []byte, records map[string]map[uint16][]string) []byte {
+	var labels []string
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		l := int(query[i])
+		if i+1+l > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[i+1:i+1+l]))
+		i += l + 1
+	}
+	if i+5 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	// QR, AA, RD and RA, NXDOMAIN for unknown names
+	flags := uint16(0x8580)
+	if _, found := records[name]; !found {
+		flags |= 3
+	}
+	answers := records[name][qtype]
+	resp := append([]byte(nil), query[:2]...)
+	resp = binary.BigEndian.AppendUint16(resp, flags)
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(answers)))
+	resp = append(resp, 0, 0, 0, 0)
+	resp = append(resp, query[12:i+5]...)
+	for _, v := range answers {
+		var rdata []byte
+		if qtype == 16 {
+			rdata = append([]byte{byte(len(v))}, v...)
+		} else {
+			rdata = netip.MustParseAddr(v).AsSlice()
+		}
+		// a pointer to the question name
+		resp = append(resp, 0xc0, 12)
+		resp = binary.BigEndian.AppendUint16(resp, qtype)
+		resp = binary.BigEndian.AppendUint16(resp, 1)
+		resp = binary.BigEndian.AppendUint32(resp, 60)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(rdata)))
+		resp = append(resp, rdata...)
+	}
+	return resp
+}
+
+func TestResolver_parseResolvers(t *testing.T) {
+	v4, v6, err := parseResolvers("https://api.ipify.org,family=ipv4; https://api6.ipify.org,family=ipv6;https://ifconfig.co/json,json=ip;" +
+		"https://example.com/whoami,json=data.addresses.0")
+	require.NoError(t, err)
+
+	assert.Equal(t, []addressResolver{
+		&httpResolver{url: "https://api.ipify.org"},
+		&httpResolver{url: "https://ifconfig.co/json", field: []string{"ip"}},
+		&httpResolver{url: "https://example.com/whoami", field: []string{"data", "addresses", "0"}},
+	}, v4)
+	assert.Equal(t, []addressResolver{
+		&httpResolver{url: "https://api6.ipify.org"},
+		&httpResolver{url: "https://ifconfig.co/json", field: []string{"ip"}},
+		&httpResolver{url: "https://example.com/whoami", field: []string{"data", "addresses", "0"}},
+	}, v6)
+
+	v4, v6, err = parseResolvers("dns://resolver1.opendns.com/myip.opendns.com;dns://ns1.google.com/o-o.myaddr.l.google.com,type=txt,family=ipv4;" +
+		"dns://[::1]:5353/myip.example.com,type=A,family=ipv6")
+	require.NoError(t, err)
+	assert.Equal(t, []addressResolver{
+		&dnsResolver{server: "resolver1.opendns.com:53", name: "myip.opendns.com."},
+		&dnsResolver{server: "ns1.google.com:53", name: "o-o.myaddr.l.google.com.", txt: true},
+	}, v4)
+	assert.Equal(t, []addressResolver{
+		&dnsResolver{server: "resolver1.opendns.com:53", name: "myip.opendns.com."},
+		&dnsResolver{server: "[::1]:5353", name: "myip.example.com."},
+	}, v6)
+	assert.Equal(t, "resolver1.opendns.com", v6[0].String())
+	assert.Equal(t, "[::1]:5353", v6[1].String())
+
+	for _, v := range []string{
+		"ftp://example.com",
+		"dns://resolver1.opendns.com",
+		"dns:///myip.opendns.com",
+		"dns://resolver1.opendns.com/myip.opendns.com,type=mx",
+		"dns://resolver1.opendns.com/myip.opendns.com,json=ip",
+		"https://api.ipify.org,family=ipv5",
+		"https://api.ipify.org,timeout=5s",
+		"https://api.ipify.org,json",
+		"https://api.ipify.org,json=",
+	} {
+		_, _, err = parseResolvers(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestResolver_JSON(t *testing.T) {
+	body := `{"data": {"addresses": ["203.0.113.7", "2001:db8::7"], "port": 443}, "ip": 5}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	for _, v := range []struct {
+		field  []string
+		expect string
+	}{
+		{field: []string{"data", "addresses", "0"}, expect: "203.0.113.7"},
+		{field: []string{"data", "addresses", "2"}},
+		{field: []string{"data", "port"}},
+		{field: []string{"ip"}},
+		{field: []string{"data", "address"}},
+		{field: []string{"data", "addresses", "0", "ip"}},
+	} {
+		r := &httpResolver{url: srv.URL, field: v.field}
+		addr, err := r.resolve(context.Background(), "tcp4")
+		if len(v.expect) == 0 {
+			assert.Error(t, err, v.field)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, v.expect, addr.String())
+	}
+
+	// a text resolver does not take JSON
+	_, err := (&httpResolver{url: srv.URL}).resolve(context.Background(), "tcp4")
+	assert.Error(t, err)
+}
+
+func TestResolver_Failover(t *testing.T) {
+	var answers [2]string
+	var queries [2]int32
+	srv1, srv2 := resolverServer(t, &answers[0], &queries[0]), resolverServer(t, &answers[1], &queries[1])
+	f := testFamily(t, ipv4, srv1.URL, srv2.URL)
+
+	answers[1] = "203.0.113.7"
+	assert.Equal(t, "IPv4 203.0.113.7", f.check(context.Background()))
+	assert.Equal(t, [2]int32{1, 1}, queries)
+
+	// the failing resolver is asked last
+	assert.Equal(t, "", f.check(context.Background()))
+	assert.Equal(t, [2]int32{1, 2}, queries)
+	status := f.resolvers[0].status(f.name)
+	assert.Equal(t, 1, status.Failures)
+	assert.Contains(t, status.Error, "503 Service Unavailable")
+	assert.Zero(t, f.resolvers[1].status(f.name).Failures)
+
+	// and is healthy again once it answers
+	answers[0], answers[1] = "203.0.113.8", ""
+	assert.Equal(t, "IPv4 203.0.113.8", f.check(context.Background()))
+	assert.Equal(t, [2]int32{2, 3}, queries)
+	assert.Zero(t, f.resolvers[0].status(f.name).Failures)
+	assert.Equal(t, 1, f.resolvers[1].status(f.name).Failures)
+
+	// all failing
+	answers[0] = ""
+	assert.Equal(t, "", f.check(context.Background()))
+	assert.Equal(t, netip.MustParseAddr("203.0.113.8"), f.known())
+}
+
+func TestResolver_Consensus(t *testing.T) {
+	publicIPConsensus.Store(true)
+	defer publicIPConsensus.Store(false)
+
+	var answers [3]string
+	var queries [3]int32
+	srv1, srv2, srv3 := resolverServer(t, &answers[0], &queries[0]), resolverServer(t, &answers[1], &queries[1]),
+		resolverServer(t, &answers[2], &queries[2])
+	f := testFamily(t, ipv4, srv1.URL, srv2.URL, srv3.URL)
+
+	answers = [3]string{"203.0.113.7", "203.0.113.7", "203.0.113.7"}
+	assert.Equal(t, "IPv4 203.0.113.7", f.check(context.Background()))
+	assert.Equal(t, [3]int32{1, 1, 1}, queries)
+
+	// an unchanged address needs no confirmation
+	assert.Equal(t, "", f.check(context.Background()))
+	assert.Equal(t, [3]int32{2, 1, 1}, queries)
+
+	// a single resolver is not trusted with a change
+	answers[0] = "198.51.100.2"
+	assert.Equal(t, "", f.check(context.Background()))
+	assert.Equal(t, [3]int32{3, 2, 2}, queries)
+	status := f.resolvers[0].status(f.name)
+	assert.Equal(t, 1, status.Failures)
+	assert.Equal(t, "answered 198.51.100.2, the majority 203.0.113.7", status.Error)
+
+	// no majority of the three
+	answers = [3]string{"198.51.100.2", "198.51.100.3", ""}
+	assert.Equal(t, "", f.check(context.Background()))
+	assert.Equal(t, netip.MustParseAddr("203.0.113.7"), f.known())
+
+	// two of the three agree
+	answers = [3]string{"198.51.100.2", "198.51.100.2", ""}
+	assert.Equal(t, "IPv4 198.51.100.2", f.check(context.Background()))
+	assert.Equal(t, 2, f.resolvers[2].status(f.name).Failures)
+}
+
+func TestResolver_DNS(t *testing.T) {
+	records := map[string]map[uint16][]string{
+		"myip.opendns.com":        {1: {"203.0.113.7"}, 28: {"2001:db8::7"}},
+		"o-o.myaddr.l.google.com": {16: {"edns0-client-subnet 198.51.100.0/24", "203.0.113.8"}},
+		"myip.example.com":        {16: {"v=spf1 -all"}},
+	}
+	server := dnsServer(t, "udp4", records)
+
+	for _, v := range []struct {
+		spec   string
+		expect string
+	}{
+		{spec: "dns://" + server + "/myip.opendns.com", expect: "203.0.113.7"},
+		{spec: "dns://" + server + "/o-o.myaddr.l.google.com,type=txt", expect: "203.0.113.8"},
+		{spec: "dns://" + server + "/myip.example.com,type=txt"},
+		{spec: "dns://" + server + "/myip.example.com"},
+		{spec: "dns://" + server + "/nosuch.example.com"},
+	} {
+		v4, _, err := parseResolvers(v.spec)
+		require.NoError(t, err)
+		addr, err := v4[0].resolve(context.Background(), "tcp4")
+		if len(v.expect) == 0 {
+			assert.Error(t, err, v.spec)
+			continue
+		}
+		if assert.NoError(t, err, v.spec) {
+			assert.Equal(t, v.expect, addr.String())
+		}
+	}
+
+	// along with the web services
+	f := testFamily(t, ipv4, "http://127.0.0.1:1/", "dns://"+server+"/myip.opendns.com")
+	assert.Equal(t, "IPv4 203.0.113.7", f.check(context.Background()))
+	assert.Equal(t, 1, f.resolvers[0].status(f.name).Failures)
+
+	// the IPv6 address is asked over IPv6
+	server = dnsServer(t, "udp6", records)
+	f = testFamily(t, ipv6, "dns://"+server+"/myip.opendns.com")
+	assert.Equal(t, "IPv6 2001:db8::7, prefix 2001:db8::/64", f.check(context.Background()))
+}
@@ -0,0 +1,35 @@
+package feed
+
+import "github.com/skrassiev/meerkat/metrics"
+
+var (
+	filesDetected      = metrics.NewCounter("meerkat_fs_files_detected_total", "Files found by the filesystem monitor.")
+	filesFiltered      = metrics.NewCounter("meerkat_fs_files_filtered_total", "Files found by the filesystem monitor, but not accepted by the filters.")
+	filesRateLimited   = metrics.NewCounter("meerkat_fs_files_ratelimited_total", "Files dropped by the filesystem monitor rate limit.")
+	inotifyWatches     = metrics.NewGaugeVec("meerkat_fs_inotify_watches", "Directories in the inotify watch list.", "directory")
+	sensorTemperature  = metrics.NewGaugeVec("meerkat_temperature_celsius", "Last temperature reading.", "sensor")
+	sensorHumidity     = metrics.NewGaugeVec("meerkat_humidity_percent", "Last relative humidity reading.", "sensor")
+	sensorPressure     = metrics.NewGaugeVec("meerkat_pressure_hpa", "Last atmospheric pressure reading.", "sensor")
+	sensorUp           = metrics.NewGaugeVec("meerkat_sensor_up", "Whether the sensor is read successfully, 0 once it's offline.", "sensor")
+	readingsRejected   = metrics.NewCounterVec("meerkat_temperature_readings_rejected_total", "Sensor readings rejected by validation.", "sensor", "reason")
+	thermostatHeaterOn = metrics.NewGauge("meerkat_thermostat_heater_on", "Whether the thermostat heater relay is on.")
+	thermostatSwitches = metrics.NewCounter("meerkat_thermostat_switches_total", "Thermostat heater relay switches.")
+	thermostatFailures = metrics.NewCounter("meerkat_thermostat_relay_failures_total", "Failed thermostat heater relay switches.")
+	publicIPChanges    = metrics.NewCounterVec("meerkat_public_ip_changes_total", "Public IP address changes detected.", "family")
+	resolverUp         = metrics.NewGaugeVec("meerkat_public_ip_resolver_up", "Whether the last query of the public IP resolver succeeded.", "resolver", "family")
+	resolverFailures   = metrics.NewCounterVec("meerkat_public_ip_resolver_failures_total", "Failed or outvoted public IP resolver queries.", "resolver", "family")
+	ddnsUpdates        = metrics.NewCounterVec("meerkat_ddns_updates_total", "DNS records set to a changed public address.", "updater")
+	ddnsFailures       = metrics.NewCounterVec("meerkat_ddns_failures_total", "Failed DNS record updates, after the retries.", "updater")
+	ipv6PrefixChanges  = metrics.NewCounter("meerkat_public_ipv6_prefix_changes_total", "Delegated IPv6 prefix changes detected.")
+	publicIPBehindNAT  = metrics.NewGaugeVec("meerkat_public_ip_behind_nat", "Whether the router's WAN address is not the public one.", "family")
+	internetUp         = metrics.NewGauge("meerkat_internet_up", "Whether any of the connectivity probe targets answers.")
+	internetOutages    = metrics.NewCounter("meerkat_internet_outages_total", "Internet outages detected by the connectivity probes.")
+	forwardedPortUp    = metrics.NewGaugeVec("meerkat_forwarded_port_up", "Whether the forwarded port is reachable at the public address.", "port", "family")
+)
+
+// sensorGauges export the last readings by quantity.
+var sensorGauges = map[Quantity]metrics.GaugeVec{
+	Temperature: sensorTemperature,
+	Humidity:    sensorHumidity,
+	Pressure:    sensorPressure,
+}
@@ -0,0 +1,86 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"syscall"
+)
+
+// the netlink multicast groups of rtnetlink.h, which syscall does not define
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6IfAddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+)
+
+// watchRoutes listens to the netlink notifications of the links, the addresses and the routes going up or down,
+// and signals changes on every one of them, which may move the default route. Returns once ctx is done.
+func watchRoutes(ctx context.Context, changes chan<- struct{}) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr | rtmgrpIPv4Route | rtmgrpIPv6Route,
+	}
+	if err = syscall.Bind(fd, sa); err != nil {
+		return err
+	}
+	// wake up every second to see if ctx is done
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &syscall.Timeval{Sec: 1}); err != nil {
+		return err
+	}
+
+	signal := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+
+	buf := make([]byte, syscall.Getpagesize()*4)
+	for ctx.Err() == nil {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			switch {
+			case errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.EINTR):
+			case errors.Is(err, syscall.ENOBUFS):
+				// some notifications are lost, any of them could be a change
+				signal()
+			default:
+				return err
+			}
+			continue
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			signal()
+			continue
+		}
+		for _, m := range msgs {
+			if isRouteChange(m) {
+				signal()
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// isRouteChange tells if the message is about a link, an address or a default route.
+func isRouteChange(m syscall.NetlinkMessage) bool {
+	switch m.Header.Type {
+	case syscall.RTM_NEWLINK, syscall.RTM_DELLINK, syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+		return true
+	case syscall.RTM_NEWROUTE, syscall.RTM_DELROUTE:
+		// the destination length is the first byte of struct rtmsg after the family
+		return len(m.Data) >= syscall.SizeofRtMsg && m.Data[1] == 0
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package feed
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetlink_isRouteChange(t *testing.T) {
+	route := func(typ uint16, dstLen byte) syscall.NetlinkMessage {
+		data := make([]byte, syscall.SizeofRtMsg)
+		data[0], data[1] = syscall.AF_INET, dstLen
+		return syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: typ}, Data: data}
+	}
+	assert.True(t, isRouteChange(route(syscall.RTM_NEWROUTE, 0)))
+	assert.True(t, isRouteChange(route(syscall.RTM_DELROUTE, 0)))
+	assert.False(t, isRouteChange(route(syscall.RTM_NEWROUTE, 24)))
+	assert.False(t, isRouteChange(syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.RTM_NEWROUTE}}))
+	assert.True(t, isRouteChange(syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.RTM_NEWADDR}}))
+	assert.True(t, isRouteChange(syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.RTM_DELLINK}}))
+	assert.False(t, isRouteChange(syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.RTM_NEWNEIGH}}))
+}
+
+func TestNetlink_watchRoutes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- watchRoutes(ctx, make(chan struct{}, 1)) }()
+
+	select {
+	case err := <-done:
+		t.Skip("no netlink:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not stopped")
+	}
+}
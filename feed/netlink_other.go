@@ -0,0 +1,13 @@
+//go:build !linux
+
+package feed
+
+import (
+	"context"
+	"errors"
+)
+
+// watchRoutes is not supported, the public addresses are checked periodically only.
+func watchRoutes(ctx context.Context, changes chan<- struct{}) error {
+	return errors.New("route notifications are only supported on Linux")
+}
@@ -2,17 +2,18 @@ package feed
 
 import (
 	"errors"
-	"net"
+	"net/netip"
 	"os"
-	"path"
 	"path/filepath"
+	"strings"
 
-	"log"
+	"log/slog"
 )
 
 const (
-	serviceName       = "meerkat"
-	ipAddressFilename = "ip.address"
+	serviceName         = "meerkat"
+	ipAddressFilename   = "ip.address"
+	ipv6AddressFilename = "ipv6.address"
 )
 
 var (
@@ -39,37 +40,33 @@ func getStorageDir() string {
 	return ""
 }
 
-type IPv4 string
+// storedAddress is a file in the persistent storage, which keeps the last public address of a family.
+type storedAddress string
 
-func (ip *IPv4) read() string {
+// read returns the stored address, or the zero address if there is none or it can't be parsed.
+func (f storedAddress) read() netip.Addr {
 	dir := getStorageDir()
-	f, err := os.Open(filepath.Join(dir, ipAddressFilename))
-	if err != nil {
-		return ""
+	if dir == "" {
+		return netip.Addr{}
 	}
-	defer f.Close()
-
-	var ipAddrBytes [4*3 + 3]byte
-	if n, err := f.Read(ipAddrBytes[:]); err == nil && n >= (4+3) {
-		if parsedIP := net.ParseIP(string(ipAddrBytes[:n])); parsedIP != nil {
-			*ip = IPv4(parsedIP.String())
-			return parsedIP.String()
-		}
+	data, err := os.ReadFile(filepath.Join(dir, string(f)))
+	if err != nil || len(data) > maxAddressResponse {
+		return netip.Addr{}
 	}
-	return ""
+	addr, err := netip.ParseAddr(strings.TrimSpace(string(data)))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr
 }
 
-// Write save IP address in the persistent storage. Given the logic of operations, we can ignore errors as persisting IP is only an optimization
-func (ip IPv4) write() {
-	if getStorageDir() == "" {
+// write saves the address in the persistent storage. Given the logic of operations, we can ignore errors as persisting IP is only an optimization
+func (f storedAddress) write(addr netip.Addr) {
+	dir := getStorageDir()
+	if dir == "" {
 		return
 	}
-	if f, err := os.Create(path.Join(getStorageDir(), ipAddressFilename)); err == nil {
-		if _, err = f.Write([]byte(ip)); err != nil {
-			log.Println("WARN: failed to persist IPv4", err)
-		}
-		f.Close()
-	} else {
-		log.Println("WARN: failed to create persist file IPv4", err)
+	if err := os.WriteFile(filepath.Join(dir, string(f)), []byte(addr.String()), 0644); err != nil {
+		slog.Warn("failed to persist public address", "file", string(f), "err", err)
 	}
 }
@@ -1,7 +1,9 @@
 package feed
 
 import (
+	"net/netip"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -31,30 +33,31 @@ func Test_StorageDirAsFilePath(t *testing.T) {
 	assert.Equal(t, "", getStorageDir())
 }
 
-func testParseIP(t *testing.T) {
-
-}
-
 func Test_StorageStoredIP(t *testing.T) {
 	assert.NotEmpty(t, getStorageDir())
 
+	stored := storedAddress("test-" + ipAddressFilename)
+	defer os.Remove(filepath.Join(getStorageDir(), string(stored)))
+
 	for _, v := range []struct {
 		data   []byte
-		expect IPv4
+		expect string
 	}{
-		{data: []byte("asasg sdfdfhsdfhgsdgf d sgsgsgas sa"), expect: ""},
-		{data: []byte{}, expect: ""},
-		{data: []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x05, 0x03, 0x06, 0x0a}, expect: ""},
-		{data: []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x05, 0x03, 0x06, 0x0a, 0x12, 0x22, 0x23, 0x03, 0x00, 0x27, 0x15}, expect: ""},
-		{data: []byte("192.168.0"), expect: ""},
+		{data: []byte("asasg sdfdfhsdfhgsdgf d sgsgsgas sa"), expect: "invalid IP"},
+		{data: []byte{}, expect: "invalid IP"},
+		{data: []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x05, 0x03, 0x06, 0x0a}, expect: "invalid IP"},
+		{data: []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x05, 0x03, 0x06, 0x0a, 0x12, 0x22, 0x23, 0x03, 0x00, 0x27, 0x15}, expect: "invalid IP"},
+		{data: []byte("192.168.0"), expect: "invalid IP"},
 		{data: []byte("192.168.0.1"), expect: "192.168.0.1"},
-		{data: []byte("192.267.0.1"), expect: ""},
-		{data: []byte("255.255.255.255"), expect: "255.255.255.255"},
+		{data: []byte("192.267.0.1"), expect: "invalid IP"},
+		{data: []byte("255.255.255.255\n"), expect: "255.255.255.255"},
+		{data: []byte("2001:db8:0:1::7"), expect: "2001:db8:0:1::7"},
+		{data: []byte("2001:0db8:0000:0001:0000:0000:0000:0007"), expect: "2001:db8:0:1::7"},
 	} {
-		ipSrc := IPv4(string(v.data))
-		ipSrc.write()
-		var ip IPv4
-		ip.read()
-		assert.Equal(t, v.expect, ip, "unexpected IP value for %s", string(v.data))
+		assert.NoError(t, os.WriteFile(filepath.Join(getStorageDir(), string(stored)), v.data, 0644))
+		assert.Equal(t, v.expect, stored.read().String(), "unexpected IP value for %s", string(v.data))
 	}
+
+	stored.write(netip.MustParseAddr("2001:db8::1"))
+	assert.Equal(t, netip.MustParseAddr("2001:db8::1"), stored.read())
 }
@@ -0,0 +1,291 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/telega"
+)
+
+const (
+	portCheckStateFilename = "ports.json"
+	portCheckTimeout       = 10 * time.Second
+	// portCheckAttempts is how many times a port is tried, before it's unreachable
+	portCheckAttempts = 2
+	maxProbeMessage   = 200
+)
+
+// portCheckRetryDelay is the pause between the attempts
+var portCheckRetryDelay = 5 * time.Second
+
+// forwardedPort is a service, which the router forwards a public port to.
+type forwardedPort struct {
+	name     string
+	port     uint16
+	families map[string]bool
+}
+
+// portChecker connects to the forwarded ports at the public addresses, directly or through a probe service,
+// since many routers don't loop the connections to their own public address back.
+type portChecker struct {
+	mu    sync.Mutex
+	ports []forwardedPort
+	// probe is the URL of the probe service with {host} and {port} in it, empty to connect directly
+	probe string
+	// reachable is the last result of a port by the family and the name, e.g. "IPv4 ssh", persisted
+	reachable map[string]bool
+	stateFile string
+}
+
+var portChecks portChecker
+
+// ConfigurePortChecks sets the forwarded ports to check, see parseForwardedPorts, and loads their state from stateFile,
+// or from the storage directory if stateFile is empty. The probe service is asked GET probe with {host} and {port}
+// replaced, and answers 200 if it could connect, any other status if it could not. A service, which connects back
+// to the client, may leave {host} out.
+func ConfigurePortChecks(spec, probe, stateFile string) error {
+	ports, err := parseForwardedPorts(spec)
+	if err != nil {
+		return err
+	}
+	if probe = strings.TrimSpace(probe); len(probe) > 0 {
+		if u, err := url.Parse(probe); err != nil || (u.Scheme != "http" && u.Scheme != "https") || !strings.Contains(probe, "{port}") {
+			return fmt.Errorf("invalid port probe %q, use an http(s) URL with {host} and {port}", probe)
+		}
+	}
+
+	if len(stateFile) == 0 {
+		if dir := getStorageDir(); len(dir) > 0 {
+			stateFile = filepath.Join(dir, portCheckStateFilename)
+		}
+	}
+
+	reachable := make(map[string]bool)
+	if len(stateFile) > 0 {
+		b, err := os.ReadFile(stateFile)
+		if err == nil {
+			err = json.Unmarshal(b, &reachable)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to load port check state", "feed", "ports", "file", stateFile, "err", err)
+			reachable = make(map[string]bool)
+		}
+	}
+
+	portChecks.mu.Lock()
+	portChecks.ports, portChecks.probe, portChecks.reachable, portChecks.stateFile = ports, probe, reachable, stateFile
+	portChecks.mu.Unlock()
+	return nil
+}
+
+// parseForwardedPorts parses the services: name,port=22[,family=ipv4|ipv6][;...]. A port is checked at
+// the addresses of both families, unless one is set.
+func parseForwardedPorts(spec string) ([]forwardedPort, error) {
+	var ports []forwardedPort
+	names := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ";") {
+		if entry = strings.TrimSpace(entry); len(entry) == 0 {
+			continue
+		}
+		fields := strings.Split(entry, ",")
+		p := forwardedPort{name: strings.TrimSpace(fields[0]), families: map[string]bool{ipv4.name: true, ipv6.name: true}}
+		if len(p.name) == 0 || names[p.name] {
+			return nil, fmt.Errorf("forwarded port %q: the name must be set and unique", entry)
+		}
+		names[p.name] = true
+
+		for _, v := range fields[1:] {
+			key, value, found := strings.Cut(strings.TrimSpace(v), "=")
+			if !found {
+				return nil, fmt.Errorf("forwarded port %s: option %q is not key=value", p.name, v)
+			}
+			switch key {
+			case "port":
+				port, err := strconv.ParseUint(value, 10, 16)
+				if err != nil || port == 0 {
+					return nil, fmt.Errorf("forwarded port %s: invalid port %s", p.name, value)
+				}
+				p.port = uint16(port)
+			case "family":
+				switch value {
+				case "ipv4":
+					p.families = map[string]bool{ipv4.name: true}
+				case "ipv6":
+					p.families = map[string]bool{ipv6.name: true}
+				default:
+					return nil, fmt.Errorf("forwarded port %s: unknown family %s", p.name, value)
+				}
+			default:
+				return nil, fmt.Errorf("forwarded port %s: unknown option %s", p.name, key)
+			}
+		}
+		if p.port == 0 {
+			return nil, fmt.Errorf("forwarded port %s: missing port", p.name)
+		}
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+// PortChecks returns a background function, which checks the forwarded ports every interval, see checkPorts,
+// and tells the changes to all chats. The attempts of the unreachable ports take a while, so they are not
+// checked by the bot's periodic tasks.
+func PortChecks(interval time.Duration) telega.BackgroundFunction {
+	return func(ctx context.Context, events chan<- telega.ChattableCloser) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if msg := checkPorts(ctx); len(msg) > 0 {
+				select {
+				case events <- &telega.ChattableText{MessageConfig: tgbotapi.NewMessage(0, "Port forwarding: "+msg)}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
+
+// checkPorts connects to the forwarded ports at the last known public addresses, and reports the ones, which
+// became unreachable, e.g. "❌ ssh is unreachable at 203.0.113.7:22: connection refused", or reachable again.
+// Returns empty string if none changed.
+func checkPorts(ctx context.Context) string {
+	portChecks.mu.Lock()
+	defer portChecks.mu.Unlock()
+
+	var lines []string
+	changed := false
+	for _, f := range publicIPFamilies {
+		addr := f.known()
+		if !addr.IsValid() {
+			continue
+		}
+		for _, p := range portChecks.ports {
+			if !p.families[f.name] {
+				continue
+			}
+			target := net.JoinHostPort(addr.String(), strconv.Itoa(int(p.port)))
+			err := portChecks.check(ctx, addr, p.port)
+			if ctx.Err() != nil {
+				return strings.Join(lines, "\n")
+			}
+
+			key := f.name + " " + p.name
+			prev, known := portChecks.reachable[key]
+			if err == nil {
+				forwardedPortUp.With(p.name, f.name).Set(1)
+				if known && !prev {
+					lines = append(lines, fmt.Sprintf("✅ %s is reachable again at %s", p.name, target))
+				}
+			} else {
+				forwardedPortUp.With(p.name, f.name).Set(0)
+				slog.Warn("forwarded port is unreachable", "feed", "ports", "port", p.name, "target", target, "err", err)
+				if prev {
+					msg := fmt.Sprintf("❌ %s is unreachable at %s: %v", p.name, target, err)
+					if wan := f.behindNAT(); wan.IsValid() {
+						msg += fmt.Sprintf(", the router is behind %s", natKind(wan))
+					}
+					lines = append(lines, msg)
+				}
+			}
+			if !known || prev != (err == nil) {
+				portChecks.reachable[key], changed = err == nil, true
+			}
+		}
+	}
+
+	if changed {
+		portChecks.save()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// check tries to connect to the port a few times, the error is of the last attempt. The caller holds the lock.
+func (c *portChecker) check(ctx context.Context, addr netip.Addr, port uint16) (err error) {
+	for i := 0; i < portCheckAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(portCheckRetryDelay):
+			}
+		}
+		if err = c.connect(ctx, addr, port); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// connect connects to the port, or asks the probe service to.
+func (c *portChecker) connect(ctx context.Context, addr netip.Addr, port uint16) error {
+	ctx, cancel := context.WithTimeout(ctx, portCheckTimeout)
+	defer cancel()
+
+	if len(c.probe) == 0 {
+		dialer := &net.Dialer{}
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr.String(), strconv.Itoa(int(port))))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	u := strings.NewReplacer("{host}", url.QueryEscape(addr.String()), "{port}", strconv.Itoa(int(port))).Replace(c.probe)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("probe: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxProbeMessage+1))
+	if msg := strings.TrimSpace(string(data)); len(msg) > 0 && len(msg) <= maxProbeMessage {
+		return fmt.Errorf("probe: %s", msg)
+	}
+	return fmt.Errorf("probe: unexpected status %s", resp.Status)
+}
+
+// save writes the state, so that a crash in the middle does not corrupt it. The caller holds the lock.
+func (c *portChecker) save() {
+	if len(c.stateFile) == 0 {
+		return
+	}
+	b, err := json.Marshal(c.reachable)
+	if err == nil {
+		tmp := c.stateFile + ".tmp"
+		if err = os.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, c.stateFile)
+		}
+	}
+	if err != nil {
+		slog.Warn("failed to save port check state", "feed", "ports", "file", c.stateFile, "err", err)
+	}
+}
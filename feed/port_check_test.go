@@ -0,0 +1,155 @@
+package feed
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skrassiev/meerkat/telega"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPortChecks checks the ports at the address, with no pause between the attempts.
+func testPortChecks(t *testing.T, addr string) *addressFamily {
+	f := testFamily(t, ipv4)
+	f.address, f.loaded = netip.MustParseAddr(addr), true
+
+	prevFamilies, prevDelay := publicIPFamilies, portCheckRetryDelay
+	publicIPFamilies, portCheckRetryDelay = []*addressFamily{f}, 0
+	t.Cleanup(func() {
+		publicIPFamilies, portCheckRetryDelay = prevFamilies, prevDelay
+		ConfigurePortChecks("", "", filepath.Join(t.TempDir(), portCheckStateFilename))
+	})
+	return f
+}
+
+func TestPortCheck_parseForwardedPorts(t *testing.T) {
+	ports, err := parseForwardedPorts("ssh,port=22; web,port=443,family=ipv6;;vpn,family=ipv4,port=51820")
+	require.NoError(t, err)
+	assert.Equal(t, []forwardedPort{
+		{name: "ssh", port: 22, families: map[string]bool{"IPv4": true, "IPv6": true}},
+		{name: "web", port: 443, families: map[string]bool{"IPv6": true}},
+		{name: "vpn", port: 51820, families: map[string]bool{"IPv4": true}},
+	}, ports)
+
+	for _, v := range []string{"ssh", "ssh,port=0", "ssh,port=65536", "ssh,port=22;ssh,port=2222", ",port=22", "ssh,port=22,family=ipx",
+		"ssh,port=22,proto=udp", "ssh,port"} {
+		_, err = parseForwardedPorts(v)
+		assert.Error(t, err, v)
+	}
+
+	stateFile := filepath.Join(t.TempDir(), portCheckStateFilename)
+	for _, v := range []string{"ftp://probe.example.com/{host}/{port}", "https://probe.example.com/check", "probe.example.com/{port}"} {
+		assert.Error(t, ConfigurePortChecks("ssh,port=22", v, stateFile), v)
+	}
+	assert.NoError(t, ConfigurePortChecks("ssh,port=22", "https://probe.example.com/check?port={port}", stateFile))
+	assert.NoError(t, ConfigurePortChecks("", "", stateFile))
+}
+
+func TestPortCheck_Direct(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("no loopback:", err)
+	}
+	defer func() { l.Close() }()
+	port := l.Addr().(*net.TCPAddr).Port
+	closed, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	testPortChecks(t, "127.0.0.1")
+	stateFile := filepath.Join(t.TempDir(), portCheckStateFilename)
+	spec := "ssh,port=" + strconv.Itoa(port) + ";web,port=" + strconv.Itoa(closedPort) + ";vpn,port=" + strconv.Itoa(port) + ",family=ipv6"
+	require.NoError(t, ConfigurePortChecks(spec, "", stateFile))
+	ctx := context.Background()
+
+	// a port, which was never reachable, is not reported
+	assert.Equal(t, "", checkPorts(ctx))
+	assert.Equal(t, map[string]bool{"IPv4 ssh": true, "IPv4 web": false}, portChecks.reachable)
+
+	l.Close()
+	msg := checkPorts(ctx)
+	assert.True(t, strings.HasPrefix(msg, "❌ ssh is unreachable at 127.0.0.1:"+strconv.Itoa(port)+": "), msg)
+	assert.Equal(t, "", checkPorts(ctx))
+
+	// the state is kept over restarts
+	require.NoError(t, ConfigurePortChecks(spec, "", stateFile))
+	assert.Equal(t, "", checkPorts(ctx))
+
+	l, err = net.Listen("tcp4", l.Addr().String())
+	require.NoError(t, err)
+	assert.Equal(t, "✅ ssh is reachable again at 127.0.0.1:"+strconv.Itoa(port), checkPorts(ctx))
+	assert.Equal(t, "", checkPorts(ctx))
+}
+
+func TestPortCheck_Probe(t *testing.T) {
+	var open atomic.Bool
+	open.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("host") != "203.0.113.7" || r.URL.Query().Get("port") != "443" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !open.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("connection timed out\n"))
+		}
+	}))
+	defer srv.Close()
+
+	f := testPortChecks(t, "203.0.113.7")
+	require.NoError(t, ConfigurePortChecks("web,port=443", srv.URL+"/check?host={host}&port={port}", filepath.Join(t.TempDir(), portCheckStateFilename)))
+	ctx := context.Background()
+
+	assert.Equal(t, "", checkPorts(ctx))
+	open.Store(false)
+	assert.Equal(t, "❌ web is unreachable at 203.0.113.7:443: probe: connection timed out", checkPorts(ctx))
+
+	// the router got behind carrier-grade NAT
+	open.Store(true)
+	assert.Equal(t, "✅ web is reachable again at 203.0.113.7:443", checkPorts(ctx))
+	f.wan = netip.MustParseAddr("100.64.1.1")
+	open.Store(false)
+	assert.Equal(t, "❌ web is unreachable at 203.0.113.7:443: probe: connection timed out, the router is behind carrier-grade NAT", checkPorts(ctx))
+}
+
+func TestPortCheck_Background(t *testing.T) {
+	var open atomic.Bool
+	open.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !open.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("connection refused\n"))
+		}
+	}))
+	defer srv.Close()
+
+	testPortChecks(t, "203.0.113.7")
+	require.NoError(t, ConfigurePortChecks("web,port=443", srv.URL+"/check?host={host}&port={port}", filepath.Join(t.TempDir(), portCheckStateFilename)))
+	require.Equal(t, "", checkPorts(context.Background()))
+	open.Store(false)
+
+	// the ports are checked off the bot loop, and the changes are sent to all chats
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan telega.ChattableCloser)
+	done := make(chan struct{})
+	go func() { PortChecks(10*time.Millisecond)(ctx, events); close(done) }()
+	defer func() { cancel(); <-done }()
+	select {
+	case e := <-events:
+		assert.Equal(t, int64(0), e.(*telega.ChattableText).ChatID)
+		assert.Equal(t, "Port forwarding: ❌ web is unreachable at 203.0.113.7:443: probe: connection refused", e.(*telega.ChattableText).Text)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no port forwarding notice")
+	}
+}
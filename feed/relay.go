@@ -0,0 +1,105 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	gpioClassDir        = "class/gpio"
+	relayCommandTimeout = 30 * time.Second
+)
+
+// relay is an output, which switches a heater.
+type relay interface {
+	Set(on bool) error
+	String() string
+}
+
+// gpioRelay drives a relay with a sysfs GPIO pin, e.g. /sys/class/gpio/gpio17/value.
+type gpioRelay struct {
+	root      string
+	pin       int
+	activeLow bool
+}
+
+func newGPIORelay(root string, pin int, activeLow bool) *gpioRelay {
+	return &gpioRelay{root: filepath.Join(root, gpioClassDir), pin: pin, activeLow: activeLow}
+}
+
+func (g *gpioRelay) String() string {
+	return fmt.Sprintf("gpio%d", g.pin)
+}
+
+// export makes the pin an output, unless it's been exported already.
+func (g *gpioRelay) export() error {
+	dir := filepath.Join(g.root, g.String())
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := os.WriteFile(filepath.Join(g.root, "export"), []byte(strconv.Itoa(g.pin)), 0200); err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("%s is not exported: %w", g, err)
+	}
+	return os.WriteFile(filepath.Join(dir, "direction"), []byte("out"), 0200)
+}
+
+// Set writes the pin value, inverted for the active low relay boards.
+func (g *gpioRelay) Set(on bool) error {
+	if err := g.export(); err != nil {
+		return err
+	}
+	value := "0"
+	if on != g.activeLow {
+		value = "1"
+	}
+	return os.WriteFile(filepath.Join(g.root, g.String(), "value"), []byte(value), 0200)
+}
+
+// commandRelay runs shell commands to switch the heater, such as a smart plug API call.
+type commandRelay struct {
+	on, off string
+}
+
+func (c *commandRelay) String() string {
+	return "command"
+}
+
+// Set runs the on or the off command. A non-zero exit is an error with the command output.
+func (c *commandRelay) Set(on bool) error {
+	command := c.off
+	if on {
+		command = c.on
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), relayCommandTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "/bin/sh", "-c", command).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); len(msg) > 0 {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// newRelay makes a GPIO relay, if a pin is set, or a command one.
+func newRelay(root string, pin int, activeLow bool, onCommand, offCommand string) (relay, error) {
+	switch {
+	case pin >= 0:
+		return newGPIORelay(root, pin, activeLow), nil
+	case len(onCommand) > 0 && len(offCommand) > 0:
+		return &commandRelay{on: onCommand, off: offCommand}, nil
+	}
+	return nil, errors.New("no relay: set a GPIO pin, or both the on and the off commands")
+}
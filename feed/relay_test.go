@@ -0,0 +1,56 @@
+package feed
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readFile(t *testing.T, name string) string {
+	b, err := os.ReadFile(name)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func Test001_gpioRelay(t *testing.T) {
+	root := t.TempDir()
+	gpio := filepath.Join(root, gpioClassDir)
+	require.NoError(t, os.MkdirAll(filepath.Join(gpio, "gpio17"), 0755))
+
+	r := newGPIORelay(root, 17, false)
+	assert.Equal(t, "gpio17", r.String())
+	require.NoError(t, r.Set(true))
+	assert.Equal(t, "1", readFile(t, filepath.Join(gpio, "gpio17", "value")))
+	require.NoError(t, r.Set(false))
+	assert.Equal(t, "0", readFile(t, filepath.Join(gpio, "gpio17", "value")))
+
+	// the relay boards are often active low
+	r = newGPIORelay(root, 17, true)
+	require.NoError(t, r.Set(true))
+	assert.Equal(t, "0", readFile(t, filepath.Join(gpio, "gpio17", "value")))
+
+	// a pin, which the kernel does not export, is an error
+	r = newGPIORelay(root, 18, false)
+	assert.Error(t, r.Set(true))
+	assert.Equal(t, "18", readFile(t, filepath.Join(gpio, "export")))
+}
+
+func Test002_commandRelay(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "heater")
+	r, err := newRelay("", -1, false, "echo on > "+state, "echo off > "+state)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Set(true))
+	assert.Equal(t, "on\n", readFile(t, state))
+	require.NoError(t, r.Set(false))
+	assert.Equal(t, "off\n", readFile(t, state))
+
+	r = &commandRelay{on: "echo plug unreachable >&2; exit 1", off: "true"}
+	assert.EqualError(t, r.Set(true), "exit status 1: plug unreachable")
+
+	_, err = newRelay("", -1, false, "true", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,122 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/telega"
+)
+
+// sensorOfflineFailures is how many reads in a row must fail for a sensor to be offline. Every read
+// is retried, so a single bad reading does not count.
+const sensorOfflineFailures = 3
+
+// sensorHealth tracks the consecutive failed reads of a sensor.
+type sensorHealth struct {
+	// failures is the number of failed reads since the last successful one
+	failures int
+	// failingSince is the time of the first of the failed reads
+	failingSince time.Time
+	lastError    error
+	// reportedOffline is the failingSince of the outage the monitor has reported, zero if none
+	reportedOffline time.Time
+}
+
+// offline tells if the sensor has failed too many times in a row.
+func (h sensorHealth) offline() bool {
+	return h.failures >= sensorOfflineFailures
+}
+
+// recordRead updates the health after a read. The caller holds the sensor lock.
+func (s *sensor) recordRead(err error, now time.Time) {
+	if err == nil {
+		s.health.failures, s.health.failingSince, s.health.lastError = 0, time.Time{}, nil
+		sensorUp.With(s.name).Set(1)
+		return
+	}
+
+	if s.health.failures == 0 {
+		s.health.failingSince = now
+	}
+	s.health.failures++
+	s.health.lastError = err
+	if s.health.offline() {
+		sensorUp.With(s.name).Set(0)
+	}
+}
+
+// getHealth returns a snapshot of the sensor health.
+func (s *sensor) getHealth() sensorHealth {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.health
+}
+
+// healthChange returns a message when the sensor goes offline or comes back, once per change.
+func (s *sensor) healthChange(now time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.health.offline() && s.health.reportedOffline.IsZero():
+		s.health.reportedOffline = s.health.failingSince
+		return fmt.Sprintf("📴 %s is offline since %s: %v", s.name, s.health.failingSince.Format("Jan 2 15:04"), s.health.lastError)
+	case s.health.failures == 0 && !s.health.reportedOffline.IsZero():
+		since := s.health.reportedOffline
+		s.health.reportedOffline = time.Time{}
+		return fmt.Sprintf("📶 %s is back after %s: %s", s.name, formatAge(now.Sub(since)), formatReadings(s.last, ", "))
+	}
+	return ""
+}
+
+// formatAge prints a duration rounded to what matters for an age, e.g. 45s, 12m or 2h5m.
+func formatAge(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(time.Second).String()
+	}
+	return formatWindow(d.Round(time.Minute))
+}
+
+// staleNote marks cached readings, which could not be refreshed, with their age, e.g. " (stale, 2h5m old: w1 CRC check failed)".
+func staleNote(readTime time.Time, err error) string {
+	if err == nil {
+		return ""
+	}
+	return fmt.Sprintf(" (stale, %s old: %v)", formatAge(time.Since(readTime)), err)
+}
+
+// HandleCommandSensors replies with the health of every sensor, e.g.
+// "attic (28-3c01d607ca0a): online, last reading 12s ago" or
+// "cellar (10-000802b4a1c2): offline since Jan 2 15:04, 5 failed reads: w1 CRC check failed".
+func HandleCommandSensors(ctx context.Context, cmd *tgbotapi.Message, _ *tgbotapi.BotAPI) (response telega.ChattableCloser, _ error) {
+	sensors := getSensors()
+	if len(sensors) == 0 {
+		return &telega.ChattableText{MessageConfig: tgbotapi.NewMessage(cmd.Chat.ID, "no temperature sensors")}, nil
+	}
+
+	lines := make([]string, 0, len(sensors))
+	for _, s := range sensors {
+		h := s.getHealth()
+		_, lastTime := s.lastReadings()
+
+		var state string
+		switch {
+		case h.offline():
+			state = fmt.Sprintf("offline since %s, %d failed reads: %v", h.failingSince.Format("Jan 2 15:04"), h.failures, h.lastError)
+		case h.failures > 0:
+			state = fmt.Sprintf("failing since %s, %d failed reads: %v", h.failingSince.Format("Jan 2 15:04"), h.failures, h.lastError)
+		case lastTime.IsZero():
+			state = "not read yet"
+		default:
+			state = "online"
+		}
+		if !lastTime.IsZero() {
+			state += ", last reading " + formatAge(time.Since(lastTime)) + " ago"
+		}
+		lines = append(lines, fmt.Sprintf("%s (%s): %s", s.name, s.dev.ID(), state))
+	}
+	return &telega.ChattableText{MessageConfig: tgbotapi.NewMessage(cmd.Chat.ID, strings.Join(lines, "\n"))}, nil
+}
@@ -0,0 +1,102 @@
+package feed
+
+import (
+	"context"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/telega"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test001_sensorOfflineAndBack(t *testing.T) {
+	ctx := context.Background()
+	s, dev := newTestSensor("cellar", "10-000802b4a1c2", "29_8c")
+	s.minRead = time.Nanosecond
+
+	_, err := s.getReadingsWithRetries(ctx, 1)
+	require.NoError(t, err)
+	assert.Empty(t, s.healthChange(time.Now()))
+
+	// the sensor is unplugged
+	dev.path = path.Join(testDataDir, "temp_sensor_readings", "missing")
+	for i := 1; i < sensorOfflineFailures; i++ {
+		readings, err := s.getReadingsWithRetries(ctx, 1)
+		assert.Error(t, err)
+		// the cached readings are still returned
+		assert.Len(t, readings, 1)
+		assert.Empty(t, s.healthChange(time.Now()))
+	}
+	assert.Equal(t, sensorOfflineFailures-1, s.getHealth().failures)
+
+	_, err = s.getReadingsWithRetries(ctx, 1)
+	assert.Error(t, err)
+	h := s.getHealth()
+	assert.True(t, h.offline())
+	msg := s.healthChange(time.Now())
+	assert.True(t, strings.HasPrefix(msg, "📴 cellar is offline since "+h.failingSince.Format("Jan 2 15:04")+": "), msg)
+	// it's reported once
+	_, _ = s.getReadingsWithRetries(ctx, 1)
+	assert.Empty(t, s.healthChange(time.Now()))
+
+	dev.path = path.Join(testDataDir, "temp_sensor_readings", "28_8c")
+	_, err = s.getReadingsWithRetries(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "📶 cellar is back after 1h: 28.8 ℃ 🌡", s.healthChange(h.failingSince.Add(time.Hour)))
+	assert.Empty(t, s.healthChange(time.Now()))
+	assert.Zero(t, s.getHealth().failures)
+}
+
+func Test002_sensorHealthReplies(t *testing.T) {
+	defer setSensors(getSensors())
+
+	attic, _ := newTestSensor("attic", "28-3c01d607ca0a", "29_8c")
+	cellar, cellarDev := newTestSensor("cellar", "10-000802b4a1c2", "minus_10_8_c")
+	shed, _ := newTestSensor("shed", "28-000000000001", "missing")
+	attic.minRead, cellar.minRead, shed.minRead = time.Nanosecond, time.Nanosecond, time.Nanosecond
+	setSensors([]*sensor{attic, cellar, shed})
+
+	reply := func(handler telega.CommandHandler, text string) string {
+		resp, err := handler(context.Background(), &tgbotapi.Message{Text: text, Chat: &tgbotapi.Chat{ID: 1}}, nil)
+		require.NoError(t, err)
+		return resp.(*telega.ChattableText).Text
+	}
+
+	assert.Equal(t, "attic (28-3c01d607ca0a): not read yet\ncellar (10-000802b4a1c2): not read yet\nshed (28-000000000001): not read yet",
+		reply(HandleCommandSensors, "/sensors"))
+
+	_, err := cellar.getReadingsWithRetries(context.Background(), 1)
+	require.NoError(t, err)
+	cellarDev.path = path.Join(testDataDir, "temp_sensor_readings", "crc_no")
+
+	lines := strings.Split(reply(HandleCommandlTemp, "/temp"), "\n")
+	require.Len(t, lines, 3)
+	assert.Regexp(t, `^attic: 29\.8 ℃ 🌡 on [^(]+$`, lines[0])
+	// a stale value is marked with its age
+	assert.Regexp(t, `^cellar: -10\.8 ℃ 🌡 on .+ \(stale, \d+s old: w1 CRC check failed\)$`, lines[1])
+	assert.True(t, strings.HasPrefix(lines[2], "shed: no readings: "), lines[2])
+
+	lines = strings.Split(reply(HandleCommandSensors, "/sensors"), "\n")
+	require.Len(t, lines, 3)
+	assert.Regexp(t, `^attic \(28-3c01d607ca0a\): online, last reading \d+s ago$`, lines[0])
+	assert.Regexp(t, `^cellar \(10-000802b4a1c2\): failing since .+, 1 failed reads: w1 CRC check failed, last reading \d+s ago$`, lines[1])
+	assert.Regexp(t, `^shed \(28-000000000001\): failing since .+, 1 failed reads: `+regexp.QuoteMeta("open "), lines[2])
+
+	status := GetStatus().Sensors
+	require.Len(t, status, 3)
+	assert.False(t, status[0].Offline)
+	assert.Equal(t, 1, status[1].Failures)
+	assert.Equal(t, "w1 CRC check failed", status[1].Error)
+}
+
+func Test003_formatAge(t *testing.T) {
+	assert.Equal(t, "45s", formatAge(45*time.Second+300*time.Millisecond))
+	assert.Equal(t, "12m", formatAge(12*time.Minute+10*time.Second))
+	assert.Equal(t, "2h5m", formatAge(2*time.Hour+5*time.Minute))
+	assert.Equal(t, "1d", formatAge(24*time.Hour))
+}
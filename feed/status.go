@@ -0,0 +1,73 @@
+package feed
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Status is a snapshot of the feeds state.
+type Status struct {
+	Directories []DirectoryStatus `json:"directories"`
+	Sensors     []SensorStatus    `json:"sensors,omitempty"`
+	Resolvers   []ResolverStatus  `json:"resolvers,omitempty"`
+}
+
+// DirectoryStatus describes a monitored directory tree.
+type DirectoryStatus struct {
+	Path    string `json:"path"`
+	Watches int32  `json:"watches"`
+}
+
+// SensorStatus is the last readings and the health of a sensor. Time is zero if the sensor has not been read yet.
+type SensorStatus struct {
+	Sensor   string    `json:"sensor"`
+	ID       string    `json:"id"`
+	Readings []Reading `json:"readings"`
+	// Display are the readings formatted in the display unit, e.g. "70.7 ℉"
+	Display []string  `json:"display"`
+	Time    time.Time `json:"time"`
+	// Failures is the number of failed reads in a row, the sensor is offline after a few
+	Failures     int       `json:"failures"`
+	Offline      bool      `json:"offline"`
+	FailingSince time.Time `json:"failing_since"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// GetStatus returns the current state of the feeds.
+func GetStatus() Status {
+	var s Status
+
+	directoryMonitors.Range(func(k, v interface{}) bool {
+		s.Directories = append(s.Directories, DirectoryStatus{Path: k.(string), Watches: atomic.LoadInt32(&v.(*watchedTree).count)})
+		return true
+	})
+	sort.Slice(s.Directories, func(i, j int) bool { return s.Directories[i].Path < s.Directories[j].Path })
+
+	for _, v := range getSensors() {
+		readings, tm := v.lastReadings()
+		h := v.getHealth()
+		status := SensorStatus{Sensor: v.name, ID: v.dev.ID(), Readings: readings, Time: tm, Failures: h.failures, Offline: h.offline(), FailingSince: h.failingSince}
+		for _, r := range readings {
+			status.Display = append(status.Display, formatQuantity(r.Quantity, r.Value))
+		}
+		if h.lastError != nil {
+			status.Error = h.lastError.Error()
+		}
+		s.Sensors = append(s.Sensors, status)
+	}
+
+	// the resolvers are shown once they've been queried
+	for _, f := range publicIPFamilies {
+		f.mu.Lock()
+		resolvers := f.resolvers
+		f.mu.Unlock()
+		for _, r := range resolvers {
+			if status := r.status(f.name); !status.LastSuccess.IsZero() || !status.LastFailure.IsZero() {
+				s.Resolvers = append(s.Resolvers, status)
+			}
+		}
+	}
+
+	return s
+}
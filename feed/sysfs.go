@@ -0,0 +1,247 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	iioDevicesDir = "bus/iio/devices"
+	hwmonClassDir = "class/hwmon"
+)
+
+// sysfsChannel is an attribute of a quantity and the factor, which converts the sysfs units to quantityUnits.
+type sysfsChannel struct {
+	quantity Quantity
+	name     string
+	factor   float64
+}
+
+var (
+	// iioChannels are in m℃, m% and kPa, as BME280, DHT11 and SHT drivers report them.
+	iioChannels = []sysfsChannel{
+		{quantity: Temperature, name: "in_temp", factor: 0.001},
+		{quantity: Humidity, name: "in_humidityrelative", factor: 0.001},
+		{quantity: Pressure, name: "in_pressure", factor: 10},
+	}
+
+	// hwmonChannels are in m℃ and m%. Devices often have several channels of a kind, the first one is used.
+	hwmonChannels = []sysfsChannel{
+		{quantity: Temperature, name: "temp", factor: 0.001},
+		{quantity: Humidity, name: "humidity", factor: 0.001},
+	}
+)
+
+// readSysfsString returns a trimmed sysfs attribute.
+func readSysfsString(fpath string) (string, error) {
+	b, err := os.ReadFile(fpath)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// readSysfsNumber returns a numeric sysfs attribute. IIO attributes can be fractional, e.g. 101.325 kPa.
+func readSysfsNumber(fpath string) (float64, error) {
+	s, err := readSysfsString(fpath)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// iioSensor is an Industrial I/O device, such as BME280, DHT11 or SHT21.
+type iioSensor struct {
+	id  string
+	dir string
+}
+
+func newIIOSensor(id, dir string) *iioSensor {
+	return &iioSensor{id: id, dir: dir}
+}
+
+// discoverIIOSensors finds IIO devices under the sysfs root, which have temperature, humidity or pressure channels.
+func discoverIIOSensors(root string) ([]Sensor, error) {
+	matches, err := filepath.Glob(filepath.Join(root, iioDevicesDir, "iio:device*"))
+	if err != nil {
+		return nil, err
+	}
+	sortByIndex(matches)
+
+	var ret []Sensor
+	for _, v := range matches {
+		if s := newIIOSensor(filepath.Base(v), v); s.hasChannels() {
+			ret = append(ret, s)
+		}
+	}
+	return ret, nil
+}
+
+// ID is the IIO device directory name, e.g. iio:device0.
+func (s *iioSensor) ID() string {
+	return s.id
+}
+
+// DeviceName is the driver name, e.g. bme280.
+func (s *iioSensor) DeviceName() string {
+	name, _ := readSysfsString(filepath.Join(s.dir, "name"))
+	return name
+}
+
+func (s *iioSensor) hasChannels() bool {
+	for _, ch := range iioChannels {
+		for _, suffix := range []string{"_input", "_raw"} {
+			if _, err := os.Stat(filepath.Join(s.dir, ch.name+suffix)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Read takes readings of all channels the device has.
+func (s *iioSensor) Read(ctx context.Context) ([]Reading, error) {
+	var ret []Reading
+	for _, ch := range iioChannels {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		v, err := s.readChannel(ch.name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", s.id, ch.name, err)
+		}
+		ret = append(ret, Reading{Quantity: ch.quantity, Value: v * ch.factor, Unit: quantityUnits[ch.quantity], Time: time.Now()})
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("%s: no temperature, humidity or pressure channels in %s", s.id, s.dir)
+	}
+	return ret, nil
+}
+
+// readChannel returns the processed value of a channel, or calculates it from the raw one as (raw + offset) * scale.
+func (s *iioSensor) readChannel(name string) (float64, error) {
+	prefix := filepath.Join(s.dir, name)
+	if v, err := readSysfsNumber(prefix + "_input"); !errors.Is(err, fs.ErrNotExist) {
+		return v, err
+	}
+
+	raw, err := readSysfsNumber(prefix + "_raw")
+	if err != nil {
+		return 0, err
+	}
+	offset, err := readSysfsNumber(prefix + "_offset")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	scale, err := readSysfsNumber(prefix + "_scale")
+	if errors.Is(err, fs.ErrNotExist) {
+		scale, err = 1, nil
+	}
+	return (raw + offset) * scale, err
+}
+
+// hwmonSensor is a hardware monitoring device, such as a SHT3x or the SoC thermal zone.
+type hwmonSensor struct {
+	id  string
+	dir string
+}
+
+func newHwmonSensor(id, dir string) *hwmonSensor {
+	return &hwmonSensor{id: id, dir: dir}
+}
+
+// discoverHwmonSensors finds hwmon devices under the sysfs root, which have temperature or humidity inputs.
+func discoverHwmonSensors(root string) ([]Sensor, error) {
+	matches, err := filepath.Glob(filepath.Join(root, hwmonClassDir, "hwmon*"))
+	if err != nil {
+		return nil, err
+	}
+	sortByIndex(matches)
+
+	var ret []Sensor
+	for _, v := range matches {
+		s := newHwmonSensor(filepath.Base(v), v)
+		for _, ch := range hwmonChannels {
+			if len(s.inputs(ch.name)) > 0 {
+				ret = append(ret, s)
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+// ID is the hwmon directory name, e.g. hwmon1.
+func (s *hwmonSensor) ID() string {
+	return s.id
+}
+
+// DeviceName is the driver name, e.g. sht3x or cpu_thermal.
+func (s *hwmonSensor) DeviceName() string {
+	name, _ := readSysfsString(filepath.Join(s.dir, "name"))
+	return name
+}
+
+// inputs returns the input attributes of a kind, e.g. temp1_input, temp2_input.
+func (s *hwmonSensor) inputs(name string) []string {
+	matches, _ := filepath.Glob(filepath.Join(s.dir, name+"[0-9]*_input"))
+	sortByIndex(matches)
+	return matches
+}
+
+// sortByIndex sorts the sysfs paths by the number in their names, so that temp10_input comes after temp2_input.
+func sortByIndex(paths []string) {
+	index := func(p string) int {
+		name := filepath.Base(p)
+		start := strings.IndexAny(name, "0123456789")
+		if start < 0 {
+			return -1
+		}
+		end := start
+		for end < len(name) && name[end] >= '0' && name[end] <= '9' {
+			end++
+		}
+		n, _ := strconv.Atoi(name[start:end])
+		return n
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		if a, b := index(paths[i]), index(paths[j]); a != b {
+			return a < b
+		}
+		return paths[i] < paths[j]
+	})
+}
+
+// Read takes readings of the first temperature and humidity inputs of the device.
+func (s *hwmonSensor) Read(ctx context.Context) ([]Reading, error) {
+	var ret []Reading
+	for _, ch := range hwmonChannels {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		inputs := s.inputs(ch.name)
+		if len(inputs) == 0 {
+			continue
+		}
+		v, err := readSysfsNumber(inputs[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", s.id, filepath.Base(inputs[0]), err)
+		}
+		ret = append(ret, Reading{Quantity: ch.quantity, Value: v * ch.factor, Unit: quantityUnits[ch.quantity], Time: time.Now()})
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("%s: no temperature or humidity inputs in %s", s.id, s.dir)
+	}
+	return ret, nil
+}
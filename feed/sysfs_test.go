@@ -0,0 +1,115 @@
+package feed
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test001_iioDiscovery(t *testing.T) {
+	devices, err := discoverIIOSensors(path.Join(testDataDir, "sys"))
+	require.NoError(t, err)
+	// the accelerometer has no environmental channels
+	require.Len(t, devices, 2)
+	assert.Equal(t, "iio:device0", devices[0].ID())
+	assert.Equal(t, "bme280", devices[0].(namedDevice).DeviceName())
+	assert.Equal(t, "iio:device1", devices[1].ID())
+}
+
+func Test002_iioRead(t *testing.T) {
+	root := path.Join(testDataDir, "sys", iioDevicesDir)
+
+	readings, err := newIIOSensor("iio:device0", path.Join(root, "iio:device0")).Read(context.Background())
+	require.NoError(t, err)
+	require.Len(t, readings, 3)
+	for i, v := range []struct {
+		quantity Quantity
+		value    float64
+		unit     string
+	}{
+		{quantity: Temperature, value: 21.34, unit: "℃"},
+		{quantity: Humidity, value: 45.23, unit: "%"},
+		{quantity: Pressure, value: 1013.25, unit: "hPa"},
+	} {
+		assert.Equal(t, v.quantity, readings[i].Quantity)
+		assert.InDelta(t, v.value, readings[i].Value, 1e-9)
+		assert.Equal(t, v.unit, readings[i].Unit)
+		assert.WithinDuration(t, time.Now(), readings[i].Time, time.Second)
+	}
+
+	// (raw + offset) * scale
+	readings, err = newIIOSensor("iio:device1", path.Join(root, "iio:device1")).Read(context.Background())
+	require.NoError(t, err)
+	require.Len(t, readings, 1)
+	assert.Equal(t, Humidity, readings[0].Quantity)
+	assert.InDelta(t, 44.0, readings[0].Value, 1e-9)
+
+	_, err = newIIOSensor("iio:device2", path.Join(root, "iio:device2")).Read(context.Background())
+	assert.Error(t, err)
+	_, err = newIIOSensor("iio:device9", path.Join(root, "iio:device9")).Read(context.Background())
+	assert.Error(t, err)
+}
+
+func Test003_iioReadError(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(dir, "in_temp_input"), []byte("timeout\n"), 0o644))
+
+	_, err := newIIOSensor("iio:device0", dir).Read(context.Background())
+	assert.Error(t, err)
+}
+
+func Test004_hwmonRead(t *testing.T) {
+	devices, err := discoverHwmonSensors(path.Join(testDataDir, "sys"))
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	assert.Equal(t, "cpu_thermal", devices[0].(namedDevice).DeviceName())
+
+	// only the first temperature input is read
+	readings, err := devices[1].Read(context.Background())
+	require.NoError(t, err)
+	require.Len(t, readings, 2)
+	assert.Equal(t, Temperature, readings[0].Quantity)
+	assert.InDelta(t, 19.875, readings[0].Value, 1e-9)
+	assert.Equal(t, Humidity, readings[1].Quantity)
+	assert.InDelta(t, 61.25, readings[1].Value, 1e-9)
+
+	// the inputs are in the order of their numbers
+	dir := t.TempDir()
+	for _, v := range []string{"temp10_input", "temp2_input", "temp3_input"} {
+		require.NoError(t, os.WriteFile(path.Join(dir, v), []byte("20000\n"), 0644))
+	}
+	inputs := newHwmonSensor("hwmon2", dir).inputs("temp")
+	assert.Equal(t, []string{path.Join(dir, "temp2_input"), path.Join(dir, "temp3_input"), path.Join(dir, "temp10_input")}, inputs)
+	paths := []string{"hwmon10", "hwmon2", "hwmon1"}
+	sortByIndex(paths)
+	assert.Equal(t, []string{"hwmon1", "hwmon2", "hwmon10"}, paths)
+}
+
+func Test005_hwmonConfigured(t *testing.T) {
+	defer setSensors(getSensors())
+	root := path.Join(testDataDir, "sys")
+
+	// hwmon devices are not used unless configured
+	require.NoError(t, ConfigureSensors(root, ""))
+	assert.Nil(t, findSensor("hwmon0"))
+	assert.Nil(t, findSensor("hwmon1"))
+
+	require.NoError(t, ConfigureSensors(root, "cpu=hwmon0;garage=sht3x;outside=bme280;shed=bmp280"))
+	assert.Equal(t, "hwmon0", findSensor("cpu").dev.ID())
+	assert.Equal(t, "hwmon1", findSensor("garage").dev.ID())
+	assert.Equal(t, "iio:device0", findSensor("outside").dev.ID())
+	// a missing device can't be made up by its driver name
+	assert.Nil(t, findSensor("shed"))
+
+	resetAlerts(t, "")
+	s := findSensor("garage")
+	s.minRead = time.Nanosecond
+	setSensors([]*sensor{s})
+	assert.Equal(t, "19.9 ℃ 🌡 61.2 % 💧", TemperatureMonitor(context.Background()))
+	assert.Empty(t, TemperatureMonitor(context.Background()))
+}
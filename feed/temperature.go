@@ -1,111 +1,387 @@
 package feed
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"fmt"
-	"log"
-	"math"
-	"os"
-	"strconv"
+	"log/slog"
+	"path/filepath"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
-	"io"
-
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/history"
 	"github.com/skrassiev/meerkat/telega"
 )
 
 const (
-	sensorDevicePath                      = "/sys/bus/w1/devices/28-3c01d607ca0a/w1_slave"
-	sensorDevicePathKey                   = "device-path"
-	sensorMinReadingIntervalPathKey       = "min-read"
-	errTemp                         int32 = -1000
-	maxRetries                            = 10
-	minRereshInterval                     = 5 * time.Second
-	monitoredTemperatureDiff              = 500
+	maxRetries        = 10
+	minRereshInterval = 5 * time.Second
+)
+
+// Quantity is a physical quantity measured by a sensor.
+type Quantity string
+
+// Quantities the sensors measure.
+const (
+	Temperature Quantity = "temperature"
+	Humidity    Quantity = "humidity"
+	Pressure    Quantity = "pressure"
 )
 
 var (
-	lastTemp             = errTemp
-	lastTime             = time.Now().Local().Add(-minRereshInterval)
-	lastTimeMutex        sync.RWMutex
-	monitoredTemperature = int32(-10.0)
+	// SysfsRoot is where sensors are discovered. Tests point it to testdata/sys.
+	SysfsRoot = "/sys"
+
+	// quantityUnits are the units of the readings. Backends convert sysfs values to them, formatQuantity shows
+	// temperatures in the display unit.
+	quantityUnits = map[Quantity]string{Temperature: "℃", Humidity: "%", Pressure: "hPa"}
+
+	quantityIcons = map[Quantity]string{Temperature: " 🌡", Humidity: " 💧"}
+
+	// monitoredChanges are the changes since the last report, which the monitor reports by default.
+	monitoredChanges = map[Quantity]float64{Temperature: 0.5, Humidity: 5, Pressure: 2}
+
+	// configuredSensors are the sensors /temp and the temperature monitor report.
+	configuredSensors   []*sensor
+	configuredSensorsMu sync.RWMutex
 )
 
-// HandlerCommandTemp reads temp from a sensor and reponds in a telegram message.
-func HandleCommandlTemp(ctx context.Context, cmd *tgbotapi.Message, _ *tgbotapi.BotAPI) (response telega.ChattableCloser, _ error) {
-	v, ts, _ := getTemperatureReadingWithRetries(ctx, sensorDevicePath, 10)
-	// Now that we know we've gotten a new message, we can construct a
-	// reply! We'll take the Chat ID and Text from the incoming message
-	// and use it to create a new message.
-	r := tgbotapi.NewMessage(cmd.Chat.ID, fmt.Sprintf("%.1f ℃ 🌡 on %v", float32(v)/1000.0, ts.Format("Jan 2 15:04:05")))
-	// We'll also say that this message is a reply to the previous message.
-	// For any other specifications than Chat ID or Text, you'll need to
-	// set fields on the `MessageConfig`.
-	// msg.ReplyToMessageID = update.Message.MessageID
-	return &telega.ChattableText{MessageConfig: r}, nil
+// Reading is a single measurement of a quantity.
+type Reading struct {
+	Quantity Quantity  `json:"quantity"`
+	Value    float64   `json:"value"`
+	Unit     string    `json:"unit"`
+	Time     time.Time `json:"time"`
+}
+
+// String formats the reading for chat messages, e.g. "21.5 ℃ 🌡".
+func (r Reading) String() string {
+	return formatQuantity(r.Quantity, r.Value) + quantityIcons[r.Quantity]
+}
+
+// Sensor is a device, which measures one or more quantities.
+type Sensor interface {
+	// ID identifies the device, e.g. 28-3c01d607ca0a, iio:device0 or hwmon1.
+	ID() string
+	// Read takes a fresh reading of every quantity the device measures.
+	Read(ctx context.Context) ([]Reading, error)
+}
+
+// namedDevice is implemented by sensors with a driver-assigned name, such as bme280. Unlike IIO and hwmon IDs,
+// the name does not change across reboots, so sensors can be configured by it.
+type namedDevice interface {
+	DeviceName() string
 }
 
-func scanTemperatureReading(reader io.Reader) (int32, error) {
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		ss := strings.Split(strings.TrimSpace(scanner.Text()), " ")
-		if len(ss) > 1 {
-			ts := ss[len(ss)-1]
-			if strings.HasPrefix(ts, "t=") {
-				st := strings.Split(ts, "=")
-				if len(st) == 2 {
-					ret, err := strconv.ParseInt(st[1], 10, 32)
-					if err != nil {
-						log.Println(err, st[1])
-						return errTemp, err
-					}
-					log.Println("scanned temp", ret)
-					return int32(ret), nil
-				}
-				log.Println("could not parse", ts)
-				return errTemp, fmt.Errorf("could not parse %v", ts)
+// sensor is a named Sensor with its own reading cache and health.
+type sensor struct {
+	name        string
+	dev         Sensor
+	minRead     time.Duration
+	calibration map[Quantity]calibration
+	filter      *readingFilter
+
+	mu       sync.RWMutex
+	last     []Reading
+	lastTime time.Time
+	health   sensorHealth
+}
+
+func newSensor(name string, dev Sensor) *sensor {
+	return &sensor{
+		name:    name,
+		dev:     dev,
+		minRead: minRereshInterval,
+	}
+}
+
+// sensorConfig is a name and settings assigned to a sensor ID.
+type sensorConfig struct {
+	name     string
+	id       string
+	settings map[string]string
+}
+
+// parseSensorConfig parses a list of sensors in the form "name=id[,key=value...][;name=id...]", e.g.
+// "attic=28-3c01d607ca0a,min-read=10s,offset=-0.7,filter=median:5;cellar=28-0316a2795fff".
+func parseSensorConfig(spec string) ([]sensorConfig, error) {
+	var ret []sensorConfig
+
+	for _, entry := range strings.Split(spec, ";") {
+		if len(strings.TrimSpace(entry)) == 0 {
+			continue
+		}
+
+		var cfg sensorConfig
+		for i, field := range strings.Split(entry, ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+				return nil, fmt.Errorf("invalid sensor setting %q", field)
+			}
+			if i == 0 {
+				cfg.name, cfg.id = kv[0], kv[1]
+				continue
+			}
+			if cfg.settings == nil {
+				cfg.settings = make(map[string]string)
+			}
+			cfg.settings[kv[0]] = kv[1]
+		}
+		ret = append(ret, cfg)
+	}
+
+	return ret, nil
+}
+
+// applySettings configures a sensor. Unknown settings are an error to catch typos.
+func (s *sensor) applySettings(settings map[string]string) error {
+	for k, v := range settings {
+		switch k {
+		case "min-read":
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("sensor %s: invalid %s: %w", s.name, k, err)
+			}
+			s.minRead = d
+		case "filter":
+			f, err := parseFilter(v)
+			if err != nil {
+				return fmt.Errorf("sensor %s: %w", s.name, err)
+			}
+			s.filter = f
+		default:
+			q, offset, ok := parseCalibrationSetting(k)
+			if !ok {
+				return fmt.Errorf("sensor %s: unknown setting %s", s.name, k)
+			}
+			if err := s.setCalibration(q, offset, v); err != nil {
+				return fmt.Errorf("sensor %s: invalid %s: %w", s.name, k, err)
 			}
 		}
 	}
+	return nil
+}
 
-	log.Println("no temp pattern found")
+// matchDevice returns the device with the ID, or the only device with the driver name.
+func matchDevice(devices []Sensor, id string) (Sensor, error) {
+	var ret []Sensor
+	for _, v := range devices {
+		if v.ID() == id {
+			return v, nil
+		}
+		if d, ok := v.(namedDevice); ok && d.DeviceName() == id {
+			ret = append(ret, v)
+		}
+	}
+	switch len(ret) {
+	case 0:
+		return nil, nil
+	case 1:
+		return ret[0], nil
+	}
+	return nil, fmt.Errorf("there are %d %s sensors, use an ID to select one", len(ret), id)
+}
 
-	return errTemp, errors.New("no temp pattern found")
+// newDeviceByID makes a sensor, which is not present yet, if the ID tells its type.
+func newDeviceByID(root, id string) Sensor {
+	switch {
+	case isW1ID(id):
+		return newW1Sensor(id, filepath.Join(root, w1DevicesDir, id, w1SlaveFile))
+	case strings.HasPrefix(id, "iio:device"):
+		return newIIOSensor(id, filepath.Join(root, iioDevicesDir, id))
+	case strings.HasPrefix(id, "hwmon"):
+		return newHwmonSensor(id, filepath.Join(root, hwmonClassDir, id))
+	}
+	return nil
 }
 
-func getTemperatureReading(fpath string) (int32, error) {
-	f, err := os.Open(fpath)
+// ConfigureSensors discovers sensors under root and assigns names and settings from spec.
+// 1-Wire and IIO sensors are used as found, hwmon devices, like the CPU thermal zone, only if they are configured.
+// Configured sensors, which are not found, are still used if the ID tells the sensor type: the device might show up later.
+func ConfigureSensors(root, spec string) error {
+	configs, err := parseSensorConfig(spec)
 	if err != nil {
-		return errTemp, err
+		return err
+	}
+
+	var auto, optional []Sensor
+	for _, discover := range []func(string) ([]Sensor, error){discoverW1Sensors, discoverIIOSensors} {
+		found, err := discover(root)
+		if err != nil {
+			return err
+		}
+		auto = append(auto, found...)
+	}
+	if optional, err = discoverHwmonSensors(root); err != nil {
+		return err
+	}
+	all := append(append([]Sensor{}, auto...), optional...)
+
+	var sensors []*sensor
+	byDevice := make(map[Sensor]*sensor)
+	for _, v := range auto {
+		s := newSensor(v.ID(), v)
+		sensors = append(sensors, s)
+		byDevice[v] = s
+	}
+
+	names := make(map[string]struct{})
+	for _, cfg := range configs {
+		if _, dup := names[cfg.name]; dup {
+			return fmt.Errorf("duplicate sensor name %s", cfg.name)
+		}
+		names[cfg.name] = struct{}{}
+
+		dev, err := matchDevice(all, cfg.id)
+		if err != nil {
+			return fmt.Errorf("sensor %s: %w", cfg.name, err)
+		}
+		if dev == nil {
+			slog.Warn("configured sensor not found", "feed", "temperature", "sensor", cfg.name, "id", cfg.id)
+			if dev = newDeviceByID(root, cfg.id); dev == nil {
+				continue
+			}
+		}
+
+		s, found := byDevice[dev]
+		if !found {
+			s = newSensor(cfg.name, dev)
+			sensors = append(sensors, s)
+			byDevice[dev] = s
+		}
+		s.name = cfg.name
+		if err = s.applySettings(cfg.settings); err != nil {
+			return err
+		}
 	}
 
-	defer func() { _ = f.Close() }()
-	return scanTemperatureReading(f)
+	for _, v := range sensors {
+		slog.Info("sensor", "feed", "temperature", "sensor", v.name, "id", v.dev.ID())
+	}
+
+	setSensors(sensors)
+	return nil
+}
+
+func setSensors(sensors []*sensor) {
+	configuredSensorsMu.Lock()
+	configuredSensors = sensors
+	configuredSensorsMu.Unlock()
 }
 
-func getTemperatureReadingWithRetries(ctx context.Context, fpath string, retries int) (temperature int32, timestamp time.Time, err error) {
+func getSensors() []*sensor {
+	configuredSensorsMu.RLock()
+	defer configuredSensorsMu.RUnlock()
+	return configuredSensors
+}
 
-	var refreshInterval = func() time.Duration {
-		if p, ok := ctx.Value(sensorMinReadingIntervalPathKey).(time.Duration); ok {
-			return p
+// findSensor looks a sensor up by its name or ID.
+func findSensor(name string) *sensor {
+	for _, v := range getSensors() {
+		if v.name == name || v.dev.ID() == name {
+			return v
 		}
-		return minRereshInterval
 	}
+	return nil
+}
 
+// commandArgs returns the words following the command.
+func commandArgs(cmd *tgbotapi.Message) []string {
+	if args := strings.Fields(cmd.Text); len(args) > 1 {
+		return args[1:]
+	}
+	return nil
+}
+
+// formatReadings joins readings of a sensor, e.g. "21.5 ℃ 🌡, 45.0 % 💧".
+func formatReadings(readings []Reading, sep string) string {
+	parts := make([]string, 0, len(readings))
+	for _, v := range readings {
+		parts = append(parts, v.String())
+	}
+	return strings.Join(parts, sep)
+}
+
+// HandlerCommandTemp reads all sensors, or the one named in the argument, and reponds in a telegram message.
+// With a window argument, such as /temp 24h or /temp attic 7d, it summarizes the history instead.
+func HandleCommandlTemp(ctx context.Context, cmd *tgbotapi.Message, _ *tgbotapi.BotAPI) (response telega.ChattableCloser, _ error) {
+	var window time.Duration
+	sensors := getSensors()
+	for _, arg := range commandArgs(cmd) {
+		if d, err := history.ParseDuration(arg); err == nil {
+			window = d
+			continue
+		}
+		s := findSensor(arg)
+		if s == nil {
+			return &telega.ChattableText{MessageConfig: tgbotapi.NewMessage(cmd.Chat.ID, "unknown sensor "+arg)}, nil
+		}
+		sensors = []*sensor{s}
+	}
+
+	if len(sensors) == 0 {
+		return &telega.ChattableText{MessageConfig: tgbotapi.NewMessage(cmd.Chat.ID, "no temperature sensors")}, nil
+	}
+
+	if window > 0 {
+		return &telega.ChattableText{MessageConfig: tgbotapi.NewMessage(cmd.Chat.ID, historyReply(sensors, window))}, nil
+	}
+
+	lines := make([]string, 0, len(sensors))
+	for _, s := range sensors {
+		line := "no readings"
+		readings, err := s.getReadingsWithRetries(ctx, 10)
+		if len(readings) > 0 {
+			line = formatReadings(readings, ", ") + " on " + readings[0].Time.Format("Jan 2 15:04:05") + staleNote(readings[0].Time, err)
+		} else if err != nil {
+			line = fmt.Sprintf("no readings: %v", err)
+		}
+		if len(getSensors()) > 1 {
+			line = s.name + ": " + line
+		}
+		lines = append(lines, line)
+	}
+
+	// Now that we know we've gotten a new message, we can construct a
+	// reply! We'll take the Chat ID and Text from the incoming message
+	// and use it to create a new message.
+	r := tgbotapi.NewMessage(cmd.Chat.ID, strings.Join(lines, "\n"))
+	// We'll also say that this message is a reply to the previous message.
+	// For any other specifications than Chat ID or Text, you'll need to
+	// set fields on the `MessageConfig`.
+	// msg.ReplyToMessageID = update.Message.MessageID
+	return &telega.ChattableText{MessageConfig: r}, nil
+}
+
+// read takes readings from the device. Rejected readings are counted by the reason.
+func (s *sensor) read(ctx context.Context) ([]Reading, error) {
+	readings, err := s.dev.Read(ctx)
+	for _, reason := range rejectionReasons {
+		if errors.Is(err, reason) {
+			slog.Warn("rejected sensor reading", "feed", "temperature", "sensor", s.name, "err", err)
+			readingsRejected.With(s.name, reason.Error()).Inc()
+			break
+		}
+	}
+	return readings, err
+}
+
+// lastReadings returns the cached readings.
+func (s *sensor) lastReadings() ([]Reading, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.last, s.lastTime
+}
+
+// getReadingsWithRetries returns fresh readings, or the cached ones along with the error if the device fails.
+func (s *sensor) getReadingsWithRetries(ctx context.Context, retries int) (readings []Reading, err error) {
 	// do not allow more frequent polls
-	lastTimeMutex.RLock()
-	if time.Since(lastTime) < refreshInterval() {
-		defer lastTimeMutex.RUnlock()
-		return atomic.LoadInt32(&lastTemp), lastTime, nil
+	last, lastTime := s.lastReadings()
+	if time.Since(lastTime) < s.minRead {
+		return last, nil
 	}
-	timestamp = lastTime
-	lastTimeMutex.RUnlock()
 
 	if retries > maxRetries {
 		retries = maxRetries
@@ -114,11 +390,8 @@ func getTemperatureReadingWithRetries(ctx context.Context, fpath string, retries
 	}
 
 	for ; retries >= 0; retries-- {
-		if temperature, err = getTemperatureReading(fpath); err == nil {
-			// sometimes the temperature is just not refreshed by a sensor. Retry few times
-			if lt := atomic.LoadInt32(&lastTemp); lt != temperature {
-				break
-			}
+		if readings, err = s.read(ctx); err == nil {
+			break
 		}
 		select {
 		case <-time.After(100 * time.Millisecond):
@@ -127,36 +400,51 @@ func getTemperatureReadingWithRetries(ctx context.Context, fpath string, retries
 		}
 	}
 
-	if err == nil {
-		atomic.StoreInt32(&lastTemp, temperature)
-		lastTimeMutex.Lock()
-		lastTime = time.Now() // ignore concurrency issues
-		timestamp = lastTime
-		lastTimeMutex.Unlock()
-	} else {
-		temperature = atomic.LoadInt32(&lastTemp)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recordRead(err, time.Now())
+	if err != nil {
+		return s.last, err
 	}
 
-	return
-}
+	readings = s.calibrate(readings)
 
-// TemperatureMonitor 's for temp changes over the threshold
-func TemperatureMonitor(ctx context.Context) string {
-	var devicePath = func() string {
-		if p, ok := ctx.Value(sensorDevicePathKey).(string); ok {
-			return p
+	for _, v := range readings {
+		if gauge, found := sensorGauges[v.Quantity]; found {
+			gauge.With(s.name).Set(v.Value)
 		}
-		return sensorDevicePath
 	}
+	s.last = readings
+	s.lastTime = time.Now()
+	return readings, nil
+}
 
-	v, _, err := getTemperatureReadingWithRetries(ctx, devicePath(), 10)
-	if err != nil {
-		return onError("error reading temperature", err)
+// TemperatureMonitor 's for sensor readings changes over the thresholds, for the alert rules and for sensors going
+// offline. Changes are reported on a single line, alerts and the sensor health on lines of their own.
+func TemperatureMonitor(ctx context.Context) string {
+	sensors := getSensors()
+
+	var changes, messages []string
+	for _, s := range sensors {
+		readings, err := s.getReadingsWithRetries(ctx, 10)
+		if msg := s.healthChange(time.Now()); len(msg) > 0 {
+			messages = append(messages, msg)
+		}
+		if err != nil {
+			onError("error reading sensor "+s.name, err)
+			continue
+		}
+		changed, alerted := alerts.check(s, readings, time.Now())
+		messages = append(messages, alerted...)
+		if msg := formatReadings(changed, " "); len(msg) > 0 {
+			if len(sensors) > 1 {
+				msg = s.name + " " + msg
+			}
+			changes = append(changes, msg)
+		}
 	}
-	log.Println("temperature monitor: prev:", monitoredTemperature, "curr:", v)
-	if math.Abs(float64(v-monitoredTemperature)) > monitoredTemperatureDiff {
-		monitoredTemperature = v
-		return fmt.Sprintf("%.1f ℃ 🌡", float32(v)/1000.0)
+	if len(changes) > 0 {
+		messages = append([]string{strings.Join(changes, ", ")}, messages...)
 	}
-	return ""
+	return strings.Join(messages, "\n")
 }
@@ -8,9 +8,14 @@ import (
 	"testing"
 	"time"
 
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/telega"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+const testSensorPath = "sys/bus/w1/devices/28-3c01d607ca0a/w1_slave"
+
 var testDataDir = func() string {
 	_, err := os.Stat("testdata")
 	if os.IsNotExist(err) {
@@ -39,67 +44,179 @@ func Test002_tempParseGood(t *testing.T) {
 }
 
 func Test003_tempParseFile(t *testing.T) {
-	v, err := getTemperatureReading(testDataDir + sensorDevicePath)
+	v, err := getTemperatureReading(path.Join(testDataDir, testSensorPath))
 	assert.NoError(t, err)
 	assert.Equal(t, int32(29812), v)
 
 }
 
+// newTestSensor is a 1-Wire sensor, which reads the fixture.
+func newTestSensor(name, id, reading string) (*sensor, *w1Sensor) {
+	dev := newW1Sensor(id, path.Join(testDataDir, "temp_sensor_readings", reading))
+	return newSensor(name, dev), dev
+}
+
 func Test004_tempParseFilePersistent(t *testing.T) {
 	ctx := context.Background()
+	s := newSensor("attic", newW1Sensor("28-3c01d607ca0a", path.Join(testDataDir, testSensorPath)))
 
-	v, ts, err := getTemperatureReadingWithRetries(ctx, testDataDir+sensorDevicePath, 11)
-	assert.NoError(t, err)
-	assert.LessOrEqual(t, time.Now().Sub(ts).Seconds(), 5.0)
-	assert.Equal(t, int32(29812), v)
+	readings, err := s.getReadingsWithRetries(ctx, 11)
+	require.NoError(t, err)
+	require.Len(t, readings, 1)
+	assert.LessOrEqual(t, time.Now().Sub(readings[0].Time).Seconds(), 5.0)
+	assert.Equal(t, Temperature, readings[0].Quantity)
+	assert.Equal(t, 29.812, readings[0].Value)
+	assert.Equal(t, "29.8 ℃ 🌡", readings[0].String())
 
-	v, _, err = getTemperatureReadingWithRetries(ctx, testDataDir+sensorDevicePath, 1000)
+	readings, err = s.getReadingsWithRetries(ctx, 1000)
 	assert.NoError(t, err)
-	assert.Equal(t, int32(29812), v)
+	assert.Equal(t, 29.812, readings[0].Value)
 
-	lastTime = time.Now().Add(-minRereshInterval)
-	v, _, err = getTemperatureReadingWithRetries(ctx, testDataDir+sensorDevicePath, -1)
+	s.lastTime = time.Now().Add(-minRereshInterval)
+	readings, err = s.getReadingsWithRetries(ctx, -1)
 	assert.NoError(t, err)
-	assert.Equal(t, int32(29812), v)
-
-	lastTime = time.Now().Add(-minRereshInterval)
-	lastTemp = errTemp
-	v, _, err = getTemperatureReadingWithRetries(ctx, testDataDir+sensorDevicePath, 0)
-	assert.NoError(t, err)
-	assert.Equal(t, int32(29812), v)
+	assert.Equal(t, 29.812, readings[0].Value)
+
+	// the cached reading is returned if the sensor fails
+	s.lastTime = time.Now().Add(-minRereshInterval)
+	s.dev.(*w1Sensor).path = path.Join(testDataDir, "nonexistent")
+	readings, err = s.getReadingsWithRetries(ctx, 0)
+	assert.Error(t, err)
+	assert.Equal(t, 29.812, readings[0].Value)
 }
 
 func Test005_tempMonitorChanges(t *testing.T) {
 
 	const (
-		datapath = "temp_sensor_readings/"
-		t88      = "28_8c"
-		t95      = "29_5c"
-		t98      = "29_8c"
-		tr28     = "32_8c"
-		m108     = "minus_10_8_c"
-		m104     = "minus_10_4_c"
+		t88  = "28_8c"
+		t95  = "29_5c"
+		t98  = "29_8c"
+		tr28 = "32_8c"
+		m108 = "minus_10_8_c"
+		m104 = "minus_10_4_c"
 	)
 
-	var noDelayCtx = func() context.Context {
-		return context.WithValue(context.Background(), sensorMinReadingIntervalPathKey, 1*time.Nanosecond)
+	defer setSensors(getSensors())
+	resetAlerts(t, "")
+
+	s, dev := newTestSensor("attic", "28-3c01d607ca0a", "")
+	s.minRead = time.Nanosecond
+	setSensors([]*sensor{s})
+
+	var monitor = func(reading string) string {
+		dev.path = path.Join(testDataDir, "temp_sensor_readings", reading)
+		return TemperatureMonitor(context.Background())
 	}
 
-	ctx := context.WithValue(noDelayCtx(), sensorDevicePathKey, path.Join(testDataDir, datapath, t98))
-	assert.True(t, strings.HasPrefix(TemperatureMonitor(ctx), "29.8"))
+	assert.True(t, strings.HasPrefix(monitor(t98), "29.8"))
+	assert.Empty(t, monitor(t95))
+	assert.True(t, strings.HasPrefix(monitor(t88), "28.8"))
+	assert.True(t, strings.HasPrefix(monitor(tr28), "32.8"))
+	assert.True(t, strings.HasPrefix(monitor(m108), "-10.8"))
+	assert.Empty(t, monitor(m104))
+}
+
+func Test006_tempMonitorSensorsIndependent(t *testing.T) {
+	defer setSensors(getSensors())
+	resetAlerts(t, "")
 
-	ctx = context.WithValue(noDelayCtx(), sensorDevicePathKey, path.Join(testDataDir, datapath, t95))
-	assert.Empty(t, TemperatureMonitor(ctx))
+	attic, atticDev := newTestSensor("attic", "28-3c01d607ca0a", "29_8c")
+	cellar, cellarDev := newTestSensor("cellar", "10-000802b4a1c2", "minus_10_8_c")
+	attic.minRead, cellar.minRead = time.Nanosecond, time.Nanosecond
+	setSensors([]*sensor{attic, cellar})
 
-	ctx = context.WithValue(noDelayCtx(), sensorDevicePathKey, path.Join(testDataDir, datapath, t88))
-	assert.True(t, strings.HasPrefix(TemperatureMonitor(ctx), "28.8"))
+	assert.Equal(t, "attic 29.8 ℃ 🌡, cellar -10.8 ℃ 🌡", TemperatureMonitor(context.Background()))
 
-	ctx = context.WithValue(noDelayCtx(), sensorDevicePathKey, path.Join(testDataDir, datapath, tr28))
-	assert.True(t, strings.HasPrefix(TemperatureMonitor(ctx), "32.8"))
+	cellarDev.path = path.Join(testDataDir, "temp_sensor_readings", "minus_10_4_c")
+	assert.Empty(t, TemperatureMonitor(context.Background()))
 
-	ctx = context.WithValue(noDelayCtx(), sensorDevicePathKey, path.Join(testDataDir, datapath, m108))
-	assert.True(t, strings.HasPrefix(TemperatureMonitor(ctx), "-10.8"))
+	atticDev.path = path.Join(testDataDir, "temp_sensor_readings", "28_8c")
+	assert.Equal(t, "attic 28.8 ℃ 🌡", TemperatureMonitor(context.Background()))
+}
 
-	ctx = context.WithValue(noDelayCtx(), sensorDevicePathKey, path.Join(testDataDir, datapath, m104))
-	assert.Empty(t, TemperatureMonitor(ctx))
+func Test007_tempSensorsDiscovery(t *testing.T) {
+	defer setSensors(getSensors())
+	root := path.Join(testDataDir, "sys")
+
+	devices, err := discoverW1Sensors(root)
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	assert.Equal(t, "10-000802b4a1c2", devices[0].ID())
+	assert.Equal(t, "28-3c01d607ca0a", devices[1].ID())
+
+	require.NoError(t, ConfigureSensors(root, "attic=28-3c01d607ca0a,min-read=1m; shed=28-000000000001"))
+	sensors := getSensors()
+	require.Len(t, sensors, 5)
+	assert.Equal(t, "10-000802b4a1c2", sensors[0].name)
+	assert.Equal(t, "attic", sensors[1].name)
+	assert.Equal(t, time.Minute, sensors[1].minRead)
+	assert.Equal(t, "iio:device0", sensors[2].name)
+	assert.Equal(t, "iio:device1", sensors[3].name)
+	assert.Equal(t, "shed", sensors[4].name)
+	assert.Same(t, sensors[1], findSensor("attic"))
+	assert.Same(t, sensors[1], findSensor("28-3c01d607ca0a"))
+	assert.Nil(t, findSensor("cellar"))
+
+	for _, v := range []string{"attic", "attic=28-1,min-read=soon", "attic=28-1,colour=red", "a=28-1;a=28-2"} {
+		assert.Error(t, ConfigureSensors(root, v), v)
+	}
+}
+
+func Test008_tempCommand(t *testing.T) {
+	defer setSensors(getSensors())
+	require.NoError(t, ConfigureSensors(path.Join(testDataDir, "sys"), "attic=28-3c01d607ca0a;cellar=10-000802b4a1c2;outside=bme280"))
+
+	reply := func(text string) string {
+		resp, err := HandleCommandlTemp(context.Background(), &tgbotapi.Message{Text: text, Chat: &tgbotapi.Chat{ID: 1}}, nil)
+		require.NoError(t, err)
+		return resp.(*telega.ChattableText).Text
+	}
+
+	lines := strings.Split(reply("/temp"), "\n")
+	require.Len(t, lines, 4)
+	assert.True(t, strings.HasPrefix(lines[0], "cellar: 4.5 ℃"), lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "attic: 29.8 ℃"), lines[1])
+	assert.True(t, strings.HasPrefix(lines[2], "outside: 21.3 ℃ 🌡, 45.2 % 💧, 1013.2 hPa on "), lines[2])
+	assert.True(t, strings.HasPrefix(lines[3], "iio:device1: 44.0 % 💧 on "), lines[3])
+
+	assert.True(t, strings.HasPrefix(reply("/temp attic"), "attic: 29.8 ℃"))
+	assert.Equal(t, "unknown sensor shed", reply("/temp shed"))
+
+	status := GetStatus().Sensors
+	require.Len(t, status, 4)
+	assert.Equal(t, "outside", status[2].Sensor)
+	assert.Equal(t, "iio:device0", status[2].ID)
+	assert.Len(t, status[2].Readings, 3)
+	assert.False(t, status[2].Time.IsZero())
+}
+
+func Test009_tempCRCAndResetRejected(t *testing.T) {
+	for _, v := range []struct {
+		reading string
+		err     error
+	}{
+		{reading: "crc_no", err: errCRCMismatch},
+		{reading: "crc_no_zeroes", err: errCRCMismatch},
+		{reading: "power_on_reset_85c", err: errPowerOnReset},
+		{reading: "out_of_range_128c", err: errOutOfRange},
+	} {
+		s, dev := newTestSensor("attic", "28-3c01d607ca0a", v.reading)
+		rejected := readingsRejected.With("attic", v.err.Error()).Value()
+
+		_, err := dev.read()
+		assert.ErrorIs(t, err, v.err, v.reading)
+
+		// a rejected reading is retried, then the cached value is returned
+		s.last = []Reading{{Quantity: Temperature, Value: 20}}
+		readings, err := s.getReadingsWithRetries(context.Background(), 2)
+		assert.ErrorIs(t, err, v.err, v.reading)
+		assert.Equal(t, s.last, readings)
+		assert.Equal(t, rejected+3, readingsRejected.With("attic", v.err.Error()).Value(), v.reading)
+	}
+
+	// MAX31850 thermocouples measure well above 85 ℃
+	_, dev := newTestSensor("kiln", "3b-0000001a2b3c", "power_on_reset_85c")
+	v, err := dev.read()
+	assert.NoError(t, err)
+	assert.Equal(t, int32(85000), v)
 }
@@ -0,0 +1,379 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/history"
+	"github.com/skrassiev/meerkat/telega"
+)
+
+const (
+	thermostatStateFilename = "thermostat.json"
+	thermostatInterval      = time.Minute
+	// the setpoint and the hysteresis are limited in ℃, so that a typo does not keep the heater on
+	minSetpoint   = -10.0
+	maxSetpoint   = 50.0
+	maxHysteresis = 10.0
+)
+
+// thermostatSettings are changed by the chat commands and persisted.
+type thermostatSettings struct {
+	// Setpoint is in ℃
+	Setpoint float64 `json:"setpoint"`
+	Enabled  bool    `json:"enabled"`
+}
+
+// thermostat switches a heater to keep a sensor around the setpoint. The heater is on below setpoint-hysteresis/2
+// and off above setpoint+hysteresis/2, but it's neither switched sooner than minOn and minOff, nor kept on longer
+// than maxRuntime. It's turned off if the sensor fails.
+type thermostat struct {
+	sensor     string
+	relay      relay
+	hysteresis float64
+	minOn      time.Duration
+	minOff     time.Duration
+	maxRuntime time.Duration
+	stateFile  string
+
+	mu       sync.Mutex
+	settings thermostatSettings
+	on       bool
+	// since is the last switch time, zero before the first one
+	since   time.Time
+	last    Reading
+	lastErr error
+	// relayFailing is set after a failed switch, to notify once about a broken relay
+	relayFailing bool
+}
+
+var activeThermostat atomic.Pointer[thermostat]
+
+// parseThermostat parses the settings in the form "sensor=name,setpoint=5[,key=value...]". The keys are hysteresis,
+// min-on, min-off, max-runtime, gpio and active-low. The temperatures are in the display unit.
+func parseThermostat(root, spec, onCommand, offCommand string) (*thermostat, error) {
+	t := &thermostat{
+		hysteresis: deltaFromDisplay(Temperature, 1),
+		minOn:      5 * time.Minute,
+		minOff:     5 * time.Minute,
+		maxRuntime: 4 * time.Hour,
+		settings:   thermostatSettings{Enabled: true},
+	}
+
+	var (
+		pin         = -1
+		activeLow   bool
+		hasSetpoint bool
+	)
+	for _, field := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 || len(kv[1]) == 0 {
+			return nil, fmt.Errorf("thermostat: invalid setting %q", field)
+		}
+
+		var (
+			err error
+			v   float64
+		)
+		switch k := kv[0]; k {
+		case "sensor":
+			t.sensor = kv[1]
+		case "setpoint":
+			v, err = strconv.ParseFloat(kv[1], 64)
+			t.settings.Setpoint, hasSetpoint = fromDisplay(Temperature, v), true
+			if err == nil {
+				err = checkSetpoint(t.settings.Setpoint)
+			}
+		case "hysteresis":
+			v, err = strconv.ParseFloat(kv[1], 64)
+			t.hysteresis = deltaFromDisplay(Temperature, v)
+			if err == nil && !(t.hysteresis > 0 && t.hysteresis <= maxHysteresis) {
+				err = fmt.Errorf("must be positive and at most %.1f %s", deltaToDisplay(Temperature, maxHysteresis), unitSymbol(Temperature))
+			}
+		case "min-on":
+			t.minOn, err = history.ParseDuration(kv[1])
+		case "min-off":
+			t.minOff, err = history.ParseDuration(kv[1])
+		case "max-runtime":
+			t.maxRuntime, err = history.ParseDuration(kv[1])
+		case "gpio":
+			pin, err = strconv.Atoi(kv[1])
+			if err == nil && pin < 0 {
+				err = errors.New("negative pin")
+			}
+		case "active-low":
+			activeLow, err = strconv.ParseBool(kv[1])
+		default:
+			err = errors.New("unknown setting")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("thermostat: %s: %w", field, err)
+		}
+	}
+
+	if len(t.sensor) == 0 || !hasSetpoint {
+		return nil, errors.New("thermostat: sensor and setpoint are required")
+	}
+	var err error
+	if t.relay, err = newRelay(root, pin, activeLow, onCommand, offCommand); err != nil {
+		return nil, fmt.Errorf("thermostat: %w", err)
+	}
+	return t, nil
+}
+
+// Thermostat returns a background function, which controls a heater relay by the spec, such as
+// "sensor=cottage,setpoint=5,gpio=17". The relay is a sysfs GPIO pin, or the on and off commands if no pin is set.
+// The setpoint and the enabled state set by the /thermostat command are kept in the storage directory.
+func Thermostat(spec, onCommand, offCommand string) (telega.BackgroundFunction, error) {
+	t, err := parseThermostat(SysfsRoot, spec, onCommand, offCommand)
+	if err != nil {
+		return nil, err
+	}
+	if dir := getStorageDir(); len(dir) > 0 {
+		t.stateFile = filepath.Join(dir, thermostatStateFilename)
+		t.load()
+	}
+	slog.Info("thermostat", "feed", "thermostat", "sensor", t.sensor, "setpoint", t.settings.Setpoint, "enabled", t.settings.Enabled, "relay", t.relay)
+	activeThermostat.Store(t)
+
+	return func(ctx context.Context, events chan<- telega.ChattableCloser) {
+		ticker := time.NewTicker(thermostatInterval)
+		defer ticker.Stop()
+
+		// start from a known state, and do not leave the heater unattended
+		t.switchRelay(false, "starting", time.Time{})
+		defer func() { t.switchRelay(false, "stopping", time.Now()) }()
+
+		for {
+			if msg := t.step(ctx, time.Now()); len(msg) > 0 {
+				select {
+				case events <- &telega.ChattableText{MessageConfig: tgbotapi.NewMessage(0, msg)}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}, nil
+}
+
+// load reads the persisted settings, which override the configured ones.
+func (t *thermostat) load() {
+	var settings thermostatSettings
+	b, err := os.ReadFile(t.stateFile)
+	if err == nil {
+		err = json.Unmarshal(b, &settings)
+	}
+	if err == nil {
+		err = checkSetpoint(settings.Setpoint)
+	}
+	if err == nil {
+		t.settings = settings
+	} else if !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("failed to load thermostat state", "feed", "thermostat", "file", t.stateFile, "err", err)
+	}
+}
+
+// checkSetpoint tells if the setpoint in ℃ is in the range a heater is kept at.
+func checkSetpoint(v float64) error {
+	if !(v >= minSetpoint && v <= maxSetpoint) {
+		return fmt.Errorf("setpoint must be between %s and %s", formatQuantity(Temperature, minSetpoint), formatQuantity(Temperature, maxSetpoint))
+	}
+	return nil
+}
+
+// save writes the settings. The caller holds the lock.
+func (t *thermostat) save() {
+	if len(t.stateFile) == 0 {
+		return
+	}
+	b, _ := json.Marshal(t.settings)
+	tmp := t.stateFile + ".tmp"
+	err := os.WriteFile(tmp, b, 0644)
+	if err == nil {
+		err = os.Rename(tmp, t.stateFile)
+	}
+	if err != nil {
+		slog.Warn("failed to save thermostat state", "feed", "thermostat", "file", t.stateFile, "err", err)
+	}
+}
+
+// decide tells if the heater should be on and why it's switched. The caller holds the lock.
+func (t *thermostat) decide(now time.Time) (on bool, reason string) {
+	low, high := t.settings.Setpoint-t.hysteresis/2, t.settings.Setpoint+t.hysteresis/2
+	elapsed := now.Sub(t.since)
+
+	switch {
+	case !t.settings.Enabled:
+		return false, "thermostat disabled"
+	case t.lastErr != nil:
+		// without readings it's safer to stop heating
+		return false, fmt.Sprintf("no readings from %s: %v", t.sensor, t.lastErr)
+	case t.on && t.maxRuntime > 0 && elapsed >= t.maxRuntime:
+		return false, fmt.Sprintf("on for the max runtime of %s", formatAge(t.maxRuntime))
+	case t.on && elapsed < t.minOn, !t.on && elapsed < t.minOff:
+		return t.on, ""
+	case t.on && t.last.Value >= high:
+		return false, fmt.Sprintf("%s %s, above %s", t.sensor, t.last, formatQuantity(Temperature, high))
+	case !t.on && t.last.Value <= low:
+		return true, fmt.Sprintf("%s %s, below %s", t.sensor, t.last, formatQuantity(Temperature, low))
+	}
+	return t.on, ""
+}
+
+// step reads the sensor and switches the relay if needed. It returns the notification of a switch or a failure.
+func (t *thermostat) step(ctx context.Context, now time.Time) string {
+	var (
+		last Reading
+		err  = fmt.Errorf("unknown sensor %s", t.sensor)
+	)
+	if s := findSensor(t.sensor); s != nil {
+		var readings []Reading
+		readings, err = s.getReadingsWithRetries(ctx, 3)
+		if err == nil {
+			err = errors.New("no temperature reading")
+			for _, v := range readings {
+				if v.Quantity == Temperature {
+					last, err = v, nil
+				}
+			}
+		}
+	}
+
+	t.mu.Lock()
+	t.lastErr = err
+	if err == nil {
+		t.last = last
+	}
+	on, reason := t.decide(now)
+	t.mu.Unlock()
+
+	if len(reason) == 0 || on == t.isOn() {
+		return ""
+	}
+	return t.switchRelay(on, reason, now)
+}
+
+func (t *thermostat) isOn() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.on
+}
+
+// switchRelay switches the heater and returns the notification.
+func (t *thermostat) switchRelay(on bool, reason string, now time.Time) string {
+	state := map[bool]string{true: "on", false: "off"}[on]
+	err := t.relay.Set(on)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		slog.Error("failed to switch heater", "feed", "thermostat", "relay", t.relay, "on", on, "err", err)
+		thermostatFailures.Inc()
+		if t.relayFailing {
+			return ""
+		}
+		t.relayFailing = true
+		return fmt.Sprintf("⚠️ failed to switch the heater %s (%s): %v", state, reason, err)
+	}
+	slog.Info("heater switched", "feed", "thermostat", "relay", t.relay, "on", on, "reason", reason)
+
+	t.relayFailing = false
+	changed := t.on != on
+	t.on, t.since = on, now
+	if on {
+		thermostatHeaterOn.Set(1)
+	} else {
+		thermostatHeaterOn.Set(0)
+	}
+	if !changed {
+		return ""
+	}
+	thermostatSwitches.Inc()
+	if on {
+		return "🔥 heater on: " + reason
+	}
+	return "❄️ heater off: " + reason
+}
+
+// status describes the thermostat, e.g. "heater on since Jan 2 15:04, cottage 3.2 ℃ 🌡, setpoint 5.0 ℃".
+func (t *thermostat) status(now time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var lines []string
+	heater := "heater off"
+	if t.on {
+		heater = "heater on"
+	}
+	if !t.since.IsZero() {
+		heater += fmt.Sprintf(" since %s (%s)", t.since.Format("Jan 2 15:04"), formatAge(now.Sub(t.since)))
+	}
+	switch {
+	case t.lastErr != nil:
+		heater += fmt.Sprintf(", no readings from %s: %v", t.sensor, t.lastErr)
+	case !t.last.Time.IsZero():
+		heater += fmt.Sprintf(", %s %s", t.sensor, t.last)
+	}
+	lines = append(lines, heater)
+
+	if !t.settings.Enabled {
+		lines = append(lines, "thermostat is disabled")
+	}
+	lines = append(lines, fmt.Sprintf("setpoint %s, hysteresis %.1f %s, relay %s",
+		formatQuantity(Temperature, t.settings.Setpoint), deltaToDisplay(Temperature, t.hysteresis), unitSymbol(Temperature), t.relay))
+	return strings.Join(lines, "\n")
+}
+
+// HandleCommandThermostat shows the thermostat state. /thermostat 6 sets the setpoint in the display unit,
+// /thermostat off disables heating and /thermostat on enables it. The changes apply within a minute.
+func HandleCommandThermostat(ctx context.Context, cmd *tgbotapi.Message, _ *tgbotapi.BotAPI) (response telega.ChattableCloser, _ error) {
+	reply := func(text string) (telega.ChattableCloser, error) {
+		return &telega.ChattableText{MessageConfig: tgbotapi.NewMessage(cmd.Chat.ID, text)}, nil
+	}
+
+	t := activeThermostat.Load()
+	if t == nil {
+		return reply("thermostat is not configured")
+	}
+
+	if args := commandArgs(cmd); len(args) > 0 {
+		t.mu.Lock()
+		switch arg := args[0]; arg {
+		case "on":
+			t.settings.Enabled = true
+		case "off":
+			t.settings.Enabled = false
+		default:
+			v, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				t.mu.Unlock()
+				return reply("usage: /thermostat [on|off|setpoint]")
+			}
+			if err = checkSetpoint(fromDisplay(Temperature, v)); err != nil {
+				t.mu.Unlock()
+				return reply(err.Error())
+			}
+			t.settings.Setpoint, t.settings.Enabled = fromDisplay(Temperature, v), true
+		}
+		t.save()
+		slog.Info("thermostat settings changed", "feed", "thermostat", "setpoint", t.settings.Setpoint, "enabled", t.settings.Enabled, "chat", cmd.Chat.ID)
+		t.mu.Unlock()
+	}
+	return reply(t.status(time.Now()))
+}
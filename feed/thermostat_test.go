@@ -0,0 +1,124 @@
+package feed
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/telega"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test001_thermostatParse(t *testing.T) {
+	th, err := parseThermostat("/sys", "sensor=cottage,setpoint=5,hysteresis=2,min-on=10m,min-off=15m,max-runtime=2h,gpio=17,active-low=true", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, "cottage", th.sensor)
+	assert.Equal(t, thermostatSettings{Setpoint: 5, Enabled: true}, th.settings)
+	assert.Equal(t, 2.0, th.hysteresis)
+	assert.Equal(t, []time.Duration{10 * time.Minute, 15 * time.Minute, 2 * time.Hour}, []time.Duration{th.minOn, th.minOff, th.maxRuntime})
+	assert.Equal(t, &gpioRelay{root: "/sys/class/gpio", pin: 17, activeLow: true}, th.relay)
+
+	th, err = parseThermostat("/sys", "sensor=cottage,setpoint=41", "on", "off")
+	require.NoError(t, err)
+	assert.Equal(t, &commandRelay{on: "on", off: "off"}, th.relay)
+
+	for _, v := range []string{
+		"sensor=cottage,gpio=17",
+		"setpoint=5,gpio=17",
+		"sensor=cottage,setpoint=warm,gpio=17",
+		"sensor=cottage,setpoint=5,hysteresis=0,gpio=17",
+		"sensor=cottage,setpoint=5,hysteresis=NaN,gpio=17",
+		"sensor=cottage,setpoint=5,hysteresis=20,gpio=17",
+		"sensor=cottage,setpoint=2100,gpio=17",
+		"sensor=cottage,setpoint=-40,gpio=17",
+		"sensor=cottage,setpoint=5,gpio=-1",
+		"sensor=cottage,setpoint=5,min-on=soon,gpio=17",
+		"sensor=cottage,setpoint=5,fan=on,gpio=17",
+		"sensor=cottage,setpoint=5",
+	} {
+		_, err = parseThermostat("/sys", v, "", "")
+		assert.Error(t, err, v)
+	}
+}
+
+func Test002_thermostatControl(t *testing.T) {
+	defer setSensors(getSensors())
+	s, dev := newTestSensor("cottage", "28-3c01d607ca0a", "28_8c")
+	s.minRead = time.Nanosecond
+	setSensors([]*sensor{s})
+
+	root := t.TempDir()
+	value := filepath.Join(root, gpioClassDir, "gpio17", "value")
+	require.NoError(t, os.MkdirAll(filepath.Dir(value), 0755))
+
+	// the heater is on at or below 28.9 ℃ and off at or above 29.7 ℃
+	th, err := parseThermostat(root, "sensor=cottage,setpoint=29.3,hysteresis=0.8,min-on=10m,min-off=10m,max-runtime=1h,gpio=17", "", "")
+	require.NoError(t, err)
+
+	start := time.Date(2024, 1, 30, 3, 0, 0, 0, time.Local)
+	step := func(minutes int, reading string) string {
+		dev.path = path.Join(testDataDir, "temp_sensor_readings", reading)
+		return th.step(context.Background(), start.Add(time.Duration(minutes)*time.Minute))
+	}
+
+	assert.Equal(t, "🔥 heater on: cottage 28.8 ℃ 🌡, below 28.9 ℃", step(0, "28_8c"))
+	assert.Equal(t, "1", readFile(t, value))
+	// not switched off sooner than min-on
+	assert.Empty(t, step(5, "29_8c"))
+	assert.Equal(t, "❄️ heater off: cottage 29.8 ℃ 🌡, above 29.7 ℃", step(10, "29_8c"))
+	assert.Equal(t, "0", readFile(t, value))
+	// not switched on sooner than min-off
+	assert.Empty(t, step(15, "28_8c"))
+	assert.Equal(t, "🔥 heater on: cottage 28.8 ℃ 🌡, below 28.9 ℃", step(20, "28_8c"))
+
+	// within the band the heater stays on, but not longer than max-runtime
+	assert.Empty(t, step(40, "29_5c"))
+	assert.Equal(t, "❄️ heater off: on for the max runtime of 1h", step(80, "29_5c"))
+
+	// the heater is off without readings
+	assert.Equal(t, "🔥 heater on: cottage 28.8 ℃ 🌡, below 28.9 ℃", step(90, "28_8c"))
+	msg := step(95, "missing")
+	assert.Regexp(t, `^❄️ heater off: no readings from cottage: `, msg)
+	assert.Equal(t, "0", readFile(t, value))
+
+	// a broken relay is reported once
+	require.NoError(t, os.RemoveAll(filepath.Dir(value)))
+	assert.Regexp(t, `^⚠️ failed to switch the heater on \(cottage 28\.8 ℃ 🌡, below 28\.9 ℃\): `, step(110, "28_8c"))
+	assert.Empty(t, step(111, "28_8c"))
+	assert.False(t, th.isOn())
+}
+
+func Test003_thermostatCommand(t *testing.T) {
+	defer activeThermostat.Store(activeThermostat.Load())
+	reply := func(text string) string {
+		resp, err := HandleCommandThermostat(context.Background(), &tgbotapi.Message{Text: text, Chat: &tgbotapi.Chat{ID: 1}}, nil)
+		require.NoError(t, err)
+		return resp.(*telega.ChattableText).Text
+	}
+
+	activeThermostat.Store(nil)
+	assert.Equal(t, "thermostat is not configured", reply("/thermostat"))
+
+	th, err := parseThermostat(t.TempDir(), "sensor=cottage,setpoint=5,gpio=17", "", "")
+	require.NoError(t, err)
+	th.stateFile = filepath.Join(t.TempDir(), thermostatStateFilename)
+	activeThermostat.Store(th)
+
+	assert.Equal(t, "heater off\nsetpoint 5.0 ℃, hysteresis 1.0 ℃, relay gpio17", reply("/thermostat"))
+	assert.Equal(t, "heater off\nthermostat is disabled\nsetpoint 5.0 ℃, hysteresis 1.0 ℃, relay gpio17", reply("/thermostat off"))
+	assert.Equal(t, "heater off\nsetpoint 7.5 ℃, hysteresis 1.0 ℃, relay gpio17", reply("/thermostat 7.5"))
+	assert.Equal(t, "usage: /thermostat [on|off|setpoint]", reply("/thermostat warm"))
+	assert.Equal(t, "setpoint must be between -10.0 ℃ and 50.0 ℃", reply("/thermostat 2100"))
+
+	// the settings survive a restart
+	restarted, err := parseThermostat(t.TempDir(), "sensor=cottage,setpoint=5,gpio=17", "", "")
+	require.NoError(t, err)
+	restarted.stateFile = th.stateFile
+	restarted.load()
+	assert.Equal(t, thermostatSettings{Setpoint: 7.5, Enabled: true}, restarted.settings)
+}
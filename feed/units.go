@@ -0,0 +1,93 @@
+package feed
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// temperatureUnit converts ℃, which the readings are kept in, to a display unit.
+type temperatureUnit struct {
+	symbol        string
+	scale, offset float64
+}
+
+var (
+	temperatureUnits = map[string]temperatureUnit{
+		"C": {symbol: "℃", scale: 1},
+		"F": {symbol: "℉", scale: 1.8, offset: 32},
+		"K": {symbol: "K", scale: 1, offset: 273.15},
+	}
+
+	// displayUnit is the unit temperatures are shown and configured in. The readings, the history and
+	// the metrics are in ℃ regardless.
+	displayUnit atomic.Pointer[temperatureUnit]
+)
+
+func init() {
+	unit := temperatureUnits["C"]
+	displayUnit.Store(&unit)
+}
+
+// SetTemperatureUnit selects C, F or K to show temperatures in. Call it before configuring the sensors
+// and the alerts, their settings are in the display unit.
+func SetTemperatureUnit(name string) error {
+	unit, found := temperatureUnits[strings.ToUpper(strings.TrimSpace(name))]
+	if !found {
+		return fmt.Errorf("unknown temperature unit %q, use C, F or K", name)
+	}
+	displayUnit.Store(&unit)
+	return nil
+}
+
+// unitSymbol is the display unit of a quantity, e.g. ℉ or %.
+func unitSymbol(q Quantity) string {
+	if q == Temperature {
+		return displayUnit.Load().symbol
+	}
+	return quantityUnits[q]
+}
+
+// toDisplay converts a value to the display unit.
+func toDisplay(q Quantity, v float64) float64 {
+	if q == Temperature {
+		u := displayUnit.Load()
+		return v*u.scale + u.offset
+	}
+	return v
+}
+
+// fromDisplay converts a configured value to the reading unit.
+func fromDisplay(q Quantity, v float64) float64 {
+	if q == Temperature {
+		u := displayUnit.Load()
+		return (v - u.offset) / u.scale
+	}
+	return v
+}
+
+// deltaToDisplay converts a difference or a rate to the display unit, e.g. 1 ℃/h is 1.8 ℉/h.
+func deltaToDisplay(q Quantity, d float64) float64 {
+	if q == Temperature {
+		return d * displayUnit.Load().scale
+	}
+	return d
+}
+
+// deltaFromDisplay converts a configured difference to the reading unit.
+func deltaFromDisplay(q Quantity, d float64) float64 {
+	if q == Temperature {
+		return d / displayUnit.Load().scale
+	}
+	return d
+}
+
+// formatQuantity is how every value is shown, e.g. "21.5 ℃" or "70.7 ℉".
+func formatQuantity(q Quantity, v float64) string {
+	return fmt.Sprintf("%.1f %s", toDisplay(q, v), unitSymbol(q))
+}
+
+// formatRate shows a rate of change per hour with its sign, e.g. "-2.2 ℃/h".
+func formatRate(q Quantity, rate float64) string {
+	return fmt.Sprintf("%+.1f %s/h", deltaToDisplay(q, rate), unitSymbol(q))
+}
@@ -0,0 +1,72 @@
+package feed
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useTemperatureUnit selects the unit for a test and restores Celsius after it.
+func useTemperatureUnit(t *testing.T, name string) {
+	require.NoError(t, SetTemperatureUnit(name))
+	t.Cleanup(func() { _ = SetTemperatureUnit("C") })
+}
+
+func Test001_temperatureUnits(t *testing.T) {
+	assert.Error(t, SetTemperatureUnit("R"))
+
+	r := Reading{Quantity: Temperature, Value: 21.5, Unit: "℃"}
+	assert.Equal(t, "21.5 ℃ 🌡", r.String())
+	assert.Equal(t, "45.0 % 💧", Reading{Quantity: Humidity, Value: 45, Unit: "%"}.String())
+
+	useTemperatureUnit(t, "f")
+	assert.Equal(t, "70.7 ℉ 🌡", r.String())
+	assert.Equal(t, "-4.0 ℉/h", formatRate(Temperature, -2.2222))
+	assert.InDelta(t, 0, fromDisplay(Temperature, 32), 1e-9)
+	assert.InDelta(t, 1, deltaFromDisplay(Temperature, 1.8), 1e-9)
+	// other quantities are not converted
+	assert.Equal(t, "1013.2 hPa", formatQuantity(Pressure, 1013.2))
+
+	useTemperatureUnit(t, "K")
+	assert.Equal(t, "294.6 K 🌡", r.String())
+	assert.Equal(t, "+1.0 K/h", formatRate(Temperature, 1))
+}
+
+func Test002_alertRulesInDisplayUnit(t *testing.T) {
+	useTemperatureUnit(t, "F")
+
+	rules, err := parseAlertRules("attic,below=35.6,hysteresis=0.9;attic,falling=3.6,predict=32")
+	require.NoError(t, err)
+	assert.InDelta(t, 2, rules[0].value, 1e-9)
+	assert.InDelta(t, 0.5, rules[0].hysteresis, 1e-9)
+	assert.InDelta(t, 2, rules[1].value, 1e-9)
+	assert.InDelta(t, 0, *rules[1].predict, 1e-9)
+
+	assert.Equal(t, "below 35.6 ℉", rules[0].threshold())
+	assert.Equal(t, "falling faster than 3.6 ℉/h", rules[1].threshold())
+
+	// the state of a rule is kept, when the unit changes
+	useTemperatureUnit(t, "C")
+	celsius, err := parseAlertRules("attic,below=35.6,hysteresis=0.9;attic,falling=3.6,predict=32")
+	require.NoError(t, err)
+	assert.Equal(t, "attic/temperature/below/35.6", celsius[0].key("attic"))
+	assert.Equal(t, celsius[0].key("attic"), rules[0].key("attic"))
+	assert.Equal(t, celsius[1].key("attic"), rules[1].key("attic"))
+}
+
+func Test003_statusInDisplayUnit(t *testing.T) {
+	defer setSensors(getSensors())
+	s, _ := newTestSensor("attic", "28-3c01d607ca0a", "29_8c")
+	setSensors([]*sensor{s})
+	_, err := s.getReadingsWithRetries(context.Background(), 1)
+	require.NoError(t, err)
+
+	useTemperatureUnit(t, "F")
+	status := GetStatus().Sensors
+	require.Len(t, status, 1)
+	assert.Equal(t, []string{"85.7 ℉"}, status[0].Display)
+	// the readings themselves stay in ℃
+	assert.Equal(t, "℃", status[0].Readings[0].Unit)
+}
@@ -0,0 +1,177 @@
+package feed
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	w1DevicesDir       = "bus/w1/devices"
+	w1SlaveFile        = "w1_slave"
+	errTemp      int32 = -1000
+	// w1RefreshRetries is how many times an unchanged reading is re-read, as the sensor sometimes does not refresh it.
+	w1RefreshRetries = 3
+	// powerOnResetTemp is the DS18x20 scratchpad value before the first conversion, it's never a valid reading.
+	powerOnResetTemp int32 = 85000
+)
+
+var (
+	// w1TemperatureFamilies are 1-Wire family codes of DS18S20, DS1822, DS18B20 and MAX31850 temperature sensors.
+	w1TemperatureFamilies = []string{"10", "22", "28", "3b"}
+
+	// w1TemperatureRanges are the measurement ranges of the sensor families in m℃.
+	// MAX31850 range depends on the thermocouple type, K-type is the widest.
+	w1TemperatureRanges = map[string][2]int32{
+		"10": {-55000, 125000},
+		"22": {-55000, 125000},
+		"28": {-55000, 125000},
+		"3b": {-270000, 1372000},
+	}
+
+	errCRCMismatch  = errors.New("w1 CRC check failed")
+	errPowerOnReset = errors.New("power-on reset value read")
+	errOutOfRange   = errors.New("reading is out of the sensor range")
+
+	// rejectionReasons are errors of readings, which were taken, but discarded as invalid.
+	rejectionReasons = []error{errCRCMismatch, errPowerOnReset, errOutOfRange}
+)
+
+// w1Sensor is a 1-Wire temperature sensor read through the w1_therm driver.
+type w1Sensor struct {
+	id   string
+	path string
+	// prev is the last valid reading in m℃
+	prev int32
+}
+
+func newW1Sensor(id, fpath string) *w1Sensor {
+	return &w1Sensor{id: id, path: fpath, prev: errTemp}
+}
+
+// isW1ID tells if id looks like a 1-Wire slave ID, such as 28-3c01d607ca0a.
+func isW1ID(id string) bool {
+	family, serial, found := strings.Cut(id, "-")
+	return found && len(family) == 2 && len(serial) > 0
+}
+
+// discoverW1Sensors finds 1-Wire temperature sensors under the sysfs root.
+func discoverW1Sensors(root string) ([]Sensor, error) {
+	var ret []Sensor
+	for _, family := range w1TemperatureFamilies {
+		matches, err := filepath.Glob(filepath.Join(root, w1DevicesDir, family+"-*", w1SlaveFile))
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range matches {
+			ret = append(ret, newW1Sensor(filepath.Base(filepath.Dir(v)), v))
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID() < ret[j].ID() })
+	return ret, nil
+}
+
+// ID is the 1-Wire slave ID.
+func (s *w1Sensor) ID() string {
+	return s.id
+}
+
+// Read takes a validated temperature reading.
+func (s *w1Sensor) Read(ctx context.Context) ([]Reading, error) {
+	prev := atomic.LoadInt32(&s.prev)
+	v, err := s.read()
+	for i := 0; err == nil && v == prev && i < w1RefreshRetries; i++ {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		v, err = s.read()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.StoreInt32(&s.prev, v)
+	return []Reading{{Quantity: Temperature, Value: float64(v) / 1000.0, Unit: quantityUnits[Temperature], Time: time.Now()}}, nil
+}
+
+// scanTemperatureReading parses w1_slave content. The first line ends with the CRC verdict, the second with the temperature:
+//
+//	dd 01 55 05 7f a5 a5 66 81 : crc=81 YES
+//	dd 01 55 05 7f a5 a5 66 81 t=29812
+func scanTemperatureReading(reader io.Reader) (int32, error) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		ss := strings.Split(strings.TrimSpace(scanner.Text()), " ")
+		if len(ss) > 1 {
+			if strings.HasPrefix(ss[len(ss)-2], "crc=") && ss[len(ss)-1] == "NO" {
+				return errTemp, errCRCMismatch
+			}
+			ts := ss[len(ss)-1]
+			if strings.HasPrefix(ts, "t=") {
+				st := strings.Split(ts, "=")
+				if len(st) == 2 {
+					ret, err := strconv.ParseInt(st[1], 10, 32)
+					if err != nil {
+						slog.Warn("could not parse temperature", "value", st[1], "err", err)
+						return errTemp, err
+					}
+					slog.Debug("scanned temperature", "value", ret)
+					return int32(ret), nil
+				}
+				slog.Warn("could not parse temperature", "value", ts)
+				return errTemp, fmt.Errorf("could not parse %v", ts)
+			}
+		}
+	}
+
+	slog.Warn("no temperature pattern found")
+
+	return errTemp, errors.New("no temp pattern found")
+}
+
+func getTemperatureReading(fpath string) (int32, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return errTemp, err
+	}
+
+	defer func() { _ = f.Close() }()
+	return scanTemperatureReading(f)
+}
+
+// validate rejects readings, which can't be real for the sensor family.
+func (s *w1Sensor) validate(v int32) error {
+	family := strings.SplitN(s.id, "-", 2)[0]
+	if v == powerOnResetTemp && family != "3b" {
+		return errPowerOnReset
+	}
+	if r, found := w1TemperatureRanges[family]; found && (v < r[0] || v > r[1]) {
+		return errOutOfRange
+	}
+	return nil
+}
+
+// read takes a single validated reading in m℃.
+func (s *w1Sensor) read() (int32, error) {
+	v, err := getTemperatureReading(s.path)
+	if err != nil {
+		return errTemp, err
+	}
+	if err = s.validate(v); err != nil {
+		slog.Debug("invalid temperature reading", "feed", "temperature", "id", s.id, "value", v, "err", err)
+		return errTemp, err
+	}
+	return v, nil
+}
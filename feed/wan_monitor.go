@@ -0,0 +1,231 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/telega"
+)
+
+// procNetIPv6Route is the IPv6 routing table, for the hosts without an IPv4 default route
+var procNetIPv6Route = "/proc/net/ipv6_route"
+
+// wanSettleDelay is how long to wait after a change for the rest of them, a reconnect comes as a burst
+var wanSettleDelay = 2 * time.Second
+
+// interfaceAddrs returns the addresses of the network interface.
+var interfaceAddrs = func(name string) ([]netip.Prefix, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]netip.Prefix, 0, len(addrs))
+	for _, v := range addrs {
+		if ipnet, ok := v.(*net.IPNet); ok {
+			addr, _ := netip.AddrFromSlice(ipnet.IP)
+			ones, _ := ipnet.Mask.Size()
+			ret = append(ret, netip.PrefixFrom(addr.Unmap(), ones))
+		}
+	}
+	return ret, nil
+}
+
+// wanState is the interface of the default route and its addresses. The IPv6 addresses are kept as
+// their prefixes, so that the temporary addresses, which change every day, are not a change.
+type wanState struct {
+	iface   string
+	gateway netip.Addr
+	addrs   []netip.Prefix
+}
+
+// String describes the state, e.g. "eth0 via 192.168.1.1: 192.168.1.10/24, 2001:db8:0:1::/64".
+func (w wanState) String() string {
+	s := w.iface
+	if w.gateway.IsValid() {
+		s += " via " + w.gateway.String()
+	}
+	if len(w.addrs) > 0 {
+		addrs := make([]string, 0, len(w.addrs))
+		for _, v := range w.addrs {
+			addrs = append(addrs, v.String())
+		}
+		s += ": " + strings.Join(addrs, ", ")
+	}
+	return s
+}
+
+// readWANState finds the interface of the IPv4 default route with the lowest metric, or of the IPv6 one if there
+// is none, and reads its global addresses. The interface is empty if there is no default route.
+func readWANState() (wanState, error) {
+	var w wanState
+	routes, err := defaultRoutes()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return w, err
+	}
+	if len(routes) == 0 {
+		if routes, err = defaultRoutes6(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return w, err
+		}
+	}
+	if len(routes) == 0 {
+		return w, nil
+	}
+	w.iface, w.gateway = routes[0].iface, routes[0].gateway
+
+	addrs, err := interfaceAddrs(w.iface)
+	if err != nil {
+		return w, err
+	}
+	seen := make(map[netip.Prefix]bool)
+	for _, v := range addrs {
+		if !v.Addr().IsGlobalUnicast() {
+			continue
+		}
+		if v.Addr().Is6() {
+			v = v.Masked()
+		}
+		if !seen[v] {
+			seen[v] = true
+			w.addrs = append(w.addrs, v)
+		}
+	}
+	sort.Slice(w.addrs, func(i, j int) bool {
+		if w.addrs[i].Addr() != w.addrs[j].Addr() {
+			return w.addrs[i].Addr().Less(w.addrs[j].Addr())
+		}
+		return w.addrs[i].Bits() < w.addrs[j].Bits()
+	})
+	return w, nil
+}
+
+// defaultRoutes6 reads the IPv6 default routes, which are up, the lowest metric first.
+func defaultRoutes6() ([]defaultRoute, error) {
+	data, err := os.ReadFile(procNetIPv6Route)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []defaultRoute
+	for _, line := range strings.Split(string(data), "\n") {
+		// destination, its length, source, its length, next hop, metric, refcnt, use, flags and the interface in hex
+		fields := strings.Fields(line)
+		if len(fields) < 10 || fields[0] != strings.Repeat("0", 32) || fields[1] != "00" {
+			continue
+		}
+		metric, err1 := strconv.ParseUint(fields[5], 16, 32)
+		flags, err2 := strconv.ParseUint(fields[8], 16, 32)
+		// up and not a reject route, which the loopback has
+		if err1 != nil || err2 != nil || flags&1 == 0 || flags&0x200 != 0 {
+			continue
+		}
+		r := defaultRoute{iface: fields[9], metric: int(metric)}
+		if b, err := hexAddr16(fields[4]); err == nil && !b.IsUnspecified() {
+			r.gateway = b
+		}
+		routes = append(routes, r)
+	}
+	sort.SliceStable(routes, func(i, j int) bool { return routes[i].metric < routes[j].metric })
+	return routes, nil
+}
+
+// hexAddr16 parses an IPv6 address written as 32 hex digits.
+func hexAddr16(s string) (netip.Addr, error) {
+	var b [16]byte
+	if len(s) != 32 {
+		return netip.Addr{}, fmt.Errorf("invalid address %q", s)
+	}
+	for i := range b {
+		v, err := strconv.ParseUint(s[2*i:2*i+2], 16, 8)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		b[i] = byte(v)
+	}
+	return netip.AddrFrom16(b), nil
+}
+
+// WANMonitor returns a background function, which watches the links, the addresses and the routes of the system,
+// see watchRoutes. When the default route or its addresses change, it tells it to all chats, e.g.
+// "WAN interface changed: ppp0: 203.0.113.9/32 (was ppp0: 203.0.113.7/32)", and checks the public addresses
+// right away, rather than by the next periodic check.
+func WANMonitor() telega.BackgroundFunction {
+	return wanMonitor(watchRoutes, readWANState)
+}
+
+func wanMonitor(watch func(context.Context, chan<- struct{}) error, read func() (wanState, error)) telega.BackgroundFunction {
+	return func(ctx context.Context, events chan<- telega.ChattableCloser) {
+		changes := make(chan struct{}, 1)
+		go func() {
+			if err := watch(ctx, changes); err != nil {
+				slog.Warn("not watching the routes, the public addresses are checked periodically only", "feed", "wan", "err", err)
+			}
+		}()
+
+		last, err := read()
+		if err != nil {
+			slog.Warn("failed to read the WAN interface", "feed", "wan", "err", err)
+		}
+		send := func(msg string) bool {
+			select {
+			case events <- &telega.ChattableText{MessageConfig: tgbotapi.NewMessage(0, msg)}:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changes:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wanSettleDelay):
+			}
+			select {
+			case <-changes:
+			default:
+			}
+
+			cur, err := read()
+			if err != nil {
+				slog.Warn("failed to read the WAN interface", "feed", "wan", "err", err)
+				continue
+			}
+			// the link is down, the change is told once it's back
+			if len(cur.iface) == 0 || cur.String() == last.String() {
+				continue
+			}
+
+			msg := "WAN interface changed: " + cur.String()
+			if len(last.iface) > 0 {
+				msg += " (was " + last.String() + ")"
+			}
+			slog.Info("WAN interface changed", "feed", "wan", "state", cur.String(), "was", last.String())
+			last = cur
+			if !send(msg) {
+				return
+			}
+			if msg := PublicIP(ctx); len(msg) > 0 && !send("Public IP Changed: "+msg) {
+				return
+			}
+		}
+	}
+}
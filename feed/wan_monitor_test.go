@@ -0,0 +1,135 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skrassiev/meerkat/telega"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAN_readWANState(t *testing.T) {
+	dir := t.TempDir()
+	prevRoute, prevRoute6, prevAddrs := procNetRoute, procNetIPv6Route, interfaceAddrs
+	procNetRoute, procNetIPv6Route = filepath.Join(dir, "route"), filepath.Join(dir, "ipv6_route")
+	interfaceAddrs = func(name string) ([]netip.Prefix, error) {
+		switch name {
+		case "eth0":
+			return []netip.Prefix{
+				netip.MustParsePrefix("2001:db8:0:1::7/64"),
+				netip.MustParsePrefix("192.168.1.10/24"),
+				netip.MustParsePrefix("fe80::7/64"),
+				netip.MustParsePrefix("2001:db8:0:1:a:b:c:d/64"),
+			}, nil
+		case "ppp0":
+			return []netip.Prefix{netip.MustParsePrefix("203.0.113.7/32")}, nil
+		}
+		return nil, errors.New("no such network interface")
+	}
+	defer func() { procNetRoute, procNetIPv6Route, interfaceAddrs = prevRoute, prevRoute6, prevAddrs }()
+
+	// no routes at all
+	w, err := readWANState()
+	require.NoError(t, err)
+	assert.Equal(t, "", w.iface)
+
+	require.NoError(t, os.WriteFile(procNetRoute, []byte(
+		"Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"+
+			"ppp0\t00000000\t00000000\t0001\t0\t0\t200\t00000000\t0\t0\t0\n"+
+			"eth0\t00000000\t0101A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n"), 0644))
+	w, err = readWANState()
+	require.NoError(t, err)
+	assert.Equal(t, "eth0 via 192.168.1.1: 192.168.1.10/24, 2001:db8:0:1::/64", w.String())
+
+	// a point-to-point link has no gateway
+	require.NoError(t, os.WriteFile(procNetRoute, []byte(
+		"Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"+
+			"ppp0\t00000000\t00000000\t0001\t0\t0\t0\t00000000\t0\t0\t0\n"), 0644))
+	w, err = readWANState()
+	require.NoError(t, err)
+	assert.Equal(t, "ppp0: 203.0.113.7/32", w.String())
+
+	// IPv6 only, the reject route of the loopback is not a default route
+	require.NoError(t, os.WriteFile(procNetRoute, []byte(
+		"Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"), 0644))
+	require.NoError(t, os.WriteFile(procNetIPv6Route, []byte(
+		"20010db8000000010000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0\n"+
+			"00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 ffffffff 00000001 00000000 00200200       lo\n"+
+			"00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00450003     eth0\n"), 0644))
+	w, err = readWANState()
+	require.NoError(t, err)
+	assert.Equal(t, "eth0 via fe80::1: 192.168.1.10/24, 2001:db8:0:1::/64", w.String())
+
+	interfaceAddrs = func(string) ([]netip.Prefix, error) { return nil, errors.New("no such network interface") }
+	_, err = readWANState()
+	assert.Error(t, err)
+}
+
+func TestWAN_Monitor(t *testing.T) {
+	resetDDNS(t, "")
+	answer, queries := "203.0.113.7", int32(0)
+	srv := resolverServer(t, &answer, &queries)
+	f := testFamily(t, ipv4, srv.URL)
+	prevFamilies, prevDelay := publicIPFamilies, wanSettleDelay
+	publicIPFamilies, wanSettleDelay = []*addressFamily{f}, time.Millisecond
+	t.Cleanup(func() { publicIPFamilies, wanSettleDelay = prevFamilies, prevDelay })
+	require.Equal(t, "IPv4 203.0.113.7", PublicIP(context.Background()))
+
+	states := make(chan wanState, 1)
+	read := func() (wanState, error) {
+		select {
+		case w := <-states:
+			return w, nil
+		default:
+			return wanState{iface: "ppp0", addrs: []netip.Prefix{netip.MustParsePrefix("203.0.113.7/32")}}, nil
+		}
+	}
+	changes := make(chan chan<- struct{}, 1)
+	watch := func(ctx context.Context, c chan<- struct{}) error {
+		changes <- c
+		<-ctx.Done()
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan telega.ChattableCloser)
+	go wanMonitor(watch, read)(ctx, events)
+	notify := <-changes
+
+	next := func() string {
+		select {
+		case e := <-events:
+			assert.Equal(t, int64(0), e.(*telega.ChattableText).ChatID)
+			return e.(*telega.ChattableText).Text
+		case <-time.After(5 * time.Second):
+			t.Fatal("no notice")
+		}
+		return ""
+	}
+
+	// the link went down and came back with a new address
+	answer = "203.0.113.9"
+	states <- wanState{}
+	notify <- struct{}{}
+	states <- wanState{iface: "ppp0", addrs: []netip.Prefix{netip.MustParsePrefix("203.0.113.9/32")}}
+	notify <- struct{}{}
+	assert.Equal(t, "WAN interface changed: ppp0: 203.0.113.9/32 (was ppp0: 203.0.113.7/32)", next())
+	assert.Equal(t, "Public IP Changed: IPv4 203.0.113.9", next())
+
+	// the route came back, yet the public address is the same
+	states <- wanState{iface: "eth0", gateway: netip.MustParseAddr("192.168.1.1")}
+	notify <- struct{}{}
+	assert.Equal(t, "WAN interface changed: eth0 via 192.168.1.1 (was ppp0: 203.0.113.9/32)", next())
+	select {
+	case e := <-events:
+		t.Fatal("unexpected notice:", e.(*telega.ChattableText).Text)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,98 @@
+// Package health serves liveness and readiness probes and reports the service state to systemd.
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Check returns nil if the checked component is healthy.
+type Check func() error
+
+// Checker is a set of named liveness and readiness checks.
+type Checker struct {
+	mu        sync.RWMutex
+	liveness  map[string]Check
+	readiness map[string]Check
+}
+
+// AddLiveness registers a check, which fails if the service is hung and should be restarted.
+// Liveness checks are readiness checks as well.
+func (c *Checker) AddLiveness(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.liveness == nil {
+		c.liveness = make(map[string]Check)
+	}
+	c.liveness[name] = check
+}
+
+// AddReadiness registers a check, which fails if the service is running, but can't do its job.
+func (c *Checker) AddReadiness(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readiness == nil {
+		c.readiness = make(map[string]Check)
+	}
+	c.readiness[name] = check
+}
+
+// Alive runs the liveness checks and returns the failures by check name.
+func (c *Checker) Alive() map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return run(c.liveness, nil)
+}
+
+// Ready runs all checks and returns the failures by check name.
+func (c *Checker) Ready() map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return run(c.readiness, run(c.liveness, nil))
+}
+
+func run(checks map[string]Check, failures map[string]string) map[string]string {
+	names := make([]string, 0, len(checks))
+	for k := range checks {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
+		if err := checks[k](); err != nil {
+			if failures == nil {
+				failures = make(map[string]string)
+			}
+			failures[k] = err.Error()
+		}
+	}
+	return failures
+}
+
+// LivenessHandler serves /healthz.
+func (c *Checker) LivenessHandler() http.Handler {
+	return probeHandler(c.Alive)
+}
+
+// ReadinessHandler serves /readyz.
+func (c *Checker) ReadinessHandler() http.Handler {
+	return probeHandler(c.Ready)
+}
+
+// probeHandler responds with 200 if there are no failures, or 503 and the failures as a JSON object.
+func probeHandler(probe func() map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		failures := probe()
+		if len(failures) == 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = w.Write([]byte("ok\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(failures)
+	})
+}
@@ -0,0 +1,137 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth_Probes(t *testing.T) {
+	var (
+		c     Checker
+		alive int32 = 1
+	)
+	c.AddLiveness("bot", func() error {
+		if atomic.LoadInt32(&alive) == 0 {
+			return errors.New("stuck")
+		}
+		return nil
+	})
+	c.AddReadiness("telegram", func() error { return errors.New("disconnected") })
+
+	probe := func(h http.Handler) (int, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, body := probe(c.LivenessHandler())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok\n", body)
+
+	code, body = probe(c.ReadinessHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.JSONEq(t, `{"telegram":"disconnected"}`, body)
+
+	atomic.StoreInt32(&alive, 0)
+	code, body = probe(c.LivenessHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.JSONEq(t, `{"bot":"stuck"}`, body)
+
+	_, body = probe(c.ReadinessHandler())
+	assert.JSONEq(t, `{"bot":"stuck","telegram":"disconnected"}`, body)
+}
+
+// listenNotify emulates systemd NOTIFY_SOCKET and returns the received datagrams.
+func listenNotify(t *testing.T) <-chan string {
+	socketPath := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", socketPath)
+
+	received := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			received <- string(buf[:n])
+		}
+	}()
+	return received
+}
+
+func TestHealth_Notify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	assert.ErrorIs(t, Notify("READY=1"), ErrNoNotifySocket)
+
+	received := listenNotify(t)
+	require.NoError(t, Notify("READY=1"))
+	assert.Equal(t, "READY=1", <-received)
+}
+
+func TestHealth_WatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	assert.Zero(t, WatchdogInterval())
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "1")
+	assert.Zero(t, WatchdogInterval())
+
+	t.Setenv("WATCHDOG_PID", "")
+	assert.Equal(t, 30*time.Second, WatchdogInterval())
+}
+
+func TestHealth_SystemdWatchdog(t *testing.T) {
+	received := listenNotify(t)
+	t.Setenv("WATCHDOG_USEC", strconv.Itoa(int((100 * time.Millisecond).Microseconds())))
+	t.Setenv("WATCHDOG_PID", "")
+
+	var (
+		c     Checker
+		alive int32 = 1
+		wg    sync.WaitGroup
+	)
+	c.AddLiveness("bot", func() error {
+		if atomic.LoadInt32(&alive) == 0 {
+			return errors.New("stuck")
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go func() { Systemd(&c, func() string { return "running" })(ctx, nil); wg.Done() }()
+
+	assert.Equal(t, "READY=1\nSTATUS=running", <-received)
+	assert.Equal(t, "STATUS=running\nWATCHDOG=1", <-received)
+
+	// a ping might have been in flight, but the pings should stop
+	atomic.StoreInt32(&alive, 0)
+	require.Eventually(t, func() bool {
+		return <-received == "STATUS=unhealthy: bot: stuck"
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	wg.Wait()
+	for msg := range received {
+		if msg == "STOPPING=1" {
+			break
+		}
+		assert.NotContains(t, msg, "WATCHDOG=1")
+	}
+}
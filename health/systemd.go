@@ -0,0 +1,109 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skrassiev/meerkat/telega"
+)
+
+// statusInterval is how often STATUS= is refreshed if the watchdog is not enabled.
+const statusInterval = time.Minute
+
+// ErrNoNotifySocket is returned by Notify if the service is not run by systemd with Type=notify.
+var ErrNoNotifySocket = errors.New("NOTIFY_SOCKET is not set")
+
+// Notify sends a sd_notify(3) state, such as "READY=1" or "WATCHDOG=1", to $NOTIFY_SOCKET.
+func Notify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if len(socketPath) == 0 {
+		return ErrNoNotifySocket
+	}
+	// abstract namespace socket
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval returns WatchdogSec of the service, or zero if the watchdog is not enabled for this process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Systemd returns a background function, which notifies systemd the service is ready, keeps STATUS= up to date
+// and pings the watchdog at half of WatchdogSec, but only while the liveness checks pass.
+// It returns immediately if the service is not run by systemd with Type=notify.
+func Systemd(checker *Checker, status func() string) telega.BackgroundFunction {
+	return func(ctx context.Context, _ chan<- telega.ChattableCloser) {
+		if err := Notify("READY=1\nSTATUS=" + status()); err != nil {
+			if !errors.Is(err, ErrNoNotifySocket) {
+				slog.Warn("sd_notify failed", "err", err)
+			}
+			return
+		}
+
+		interval := statusInterval
+		watchdog := WatchdogInterval()
+		if watchdog > 0 {
+			interval = watchdog / 2
+			slog.Info("systemd watchdog enabled", "interval", interval)
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				_ = Notify("STOPPING=1")
+				return
+			case <-ticker.C:
+				state := "STATUS=" + status()
+				if watchdog > 0 {
+					if failures := checker.Alive(); len(failures) == 0 {
+						state += "\nWATCHDOG=1"
+					} else {
+						// systemd restarts the service once WatchdogSec passes without a ping
+						slog.Error("liveness checks failed, skipping watchdog ping", "failures", formatFailures(failures))
+						state = "STATUS=unhealthy: " + formatFailures(failures)
+					}
+				}
+				if err := Notify(state); err != nil {
+					slog.Warn("sd_notify failed", "err", err)
+				}
+			}
+		}
+	}
+}
+
+func formatFailures(failures map[string]string) string {
+	parts := make([]string, 0, len(failures))
+	for k, v := range failures {
+		parts = append(parts, k+": "+v)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "; ")
+}
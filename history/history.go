@@ -0,0 +1,400 @@
+// Package history is a compact on-disk store of sensor readings. Raw samples are kept in daily files and
+// downsampled to hourly min/max/avg, which are kept for much longer in monthly files.
+package history
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rawDir        = "raw"
+	hourlyDir     = "hourly"
+	rawLayout     = "2006-01-02"
+	hourlyLayout  = "2006-01"
+	fileExt       = ".dat"
+	rawRecordLen  = 8  // seconds uint32, value float32
+	hourRecordLen = 20 // seconds uint32, min, max, avg float32, count uint32
+)
+
+// Retention is how long the raw samples and the hourly aggregates are kept.
+type Retention struct {
+	Raw    time.Duration
+	Hourly time.Duration
+}
+
+// DefaultRetention keeps raw samples for a week and hourly aggregates for a year.
+var DefaultRetention = Retention{Raw: 7 * 24 * time.Hour, Hourly: 365 * 24 * time.Hour}
+
+// Point is a raw sample, or an hourly aggregate starting at Time. Min, Max and Avg of a raw sample are its value.
+type Point struct {
+	Time  time.Time
+	Min   float64
+	Max   float64
+	Avg   float64
+	Count int
+}
+
+// Store keeps time series in a directory, one subdirectory per series.
+type Store struct {
+	dir       string
+	retention Retention
+	now       func() time.Time
+
+	mu sync.Mutex
+	// lastHour is the hour of the latest raw sample by series, the hour is downsampled once a sample of a later one comes
+	lastHour map[string]time.Time
+}
+
+// Open creates the store directory if needed.
+func Open(dir string, retention Retention) (*Store, error) {
+	if retention.Raw <= 0 || retention.Hourly <= 0 {
+		return nil, errors.New("retention must be positive")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, retention: retention, now: time.Now, lastHour: make(map[string]time.Time)}, nil
+}
+
+// Dir is the store directory.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// seriesDir maps a series name to a directory, so that names like "iio:device0.temperature" or "../x" are safe.
+func (s *Store) seriesDir(series string) (string, error) {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, series)
+	if len(strings.Trim(name, ".")) == 0 {
+		return "", fmt.Errorf("invalid series name %q", series)
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+// Append stores a sample. Samples are expected in chronological order, once a sample of a new hour comes,
+// the previous hour is downsampled and the expired files are removed.
+func (s *Store) Append(series string, t time.Time, v float64) error {
+	dir, err := s.seriesDir(series)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t = t.UTC().Truncate(time.Second)
+	hour := t.Truncate(time.Hour)
+
+	last, found := s.lastHour[series]
+	if !found {
+		if p, err := lastRawPoint(dir); err == nil {
+			last, found = p.Time.Truncate(time.Hour), true
+		}
+	}
+	if found && hour.After(last) {
+		if err = downsample(dir, last); err != nil {
+			return fmt.Errorf("downsample %s: %w", series, err)
+		}
+		if err = s.prune(dir); err != nil {
+			return fmt.Errorf("prune %s: %w", series, err)
+		}
+	}
+	if !found || hour.After(last) {
+		s.lastHour[series] = hour
+	}
+
+	var rec [rawRecordLen]byte
+	binary.LittleEndian.PutUint32(rec[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], math.Float32bits(float32(v)))
+	return appendRecord(filepath.Join(dir, rawDir, t.Format(rawLayout)+fileExt), rec[:])
+}
+
+// Query returns the points of a series in [from, to). Raw samples are returned if the raw ones are still kept
+// for the whole window, otherwise hourly aggregates followed by the raw samples of the hour, which is not downsampled yet.
+func (s *Store) Query(series string, from, to time.Time) ([]Point, error) {
+	dir, err := s.seriesDir(series)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	from, to = from.UTC(), to.UTC()
+	if !from.Before(s.now().Add(-s.retention.Raw)) {
+		return readRaw(dir, from, to)
+	}
+
+	ret, err := readHourly(dir, from, to)
+	if err != nil {
+		return nil, err
+	}
+	rawFrom := from
+	if len(ret) > 0 {
+		rawFrom = ret[len(ret)-1].Time.Add(time.Hour)
+	}
+	raw, err := readRaw(dir, rawFrom, to)
+	if err != nil {
+		return nil, err
+	}
+	return append(ret, raw...), nil
+}
+
+// prune removes files, which are entirely past the retention.
+func (s *Store) prune(dir string) error {
+	now := s.now()
+	if err := removeExpired(filepath.Join(dir, rawDir), rawLayout, now.Add(-s.retention.Raw), func(t time.Time) time.Time {
+		return t.AddDate(0, 0, 1)
+	}); err != nil {
+		return err
+	}
+	return removeExpired(filepath.Join(dir, hourlyDir), hourlyLayout, now.Add(-s.retention.Hourly), func(t time.Time) time.Time {
+		return t.AddDate(0, 1, 0)
+	})
+}
+
+func removeExpired(dir, layout string, before time.Time, end func(time.Time) time.Time) error {
+	for _, v := range listFiles(dir, layout) {
+		if !end(v.start).After(before) {
+			if err := os.Remove(v.path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type dataFile struct {
+	path  string
+	start time.Time
+}
+
+// listFiles returns the data files of a directory in chronological order. Unknown files are ignored.
+func listFiles(dir, layout string) []dataFile {
+	entries, _ := os.ReadDir(dir)
+	var ret []dataFile
+	for _, v := range entries {
+		name := v.Name()
+		if v.IsDir() || !strings.HasSuffix(name, fileExt) {
+			continue
+		}
+		start, err := time.Parse(layout, strings.TrimSuffix(name, fileExt))
+		if err != nil {
+			continue
+		}
+		ret = append(ret, dataFile{path: filepath.Join(dir, name), start: start})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].start.Before(ret[j].start) })
+	return ret
+}
+
+// appendRecord appends a fixed size record. A record torn by a crash is cut off first, so that the file stays aligned.
+func appendRecord(fpath string, rec []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fpath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if tail := size % int64(len(rec)); tail != 0 {
+		if err = f.Truncate(size - tail); err != nil {
+			return err
+		}
+		if _, err = f.Seek(size-tail, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	_, err = f.Write(rec)
+	return err
+}
+
+// readRecords returns the whole records of a file.
+func readRecords(fpath string, recLen int) ([][]byte, error) {
+	b, err := os.ReadFile(fpath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret := make([][]byte, 0, len(b)/recLen)
+	for i := 0; i+recLen <= len(b); i += recLen {
+		ret = append(ret, b[i:i+recLen])
+	}
+	return ret, nil
+}
+
+func decodeRaw(rec []byte) Point {
+	v := float64(math.Float32frombits(binary.LittleEndian.Uint32(rec[4:])))
+	return Point{Time: time.Unix(int64(binary.LittleEndian.Uint32(rec[0:])), 0).UTC(), Min: v, Max: v, Avg: v, Count: 1}
+}
+
+func decodeHourly(rec []byte) Point {
+	return Point{
+		Time:  time.Unix(int64(binary.LittleEndian.Uint32(rec[0:])), 0).UTC(),
+		Min:   float64(math.Float32frombits(binary.LittleEndian.Uint32(rec[4:]))),
+		Max:   float64(math.Float32frombits(binary.LittleEndian.Uint32(rec[8:]))),
+		Avg:   float64(math.Float32frombits(binary.LittleEndian.Uint32(rec[12:]))),
+		Count: int(binary.LittleEndian.Uint32(rec[16:])),
+	}
+}
+
+func encodeHourly(p Point) []byte {
+	var rec [hourRecordLen]byte
+	binary.LittleEndian.PutUint32(rec[0:], uint32(p.Time.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], math.Float32bits(float32(p.Min)))
+	binary.LittleEndian.PutUint32(rec[8:], math.Float32bits(float32(p.Max)))
+	binary.LittleEndian.PutUint32(rec[12:], math.Float32bits(float32(p.Avg)))
+	binary.LittleEndian.PutUint32(rec[16:], uint32(p.Count))
+	return rec[:]
+}
+
+// readRaw returns the raw samples in [from, to).
+func readRaw(dir string, from, to time.Time) ([]Point, error) {
+	var ret []Point
+	for _, v := range listFiles(filepath.Join(dir, rawDir), rawLayout) {
+		if !v.start.AddDate(0, 0, 1).After(from) || !v.start.Before(to) {
+			continue
+		}
+		records, err := readRecords(v.path, rawRecordLen)
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range records {
+			if p := decodeRaw(rec); !p.Time.Before(from) && p.Time.Before(to) {
+				ret = append(ret, p)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// readHourly returns the hourly aggregates of the hours starting in [from, to).
+func readHourly(dir string, from, to time.Time) ([]Point, error) {
+	var ret []Point
+	for _, v := range listFiles(filepath.Join(dir, hourlyDir), hourlyLayout) {
+		if !v.start.AddDate(0, 1, 0).After(from) || !v.start.Before(to) {
+			continue
+		}
+		records, err := readRecords(v.path, hourRecordLen)
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range records {
+			if p := decodeHourly(rec); !p.Time.Before(from.Truncate(time.Hour)) && p.Time.Before(to) {
+				ret = append(ret, p)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// lastRawPoint returns the latest raw sample of a series.
+func lastRawPoint(dir string) (Point, error) {
+	files := listFiles(filepath.Join(dir, rawDir), rawLayout)
+	for i := len(files) - 1; i >= 0; i-- {
+		records, err := readRecords(files[i].path, rawRecordLen)
+		if err != nil {
+			return Point{}, err
+		}
+		if len(records) > 0 {
+			return decodeRaw(records[len(records)-1]), nil
+		}
+	}
+	return Point{}, os.ErrNotExist
+}
+
+// downsample aggregates the raw samples of an hour, unless it's been done already.
+func downsample(dir string, hour time.Time) error {
+	fpath := filepath.Join(dir, hourlyDir, hour.Format(hourlyLayout)+fileExt)
+	records, err := readRecords(fpath, hourRecordLen)
+	if err != nil {
+		return err
+	}
+	if len(records) > 0 && !decodeHourly(records[len(records)-1]).Time.Before(hour) {
+		return nil
+	}
+
+	raw, err := readRaw(dir, hour, hour.Add(time.Hour))
+	if err != nil || len(raw) == 0 {
+		return err
+	}
+	agg := Summarize(raw)
+	return appendRecord(fpath, encodeHourly(Point{Time: hour, Min: agg.Min, Max: agg.Max, Avg: agg.Avg, Count: agg.Count}))
+}
+
+// Summary describes a window of points.
+type Summary struct {
+	Min     float64
+	MinTime time.Time
+	Max     float64
+	MaxTime time.Time
+	Avg     float64
+	Count   int
+	Last    Point
+}
+
+// Summarize returns min, max and the average weighted by the number of samples of the points.
+// Count is zero if there are no points.
+func Summarize(points []Point) Summary {
+	var (
+		ret Summary
+		sum float64
+	)
+	for i, v := range points {
+		if i == 0 || v.Min < ret.Min {
+			ret.Min, ret.MinTime = v.Min, v.Time
+		}
+		if i == 0 || v.Max > ret.Max {
+			ret.Max, ret.MaxTime = v.Max, v.Time
+		}
+		sum += v.Avg * float64(v.Count)
+		ret.Count += v.Count
+		ret.Last = v
+	}
+	if ret.Count > 0 {
+		ret.Avg = sum / float64(ret.Count)
+	}
+	return ret
+}
+
+// ParseDuration is time.ParseDuration, which also accepts whole days, weeks and years, e.g. 7d, 2w or 1y.
+func ParseDuration(s string) (time.Duration, error) {
+	units := map[byte]time.Duration{'d': 24 * time.Hour, 'w': 7 * 24 * time.Hour, 'y': 365 * 24 * time.Hour}
+	if len(s) > 1 {
+		if unit, found := units[s[len(s)-1]]; found {
+			n, err := strconv.Atoi(s[:len(s)-1])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, err
+}
@@ -0,0 +1,138 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var epoch = time.Date(2024, 1, 30, 22, 0, 0, 0, time.UTC)
+
+func openTestStore(t *testing.T, now *time.Time) *Store {
+	s, err := Open(t.TempDir(), Retention{Raw: 2 * 24 * time.Hour, Hourly: 60 * 24 * time.Hour})
+	require.NoError(t, err)
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+func TestHistory_AppendQueryRaw(t *testing.T) {
+	now := epoch
+	s := openTestStore(t, &now)
+
+	// every 10 minutes for 4 hours, crossing midnight
+	for i := 0; i < 24; i++ {
+		now = epoch.Add(time.Duration(i) * 10 * time.Minute)
+		require.NoError(t, s.Append("attic.temperature", now, float64(i)))
+	}
+
+	points, err := s.Query("attic.temperature", epoch.Add(time.Hour), epoch.Add(3*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, points, 12)
+	assert.Equal(t, epoch.Add(time.Hour), points[0].Time)
+	assert.Equal(t, 6.0, points[0].Avg)
+	assert.Equal(t, 1, points[0].Count)
+	assert.Equal(t, 17.0, points[11].Max)
+
+	// the raw samples are in daily files
+	entries, err := os.ReadDir(filepath.Join(s.Dir(), "attic.temperature", rawDir))
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	points, err = s.Query("cellar.temperature", epoch, now)
+	assert.NoError(t, err)
+	assert.Empty(t, points)
+}
+
+func TestHistory_DownsampleAndRetention(t *testing.T) {
+	now := epoch
+	s := openTestStore(t, &now)
+
+	for i := 0; i < 5*24*6; i++ {
+		now = epoch.Add(time.Duration(i) * 10 * time.Minute)
+		require.NoError(t, s.Append("attic.temperature", now, float64(i%6)))
+	}
+
+	// raw files older than 2 days are removed, 3 days ago is served from the hourly aggregates
+	entries, err := os.ReadDir(filepath.Join(s.Dir(), "attic.temperature", rawDir))
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	points, err := s.Query("attic.temperature", epoch, now.Add(time.Minute))
+	require.NoError(t, err)
+	// 5 days of hourly aggregates but the last hour, which is still raw
+	require.Len(t, points, 5*24-1+6)
+	assert.Equal(t, epoch, points[0].Time)
+	assert.Equal(t, Point{Time: epoch, Min: 0, Max: 5, Avg: 2.5, Count: 6}, points[0])
+	assert.Equal(t, 1, points[len(points)-1].Count)
+
+	sum := Summarize(points)
+	assert.Equal(t, 5*24*6, sum.Count)
+	assert.Equal(t, 0.0, sum.Min)
+	assert.Equal(t, 5.0, sum.Max)
+	assert.InDelta(t, 2.5, sum.Avg, 1e-9)
+	assert.Equal(t, now, sum.Last.Time)
+
+	// hourly aggregates expire as well
+	now = now.Add(90 * 24 * time.Hour)
+	require.NoError(t, s.Append("attic.temperature", now, 1))
+	entries, err = os.ReadDir(filepath.Join(s.Dir(), "attic.temperature", hourlyDir))
+	require.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
+
+func TestHistory_Restart(t *testing.T) {
+	now := epoch
+	s := openTestStore(t, &now)
+	require.NoError(t, s.Append("attic.temperature", now, 1))
+	require.NoError(t, s.Append("attic.temperature", now.Add(time.Minute), 3))
+
+	// a torn record is cut off
+	f, err := os.OpenFile(filepath.Join(s.Dir(), "attic.temperature", rawDir, "2024-01-30.dat"), os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// the hour before the restart is downsampled by the new instance
+	s, err = Open(s.Dir(), s.retention)
+	require.NoError(t, err)
+	now = epoch.Add(time.Hour)
+	s.now = func() time.Time { return now }
+	require.NoError(t, s.Append("attic.temperature", now, 5))
+
+	points, err := readHourly(filepath.Join(s.Dir(), "attic.temperature"), epoch, now)
+	require.NoError(t, err)
+	assert.Equal(t, []Point{{Time: epoch, Min: 1, Max: 3, Avg: 2, Count: 2}}, points)
+
+	points, err = s.Query("attic.temperature", epoch, now.Add(time.Second))
+	require.NoError(t, err)
+	assert.Len(t, points, 3)
+}
+
+func TestHistory_SeriesNames(t *testing.T) {
+	now := epoch
+	s := openTestStore(t, &now)
+
+	require.NoError(t, s.Append("iio:device0.temperature", now, 1))
+	require.NoError(t, s.Append("../../etc", now, 1))
+	_, err := os.Stat(filepath.Join(s.Dir(), ".._.._etc"))
+	assert.NoError(t, err)
+	assert.Error(t, s.Append("..", now, 1))
+	assert.Error(t, s.Append("", now, 1))
+}
+
+func TestHistory_ParseDuration(t *testing.T) {
+	for k, v := range map[string]time.Duration{"24h": 24 * time.Hour, "90m": 90 * time.Minute, "7d": 7 * 24 * time.Hour, "2w": 14 * 24 * time.Hour, "1y": 365 * 24 * time.Hour} {
+		d, err := ParseDuration(k)
+		assert.NoError(t, err, k)
+		assert.Equal(t, v, d, k)
+	}
+	for _, v := range []string{"", "d", "-1d", "0h", "1.5d", "attic"} {
+		_, err := ParseDuration(v)
+		assert.Error(t, err, v)
+	}
+}
@@ -0,0 +1,127 @@
+// Package logging configures log/slog for the service and keeps secrets out of the logs.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces secrets in the log output.
+const Redacted = "[REDACTED]"
+
+var (
+	// botTokenPattern matches Telegram bot tokens, which also appear in the API URLs of the errors.
+	botTokenPattern = regexp.MustCompile(`\d{5,}:[A-Za-z0-9_-]{30,}`)
+
+	// sensitiveKeys are attributes, which are never logged as is.
+	sensitiveKeys = map[string]struct{}{
+		"token":    {},
+		"password": {},
+		"secret":   {},
+		"payload":  {},
+	}
+)
+
+// Options configure the logger.
+type Options struct {
+	// Level is one of debug, info, warn or error. Defaults to info.
+	Level string
+	// Format is text or json. Defaults to text.
+	Format string
+	// Secrets are redacted from messages and attributes.
+	Secrets []string
+}
+
+// OptionsFromEnv reads LOG_LEVEL, LOG_FORMAT and treats TELEGRAM_APITOKEN as a secret.
+func OptionsFromEnv() Options {
+	return Options{
+		Level:   os.Getenv("LOG_LEVEL"),
+		Format:  os.Getenv("LOG_FORMAT"),
+		Secrets: []string{os.Getenv("TELEGRAM_APITOKEN")},
+	}
+}
+
+// Setup installs the default slog logger, which the standard log package writes to as well.
+func Setup(w io.Writer, opts Options) error {
+	logger, err := New(w, opts)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// New returns a logger, which redacts secrets.
+func New(w io.Writer, opts Options) (*slog.Logger, error) {
+	var level slog.Level
+	if len(opts.Level) > 0 {
+		if err := level.UnmarshalText([]byte(opts.Level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q", opts.Level)
+		}
+	}
+
+	r := newRedactor(opts.Secrets)
+	handlerOpts := &slog.HandlerOptions{Level: level, ReplaceAttr: r.replaceAttr}
+
+	switch strings.ToLower(opts.Format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q", opts.Format)
+}
+
+type redactor struct {
+	replacer *strings.Replacer
+}
+
+func newRedactor(secrets []string) redactor {
+	var oldnew []string
+	for _, v := range secrets {
+		if len(strings.TrimSpace(v)) > 0 {
+			oldnew = append(oldnew, v, Redacted)
+		}
+	}
+	return redactor{replacer: strings.NewReplacer(oldnew...)}
+}
+
+// Redact removes secrets from s.
+func (r redactor) Redact(s string) string {
+	return botTokenPattern.ReplaceAllString(r.replacer.Replace(s), Redacted)
+}
+
+// replaceAttr is called by slog handlers for every attribute, including the message.
+func (r redactor) replaceAttr(_ []string, a slog.Attr) slog.Attr {
+	if _, found := sensitiveKeys[strings.ToLower(a.Key)]; found {
+		return slog.String(a.Key, Redacted)
+	}
+
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, r.Redact(v.String()))
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case error:
+			return slog.String(a.Key, r.Redact(x.Error()))
+		case fmt.Stringer:
+			return slog.String(a.Key, r.Redact(x.String()))
+		case []byte:
+			return slog.String(a.Key, r.Redact(string(x)))
+		default:
+			return slog.String(a.Key, r.Redact(fmt.Sprintf("%+v", x)))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// Fatal logs an error and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testToken = "1234567890:AAHdqTcvCH1vGWJxfSeofSAs0K5PALDsaw"
+
+func TestLogging_RedactsToken(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Options{Secrets: []string{testToken, " "}})
+	require.NoError(t, err)
+
+	logger.Info("calling https://api.telegram.org/bot"+testToken+"/getMe",
+		"err", errors.New(`Post "https://api.telegram.org/bot`+testToken+`/sendMessage": timeout`),
+		"url", "https://api.telegram.org/bot"+testToken,
+		slog.Group("request", "token", "anything", "chat_id", 42))
+
+	out := buf.String()
+	assert.NotContains(t, out, testToken)
+	assert.Contains(t, out, "bot"+Redacted+"/getMe")
+	assert.Contains(t, out, "request.token="+Redacted)
+	assert.Contains(t, out, "request.chat_id=42")
+}
+
+func TestLogging_RedactsUnknownTokens(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Options{})
+	require.NoError(t, err)
+
+	logger.Warn("failure", "err", errors.New("/bot987654321:ZZHdqTcvCH1vGWJxfSeofSAs0K5PALDsaw/getUpdates"))
+	assert.NotContains(t, buf.String(), "ZZHdqTcvCH1vGWJxfSeofSAs0K5PALDsaw")
+}
+
+func TestLogging_JSONAndLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Options{Level: "warn", Format: "json", Secrets: []string{testToken}})
+	require.NoError(t, err)
+
+	logger.Info("hidden")
+	logger.Warn("token "+testToken, "payload", "hello", "chat_id", int64(42))
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "WARN", entry["level"])
+	assert.Equal(t, "token "+Redacted, entry["msg"])
+	assert.Equal(t, Redacted, entry["payload"])
+	assert.Equal(t, float64(42), entry["chat_id"])
+}
+
+func TestLogging_InvalidOptions(t *testing.T) {
+	_, err := New(&bytes.Buffer{}, Options{Level: "verbose"})
+	assert.Error(t, err)
+	_, err = New(&bytes.Buffer{}, Options{Format: "xml"})
+	assert.Error(t, err)
+}
+
+func TestLogging_StdLogRedirected(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	defer log.SetFlags(log.Flags())
+	defer log.SetOutput(log.Writer())
+
+	var buf bytes.Buffer
+	require.NoError(t, Setup(&buf, Options{Secrets: []string{testToken}}))
+
+	log.Println("legacy", testToken)
+	assert.Contains(t, buf.String(), "legacy "+Redacted)
+}
@@ -0,0 +1,332 @@
+// Package metrics is a minimal implementation of Prometheus counters, gauges and histograms
+// exposed in the Prometheus text format. It has no dependencies, so metrics cost nothing when not scraped.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are the default histogram buckets in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Default is the registry, which the package level constructors register metrics with.
+var Default = &Registry{}
+
+// Registry is a set of metric families.
+type Registry struct {
+	mu       sync.RWMutex
+	families []*family
+}
+
+type metricType string
+
+const (
+	typeCounter   metricType = "counter"
+	typeGauge     metricType = "gauge"
+	typeHistogram metricType = "histogram"
+)
+
+// family is a named metric with a set of label values.
+type family struct {
+	name    string
+	help    string
+	typ     metricType
+	labels  []string
+	buckets []float64
+
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+// series is a single time series of a family: a value or a histogram.
+type series struct {
+	labelValues []string
+	value       uint64 // float64 bits
+	counts      []uint64
+	count       uint64
+	sum         uint64 // float64 bits
+}
+
+func (r *Registry) register(name, help string, typ metricType, buckets []float64, labels []string) *family {
+	f := &family{name: name, help: help, typ: typ, labels: labels, buckets: buckets, series: make(map[string]*series)}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range r.families {
+		if v.name == name {
+			panic("metrics: duplicate metric " + name)
+		}
+	}
+	r.families = append(r.families, f)
+	return f
+}
+
+func (f *family) with(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.RLock()
+	s, found := f.series[key]
+	f.mu.RUnlock()
+	if found {
+		return s
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, found = f.series[key]; !found {
+		s = &series{labelValues: append([]string(nil), labelValues...), counts: make([]uint64, len(f.buckets))}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) delete(labelValues []string) {
+	f.mu.Lock()
+	delete(f.series, strings.Join(labelValues, "\xff"))
+	f.mu.Unlock()
+}
+
+func addFloat(addr *uint64, delta float64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		if atomic.CompareAndSwapUint64(addr, old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func loadFloat(addr *uint64) float64 {
+	return math.Float64frombits(atomic.LoadUint64(addr))
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct{ s *series }
+
+// Inc increments the counter by 1.
+func (c Counter) Inc() { c.Add(1) }
+
+// Add increments the counter by a non-negative delta.
+func (c Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counter can't decrease")
+	}
+	addFloat(&c.s.value, delta)
+}
+
+// Value returns the current value.
+func (c Counter) Value() float64 { return loadFloat(&c.s.value) }
+
+// Gauge is a value, which can go up and down.
+type Gauge struct{ s *series }
+
+// Set sets the gauge value.
+func (g Gauge) Set(v float64) { atomic.StoreUint64(&g.s.value, math.Float64bits(v)) }
+
+// Add adds delta, which may be negative, to the gauge.
+func (g Gauge) Add(delta float64) { addFloat(&g.s.value, delta) }
+
+// Value returns the current value.
+func (g Gauge) Value() float64 { return loadFloat(&g.s.value) }
+
+// Histogram samples observations into buckets.
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// Observe adds a single observation.
+func (h Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		atomic.AddUint64(&h.s.counts[i], 1)
+	}
+	atomic.AddUint64(&h.s.count, 1)
+	addFloat(&h.s.sum, v)
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct{ f *family }
+
+// With returns the counter for the label values given in the order of the label names.
+func (v CounterVec) With(labelValues ...string) Counter { return Counter{v.f.with(labelValues)} }
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct{ f *family }
+
+// With returns the gauge for the label values given in the order of the label names.
+func (v GaugeVec) With(labelValues ...string) Gauge { return Gauge{v.f.with(labelValues)} }
+
+// Delete removes the gauge for the label values from the output.
+func (v GaugeVec) Delete(labelValues ...string) { v.f.delete(labelValues) }
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct{ f *family }
+
+// With returns the histogram for the label values given in the order of the label names.
+func (v HistogramVec) With(labelValues ...string) Histogram {
+	return Histogram{v.f.with(labelValues), v.f.buckets}
+}
+
+// NewCounter registers a counter without labels.
+func (r *Registry) NewCounter(name, help string) Counter {
+	return Counter{r.register(name, help, typeCounter, nil, nil).with(nil)}
+}
+
+// NewCounterVec registers a counter partitioned by labels.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) CounterVec {
+	return CounterVec{r.register(name, help, typeCounter, nil, labels)}
+}
+
+// NewGauge registers a gauge without labels.
+func (r *Registry) NewGauge(name, help string) Gauge {
+	return Gauge{r.register(name, help, typeGauge, nil, nil).with(nil)}
+}
+
+// NewGaugeVec registers a gauge partitioned by labels.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) GaugeVec {
+	return GaugeVec{r.register(name, help, typeGauge, nil, labels)}
+}
+
+// NewHistogram registers a histogram without labels. Buckets must be sorted.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) Histogram {
+	return HistogramVec{r.register(name, help, typeHistogram, buckets, nil)}.With()
+}
+
+// NewHistogramVec registers a histogram partitioned by labels. Buckets must be sorted.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) HistogramVec {
+	return HistogramVec{r.register(name, help, typeHistogram, buckets, labels)}
+}
+
+// NewCounter registers a counter without labels with the default registry.
+func NewCounter(name, help string) Counter { return Default.NewCounter(name, help) }
+
+// NewCounterVec registers a counter partitioned by labels with the default registry.
+func NewCounterVec(name, help string, labels ...string) CounterVec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+
+// NewGauge registers a gauge without labels with the default registry.
+func NewGauge(name, help string) Gauge { return Default.NewGauge(name, help) }
+
+// NewGaugeVec registers a gauge partitioned by labels with the default registry.
+func NewGaugeVec(name, help string, labels ...string) GaugeVec {
+	return Default.NewGaugeVec(name, help, labels...)
+}
+
+// NewHistogram registers a histogram without labels with the default registry.
+func NewHistogram(name, help string, buckets []float64) Histogram {
+	return Default.NewHistogram(name, help, buckets)
+}
+
+// NewHistogramVec registers a histogram partitioned by labels with the default registry.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labels...)
+}
+
+// Write writes all metrics in the Prometheus text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.RLock()
+	families := append([]*family(nil), r.families...)
+	r.mu.RUnlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	var b strings.Builder
+	for _, f := range families {
+		f.write(&b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *family) write(b *strings.Builder) {
+	f.mu.RLock()
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	f.mu.RUnlock()
+
+	if len(all) == 0 {
+		return
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].labelValues, "\xff") < strings.Join(all[j].labelValues, "\xff")
+	})
+
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, escape(f.help, false))
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.typ)
+
+	for _, s := range all {
+		if f.typ != typeHistogram {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, f.labelPairs(s.labelValues, ""), formatFloat(loadFloat(&s.value)))
+			continue
+		}
+
+		var cumulative uint64
+		for i, upper := range f.buckets {
+			cumulative += atomic.LoadUint64(&s.counts[i])
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, f.labelPairs(s.labelValues, formatFloat(upper)), cumulative)
+		}
+		count := atomic.LoadUint64(&s.count)
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, f.labelPairs(s.labelValues, "+Inf"), count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, f.labelPairs(s.labelValues, ""), formatFloat(loadFloat(&s.sum)))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, f.labelPairs(s.labelValues, ""), count)
+	}
+}
+
+// labelPairs formats labels as {a="b",c="d"}, adding the histogram bucket label if le is not empty.
+func (f *family) labelPairs(values []string, le string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, v := range values {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", f.labels[i], escape(v, true)))
+	}
+	if len(le) > 0 {
+		pairs = append(pairs, fmt.Sprintf("le=\"%s\"", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(s string, quotes bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quotes {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler serves the registry in the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.Write(w)
+	})
+}
+
+// Handler serves the default registry.
+func Handler() http.Handler {
+	return Default.Handler()
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics_Counter(t *testing.T) {
+	r := &Registry{}
+	c := r.NewCounterVec("meerkat_messages_sent_total", "Messages sent.", "type")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() { c.With("text").Inc(); wg.Done() }()
+	}
+	wg.Wait()
+	c.With(`pic"ture`).Add(2.5)
+
+	var b strings.Builder
+	require.NoError(t, r.Write(&b))
+	assert.Equal(t, `# HELP meerkat_messages_sent_total Messages sent.
+# TYPE meerkat_messages_sent_total counter
+meerkat_messages_sent_total{type="pic\"ture"} 2.5
+meerkat_messages_sent_total{type="text"} 100
+`, b.String())
+
+	assert.Panics(t, func() { c.With("text").Add(-1) })
+	assert.Panics(t, func() { c.With("text", "extra") })
+	assert.Panics(t, func() { r.NewCounter("meerkat_messages_sent_total", "") })
+}
+
+func TestMetrics_Gauge(t *testing.T) {
+	r := &Registry{}
+	g := r.NewGauge("meerkat_watches", "Watches.")
+	gv := r.NewGaugeVec("meerkat_temperature_celsius", "Temperature.", "sensor")
+
+	g.Set(10)
+	g.Add(-3)
+	gv.With("attic").Set(-1.5)
+	gv.With("cellar").Set(4)
+	gv.Delete("cellar")
+
+	var b strings.Builder
+	require.NoError(t, r.Write(&b))
+	assert.Equal(t, `# HELP meerkat_temperature_celsius Temperature.
+# TYPE meerkat_temperature_celsius gauge
+meerkat_temperature_celsius{sensor="attic"} -1.5
+# HELP meerkat_watches Watches.
+# TYPE meerkat_watches gauge
+meerkat_watches 7
+`, b.String())
+}
+
+func TestMetrics_Histogram(t *testing.T) {
+	r := &Registry{}
+	h := r.NewHistogramVec("meerkat_task_duration_seconds", "Task duration.", []float64{0.1, 1}, "task")
+
+	h.With("ip").Observe(0.05)
+	h.With("ip").Observe(0.5)
+	h.With("ip").Observe(5)
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+	assert.Equal(t, `# HELP meerkat_task_duration_seconds Task duration.
+# TYPE meerkat_task_duration_seconds histogram
+meerkat_task_duration_seconds_bucket{task="ip",le="0.1"} 1
+meerkat_task_duration_seconds_bucket{task="ip",le="1"} 2
+meerkat_task_duration_seconds_bucket{task="ip",le="+Inf"} 3
+meerkat_task_duration_seconds_sum{task="ip"} 5.55
+meerkat_task_duration_seconds_count{task="ip"} 3
+`, rec.Body.String())
+}
+
+func TestMetrics_EmptyFamilyOmitted(t *testing.T) {
+	r := &Registry{}
+	r.NewCounterVec("meerkat_commands_total", "Commands.", "command")
+
+	var b strings.Builder
+	require.NoError(t, r.Write(&b))
+	assert.Empty(t, b.String())
+}
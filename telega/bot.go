@@ -5,16 +5,19 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/logging"
 )
 
 // handler for a single command.
@@ -86,6 +89,47 @@ func (c *ChattableDocument) SetChatID(chatID int64) {
 	c.BaseChat.ChatID = chatID
 }
 
+// ChattableAddressed is a chattable message, which is delivered to a single chat rather than to all of the allowed chats.
+// It travels the same path as background events, so the chat must be one of the allowed chats.
+type ChattableAddressed struct {
+	ChattableCloser
+	// ChatID is the recipient chat. Zero means all of the allowed chats.
+	ChatID int64
+	// Result, if not nil, receives the delivery outcome. It should be buffered to not block the bot.
+	Result chan<- error
+}
+
+// ErrChatNotAllowed is reported for messages addressed to a chat, which is not in the allowed chats list.
+var ErrChatNotAllowed = errors.New("chat is not allowed")
+
+// DeliveryError is reported for messages, which some of the chats did not get. The rest of them did, so
+// the message should not be sent again to all of the chats.
+type DeliveryError struct {
+	// Failed are the errors by the chat
+	Failed map[int64]error
+	// Delivered are the chats, which got the message
+	Delivered []int64
+}
+
+func (e *DeliveryError) Error() string {
+	chats := e.Undelivered()
+	msgs := make([]string, 0, len(chats))
+	for _, v := range chats {
+		msgs = append(msgs, fmt.Sprintf("chat %d: %v", v, e.Failed[v]))
+	}
+	return fmt.Sprintf("not delivered to %s, delivered to %d of %d chats", strings.Join(msgs, ", "), len(e.Delivered), len(e.Delivered)+len(chats))
+}
+
+// Undelivered returns the chats, which did not get the message.
+func (e *DeliveryError) Undelivered() []int64 {
+	chats := make([]int64, 0, len(e.Failed))
+	for k := range e.Failed {
+		chats = append(chats, k)
+	}
+	sort.Slice(chats, func(i, j int) bool { return chats[i] < chats[j] })
+	return chats
+}
+
 // CommandHandler is a function, which can handle a specific bot command
 type CommandHandler func(ctx context.Context, cmd *tgbotapi.Message, bot *tgbotapi.BotAPI) (response ChattableCloser, err error)
 
@@ -97,15 +141,18 @@ type BackgroundFunction func(ctx context.Context, events chan<- ChattableCloser)
 
 // define periodic functions.
 type periodicTaskDef struct {
-	interval uint32
-	intro    string
-	fn       TaskFunction
+	interval   uint32
+	intro      string
+	fn         TaskFunction
+	lastRun    time.Time
+	lastResult string
 }
 
 const (
 	httpTimeout         = 30 * time.Second
 	retryInterval       = 2 * time.Second
 	minPeriodicInterval = 5 * time.Minute
+	heartbeatInterval   = 5 * time.Second
 )
 
 type interruptedErr struct {
@@ -133,15 +180,20 @@ type Bot struct {
 	periodicTasks       []periodicTaskDef
 	backgroundFunctions []BackgroundFunction
 	periodicTaskCycle   uint32
+	periodicTick        time.Time
 	ctx                 context.Context
 	backgroundEvents    chan ChattableCloser
+	backgroundRunning   int32
+	heartbeat           int64
+	mu                  sync.RWMutex
 }
 
 // Init initializes telegram bot.
 func (b *Bot) Init(ctx context.Context, runtime string) error {
 	var err error
 
-	log.Println("connecting bot client to API")
+	slog.Info("connecting bot client to API")
+	_ = tgbotapi.SetLogger(apiLogger{})
 
 	c := &http.Client{Timeout: httpTimeout}
 	err = retryTillInterrupt(ctx, func(_ context.Context) error {
@@ -155,7 +207,8 @@ func (b *Bot) Init(ctx context.Context, runtime string) error {
 	}
 
 	b.runtime = runtime
-	b.bot.Debug = true
+	// API tracing dumps the requests and responses, including the messages
+	b.bot.Debug = os.Getenv("TELEGRAM_DEBUG") == "true"
 	b.ctx = ctx
 	b.backgroundEvents = make(chan ChattableCloser, 10)
 
@@ -164,11 +217,14 @@ func (b *Bot) Init(ctx context.Context, runtime string) error {
 
 // AddHandler registers a new handler function against a command string.
 func (b *Bot) AddHandler(cmd string, handler CommandHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	if b.cmdHandlers == nil {
 		b.cmdHandlers = make(map[string]CommandHandler)
 	}
 
-	log.Println("registered command:", cmd)
+	slog.Info("registered command", "command", cmd)
 
 	b.cmdHandlers[cmd] = handler
 }
@@ -188,8 +244,10 @@ func (b *Bot) AddPeriodicTask(interval time.Duration, reportMessage string, fn T
 		taskDef.interval = uint32(math.Floor(fullIntervals))
 	}
 
-	log.Println("added task [", taskDef.intro, "] to run every", uint32(time.Duration(taskDef.interval)*minPeriodicInterval/time.Minute), "minutes")
+	slog.Info("added periodic task", "task", taskDef.intro, "interval", time.Duration(taskDef.interval)*minPeriodicInterval)
+	b.mu.Lock()
 	b.periodicTasks = append(b.periodicTasks, taskDef)
+	b.mu.Unlock()
 }
 
 func (b *Bot) AddBackgroundTask(fn BackgroundFunction) {
@@ -197,11 +255,11 @@ func (b *Bot) AddBackgroundTask(fn BackgroundFunction) {
 }
 
 // Run starts the bot till interrupted.
-func (b Bot) Run() (string, error) {
+func (b *Bot) Run() (string, error) {
 	// parse restrictions
 	strChatIDs := strings.Split(strings.TrimSpace(os.Getenv("CHAT_ID")), ",")
 	if len(strChatIDs) == 0 {
-		log.Fatal("CHAT_ID env var is not set or empty")
+		logging.Fatal("CHAT_ID env var is not set or empty")
 	}
 
 	var (
@@ -212,7 +270,7 @@ func (b Bot) Run() (string, error) {
 	for _, v := range strChatIDs {
 		vv, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
-			log.Fatal("failed to parse chatID", v)
+			logging.Fatal("failed to parse chatID", "chat_id", v)
 		}
 
 		allowedChatIDs[vv] = struct{}{}
@@ -233,12 +291,16 @@ func (b Bot) Run() (string, error) {
 	// Start polling Telegram for updates.
 	updates := b.bot.GetUpdatesChan(updateConfig)
 
+	atomic.StoreInt64(&b.heartbeat, time.Now().UnixNano())
+
 	// launch background jobs
 	var wg sync.WaitGroup
 	for _, v := range b.backgroundFunctions {
 		wg.Add(1)
+		atomic.AddInt32(&b.backgroundRunning, 1)
 		go func(f BackgroundFunction) {
 			f(b.ctx, b.backgroundEvents)
+			atomic.AddInt32(&b.backgroundRunning, -1)
 			wg.Done()
 		}(v)
 	}
@@ -247,11 +309,22 @@ func (b Bot) Run() (string, error) {
 	periodic := time.NewTicker(minPeriodicInterval)
 	defer periodic.Stop()
 
+	// the heartbeat proves the loop below is not stuck
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	b.mu.Lock()
+	b.periodicTick = time.Now()
+	b.mu.Unlock()
+
 	// Let's go through each update that we're getting from Telegram.
 	for {
+		atomic.StoreInt64(&b.heartbeat, time.Now().UnixNano())
+
 		select {
 		case <-b.ctx.Done():
 			return fmt.Sprintf("%s context cancelled", b.runtime), nil
+		case <-heartbeat.C:
 		case <-periodic.C:
 			b.processPeriodicTasks(chatIDs)
 
@@ -264,19 +337,22 @@ func (b Bot) Run() (string, error) {
 			}
 
 			if _, found := allowedChatIDs[update.Message.Chat.ID]; !found {
-				pos := int(math.Min(10, float64(len(update.Message.Text))))
-				log.Println("received", update.Message.Text[:pos], "message from unknown chat")
+				slog.Warn("received message from unknown chat", "chat_id", update.Message.Chat.ID, "username", update.Message.Chat.UserName)
 				continue
 			}
 
-			if h, exists := b.cmdHandlers[strings.Split(update.Message.Text, "@")[0]]; exists {
+			// commands may have arguments and be addressed as /cmd@botname
+			cmd := strings.Split(strings.SplitN(strings.TrimSpace(update.Message.Text), " ", 2)[0], "@")[0]
+			if h, exists := b.cmdHandlers[cmd]; exists {
+				commandsHandled.With(cmd).Inc()
+				slog.Info("handling command", "command", cmd, "chat_id", update.Message.Chat.ID)
 				// Okay, we're sending our message off! We don't care about the message
 				// we just sent, so we'll discard it.
 				if err := retryTillInterrupt(b.ctx, func(ctx context.Context) error {
 					outmsg, err := h(ctx, update.Message, b.bot)
 					if err == nil {
 						defer outmsg.Close()
-						_, err = b.bot.Send(outmsg)
+						err = sendChattable(b.bot, outmsg)
 					}
 					return err
 				}, b.runtime); err != nil {
@@ -285,42 +361,116 @@ func (b Bot) Run() (string, error) {
 			}
 		case bgEvent := <-b.backgroundEvents:
 
-			log.Println("received BG event")
-
-			var invalidChatIDs []int64
-			//= make(map[int64]interface{})
-			for k, _ := range allowedChatIDs {
-				bgEvent.SetChatID(k)
-				log.Printf("after  %+v\n", bgEvent)
-				if err := func() error {
-					defer bgEvent.Close()
-					return retryTillInterrupt(b.ctx, func(ctx context.Context) error {
-						_, err := b.bot.Send(bgEvent)
-						return err
-					}, b.runtime)
-				}(); err != nil {
-					var chatErr chatNotFound
-					if !errors.As(err, &chatErr) {
-						return err.Error(), nil
-					}
-					log.Println("chat", k, "not found")
-					invalidChatIDs = append(invalidChatIDs, k)
-				}
+			slog.Debug("received background event")
+
+			if err := b.deliverEvent(bgEvent, allowedChatIDs); err != nil {
+				return err.Error(), nil
 			}
-			for _, v := range invalidChatIDs {
-				delete(allowedChatIDs, v)
+		}
+	}
+}
+
+// deliverEvent sends a background event to all allowed chats, or to a single chat if the event is addressed.
+// Chats, which are not found, are removed from allowedChatIDs. Returns an error only if the bot should stop.
+func (b *Bot) deliverEvent(bgEvent ChattableCloser, allowedChatIDs map[int64]interface{}) error {
+	var (
+		recipients []int64
+		result     chan<- error
+	)
+
+	if addressed, ok := bgEvent.(*ChattableAddressed); ok {
+		// tgbotapi checks for the file uploads on the concrete type, so send the wrapped message
+		bgEvent, result = addressed.ChattableCloser, addressed.Result
+		if addressed.ChatID != 0 {
+			if _, found := allowedChatIDs[addressed.ChatID]; !found {
+				slog.Warn("addressed event to not allowed chat", "chat_id", addressed.ChatID)
+				bgEvent.Close()
+				reportResult(result, ErrChatNotAllowed)
+				return nil
 			}
+			recipients = []int64{addressed.ChatID}
+		}
+	}
+
+	if recipients == nil {
+		for k := range allowedChatIDs {
+			recipients = append(recipients, k)
+		}
+	}
+
+	// the delivery is tracked by the chat, so that the chats, which got the message, don't get it again
+	delivery := DeliveryError{Failed: make(map[int64]error)}
+	for _, k := range recipients {
+		bgEvent.SetChatID(k)
+		slog.Debug("delivering background event", "chat_id", k, "type", messageType(bgEvent))
+		err := func() error {
+			defer bgEvent.Close()
+			return retryTillInterrupt(b.ctx, func(ctx context.Context) error {
+				return sendChattable(b.bot, bgEvent)
+			}, b.runtime)
+		}()
+		if err == nil {
+			delivery.Delivered = append(delivery.Delivered, k)
+			continue
+		}
+
+		delivery.Failed[k] = err
+		var chatErr chatNotFound
+		if !errors.As(err, &chatErr) {
+			// the bot is stopping
+			reportResult(result, deliveryResult(&delivery))
+			return err
 		}
+		slog.Warn("chat not found", "chat_id", k)
+		delete(allowedChatIDs, k)
+	}
+
+	reportResult(result, deliveryResult(&delivery))
+	return nil
+}
+
+// deliveryResult is nil if all of the chats got the message, the error of the only recipient, or the DeliveryError.
+func deliveryResult(delivery *DeliveryError) error {
+	switch {
+	case len(delivery.Failed) == 0:
+		return nil
+	case len(delivery.Failed) == 1 && len(delivery.Delivered) == 0:
+		for _, v := range delivery.Failed {
+			return v
+		}
+	}
+	return delivery
+}
+
+func reportResult(result chan<- error, err error) {
+	if result != nil {
+		result <- err
 	}
 }
 
 func (b *Bot) processPeriodicTasks(chatIDs []int64) {
+	b.mu.Lock()
 	b.periodicTaskCycle++
-	log.Println("bot: processing periodic tasks")
-	for _, h := range b.periodicTasks {
-		log.Println("bot: executing periodic task", h.intro, b.periodicTaskCycle, h.interval, (b.periodicTaskCycle % h.interval))
-		if b.periodicTaskCycle%h.interval == 0 {
-			notificationMessageWrapper(b.ctx, h.intro, h.fn, b.bot, chatIDs)
+	b.periodicTick = time.Now()
+	cycle, tasks := b.periodicTaskCycle, b.periodicTasks
+	b.mu.Unlock()
+
+	slog.Debug("processing periodic tasks", "cycle", cycle)
+	for i, h := range tasks {
+		if cycle%h.interval == 0 {
+			slog.Debug("executing periodic task", "task", h.intro)
+			var result string
+			notificationMessageWrapper(b.ctx, h.intro, func(ctx context.Context) string {
+				started := time.Now()
+				result = h.fn(ctx)
+				taskDuration.With(h.intro).Observe(time.Since(started).Seconds())
+				return result
+			}, b.bot, chatIDs)
+
+			b.mu.Lock()
+			b.periodicTasks[i].lastRun = time.Now()
+			b.periodicTasks[i].lastResult = result
+			b.mu.Unlock()
 		}
 	}
 }
@@ -328,12 +478,15 @@ func (b *Bot) processPeriodicTasks(chatIDs []int64) {
 // retries operation and watches for interrupt. Never return an error on success.
 func retryTillInterrupt(ctx context.Context, f func(ctx context.Context) error, runtime string) error {
 	for {
-		if err := f(ctx); err != nil {
-			log.Println("Telegram API failure", err)
+		err := f(ctx)
+		apiHealth.record(err)
+		if err != nil {
+			slog.Warn("Telegram API failure", "err", err)
 			var vv chatNotFound
 			if errors.As(err, &vv.err) && vv.Error() == vv.err.Message {
 				return vv
 			}
+			apiRetries.Inc()
 			select {
 			case <-ctx.Done():
 				return interruptedErr{fmt.Sprintf("%s was cancelled", runtime)}
@@ -350,11 +503,13 @@ func notificationMessageWrapper(ctx context.Context, msgInfo string, messageFunc
 	if msgText := messageFunc(ctx); len(msgText) != 0 {
 		for _, v := range chatIDs {
 			msg := tgbotapi.NewMessage(v, fmt.Sprintf("%s %s", msgInfo, msgText))
-			if _, err := bot.Send(msg); err != nil {
+			err := sendChattable(bot, msg)
+			apiHealth.record(err)
+			if err != nil {
 				var tgErr *tgbotapi.Error
 				if errors.As(err, &tgErr) {
 					if tgErr.Code == 400 && tgErr.Message == "Bad Request: chat not found" {
-						log.Println("api error:", tgErr.Message)
+						slog.Warn("api error", "chat_id", v, "err", tgErr.Message)
 						continue
 					}
 				}
@@ -0,0 +1,18 @@
+package telega
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// apiLogger routes tgbotapi logs, including the opt-in API tracing, to slog, which redacts the bot token.
+type apiLogger struct{}
+
+func (apiLogger) Println(v ...interface{}) {
+	slog.Info(strings.TrimSuffix(fmt.Sprintln(v...), "\n"), "component", "tgbotapi")
+}
+
+func (apiLogger) Printf(format string, v ...interface{}) {
+	slog.Info(strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"), "component", "tgbotapi")
+}
@@ -0,0 +1,45 @@
+package telega
+
+import (
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/skrassiev/meerkat/metrics"
+)
+
+var (
+	messagesSent    = metrics.NewCounterVec("meerkat_messages_sent_total", "Messages sent to Telegram chats.", "type")
+	messagesFailed  = metrics.NewCounterVec("meerkat_messages_failed_total", "Messages, which Telegram API failed to send.", "type")
+	apiLatency      = metrics.NewHistogram("meerkat_telegram_api_duration_seconds", "Telegram API send latency.", metrics.DefBuckets)
+	apiRetries      = metrics.NewCounter("meerkat_telegram_api_retries_total", "Telegram API calls retried after a failure.")
+	commandsHandled = metrics.NewCounterVec("meerkat_commands_handled_total", "Bot commands handled.", "command")
+	taskDuration    = metrics.NewHistogramVec("meerkat_periodic_task_duration_seconds", "Periodic task execution time.", metrics.DefBuckets, "task")
+)
+
+// sendChattable sends a message and accounts for it in the metrics.
+func sendChattable(bot *tgbotapi.BotAPI, c tgbotapi.Chattable) error {
+	started := time.Now()
+	_, err := bot.Send(c)
+	apiLatency.Observe(time.Since(started).Seconds())
+
+	if err != nil {
+		messagesFailed.With(messageType(c)).Inc()
+	} else {
+		messagesSent.With(messageType(c)).Inc()
+	}
+	return err
+}
+
+func messageType(c tgbotapi.Chattable) string {
+	switch c.(type) {
+	case *ChattableText, tgbotapi.MessageConfig:
+		return "text"
+	case *ChattablePicture, tgbotapi.PhotoConfig:
+		return "picture"
+	case *ChattableVideo, tgbotapi.VideoConfig:
+		return "video"
+	case *ChattableDocument, tgbotapi.DocumentConfig:
+		return "document"
+	}
+	return "other"
+}
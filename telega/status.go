@@ -0,0 +1,118 @@
+package telega
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Status is a snapshot of the bot state.
+// BackgroundRunning is the number of background tasks, which have not exited yet.
+// Heartbeat is the last time the Run loop was not busy, or zero if the bot is not running.
+type Status struct {
+	Runtime           string       `json:"runtime"`
+	Commands          []string     `json:"commands"`
+	PeriodicTasks     []TaskStatus `json:"periodic_tasks"`
+	BackgroundTasks   int          `json:"background_tasks"`
+	BackgroundRunning int          `json:"background_running"`
+	Outbox            int          `json:"outbox"`
+	Telegram          APIStatus    `json:"telegram"`
+	Heartbeat         time.Time    `json:"heartbeat"`
+}
+
+// TaskStatus describes a periodic task.
+type TaskStatus struct {
+	Name       string        `json:"name"`
+	Interval   time.Duration `json:"interval"`
+	LastRun    time.Time     `json:"last_run"`
+	NextRun    time.Time     `json:"next_run"`
+	LastResult string        `json:"last_result"`
+}
+
+// APIStatus describes connectivity to Telegram API as seen by the latest API calls.
+type APIStatus struct {
+	Connected   bool      `json:"connected"`
+	LastSuccess time.Time `json:"last_success"`
+	LastFailure time.Time `json:"last_failure"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// connectivity tracks outcomes of Telegram API calls.
+type connectivity struct {
+	mu     sync.RWMutex
+	status APIStatus
+}
+
+var apiHealth connectivity
+
+// record registers an outcome of an API call. Errors reported by Telegram itself still prove connectivity.
+func (c *connectivity) record(err error) {
+	var tgErr *tgbotapi.Error
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil || errors.As(err, &tgErr) {
+		c.status.LastSuccess = time.Now()
+		c.status.Connected = true
+		return
+	}
+	c.status.LastFailure = time.Now()
+	c.status.LastError = err.Error()
+	c.status.Connected = false
+}
+
+func (c *connectivity) get() APIStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.status
+}
+
+// LastHeartbeat returns the last time the Run loop was not busy, or zero time if the bot is not running.
+func (b *Bot) LastHeartbeat() time.Time {
+	if hb := atomic.LoadInt64(&b.heartbeat); hb != 0 {
+		return time.Unix(0, hb)
+	}
+	return time.Time{}
+}
+
+// Status returns a snapshot of the bot state. It's safe to call concurrently with Run.
+func (b *Bot) Status() Status {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	s := Status{
+		Runtime:           b.runtime,
+		BackgroundTasks:   len(b.backgroundFunctions),
+		BackgroundRunning: int(atomic.LoadInt32(&b.backgroundRunning)),
+		Outbox:            len(b.backgroundEvents),
+		Telegram:          apiHealth.get(),
+		Heartbeat:         b.LastHeartbeat(),
+	}
+
+	for k := range b.cmdHandlers {
+		s.Commands = append(s.Commands, k)
+	}
+	sort.Strings(s.Commands)
+
+	for _, v := range b.periodicTasks {
+		ts := TaskStatus{
+			Name:       v.intro,
+			Interval:   time.Duration(v.interval) * minPeriodicInterval,
+			LastRun:    v.lastRun,
+			LastResult: v.lastResult,
+		}
+		if !b.periodicTick.IsZero() {
+			// tasks run on the cycles, which are multiples of the task interval
+			cyclesLeft := v.interval - b.periodicTaskCycle%v.interval
+			ts.NextRun = b.periodicTick.Add(time.Duration(cyclesLeft) * minPeriodicInterval)
+		}
+		s.PeriodicTasks = append(s.PeriodicTasks, ts)
+	}
+
+	return s
+}